@@ -0,0 +1,136 @@
+package azblob
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ErrNoCredentials is returned by FromEnvironment when the environment names
+// no storage account.
+var ErrNoCredentials = errors.New("azblob: no storage account in $AZURE_STORAGE_CONNECTION_STRING or $AZURE_STORAGE_ACCOUNT")
+
+// FromEnvironment returns the Config of the storage account the environment
+// names, as the az command line takes it: the connection string of
+// AZURE_STORAGE_CONNECTION_STRING, or else AZURE_STORAGE_ACCOUNT with
+// AZURE_STORAGE_KEY or AZURE_STORAGE_SAS_TOKEN.
+func FromEnvironment() (Config, error) {
+	if s := os.Getenv("AZURE_STORAGE_CONNECTION_STRING"); s != "" {
+		return ParseConnectionString(s)
+	}
+	cfg := Config{
+		Account: os.Getenv("AZURE_STORAGE_ACCOUNT"),
+		Key:     os.Getenv("AZURE_STORAGE_KEY"),
+		SAS:     os.Getenv("AZURE_STORAGE_SAS_TOKEN"),
+	}
+	if cfg.Account == "" {
+		return Config{}, ErrNoCredentials
+	}
+	return cfg, nil
+}
+
+// ParseConnectionString returns the Config of a connection string, as the
+// Azure portal gives them, or UseDevelopmentStorage=true for Azurite.
+func ParseConnectionString(s string) (Config, error) {
+	var cfg Config
+	protocol, suffix := "https", "core.windows.net"
+	for _, field := range strings.Split(s, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch strings.ToLower(name) {
+		case "usedevelopmentstorage":
+			if strings.EqualFold(value, "true") {
+				cfg.Account, cfg.Key = devAccount, devKey
+				cfg.Endpoint = "http://127.0.0.1:10000/" + devAccount
+			}
+		case "accountname":
+			cfg.Account = value
+		case "accountkey":
+			cfg.Key = value
+		case "sharedaccesssignature":
+			cfg.SAS = value
+		case "blobendpoint":
+			cfg.Endpoint = value
+		case "defaultendpointsprotocol":
+			protocol = value
+		case "endpointsuffix":
+			suffix = value
+		}
+	}
+	if cfg.Account == "" && cfg.Endpoint == "" {
+		return Config{}, errors.New("azblob: connection string has no AccountName or BlobEndpoint")
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = protocol + "://" + cfg.Account + ".blob." + suffix
+	}
+	return cfg, nil
+}
+
+// The well known account of the Azurite emulator.
+const (
+	devAccount = "devstoreaccount1"
+	devKey     = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+// apiVersion is the version of the REST API requests ask for.
+const apiVersion = "2021-08-06"
+
+// sign authorizes req with the shared key of account. The x-ms-date and
+// x-ms-version headers, and every other one signed, must be set already.
+func sign(req *http.Request, account string, key []byte) {
+	var b strings.Builder
+	b.WriteString(req.Method + "\n")
+	length := ""
+	if req.ContentLength > 0 {
+		length = fmt.Sprint(req.ContentLength)
+	}
+	for _, name := range []string{"Content-Encoding", "Content-Language", "", "Content-MD5", "Content-Type", "Date",
+		"If-Modified-Since", "If-Match", "If-None-Match", "If-Unmodified-Since", "Range"} {
+		if name == "" {
+			b.WriteString(length + "\n")
+			continue
+		}
+		b.WriteString(req.Header.Get(name) + "\n")
+	}
+	var names []string
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return strings.ToLower(names[i]) < strings.ToLower(names[j]) })
+	for _, name := range names {
+		b.WriteString(strings.ToLower(name) + ":" + strings.TrimSpace(strings.Join(req.Header[name], ",")) + "\n")
+	}
+	b.WriteString("/" + account + req.URL.EscapedPath())
+	query := req.URL.Query()
+	params := make([]string, 0, len(query))
+	for name := range query {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		values := query[name]
+		sort.Strings(values)
+		b.WriteString("\n" + strings.ToLower(name) + ":" + strings.Join(values, ","))
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(b.String()))
+	req.Header.Set("Authorization", "SharedKey "+account+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// withSAS adds the query of a shared access signature to u.
+func withSAS(u *url.URL, sas string) {
+	sas = strings.TrimPrefix(sas, "?")
+	if u.RawQuery == "" {
+		u.RawQuery = sas
+	} else {
+		u.RawQuery += "&" + sas
+	}
+}
@@ -0,0 +1,65 @@
+package azblob
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestSign checks SharedKey signatures of requests to the Azurite account
+// against ones made from the string to sign the REST API documents.
+func TestSign(t *testing.T) {
+	key, err := base64.StdEncoding.DecodeString(devKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		query  url.Values
+		header http.Header
+		size   int64
+		want   string
+	}{
+		{
+			name:   "put blob",
+			method: http.MethodPut,
+			path:   "/devstoreaccount1/photos/a b+c=d.txt",
+			header: http.Header{"X-Ms-Blob-Type": {"BlockBlob"}, "Content-Type": {"text/plain"}},
+			size:   11,
+			want:   "nOVie7Omf4H1ptX8l/ncbdTAHvx5ERmvUPyb7TcEqL0=",
+		},
+		{
+			name:   "list blobs",
+			method: http.MethodGet,
+			path:   "/devstoreaccount1/photos",
+			query:  url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {"a b+c"}},
+			header: http.Header{"Range": {"bytes=0-99"}},
+			want:   "hjSJizKrfCx0pz0KMQ31DEIt2X9yF8Fb7HFAbkYlpj8=",
+		},
+	} {
+		// The URL is made as Client.do makes it
+		u := url.URL{Scheme: "http", Host: "127.0.0.1:10000", Path: tc.path, RawQuery: tc.query.Encode()}
+		var body io.Reader
+		if tc.size > 0 {
+			body = strings.NewReader(strings.Repeat("x", int(tc.size)))
+		}
+		req, err := http.NewRequest(tc.method, u.String(), body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, values := range tc.header {
+			req.Header[name] = values
+		}
+		req.Header.Set("X-Ms-Date", "Fri, 26 Jun 2015 23:39:12 GMT")
+		req.Header.Set("X-Ms-Version", apiVersion)
+		sign(req, devAccount, key)
+		if got, want := req.Header.Get("Authorization"), "SharedKey "+devAccount+":"+tc.want; got != want {
+			t.Errorf("%s: signed as %s, want %s", tc.name, got, want)
+		}
+	}
+}
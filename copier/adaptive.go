@@ -0,0 +1,83 @@
+package copier
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// adaptInterval is how often -adaptive reconsiders the number of active jobs.
+const adaptInterval = 2 * time.Second
+
+// adapt runs the -adaptive feedback loop until stop is closed. Every interval
+// it compares the throughput with that of the interval before and moves the
+// limit on active workers one step, between 1 and maxJobs, keeping direction
+// while throughput improves and turning back when it drops. When throughput
+// is flat but files take longer, the extra workers only queue up, so it
+// steps down. A mean per-file latency four times the best seen lately means
+// the destination is struggling, and halves the limit at once.
+func (j *copyJob) adapt(maxJobs int64, stop <-chan struct{}) {
+	ticker := time.NewTicker(adaptInterval)
+	defer ticker.Stop()
+	step := int64(1)
+	var lastCopied, lastRate int64
+	var lastLatency, bestLatency time.Duration
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		copied := atomic.LoadInt64(&j.copied)
+		files := atomic.SwapInt64(&j.files, 0)
+		busy := atomic.SwapInt64(&j.busy, 0)
+		rate := (copied - lastCopied) * int64(time.Second) / int64(adaptInterval)
+		lastCopied = copied
+		// A stopped job hands out no more files, so none are held back
+		if j.stopping() {
+			j.mu.Lock()
+			j.wake.Broadcast()
+			j.mu.Unlock()
+			return
+		}
+		// Nothing is copied while paused, which says nothing about the jobs
+		if j.paused != nil && j.paused.Load() {
+			lastRate = 0
+			continue
+		}
+		// A long file keeps every worker busy without finishing anything
+		if files == 0 {
+			continue
+		}
+		latency := time.Duration(busy / files)
+		// Slowly forget the best latency, as the mix of file sizes changes
+		bestLatency += bestLatency / 10
+		if bestLatency == 0 || latency < bestLatency {
+			bestLatency = latency
+		}
+
+		j.mu.Lock()
+		limit := j.limit
+		switch {
+		case latency > 4*bestLatency:
+			step = 1
+			limit = (limit + 1) / 2
+		case lastRate > 0 && rate < lastRate-lastRate/20:
+			step = -step
+			limit += step
+		case lastRate > 0 && rate <= lastRate+lastRate/20 && latency > lastLatency+lastLatency/2:
+			step = -1
+			limit += step
+		default:
+			limit += step
+		}
+		limit = min(max(limit, 1), maxJobs)
+		if limit != j.limit {
+			slog.Debug("Adjusting active jobs", "from", j.limit, "to", limit, "rate", formatBytes(rate)+"/s", "latency", latency.Round(time.Millisecond))
+			atomic.StoreInt64(&j.limit, limit)
+			j.wake.Broadcast()
+		}
+		j.mu.Unlock()
+		lastRate, lastLatency = rate, latency
+	}
+}
@@ -0,0 +1,137 @@
+package copier
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// maxRequestSize caps the body of a request to the REST API.
+const maxRequestSize = 1 << 20
+
+// serveHTTP serves the REST API of the daemon on addr, alongside its socket:
+//
+//	POST /jobs              queue a job, given as {"dir": ..., "args": [...]},
+//	                        with "schedule": ... to make it recur
+//	GET  /jobs              list every job
+//	GET  /jobs/{id}         describe a job, with its progress while it runs
+//	POST /jobs/{id}/cancel  cancel a job
+//
+// Answers are JSON, errors being {"error": ...}. Every request must carry
+// token in an Authorization: Bearer header, as a job runs with the daemon's
+// privileges, and a job must be posted as application/json, which a web page
+// can't send another site without its consent.
+//
+// The gRPC service of jobs.proto is served on addr too, over HTTP/2 without
+// TLS, for typed clients and streamed progress. Its calls carry the token the
+// same way, as authorization metadata.
+func (d *daemon) serveHTTP(addr, token string) (*http.Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /jobs", func(w http.ResponseWriter, r *http.Request) {
+		if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/json" {
+			httpError(w, http.StatusUnsupportedMediaType, "a job must be posted as application/json")
+			return
+		}
+		var job daemonJob
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&job); err != nil {
+			httpError(w, http.StatusBadRequest, "invalid job: "+err.Error())
+			return
+		}
+		queued, err := d.submit(job.Dir, job.Args, job.Schedule)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		w.Header().Set("Location", "/jobs/"+strconv.Itoa(queued.ID))
+		httpReply(w, http.StatusCreated, queued)
+	})
+	mux.HandleFunc("GET /jobs", func(w http.ResponseWriter, r *http.Request) {
+		httpReply(w, http.StatusOK, d.list())
+	})
+	job := func(cancel bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if job, ok := d.httpJob(w, r, cancel); ok {
+				httpReply(w, http.StatusOK, job)
+			}
+		}
+	}
+	mux.HandleFunc("GET /jobs/{id}", job(false))
+	mux.HandleFunc("POST /jobs/{id}/cancel", job(true))
+	mux.HandleFunc("POST "+grpcServicePrefix, d.serveGRPC)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" && !sameOrigin(origin, r.Host) {
+			if isGRPC(r) {
+				grpcRefuse(w, grpcPermissionDenied, "calls from "+origin+" are refused")
+			} else {
+				httpError(w, http.StatusForbidden, "requests from "+origin+" are refused")
+			}
+			return
+		}
+		given, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			if isGRPC(r) {
+				grpcRefuse(w, grpcUnauthenticated, "missing or wrong token")
+				return
+			}
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			httpError(w, http.StatusUnauthorized, "missing or wrong token")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+	// gRPC clients speak HTTP/2 from the start, without TLS
+	srv := &http.Server{Addr: l.Addr().String(), Handler: handler, Protocols: new(http.Protocols)}
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetUnencryptedHTTP2(true)
+	go func() {
+		if err := srv.Serve(l); err != http.ErrServerClosed {
+			log.Print(err)
+		}
+	}()
+	return srv, nil
+}
+
+// sameOrigin reports whether the Origin header origin names the API itself,
+// served as host.
+func sameOrigin(origin, host string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == host
+}
+
+// httpJob returns the job named in the path of r, cancelling it first if
+// cancel is set, or answers r with an error.
+func (d *daemon) httpJob(w http.ResponseWriter, r *http.Request, cancel bool) (daemonJob, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "invalid job id "+strconv.Quote(r.PathValue("id")))
+		return daemonJob{}, false
+	}
+	job, err := d.find(id, cancel)
+	if err != nil {
+		httpError(w, http.StatusNotFound, err.Error())
+		return daemonJob{}, false
+	}
+	return job, true
+}
+
+// httpReply writes v as the JSON body of a response with status.
+func httpReply(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func httpError(w http.ResponseWriter, status int, msg string) {
+	httpReply(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,419 @@
+package copier
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/flate"
+	"cpj/cp"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// archiveSuffixes are the names of destinations that a source directory is
+// archived into rather than copied below, with the archive format, tar or
+// zip, and the format of compressors a tar archive is compressed with, if
+// any.
+var archiveSuffixes = []struct{ suffix, format, compress string }{
+	{".tar", "tar", ""},
+	{".tar.gz", "tar", "gzip"},
+	{".tgz", "tar", "gzip"},
+	{".tar.zst", "tar", "zstd"},
+	{".tzst", "tar", "zstd"},
+	{".zip", "zip", ""},
+}
+
+// archiveDest reports whether dest names an archive, in which format, and
+// how it is compressed.
+func archiveDest(dest string) (format, compress string, ok bool) {
+	lower := strings.ToLower(dest)
+	for _, a := range archiveSuffixes {
+		if strings.HasSuffix(lower, a.suffix) {
+			return a.format, a.compress, true
+		}
+	}
+	return "", "", false
+}
+
+// archiveWriter writes the entries of an archive, described by tar headers
+// whatever its format.
+type archiveWriter interface {
+	// create starts the entry hdr, returning the writer its contents go
+	// to.
+	create(hdr *tar.Header) (io.Writer, error)
+	Close() error
+}
+
+type tarArchive struct {
+	*tar.Writer
+}
+
+func (a tarArchive) create(hdr *tar.Header) (io.Writer, error) {
+	return a.Writer, a.WriteHeader(hdr)
+}
+
+// zipArchive writes a zip archive, storing the files with an extension in
+// store as they are and deflating the rest. Entries of 4 GB and more are
+// written as zip64.
+type zipArchive struct {
+	*zip.Writer
+	store extList
+}
+
+// newZipArchive returns a zipArchive writing to w, deflating at level, with
+// 0 meaning the default.
+func newZipArchive(w io.Writer, level int, store extList) zipArchive {
+	zw := zip.NewWriter(w)
+	if level != 0 {
+		zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		})
+	}
+	return zipArchive{zw, store}
+}
+
+// create starts the entry hdr. A symlink is stored with its target as its
+// contents, as zip tools on unix do.
+func (a zipArchive) create(hdr *tar.Header) (io.Writer, error) {
+	fh := &zip.FileHeader{Name: hdr.Name, Modified: hdr.ModTime, Method: zip.Deflate}
+	fh.SetMode(hdr.FileInfo().Mode())
+	if hdr.Typeflag != tar.TypeReg || a.store[strings.ToLower(path.Ext(hdr.Name))] {
+		fh.Method = zip.Store
+	}
+	w, err := a.CreateHeader(fh)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		_, err = io.WriteString(w, hdr.Linkname)
+	}
+	return w, err
+}
+
+// setFlag is a flag and whether it was given, for rejectFlags.
+type setFlag struct {
+	set  bool
+	name string
+}
+
+// rejectFlags returns a usage error for the first of flags set, which can't
+// be used in the situation described by when.
+func rejectFlags(when string, flags []setFlag) error {
+	for _, f := range flags {
+		if f.set {
+			return errorOf(ErrUsage, "%s can't be used %s", f.name, when)
+		}
+	}
+	return nil
+}
+
+// errNotArchived marks the failures of files left out of an archive before
+// anything of them was written, which -continue carries on after.
+var errNotArchived = errors.New("not archived")
+
+// archiveTree writes the tree below srcAbs into the tar or zip archive
+// destAbs.
+// The files are read ahead by -jobs readers, in the order they are
+// archived, and written out by one writer, the archive only replacing
+// destAbs once complete.
+func archiveTree(srcAbs, destAbs string, opts *options) (err error) {
+	if err := rejectFlags("when writing an archive", []setFlag{
+		{opts.delete, "-delete"}, {opts.move, "-move"}, {opts.staged, "-staged"}, {opts.checkpoint != "", "-checkpoint"},
+		{opts.manifest != "", "-manifest"}, {len(opts.linkDest.dirs) > 0, "-link-dest"}, {opts.delta, "-delta"},
+		{opts.dedup, "-dedup"}, {opts.compress.format != "", "-compress"}, {opts.compress.decompress, "-decompress"},
+		{opts.crypt.encrypt, "-encrypt"}, {opts.crypt.decrypt, "-decrypt"},
+		{perFile(opts.exec.before), "-exec-before naming {src} or {dest}"}, {perFile(opts.exec.after), "-exec-after naming {src} or {dest}"},
+	}); err != nil {
+		return err
+	}
+	archive, compress, _ := archiveDest(destAbs)
+	if err := rejectFlags("when writing a zip archive", []setFlag{{archive == "zip" && opts.hardLinks, "-hard-links"}}); err != nil {
+		return err
+	}
+	// Every compression of archiveSuffixes is one of compressors
+	format := compressors[compress]
+	if info, err := os.Stat(destAbs); err == nil {
+		if info.IsDir() {
+			return errorOf(ErrUsage, "cannot overwrite directory %s with an archive", destAbs)
+		}
+		if opts.noClobber {
+			slog.Info("Not replacing existing archive", "archive", destAbs)
+			return nil
+		}
+	}
+
+	scan := treeScan{sizes: make(map[string]int64), infos: make(map[string]os.FileInfo)}
+	var links *hardLinks
+	if opts.hardLinks {
+		links = newHardLinks()
+	}
+	files, dirs, err := recurseFileTree(srcAbs, &scan, links, opts)
+	if err != nil {
+		return err
+	}
+	// The walk may be parallel, so sort for archives that are the same
+	// from one run to the next, with parents before their entries
+	sort.Strings(files)
+	sort.Strings(dirs)
+	name := func(path string) string {
+		rel, _ := filepath.Rel(srcAbs, path)
+		return filepath.ToSlash(opts.destRel(rel))
+	}
+	if opts.dryRun {
+		for _, path := range files {
+			fmt.Printf("Would archive %s as %s.\n", path, name(path))
+		}
+		return walkIncomplete(opts)
+	}
+
+	dir := filepath.Dir(destAbs)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if !opts.mkdir {
+			return errorOf(ErrDestMissing, "destination directory %s does not exist", dir)
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	tmp := cp.TempPath(destAbs)
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	// An archive missing files left out with -continue still replaces
+	// destAbs
+	defer func() {
+		complete := err == nil || errors.Is(err, ErrPartial)
+		if cerr := out.Close(); cerr != nil && complete {
+			err, complete = cerr, false
+		}
+		if complete {
+			if rerr := os.Rename(tmp, destAbs); rerr != nil {
+				err, complete = rerr, false
+			}
+		}
+		if !complete {
+			os.Remove(tmp)
+		}
+	}()
+	bw := bufio.NewWriterSize(out, int(opts.bufferSize))
+	var w io.Writer = bw
+	var comp io.WriteCloser
+	if compress != "" {
+		level := opts.compress.level
+		if level == 0 {
+			level = format.defaultLevel
+		}
+		if comp, err = format.writer(bw, level); err != nil {
+			return err
+		}
+		w = comp
+	}
+	var aw archiveWriter = tarArchive{tar.NewWriter(w)}
+	if archive == "zip" {
+		aw = newZipArchive(w, opts.compress.level, opts.zipStore)
+	}
+
+	for _, dir := range dirs {
+		info, err := os.Lstat(dir)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = name(dir) + "/"
+		if _, err := aw.create(hdr); err != nil {
+			return err
+		}
+	}
+	failed, archived, bytes, err := archiveFiles(aw, destAbs, files, &scan, name, opts)
+	if err != nil {
+		return err
+	}
+	if links != nil {
+		for _, link := range links.links {
+			info, err := os.Lstat(link.src)
+			if err != nil {
+				return err
+			}
+			hdr, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			hdr.Typeflag, hdr.Name, hdr.Linkname, hdr.Size = tar.TypeLink, name(link.src), name(link.target), 0
+			if _, err := aw.create(hdr); err != nil {
+				return err
+			}
+		}
+	}
+	if err := aw.Close(); err != nil {
+		return err
+	}
+	if comp != nil {
+		if err := comp.Close(); err != nil {
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	slog.Info("Archived", "archive", destAbs, "files", archived, "bytes", bytes)
+	if len(failed) > 0 {
+		return errorOf(ErrPartial, "%d files could not be archived, first error: %w", len(failed), failed[0])
+	}
+	return walkIncomplete(opts)
+}
+
+// archiveFiles writes files to aw, the archive at path archive, in order,
+// read ahead by -jobs readers. It returns the errors of the files left out
+// with -continue.
+func archiveFiles(aw archiveWriter, archive string, files []string, scan *treeScan, name func(string) string, opts *options) (failed []error, archived int, bytes int64, err error) {
+	buffers := &sync.Pool{New: func() any {
+		buf := make([]byte, opts.bufferSize)
+		return &buf
+	}}
+	jobs := max(int(opts.jobs), 1)
+	// ready holds the files in flight, in order, and work hands them to
+	// the readers
+	ready := make(chan *transfer, jobs)
+	work := make(chan *transfer)
+	quit := make(chan struct{})
+	for i := 0; i < jobs; i++ {
+		go func() {
+			for t := range work {
+				t.fill()
+			}
+		}()
+	}
+	go func() {
+		defer close(ready)
+		defer close(work)
+		for _, file := range files {
+			t := &transfer{fileEntry: fileEntry{src: file, size: scan.sizes[file], info: scan.infos[file]}, buffers: buffers, done: make(chan struct{})}
+			if archiveReads(t.fileEntry, opts) {
+				t.chunks = make(chan chunk, pipeChunks)
+			}
+			select {
+			case ready <- t:
+			case <-quit:
+				return
+			}
+			if t.chunks == nil {
+				continue
+			}
+			select {
+			case work <- t:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	for t := range ready {
+		if err != nil {
+			t.close()
+			continue
+		}
+		entry := name(t.src)
+		f := fileEntry{src: t.src, dest: archive + "/" + entry, size: t.size}
+		opts.events.started(f)
+		n, ferr := archiveFile(aw, t, entry, opts)
+		t.close()
+		if ferr != nil {
+			opts.events.fail(copyError{src: f.src, dest: f.dest, err: ferr})
+		}
+		switch {
+		case ferr == nil:
+			archived++
+			bytes += n
+			f.size = n
+			opts.events.copied(f)
+		case errors.Is(ferr, errNotArchived) && opts.cont:
+			slog.Warn(ferr.Error())
+			failed = append(failed, ferr)
+		default:
+			err = ferr
+			close(quit)
+		}
+	}
+	return failed, archived, bytes, err
+}
+
+// archiveReads reports whether the contents of f are read into the archive,
+// rather than it being a symlink or special file recorded as such.
+func archiveReads(f fileEntry, opts *options) bool {
+	if f.info != nil && f.info.Mode()&os.ModeSymlink != 0 && opts.links == linksPreserve {
+		return false
+	}
+	info, err := f.stat()
+	// A file that can't be statted is read, for the reader to report it
+	return err != nil || info.Mode().IsRegular()
+}
+
+// archiveFile writes the file of t to aw as name, returning how many bytes
+// of it were written. A file that can't be read is reported before its
+// header is written, as errNotArchived.
+func archiveFile(aw archiveWriter, t *transfer, name string, opts *options) (int64, error) {
+	info, link := t.info, ""
+	var err error
+	if info == nil {
+		if info, err = os.Lstat(t.src); err != nil {
+			return 0, fmt.Errorf("%w: %w", errNotArchived, err)
+		}
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		if t.chunks == nil {
+			link, err = os.Readlink(t.src)
+		} else {
+			info, err = os.Stat(t.src)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%w: %w", errNotArchived, err)
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s: %w", errNotArchived, t.src, err)
+	}
+	hdr.Name = name
+	if t.chunks == nil {
+		_, err := aw.create(hdr)
+		return 0, err
+	}
+	// Wait for the first chunk, so a file that can't be opened is left out
+	// whole
+	r := &chunkReader{t: t}
+	if c, ok := <-t.chunks; ok {
+		r.cur, r.rest = c.buf, (*c.buf)[:c.n]
+	} else if t.err != nil {
+		return 0, fmt.Errorf("%w: %w", errNotArchived, t.err)
+	}
+	defer r.Close()
+	w, err := aw.create(hdr)
+	if err != nil {
+		return 0, err
+	}
+	// The header has the size the walk found, so a file that grew since
+	// is cut off there, and one that shrank can't be archived
+	n, err := io.CopyN(w, r, hdr.Size)
+	if err == io.EOF {
+		return n, fmt.Errorf("%s shrank while being archived", t.src)
+	}
+	if err == nil {
+		slog.Debug("Archived", "src", t.src, "name", name, "bytes", n)
+	}
+	return n, err
+}
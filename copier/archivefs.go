@@ -0,0 +1,311 @@
+package copier
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// treeIndex is a tree listed up front, for a filesystem that can't list a
+// directory by itself: what each name is, and the entries of each directory,
+// including those only implied by the names below them.
+type treeIndex struct {
+	infos    map[string]fs.FileInfo
+	children map[string][]fs.DirEntry
+}
+
+func newTreeIndex() *treeIndex {
+	return &treeIndex{
+		infos:    map[string]fs.FileInfo{".": prefixInfo(".")},
+		children: map[string][]fs.DirEntry{".": nil},
+	}
+}
+
+// add adds name, described by info, and the directories above it not added
+// yet. A name added again keeps what it was first.
+func (t *treeIndex) add(name string, info fs.FileInfo) {
+	for name != "." {
+		if _, seen := t.infos[name]; seen {
+			return
+		}
+		t.infos[name] = info
+		if _, ok := t.children[name]; !ok && info.IsDir() {
+			t.children[name] = nil
+		}
+		dir := path.Dir(name)
+		t.children[dir] = append(t.children[dir], fs.FileInfoToDirEntry(info))
+		name, info = dir, prefixInfo(path.Base(dir))
+	}
+}
+
+// sort sorts the entries of each directory by name, once all are added.
+func (t *treeIndex) sort() {
+	for _, entries := range t.children {
+		slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	}
+}
+
+func (t *treeIndex) stat(name string) (fs.FileInfo, error) {
+	if info, ok := t.infos[name]; ok {
+		return info, nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (t *treeIndex) readDir(name string) ([]fs.DirEntry, error) {
+	entries, ok := t.children[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	return slices.Clone(entries), nil
+}
+
+// openArchive returns the tar or zip archive, the source of -extract, as a
+// vfs.FS, for extracting it where extractArchive can't: anywhere but a local
+// directory.
+func openArchive(archive string, opts *options) (*archiveFS, error) {
+	if strings.EqualFold(filepath.Ext(archive), ".zip") {
+		return openZipFS(archive)
+	}
+	return openTarFS(archive, opts)
+}
+
+// archiveFS is a tar or zip archive, indexed, with each file read from
+// where its contents are in the archive file. A compressed tar archive is
+// decompressed to a temporary file first, to have somewhere to read them
+// from.
+type archiveFS struct {
+	index *treeIndex
+	// open opens the contents of the entry name.
+	open func(name string) (io.ReadCloser, error)
+	// links are the targets of symlinks, by name.
+	links map[string]string
+	close func() error
+}
+
+func openZipFS(archive string) (*archiveFS, error) {
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, err
+	}
+	t := &archiveFS{index: newTreeIndex(), links: make(map[string]string), close: r.Close}
+	files := make(map[string]*zip.File)
+	for _, f := range r.File {
+		name, ok := archiveName(archive, f.Name)
+		if !ok {
+			continue
+		}
+		info := f.FileInfo()
+		if info.Mode()&fs.ModeSymlink != 0 {
+			target, err := readZipLink(f)
+			if err != nil {
+				r.Close()
+				return nil, fmt.Errorf("%s/%s: %w", archive, name, err)
+			}
+			t.links[name] = target
+		}
+		files[name] = f
+		t.index.add(name, info)
+	}
+	t.index.sort()
+	t.open = func(name string) (io.ReadCloser, error) {
+		return files[name].Open()
+	}
+	return t, nil
+}
+
+func openTarFS(archive string, opts *options) (*archiveFS, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	t := &archiveFS{index: newTreeIndex(), links: make(map[string]string), close: f.Close}
+	if format, ok := decompressors[strings.ToLower(filepath.Ext(archive))]; ok {
+		slog.Debug("Decompressing archive to a temporary file", "archive", archive)
+		f, err = decompressTemp(f, format, opts)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", archive, err)
+		}
+		t.close = func() error {
+			defer os.Remove(f.Name())
+			return f.Close()
+		}
+	}
+	// A tar.Reader reads the headers, and seeks past the contents, of a
+	// file, so its offset after each header is where the contents start
+	type section struct{ offset, size int64 }
+	sections := make(map[string]section)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil && hdr.Typeflag == tar.TypeGNUSparse {
+			err = errors.New("sparse files are not supported")
+		}
+		if err != nil {
+			t.close()
+			return nil, fmt.Errorf("%s: %w", archive, err)
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		name, ok := archiveName(archive, hdr.Name)
+		if !ok {
+			continue
+		}
+		info := hdr.FileInfo()
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			t.links[name] = hdr.Linkname
+		case tar.TypeLink:
+			// A hard link has the contents of its target, which comes
+			// before it
+			target, ok := archiveName(archive, hdr.Linkname)
+			s, found := sections[target]
+			if !ok || !found {
+				slog.Warn("Skipping hard link to a file not in the archive", "path", archive+"/"+name, "target", hdr.Linkname)
+				continue
+			}
+			sections[name] = s
+			regular := *hdr
+			regular.Typeflag, regular.Size = tar.TypeReg, s.size
+			info = regular.FileInfo()
+		case tar.TypeReg:
+			offset, err := f.Seek(0, io.SeekCurrent)
+			if err != nil {
+				t.close()
+				return nil, err
+			}
+			sections[name] = section{offset, hdr.Size}
+		}
+		t.index.add(name, info)
+	}
+	t.index.sort()
+	t.open = func(name string) (io.ReadCloser, error) {
+		s := sections[name]
+		return io.NopCloser(io.NewSectionReader(f, s.offset, s.size)), nil
+	}
+	return t, nil
+}
+
+// decompressTemp decompresses the archive f, which it closes, to a temporary
+// file, returned open.
+func decompressTemp(f *os.File, format decompressor, opts *options) (*os.File, error) {
+	defer f.Close()
+	r, err := format.reader(bufio.NewReaderSize(f, int(opts.bufferSize)))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	tmp, err := os.CreateTemp("", ".cpj-extract-*.tar")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(tmp, r)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return tmp, nil
+}
+
+// archiveName returns the entry name of an archive cleaned into a name of
+// a vfs.FS, or false, with a warning, if it isn't one.
+func archiveName(archive, name string) (string, bool) {
+	clean := path.Clean(strings.TrimPrefix(name, "./"))
+	if !fs.ValidPath(clean) {
+		slog.Warn("Skipping entry outside the destination", "archive", archive, "name", name)
+		return "", false
+	}
+	return clean, clean != "."
+}
+
+func (t *archiveFS) Close() error {
+	return t.close()
+}
+
+// Stat describes name, following symlinks to other entries of the archive.
+func (t *archiveFS) Stat(name string) (fs.FileInfo, error) {
+	_, info, err := t.resolve(name)
+	return info, err
+}
+
+// resolve follows the symlinks of the archive from name, returning the name
+// of the entry they lead to and what it is. Targets outside the archive
+// don't exist.
+func (t *archiveFS) resolve(name string) (string, fs.FileInfo, error) {
+	for hops := 0; hops < maxSymlinkHops; hops++ {
+		info, err := t.index.stat(name)
+		if err != nil || info.Mode()&fs.ModeSymlink == 0 {
+			return name, info, err
+		}
+		target := t.links[name]
+		name = path.Join(path.Dir(name), target)
+		if path.IsAbs(target) || !fs.ValidPath(name) {
+			return "", nil, &fs.PathError{Op: "stat", Path: target, Err: fs.ErrNotExist}
+		}
+	}
+	return "", nil, &fs.PathError{Op: "stat", Path: name, Err: errors.New("too many levels of symbolic links")}
+}
+
+// maxSymlinkHops is how many symlinks resolve follows, as many as Linux.
+const maxSymlinkHops = 40
+
+func (t *archiveFS) Lstat(name string) (fs.FileInfo, error) {
+	return t.index.stat(name)
+}
+
+func (t *archiveFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return t.index.readDir(name)
+}
+
+func (t *archiveFS) ReadLink(name string) (string, error) {
+	target, ok := t.links[name]
+	if !ok {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return target, nil
+}
+
+// Open opens the contents of the regular file name, or of the file it links
+// to.
+func (t *archiveFS) Open(name string) (fs.File, error) {
+	name, info, err := t.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.ErrUnsupported}
+	}
+	r, err := t.open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &readerFile{ReadCloser: r, info: info}, nil
+}
+
+// readerFile is an fs.File read from start to end, described by info.
+type readerFile struct {
+	io.ReadCloser
+	info fs.FileInfo
+}
+
+func (f *readerFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
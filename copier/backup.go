@@ -0,0 +1,187 @@
+package copier
+
+import (
+	"cpj/cp"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// defaultBackupSuffix is appended to simple backups when -backup has no suffix.
+const defaultBackupSuffix = "~"
+
+// backupMode selects how backup files are named, following GNU cp.
+type backupMode string
+
+const (
+	// backupSimple appends the suffix, replacing any earlier backup.
+	backupSimple backupMode = "simple"
+	// backupNumbered keeps every backup as FILE.~N~.
+	backupNumbered backupMode = "numbered"
+	// backupExisting makes numbered backups of files that already have
+	// them, and simple backups otherwise.
+	backupExisting backupMode = "existing"
+)
+
+func (m *backupMode) String() string {
+	return string(*m)
+}
+
+func (m *backupMode) Set(val string) error {
+	switch mode := backupMode(val); mode {
+	case backupSimple, backupNumbered, backupExisting:
+		*m = mode
+		return nil
+	}
+	return fmt.Errorf("invalid backup mode %q, must be simple, numbered or existing", val)
+}
+
+// backupSettings holds the -backup family of flags. It implements -backup[=SUFFIX]
+// as a boolean flag, so a custom suffix has to be given with '='.
+type backupSettings struct {
+	enabled bool
+	suffix  string
+	// explicit is set when the suffix was given on the command line.
+	explicit bool
+	mode     backupMode
+	// dir, if set, receives the backups in a tree mirroring the destination.
+	// A relative dir is relative to root, as with rsync's --backup-dir.
+	dir string
+	// root is the destination root that dir mirrors.
+	root string
+}
+
+func (b *backupSettings) String() string {
+	if b == nil || !b.enabled {
+		return "false"
+	}
+	return b.suffix
+}
+
+func (b *backupSettings) Set(val string) error {
+	if on, err := strconv.ParseBool(val); err == nil {
+		b.enabled = on
+		return nil
+	}
+	b.enabled, b.suffix, b.explicit = true, val, true
+	return nil
+}
+
+func (b *backupSettings) IsBoolFlag() bool {
+	return true
+}
+
+// normalize applies the defaults once all flags are parsed. A backup mode or
+// directory implies -backup. Backups moved to a directory keep their names
+// unless a suffix was given, like rsync's --backup-dir.
+func (b *backupSettings) normalize() error {
+	if b.mode != "" || b.dir != "" {
+		b.enabled = true
+	}
+	if b.mode == "" {
+		b.mode = backupSimple
+	}
+	if !b.explicit && b.dir == "" {
+		b.suffix = defaultBackupSuffix
+	}
+	if filepath.IsAbs(b.dir) || strings.HasPrefix(b.dir, "~") {
+		dir, err := cp.AbsolutePath(b.dir)
+		if err != nil {
+			return err
+		}
+		b.dir = dir
+	}
+	return nil
+}
+
+// dirAbs returns the directory backups are moved into, resolved against the
+// destination root.
+func (b *backupSettings) dirAbs() string {
+	if filepath.IsAbs(b.dir) {
+		return b.dir
+	}
+	return filepath.Join(b.root, b.dir)
+}
+
+// backup moves the existing file dst out of the way before it is replaced.
+func (b *backupSettings) backup(dst string) error {
+	target := dst
+	if b.dir != "" {
+		rel, err := filepath.Rel(b.root, dst)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			rel = filepath.Base(dst)
+		}
+		target = filepath.Join(b.dirAbs(), rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+	}
+	switch n := highestBackup(target); {
+	case b.mode == backupNumbered, b.mode == backupExisting && n > 0:
+		target = fmt.Sprintf("%s.~%d~", target, n+1)
+	default:
+		target += b.suffix
+	}
+	return moveFile(dst, target)
+}
+
+// highestBackup returns the highest N of the existing numbered backups
+// path.~N~, or 0 if there are none.
+func highestBackup(path string) int {
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return 0
+	}
+	prefix := filepath.Base(path) + ".~"
+	highest := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, "~") {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, prefix), "~")); err == nil && n > highest {
+			highest = n
+		}
+	}
+	return highest
+}
+
+// moveFile renames src to dst, copying and removing it when they are on
+// different filesystems.
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	opts := cp.Options{PreservePerms: true, PreserveTimes: true, PreserveLinks: true}
+	if err := cp.CopyFile(src, dst, opts); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// protects reports whether path is, or is inside, a backup that -delete must
+// leave alone.
+func (b *backupSettings) protects(path string) bool {
+	if !b.enabled {
+		return false
+	}
+	if b.dir != "" {
+		dir := b.dirAbs()
+		return path == dir || strings.HasPrefix(path, dir+string(os.PathSeparator))
+	}
+	name := filepath.Base(path)
+	if b.suffix != "" && strings.HasSuffix(name, b.suffix) {
+		return true
+	}
+	// Numbered backups look like FILE.~N~
+	if i := strings.LastIndex(name, ".~"); i >= 0 && strings.HasSuffix(name, "~") {
+		_, err := strconv.Atoi(name[i+2 : len(name)-1])
+		return err == nil
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package copier
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestForceBackup checks that -force doesn't fail on the destination -backup
+// has just moved away, for simple and numbered backups.
+func TestForceBackup(t *testing.T) {
+	for _, tc := range []struct {
+		flags  []string
+		backup string
+	}{
+		{[]string{"-backup"}, "f~"},
+		{[]string{"-backup-mode", "numbered"}, "f.~1~"},
+	} {
+		dir := t.TempDir()
+		src, dest := filepath.Join(dir, "src"), filepath.Join(dir, "dest")
+		for _, d := range []string{src, dest} {
+			if err := os.Mkdir(d, 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.WriteFile(filepath.Join(src, "f"), []byte("new"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dest, "f"), []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		args := append([]string{"-quiet", "-force", "-recurse"}, tc.flags...)
+		if status := runCopy("copy", nil, append(args, src+"/", dest)); status != 0 {
+			t.Fatalf("copy %v exited with status %d", tc.flags, status)
+		}
+		if data, err := os.ReadFile(filepath.Join(dest, "f")); err != nil || string(data) != "new" {
+			t.Errorf("copy %v left dest/f holding %q: %v", tc.flags, data, err)
+		}
+		if data, err := os.ReadFile(filepath.Join(dest, tc.backup)); err != nil || string(data) != "old" {
+			t.Errorf("copy %v left the backup %s holding %q: %v", tc.flags, tc.backup, data, err)
+		}
+	}
+}
@@ -0,0 +1,628 @@
+package copier
+
+import (
+	"cpj/azblob"
+	"cpj/cp"
+	"cpj/gcs"
+	"cpj/s3"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultS3PartSize is the -s3-part-size files are uploaded and downloaded
+// in, one part a job.
+const defaultS3PartSize = 64 << 20
+
+// s3Settings holds the flags of s3:// paths.
+type s3Settings struct {
+	endpoint, region string
+	partSize         byteSize
+}
+
+// client returns a client for the store of the flags, the AWS environment
+// filling in what they leave out.
+func (s *s3Settings) client() (*s3.Client, error) {
+	cfg := s3.Config{Endpoint: s.endpoint, Region: s.region}
+	for _, name := range []string{"AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"} {
+		if cfg.Endpoint == "" {
+			cfg.Endpoint = os.Getenv(name)
+		}
+	}
+	if cfg.Region == "" {
+		cfg.Region = s3.DefaultRegion()
+	}
+	return s3.New(cfg)
+}
+
+// objectStore is what copying to and from a bucket needs of its store, in
+// the terms of package s3, which talks to S3 and Google Cloud Storage.
+type objectStore interface {
+	List(bucket, prefix string, fn func(s3.Object) error) error
+	Head(bucket, key string) (s3.Object, error)
+	Get(bucket, key string, offset, size int64) (io.ReadCloser, error)
+	Put(bucket, key string, body io.Reader, size int64) error
+	CreateMultipart(bucket, key string) (string, error)
+	UploadPart(bucket, key, id string, number int, body io.Reader, size int64) (s3.Part, error)
+	CompleteMultipart(bucket, key, id string, parts []s3.Part) error
+	AbortMultipart(bucket, key, id string) error
+}
+
+// bucketSchemes are the schemes of bucket operands: S3, Google Cloud
+// Storage, and the containers of Azure Blob Storage.
+var bucketSchemes = []string{"s3", "gs", "az"}
+
+// openStore returns the store of scheme, configured by the flags and the
+// environment, as the tools of each cloud would be.
+func openStore(scheme string, opts *options) (objectStore, error) {
+	switch scheme {
+	case "gs":
+		cfg := s3.Config{Endpoint: gcs.EmulatorEndpoint(), Region: "auto", Scheme: "gs"}
+		if cfg.Endpoint == "" {
+			cfg.Endpoint, cfg.Token = gcs.Endpoint, gcs.DefaultToken()
+		} else {
+			cfg.Token = func() (string, error) { return "", nil }
+		}
+		return s3.New(cfg)
+	case "az":
+		cfg, err := azblob.FromEnvironment()
+		if err != nil {
+			return nil, err
+		}
+		c, err := azblob.New(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return azureStore{c}, nil
+	}
+	return opts.s3.client()
+}
+
+// azureStore is an objectStore of Azure containers. The ids of the blocks of
+// an upload stand in for the ETags of parts.
+type azureStore struct {
+	*azblob.Client
+}
+
+func (a azureStore) List(container, prefix string, fn func(s3.Object) error) error {
+	return a.Client.List(container, prefix, func(obj azblob.Object) error {
+		return fn(s3.Object(obj))
+	})
+}
+
+func (a azureStore) Head(container, key string) (s3.Object, error) {
+	obj, err := a.Client.Head(container, key)
+	return s3.Object(obj), err
+}
+
+func (a azureStore) UploadPart(container, key, id string, number int, body io.Reader, size int64) (s3.Part, error) {
+	part, err := a.Client.UploadPart(container, key, id, number, body, size)
+	return s3.Part{Number: part.Number, ETag: part.BlockID}, err
+}
+
+func (a azureStore) CompleteMultipart(container, key, id string, parts []s3.Part) error {
+	blocks := make([]azblob.Part, len(parts))
+	for i, p := range parts {
+		blocks[i] = azblob.Part{Number: p.Number, BlockID: p.ETag}
+	}
+	return a.Client.CompleteMultipart(container, key, id, blocks)
+}
+
+// bucketURL is a scheme://bucket/key operand. key may be a prefix, or empty
+// for the whole bucket.
+type bucketURL struct {
+	scheme, bucket, key string
+}
+
+func (u bucketURL) String() string {
+	return u.scheme + "://" + u.bucket + "/" + u.key
+}
+
+// parseBucketURL reports whether arg is a bucket operand, and what it names.
+func parseBucketURL(arg string) (bucketURL, bool) {
+	for _, scheme := range bucketSchemes {
+		if rest, ok := strings.CutPrefix(arg, scheme+"://"); ok {
+			bucket, key, _ := strings.Cut(rest, "/")
+			return bucketURL{scheme, bucket, key}, true
+		}
+	}
+	return bucketURL{}, false
+}
+
+// isBucketURL reports whether arg is a bucket operand.
+func isBucketURL(arg string) bool {
+	_, ok := parseBucketURL(arg)
+	return ok
+}
+
+// bucketCopy uploads the local src to the bucket dest, or downloads the
+// bucket src to the local dest. A directory or prefix needs -recurse, and is
+// copied file by file, each file split into parts of -s3-part-size, which
+// -jobs workers copy at once.
+func bucketCopy(src, dest string, opts *options) error {
+	from, fromBucket := parseBucketURL(src)
+	to, toBucket := parseBucketURL(dest)
+	remote := to
+	if fromBucket {
+		remote = from
+	}
+	if err := rejectFlags("with "+remote.scheme+":// paths", []setFlag{
+		{opts.delete, "-delete"}, {opts.move, "-move"}, {opts.staged, "-staged"}, {opts.checkpoint != "", "-checkpoint"},
+		{len(opts.linkDest.dirs) > 0, "-link-dest"}, {opts.delta, "-delta"}, {opts.dedup, "-dedup"},
+		{opts.checksum, "-checksum"}, {opts.manifest != "", "-manifest"}, {opts.hardLinks, "-hard-links"},
+		{opts.link, "-link"}, {opts.interactive, "-interactive"}, {opts.filter.dirFilter != "", "-dir-filter"},
+		{opts.preservePerms, "-preserve-perms"}, {opts.preserveOwner, "-preserve-owner"}, {opts.extract, "-extract"},
+		{opts.compress.format != "", "-compress"}, {opts.compress.decompress, "-decompress"},
+		{opts.crypt.encrypt, "-encrypt"}, {opts.crypt.decrypt, "-decrypt"},
+	}); err != nil {
+		return err
+	}
+	if remote.bucket == "" {
+		return errorOf(ErrUsage, "%s:// paths must name a bucket", remote.scheme)
+	}
+	store, err := openStore(remote.scheme, opts)
+	if err != nil {
+		return errorOf(ErrUsage, "%w", err)
+	}
+	x := &bucketTransfer{workerPool: workerPool{opts: opts}, store: store, scheme: remote.scheme, partSize: int64(opts.s3.partSize), work: make(chan bucketPart)}
+	for i := 0; i < max(int(opts.jobs), 1); i++ {
+		x.wg.Add(1)
+		go x.worker()
+	}
+	if opts.signals {
+		defer handleInterrupts(x.interrupt, opts)()
+	}
+	if toBucket {
+		err = x.upload(src, to)
+	} else {
+		err = x.download(from, dest)
+	}
+	close(x.work)
+	x.wg.Wait()
+	if err == nil || errors.Is(err, errBucketStopped) {
+		err = x.err
+	}
+	if err != nil {
+		return err
+	}
+	slog.Info("Copied", "files", x.files, "bytes", x.bytes)
+	if len(x.failed) > 0 {
+		return errorOf(ErrPartial, "%d files could not be copied, first error: %w", len(x.failed), x.failed[0])
+	}
+	return walkIncomplete(opts)
+}
+
+// bucketTransfer copies files to or from a bucket. The parts of the files are
+// copied by -jobs workers, and the worker copying the last part of a file
+// finishes it.
+type bucketTransfer struct {
+	workerPool
+	store    objectStore
+	scheme   string
+	partSize int64
+	work     chan bucketPart
+	wg       sync.WaitGroup
+}
+
+// bucketFile is a file being uploaded or downloaded.
+type bucketFile struct {
+	// src and dest name the file in messages, the one in the bucket as a
+	// URL.
+	src, dest   string
+	local       string
+	bucket, key string
+	size        int64
+	modified    time.Time
+	// upload is the id of the multipart upload of a file uploaded in
+	// several parts.
+	upload string
+	// out is the temporary file a download is written to, renamed to
+	// local once complete.
+	out *os.File
+	// mu guards the parts uploaded, the number of parts left and the
+	// first error of any.
+	mu    sync.Mutex
+	parts []s3.Part
+	left  int
+	err   error
+}
+
+// bucketPart is a range of a file, which a worker copies at once.
+type bucketPart struct {
+	file   *bucketFile
+	number int
+	offset int64
+	size   int64
+}
+
+// errBucketStopped fails the parts left once the copy has stopped.
+var errBucketStopped = errors.New("copy stopped")
+
+// upload copies the file or, with -recurse, the tree src to the bucket.
+func (x *bucketTransfer) upload(src string, to bucketURL) error {
+	srcAbs, err := cp.AbsolutePath(src)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(srcAbs)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]s3.Object)
+	if !info.IsDir() {
+		key := to.key
+		if key == "" || strings.HasSuffix(key, "/") {
+			key += filepath.Base(srcAbs)
+		}
+		if x.opts.skipExisting || x.opts.noClobber {
+			obj, err := x.store.Head(to.bucket, key)
+			if err == nil {
+				existing[key] = obj
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+		x.uploadFile(srcAbs, to.bucket, key, existing)
+		return nil
+	}
+	if !x.opts.recurse {
+		return errorOf(ErrUsage, "source is a directory, but you did not provide -recurse")
+	}
+	prefix := to.key
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	if x.opts.skipExisting || x.opts.noClobber {
+		err := x.store.List(to.bucket, prefix, func(obj s3.Object) error {
+			existing[obj.Key] = obj
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	x.opts.walkFailed = 0
+	scan := treeScan{sizes: make(map[string]int64), infos: make(map[string]os.FileInfo)}
+	files, _, err := recurseFileTree(srcAbs, &scan, nil, x.opts)
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		if x.stopping() {
+			break
+		}
+		rel, _ := filepath.Rel(srcAbs, file)
+		x.uploadFile(file, to.bucket, prefix+filepath.ToSlash(x.opts.destRel(rel)), existing)
+	}
+	return nil
+}
+
+// uploadFile hands the parts of the local file to the workers, unless
+// existing has an object at key that -skip-existing or -no-clobber keeps.
+func (x *bucketTransfer) uploadFile(local, bucket, key string, existing map[string]s3.Object) {
+	f := &bucketFile{src: local, dest: bucketURL{x.scheme, bucket, key}.String(), local: local, bucket: bucket, key: key}
+	info, err := os.Stat(local)
+	if err != nil {
+		x.fail(f, err)
+		return
+	}
+	if !info.Mode().IsRegular() {
+		slog.Warn("Skipping file that isn't regular", "path", local, "mode", info.Mode().String())
+		return
+	}
+	f.size, f.modified = info.Size(), info.ModTime()
+	if obj, ok := existing[key]; ok {
+		// An object is uploaded after the file it was uploaded from was
+		// last changed
+		if x.opts.noClobber || obj.Size == f.size && !obj.LastModified.Before(f.modified) {
+			x.opts.events.skipped(f.src, f.dest, "existing")
+			return
+		}
+	}
+	if x.opts.dryRun {
+		fmt.Printf("Would upload %s to %s.\n", f.src, f.dest)
+		return
+	}
+	x.opts.events.started(fileEntry{src: f.src, dest: f.dest, size: f.size})
+	if err := x.opts.beforeFile(f.src, f.dest); err != nil {
+		x.fail(f, err)
+		return
+	}
+	partSize := x.fileParts(f)
+	if f.left > 1 {
+		if err := x.retry(func() (err error) {
+			f.upload, err = x.store.CreateMultipart(bucket, key)
+			return err
+		}); err != nil {
+			x.fail(f, err)
+			return
+		}
+	}
+	x.queue(f, partSize)
+}
+
+// download copies the object or, with -recurse, the objects below the
+// prefix from to the local dest.
+func (x *bucketTransfer) download(from bucketURL, dest string) error {
+	destAbs, err := cp.AbsolutePath(dest)
+	if err != nil {
+		return err
+	}
+	if !x.opts.recurse {
+		if from.key == "" || strings.HasSuffix(from.key, "/") {
+			return errorOf(ErrUsage, "source is a prefix, but you did not provide -recurse")
+		}
+		obj, err := x.store.Head(from.bucket, from.key)
+		if err != nil {
+			return err
+		}
+		if destAbs, err = fileDest(filepath.FromSlash("/"+from.key), dest, destAbs, x.opts); err != nil {
+			return err
+		}
+		x.opts.backup.root = filepath.Dir(destAbs)
+		x.downloadFile(from.bucket, obj, destAbs)
+		return nil
+	}
+	if err := ensureDestDir(dest, destAbs, x.opts); err != nil {
+		return err
+	}
+	x.opts.backup.root = destAbs
+	prefix := from.key
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return x.store.List(from.bucket, prefix, func(obj s3.Object) error {
+		if x.stopping() {
+			return errBucketStopped
+		}
+		rel := strings.TrimPrefix(obj.Key, prefix)
+		// Keys ending in a slash stand for directories, made by some tools
+		if rel == "" || strings.HasSuffix(rel, "/") {
+			return nil
+		}
+		rel = filepath.FromSlash(rel)
+		if !filepath.IsLocal(rel) {
+			x.fail(&bucketFile{src: bucketURL{x.scheme, from.bucket, obj.Key}.String()}, fmt.Errorf("key %q is outside the destination", obj.Key))
+			return nil
+		}
+		if !entrySelected(rel, 0, objectInfo{obj}, x.opts) {
+			return nil
+		}
+		x.downloadFile(from.bucket, obj, filepath.Join(destAbs, x.opts.destRel(rel)))
+		return nil
+	})
+}
+
+// downloadFile hands the parts of obj to the workers, unless there is a file
+// at local that -skip-existing or -no-clobber keeps.
+func (x *bucketTransfer) downloadFile(bucket string, obj s3.Object, local string) {
+	f := &bucketFile{src: bucketURL{x.scheme, bucket, obj.Key}.String(), dest: local, local: local, bucket: bucket, key: obj.Key,
+		size: obj.Size, modified: obj.LastModified}
+	if info, err := os.Lstat(local); err == nil {
+		if info.IsDir() {
+			x.fail(f, fmt.Errorf("cannot overwrite directory %s with %s", local, f.src))
+			return
+		}
+		if x.opts.noClobber || x.opts.skipExisting && info.Size() == f.size && info.ModTime().Equal(f.modified) {
+			x.opts.events.skipped(f.src, f.dest, "existing")
+			return
+		}
+	}
+	if x.opts.dryRun {
+		fmt.Printf("Would download %s to %s.\n", f.src, f.dest)
+		return
+	}
+	x.opts.events.started(fileEntry{src: f.src, dest: f.dest, size: f.size})
+	if err := x.opts.beforeFile(f.src, f.dest); err != nil {
+		x.fail(f, err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		x.fail(f, err)
+		return
+	}
+	out, err := os.Create(cp.TempPath(local))
+	if err == nil {
+		err = out.Truncate(f.size)
+	}
+	if err != nil {
+		if out != nil {
+			out.Close()
+			os.Remove(out.Name())
+		}
+		x.fail(f, err)
+		return
+	}
+	f.out = out
+	x.queue(f, x.fileParts(f))
+}
+
+// fileParts works out how many parts f is copied in, returning their size:
+// -s3-part-size, unless that would make more parts than an upload can have.
+func (x *bucketTransfer) fileParts(f *bucketFile) int64 {
+	size := max(x.partSize, (f.size+s3.MaxParts-1)/s3.MaxParts)
+	f.left = max(int((f.size+size-1)/size), 1)
+	return size
+}
+
+// queue hands the parts of f, of partSize each, to the workers.
+func (x *bucketTransfer) queue(f *bucketFile, partSize int64) {
+	left := f.left
+	for i := 0; i < left; i++ {
+		offset := int64(i) * partSize
+		x.work <- bucketPart{file: f, number: i + 1, offset: offset, size: min(partSize, f.size-offset)}
+	}
+}
+
+// worker copies the parts handed to it until work is closed. Once the copy
+// has stopped it only winds up their files.
+func (x *bucketTransfer) worker() {
+	defer x.wg.Done()
+	for p := range x.work {
+		err := errBucketStopped
+		if !x.stopping() {
+			err = x.retry(func() error { return x.copyPart(p) })
+		}
+		x.partDone(p, err)
+	}
+}
+
+// copyPart uploads or downloads the part p.
+func (x *bucketTransfer) copyPart(p bucketPart) error {
+	f := p.file
+	if f.out != nil {
+		r, err := x.store.Get(f.bucket, f.key, p.offset, p.size)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		n, err := io.Copy(io.NewOffsetWriter(f.out, p.offset), cp.ContextReader(x.opts.ctx, r))
+		if err == nil && n != p.size {
+			err = fmt.Errorf("%s: read %d bytes of a part of %d", f.src, n, p.size)
+		}
+		return err
+	}
+	in, err := os.Open(f.local)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	body := io.NewSectionReader(in, p.offset, p.size)
+	if f.upload == "" {
+		return x.store.Put(f.bucket, f.key, body, p.size)
+	}
+	part, err := x.store.UploadPart(f.bucket, f.key, f.upload, p.number, body, p.size)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.parts = append(f.parts, part)
+	f.mu.Unlock()
+	return nil
+}
+
+// partDone records that p was copied, or failed with err, finishing its
+// file after the last part.
+func (x *bucketTransfer) partDone(p bucketPart, err error) {
+	f := p.file
+	f.mu.Lock()
+	if err != nil && f.err == nil {
+		f.err = err
+	}
+	f.left--
+	last := f.left == 0
+	f.mu.Unlock()
+	if !last {
+		return
+	}
+	if err = x.finish(f); err == nil {
+		err = x.opts.afterFile(f.src, f.dest)
+	}
+	if err != nil {
+		if !errors.Is(err, errBucketStopped) {
+			x.fail(f, err)
+		}
+		return
+	}
+	slog.Debug("Copied", "src", f.src, "dest", f.dest, "bytes", f.size)
+	x.opts.events.copied(fileEntry{src: f.src, dest: f.dest, size: f.size})
+	x.count(f.size)
+}
+
+// finish completes or discards the multipart upload of f, or renames its
+// download into place or removes it, after its parts are done. It returns
+// the first error of f.
+func (x *bucketTransfer) finish(f *bucketFile) error {
+	err := f.err
+	if f.out != nil {
+		tmp := f.out.Name()
+		if cerr := f.out.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil && x.opts.preserveTimes {
+			err = os.Chtimes(tmp, time.Time{}, f.modified)
+		}
+		if err == nil && x.opts.backup.enabled {
+			if _, serr := os.Lstat(f.local); serr == nil {
+				err = x.opts.backup.backup(f.local)
+			}
+		}
+		if err == nil {
+			err = os.Rename(tmp, f.local)
+		}
+		if err != nil {
+			os.Remove(tmp)
+		}
+		return err
+	}
+	if f.upload == "" {
+		return err
+	}
+	if err == nil {
+		sort.Slice(f.parts, func(i, j int) bool { return f.parts[i].Number < f.parts[j].Number })
+		err = x.retry(func() error { return x.store.CompleteMultipart(f.bucket, f.key, f.upload, f.parts) })
+	}
+	if err != nil {
+		if aerr := x.store.AbortMultipart(f.bucket, f.key, f.upload); aerr != nil {
+			slog.Warn("Could not abort multipart upload, its parts are kept", "dest", f.dest, "upload", f.upload, "error", aerr)
+		}
+	}
+	return err
+}
+
+// retry calls fn until it succeeds, fails for good, or -retries is used up,
+// backing off as copyWithRetry does.
+func (x *bucketTransfer) retry(fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= x.opts.retries || !storeRetryable(err) || x.opts.ctx.Err() != nil {
+			return err
+		}
+		delay := backoff(x.opts.retryDelay, attempt)
+		slog.Debug("Request failed, retrying", "error", err, "attempt", attempt+1, "delay", delay.Round(time.Millisecond))
+		if !sleep(x.opts.ctx, delay) {
+			return err
+		}
+	}
+}
+
+// storeRetryable reports whether err might go away on another attempt: the
+// store answered that it might, or didn't answer.
+func storeRetryable(err error) bool {
+	var serr *s3.Error
+	if errors.As(err, &serr) {
+		return serr.Temporary()
+	}
+	var aerr *azblob.Error
+	if errors.As(err, &aerr) {
+		return aerr.Temporary()
+	}
+	return retryable(err)
+}
+
+// fail records the failure of f, stopping the copy unless -continue is set.
+func (x *bucketTransfer) fail(f *bucketFile, err error) {
+	x.workerPool.fail(copyError{src: f.src, dest: f.dest, err: err}, "Could not copy file")
+}
+
+// objectInfo is the os.FileInfo of an object, for the walk flags.
+type objectInfo struct {
+	obj s3.Object
+}
+
+func (i objectInfo) Name() string       { return path.Base(i.obj.Key) }
+func (i objectInfo) Size() int64        { return i.obj.Size }
+func (i objectInfo) Mode() fs.FileMode  { return 0644 }
+func (i objectInfo) ModTime() time.Time { return i.obj.LastModified }
+func (i objectInfo) IsDir() bool        { return false }
+func (i objectInfo) Sys() any           { return nil }
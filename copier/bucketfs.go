@@ -0,0 +1,238 @@
+package copier
+
+import (
+	"cpj/s3"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bucketFS is the tree of the objects below a prefix of a bucket, as a
+// vfs.FS and a vfs.Atomic. Its directories are the prefixes of the keys of
+// its objects, so the whole prefix is listed once, when first needed, and
+// that listing answers for what is there. A file written is spooled to a
+// local temporary file and uploaded once closed, in parts of partSize if
+// larger.
+type bucketFS struct {
+	store    objectStore
+	url      bucketURL
+	partSize int64
+
+	listing sync.Once
+	listErr error
+	index   *treeIndex
+}
+
+func newBucketFS(store objectStore, url bucketURL, partSize int64) *bucketFS {
+	url.key = strings.TrimSuffix(url.key, "/")
+	return &bucketFS{store: store, url: url, partSize: partSize}
+}
+
+// key returns the key of the object name.
+func (b *bucketFS) key(name string) string {
+	switch {
+	case name == ".":
+		return b.url.key
+	case b.url.key == "":
+		return name
+	}
+	return b.url.key + "/" + name
+}
+
+// label is how messages name name: its URL.
+func (b *bucketFS) label(name string) string {
+	return bucketURL{b.url.scheme, b.url.bucket, b.key(name)}.String()
+}
+
+// list lists the prefix, once.
+func (b *bucketFS) list() error {
+	b.listing.Do(func() {
+		b.index = newTreeIndex()
+		prefix := b.key(".")
+		if prefix != "" {
+			prefix += "/"
+		}
+		b.listErr = b.store.List(b.url.bucket, prefix, func(obj s3.Object) error {
+			name := strings.TrimPrefix(obj.Key, prefix)
+			// Keys ending in a slash stand for directories, made by
+			// some tools
+			if name == "" || strings.HasSuffix(name, "/") {
+				return nil
+			}
+			if !fs.ValidPath(name) {
+				slog.Warn("Skipping object whose key isn't a path", "key", b.label(name))
+				return nil
+			}
+			b.index.add(name, objectInfo{obj})
+			return nil
+		})
+		b.index.sort()
+	})
+	return b.listErr
+}
+
+func (b *bucketFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	if err := b.list(); err != nil {
+		return nil, err
+	}
+	if name != "." {
+		info, err := b.index.stat(name)
+		if err != nil {
+			return nil, &fs.PathError{Op: "stat", Path: b.label(name), Err: fs.ErrNotExist}
+		}
+		return info, nil
+	}
+	// The root is a directory if there are objects below it, or else
+	// may be an object itself
+	if b.url.key == "" || len(b.index.children["."]) > 0 {
+		return prefixInfo(path.Base(b.url.key)), nil
+	}
+	obj, err := b.store.Head(b.url.bucket, b.url.key)
+	if err != nil {
+		return nil, err
+	}
+	return objectInfo{obj}, nil
+}
+
+// Lstat is Stat, as there are no symlinks in a bucket.
+func (b *bucketFS) Lstat(name string) (fs.FileInfo, error) {
+	return b.Stat(name)
+}
+
+func (b *bucketFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := b.list(); err != nil {
+		return nil, err
+	}
+	return b.index.readDir(name)
+}
+
+func (b *bucketFS) ReadLink(name string) (string, error) {
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: errors.ErrUnsupported}
+}
+
+// Open returns a reader of the whole of the object name.
+func (b *bucketFS) Open(name string) (fs.File, error) {
+	info, err := b.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.ErrUnsupported}
+	}
+	r, err := b.store.Get(b.url.bucket, b.key(name), 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	return &readerFile{ReadCloser: r, info: info}, nil
+}
+
+// AtomicCreate marks bucketFS a vfs.Atomic: an object only appears once
+// uploaded whole.
+func (b *bucketFS) AtomicCreate() {}
+
+// MkdirAll does nothing: the prefix of a key needs no creating.
+func (b *bucketFS) MkdirAll(name string, perm fs.FileMode) error {
+	return nil
+}
+
+// Create returns a writer of the object name, uploaded once it is closed.
+func (b *bucketFS) Create(name string, perm fs.FileMode) (io.WriteCloser, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrInvalid}
+	}
+	spool, err := os.CreateTemp("", ".cpj-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	return &objectWriter{File: spool, b: b, key: b.key(name)}, nil
+}
+
+// objectWriter spools an object to a temporary file until closed.
+type objectWriter struct {
+	*os.File
+	b   *bucketFS
+	key string
+}
+
+// Close uploads the object, in parts if larger than the part size, and
+// removes the temporary file.
+func (w *objectWriter) Close() error {
+	defer os.Remove(w.Name())
+	defer w.File.Close()
+	info, err := w.Stat()
+	if err != nil {
+		return err
+	}
+	b, size := w.b, info.Size()
+	partSize := max(b.partSize, (size+s3.MaxParts-1)/s3.MaxParts)
+	if size <= partSize {
+		return b.store.Put(b.url.bucket, w.key, io.NewSectionReader(w.File, 0, size), size)
+	}
+	id, err := b.store.CreateMultipart(b.url.bucket, w.key)
+	if err != nil {
+		return err
+	}
+	var parts []s3.Part
+	for offset := int64(0); offset < size && err == nil; offset += partSize {
+		n := min(partSize, size-offset)
+		var part s3.Part
+		part, err = b.store.UploadPart(b.url.bucket, w.key, id, len(parts)+1, io.NewSectionReader(w.File, offset, n), n)
+		parts = append(parts, part)
+	}
+	if err == nil {
+		err = b.store.CompleteMultipart(b.url.bucket, w.key, id, parts)
+	}
+	if err != nil {
+		if aerr := b.store.AbortMultipart(b.url.bucket, w.key, id); aerr != nil {
+			slog.Warn("Could not abort multipart upload, its parts are kept", "key", w.key, "upload", id, "error", aerr)
+		}
+	}
+	return err
+}
+
+// Abort removes the temporary file without uploading the object.
+func (w *objectWriter) Abort() error {
+	defer os.Remove(w.Name())
+	return w.File.Close()
+}
+
+func (b *bucketFS) Rename(oldname, newname string) error {
+	return &fs.PathError{Op: "rename", Path: oldname, Err: errors.ErrUnsupported}
+}
+
+func (b *bucketFS) Remove(name string) error {
+	return &fs.PathError{Op: "remove", Path: name, Err: errors.ErrUnsupported}
+}
+
+func (b *bucketFS) Symlink(target, name string) error {
+	return &fs.PathError{Op: "symlink", Path: name, Err: errors.ErrUnsupported}
+}
+
+func (b *bucketFS) Chmod(name string, mode fs.FileMode) error {
+	return &fs.PathError{Op: "chmod", Path: name, Err: errors.ErrUnsupported}
+}
+
+// Chtimes fails: an object was last modified when it was uploaded.
+func (b *bucketFS) Chtimes(name string, mtime time.Time) error {
+	return &fs.PathError{Op: "chtimes", Path: name, Err: errors.ErrUnsupported}
+}
+
+// prefixInfo is the fs.FileInfo of a directory only implied by the names
+// below it, such as a prefix of the keys of a bucket.
+type prefixInfo string
+
+func (i prefixInfo) Name() string       { return string(i) }
+func (i prefixInfo) Size() int64        { return 0 }
+func (i prefixInfo) Mode() fs.FileMode  { return fs.ModeDir | 0755 }
+func (i prefixInfo) ModTime() time.Time { return time.Time{} }
+func (i prefixInfo) IsDir() bool        { return true }
+func (i prefixInfo) Sys() any           { return nil }
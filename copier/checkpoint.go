@@ -0,0 +1,148 @@
+package copier
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// checkpointInterval is how often a running job saves its checkpoint.
+const checkpointInterval = 5 * time.Second
+
+// checkpoint is the state of a recursive copy saved by -checkpoint, so that a
+// killed run can be picked up with -resume without walking the source again.
+// Files still missing from Done when the run stopped are copied from scratch.
+type checkpoint struct {
+	// Command is the subcommand that was run, copy if empty.
+	Command string           `json:"command,omitempty"`
+	Args    []string         `json:"args"`
+	Src     string           `json:"src"`
+	Dest    string           `json:"dest"`
+	Dirs    []string         `json:"dirs"`
+	Files   []string         `json:"files"`
+	Sizes   map[string]int64 `json:"sizes"`
+	Links   []checkpointLink `json:"links,omitempty"`
+	Done    []string         `json:"done"`
+
+	mu      sync.Mutex
+	path    string
+	resumed bool
+	done    map[string]bool
+}
+
+type checkpointLink struct {
+	Src    string `json:"src"`
+	Target string `json:"target"`
+}
+
+// newCheckpoint starts a checkpoint for a run of the named subcommand with
+// the given command line.
+func newCheckpoint(path, command string, args []string) *checkpoint {
+	return &checkpoint{path: path, Command: command, Args: args, done: make(map[string]bool)}
+}
+
+// loadCheckpoint reads the checkpoint saved at path by an earlier run.
+func loadCheckpoint(path string) (*checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	job := &checkpoint{path: path, resumed: true}
+	if err := json.Unmarshal(data, job); err != nil {
+		return nil, err
+	}
+	job.done = make(map[string]bool, len(job.Done))
+	for _, file := range job.Done {
+		job.done[file] = true
+	}
+	return job, nil
+}
+
+// record stores the result of the source walk. It is a no-op when resuming,
+// as the walk is skipped then.
+func (c *checkpoint) record(src, dest string, dirs, files []string, sizes map[string]int64, links []hardLink) {
+	if c.resumed {
+		return
+	}
+	c.Src, c.Dest, c.Dirs, c.Files = src, dest, dirs, files
+	c.Sizes = make(map[string]int64, len(files))
+	for _, file := range files {
+		c.Sizes[file] = sizes[file]
+	}
+	for _, link := range links {
+		c.Links = append(c.Links, checkpointLink{Src: link.src, Target: link.target})
+	}
+}
+
+// remaining returns the files that have not been copied yet.
+func (c *checkpoint) remaining() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var files []string
+	for _, file := range c.Files {
+		if !c.done[file] {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+func (c *checkpoint) hardLinks() []hardLink {
+	var links []hardLink
+	for _, link := range c.Links {
+		links = append(links, hardLink{src: link.Src, target: link.Target})
+	}
+	return links
+}
+
+// markDone records that file has been copied. It is safe to call from
+// several workers at once.
+func (c *checkpoint) markDone(file string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.done[file] {
+		c.done[file] = true
+		c.Done = append(c.Done, file)
+	}
+}
+
+// save writes the checkpoint to a temporary file and renames it into place,
+// so a crash while saving leaves the previous checkpoint intact.
+func (c *checkpoint) save() error {
+	c.mu.Lock()
+	data, err := json.Marshal(c)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// run saves the checkpoint every checkpointInterval until stop is closed,
+// then saves it a final time.
+func (c *checkpoint) run(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(checkpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			c.logSave()
+			return
+		}
+		c.logSave()
+	}
+}
+
+func (c *checkpoint) logSave() {
+	if err := c.save(); err != nil {
+		slog.Warn("Could not save checkpoint", "path", c.path, "error", err)
+	}
+}
@@ -0,0 +1,44 @@
+package copier
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestResumeFlagsOnce checks that a flag given again on the command line of
+// -resume is applied once, so a -rename rule doesn't rename twice.
+func TestResumeFlagsOnce(t *testing.T) {
+	dir := t.TempDir()
+	src, dest := filepath.Join(dir, "src"), filepath.Join(dir, "dest")
+	for _, d := range []string{src, dest} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file := filepath.Join(src, "a")
+	if err := os.WriteFile(file, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	job := checkpoint{Args: []string{"-recurse", src, dest}, Src: src, Dest: dest,
+		Files: []string{file}, Sizes: map[string]int64{file: 1}}
+	data, err := json.Marshal(&job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := filepath.Join(dir, "job")
+	if err := os.WriteFile(saved, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := runCopy("copy", nil, []string{"-quiet", "-resume", saved, "-rename", "s/a/ab/"}); status != 0 {
+		t.Fatalf("copy -resume exited with status %d", status)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "ab")); err != nil {
+		t.Errorf("the -rename rule wasn't applied once: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "abb")); err == nil {
+		t.Error("the -rename rule was applied twice")
+	}
+}
@@ -0,0 +1,71 @@
+package copier
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// colorMode is the -color flag, deciding whether output is colored.
+type colorMode string
+
+const (
+	// colorAuto colors output written to a terminal, unless NO_COLOR is set
+	// or the terminal is dumb.
+	colorAuto   colorMode = "auto"
+	colorAlways colorMode = "always"
+	colorNever  colorMode = "never"
+)
+
+func (c *colorMode) String() string {
+	return string(*c)
+}
+
+func (c *colorMode) Set(val string) error {
+	switch mode := colorMode(val); mode {
+	case colorAuto, colorAlways, colorNever:
+		*c = mode
+		return nil
+	}
+	return fmt.Errorf("invalid color mode %q, must be auto, always or never", val)
+}
+
+// enabled reports whether output written to w is colored.
+func (c colorMode) enabled(w io.Writer) bool {
+	switch c {
+	case colorAlways:
+		return true
+	case colorNever:
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	return isTerminal(w)
+}
+
+// isTerminal reports whether w is a terminal.
+func isTerminal(w io.Writer) bool {
+	file, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// ANSI escapes for the colors used.
+const (
+	ansiRed    = "\033[31m"
+	ansiYellow = "\033[33m"
+	ansiGreen  = "\033[32m"
+	ansiReset  = "\033[0m"
+)
+
+// paint wraps s in color if on is set.
+func paint(s, color string, on bool) string {
+	if !on {
+		return s
+	}
+	return color + s + ansiReset
+}
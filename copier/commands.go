@@ -0,0 +1,257 @@
+package copier
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// command is a cpj subcommand. Each parses its own flags from args and
+// returns the process exit status.
+type command struct {
+	name string
+	// short is the one line description in the list of commands, and doc
+	// the longer one shown by help.
+	short, doc string
+	// usage holds the synopsis lines shown by help, without the program name.
+	usage []string
+	run   func(args []string) int
+}
+
+// commands is filled in by init, as help refers back to it.
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{
+			name:  "copy",
+			short: "Copy files and directory trees using parallel jobs",
+			doc:   "Copy files and directory trees using parallel jobs. This is the default when no command is given.",
+			usage: []string{
+				"copy [flags] src dest",
+				"copy [flags] src... dir",
+				"copy [flags] -t dir src...",
+				"copy [flags] -parents src... dir",
+				"copy [flags] src s3|gs|az://bucket/prefix",
+				"copy [flags] s3|gs|az://bucket/prefix dest",
+				"copy [flags] src [user@]host:path",
+				"copy [flags] [user@]host:path dest",
+				"copy -from-failures file [-failures file] [-continue] [-jobs n] [flags]",
+			},
+			run: copyMain,
+		},
+		{
+			name:  "sync",
+			short: "Make dest a mirror of a directory",
+			doc:   "Make dest a mirror of the src directory: copy with -recurse, -mkdir, -preserve-times, -skip-existing and -delete turned on. Turn any of them off with e.g. -delete=false.",
+			usage: []string{"sync [flags] src dest"},
+			run:   syncMain,
+		},
+		{
+			name:  "watch",
+			short: "Keep dest a live mirror of a directory",
+			doc:   "Sync src to dest as sync does, then keep watching src, copying the files created or changed below it once it has been quiet for -debounce. Removals, and changes too many to keep up with, sync the whole tree again. Any flag of sync may be given. Where src can't be watched, it is synced again every minute.",
+			usage: []string{"watch [-debounce duration] [sync flags] src dest"},
+			run:   watchMain,
+		},
+		{
+			name:  "snapshot",
+			short: "Take a timestamped backup of a directory",
+			doc:   "Sync src into a new directory of dest named by the time, like dest/2024-05-01T12:00:00, hard linking the files unchanged since the snapshot dest/latest points at instead of copying them again. Once it is complete, latest is pointed at it and the snapshots -keep doesn't keep are removed. Any flag of sync may be given.",
+			usage: []string{"snapshot [-keep policy] [sync flags] src dest"},
+			run:   snapshotMain,
+		},
+		{
+			name:  "verify",
+			short: "Check a tree against a manifest",
+			doc:   "Check a destination tree against a manifest written by -manifest.",
+			usage: []string{"verify -manifest file [-jobs n] [-verbose] dest"},
+			run:   verifyMain,
+		},
+		{
+			name:  "resume",
+			short: "Resume an interrupted copy",
+			doc:   "Resume a copy or sync saved by -checkpoint. Flags of the saved command given here override the saved ones.",
+			usage: []string{"resume [flags] checkpoint"},
+			run:   resumeMain,
+		},
+		{
+			name:  "stats",
+			short: "Summarise a source tree without copying it",
+			doc:   "Count the directories, files and bytes a recursive copy of src would see, without copying anything.",
+			usage: []string{"stats [flags] src"},
+			run:   statsMain,
+		},
+		{
+			name:  "dedup",
+			short: "Replace identical files of a tree by hard links",
+			doc:   "Find the files of an existing tree, such as a backup, that are byte for byte identical, and replace all but one of each set by hard links to it, or by clones with -reflink, reporting the space reclaimed. Only files of the same mode and owner are hard linked together. Each file is replaced atomically.",
+			usage: []string{"dedup [-reflink] [-dry-run] [-jobs n] [-hash-cache file] [flags] dir"},
+			run:   dedupMain,
+		},
+		{
+			name:  "daemon",
+			short: "Run submitted copies in the background",
+			doc:   "Stay resident, running the copies and syncs submitted with cpj.go submit, on the socket or through the REST API and gRPC service of -http, a few at a time, and running scheduled ones when their time comes. The queue is kept in the state directory, so jobs survive a restart, and those running when the daemon stops are run again.",
+			usage: []string{"daemon [-socket path] [-state-dir dir] [-max-jobs n] [-http addr [-http-token token]]"},
+			run:   daemonMain,
+		},
+		{
+			name:  "submit",
+			short: "Queue a copy or sync with the daemon",
+			doc:   "Queue a copy or sync with the daemon, printing its job id. The command is run in the current directory, with the flags and operands given. With -schedule, the job recurs until cancelled, its schedule kept by the daemon with the queue.",
+			usage: []string{"submit [-socket path] [-schedule spec] copy|sync [flags] args..."},
+			run:   submitMain,
+		},
+		{
+			name:  "jobs",
+			short: "List the daemon's jobs, or show or cancel one",
+			doc:   "List the jobs of the daemon, or show how far one has got, or cancel it.",
+			usage: []string{"jobs [-socket path] [-cancel] [id]"},
+			run:   jobsMain,
+		},
+		{
+			name:  "keygen",
+			short: "Generate a key pair for -encrypt and -decrypt",
+			doc:   "Generate a key pair for -encrypt and -decrypt, writing the identity holding the secret key to stdout, or to the file of -o while printing the public key. Give the public key to -recipient, and the identity file to -identity.",
+			usage: []string{"keygen [-o file]"},
+			run:   keygenMain,
+		},
+		{
+			name:  "help",
+			short: "Show the usage of cpj or of one command",
+			doc:   "Show the usage of cpj or of one command.",
+			usage: []string{"help [command]"},
+			run:   helpMain,
+		},
+	}
+}
+
+// lookupCommand returns the command called name, or nil.
+func lookupCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// printUsage prints the synopsis and description of cmd. Its flags follow.
+func (cmd *command) printUsage() {
+	for i, line := range cmd.usage {
+		prefix := "       cpj.go "
+		if i == 0 {
+			prefix = "Usage: cpj.go "
+		}
+		fmt.Println(prefix + line)
+	}
+	fmt.Println(cmd.doc)
+}
+
+// usage prints the list of commands.
+func usage() {
+	fmt.Println("Usage: cpj.go command [flags] args...")
+	fmt.Println("       cpj.go [flags] src dest")
+	fmt.Println("Commands:")
+	width := 0
+	for _, cmd := range commands {
+		width = max(width, len(cmd.name))
+	}
+	for _, cmd := range commands {
+		fmt.Printf("  %-*s  %s\n", width, cmd.name, cmd.short)
+	}
+	fmt.Println("Run cpj.go help command for the flags of each command. A source named like a command must be given as e.g. ./sync.")
+	fmt.Printf("Flags can also be set from the environment, e.g. %s for -jobs or %s for -buffer-size. Flags given on the command line win.\n", envName("jobs"), envName("buffer-size"))
+}
+
+func copyMain(args []string) int {
+	return runCopy("copy", nil, args)
+}
+
+// syncDefaults are the flags sync turns on to mirror src.
+var syncDefaults = []string{"recurse", "mkdir", "preserve-times", "skip-existing", "delete"}
+
+func syncMain(args []string) int {
+	return runCopy("sync", syncDefaults, args)
+}
+
+// cutFlags takes the flags defined by flags, those of a command wrapping
+// sync, out of args, setting them, and returns the rest, which sync parses on
+// each run. It returns flag.ErrHelp for -h after printing the usage.
+func cutFlags(flags *flag.FlagSet, args []string) (rest []string, err error) {
+	for i := 0; i < len(args); i++ {
+		name, val, hasVal := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+		if !strings.HasPrefix(args[i], "-") {
+			rest = append(rest, args[i])
+			continue
+		}
+		if name == "h" || name == "help" {
+			flags.Usage()
+			return nil, flag.ErrHelp
+		}
+		f := flags.Lookup(name)
+		if f == nil {
+			rest = append(rest, args[i])
+			continue
+		}
+		if !hasVal {
+			if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+				val = "true"
+			} else if i+1 < len(args) {
+				i++
+				val = args[i]
+			}
+		}
+		if err := flags.Set(name, val); err != nil {
+			return nil, fmt.Errorf("invalid value %q for -%s: %w", val, name, err)
+		}
+	}
+	return rest, nil
+}
+
+// resumeMain implements `cpj resume`, rerunning the command saved in a
+// checkpoint file with -resume.
+func resumeMain(args []string) int {
+	cmd := lookupCommand("resume")
+	if len(args) == 0 || strings.HasPrefix(args[len(args)-1], "-") {
+		cmd.printUsage()
+		return 1
+	}
+	path := args[len(args)-1]
+	job, err := loadCheckpoint(path)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	saved := lookupCommand(job.Command)
+	if job.Command == "" {
+		saved = lookupCommand("copy")
+	}
+	if saved == nil || saved.name != "copy" && saved.name != "sync" {
+		log.Printf("%s: cannot resume command %q", path, job.Command)
+		return 1
+	}
+	return saved.run(append([]string{"-resume", path}, args[:len(args)-1]...))
+}
+
+// helpMain implements `cpj help`.
+func helpMain(args []string) int {
+	if len(args) == 0 {
+		usage()
+		return 0
+	}
+	cmd := lookupCommand(args[0])
+	if cmd == nil {
+		fmt.Printf("Unknown command %q.\n", args[0])
+		usage()
+		return 1
+	}
+	if cmd.name == "help" {
+		usage()
+		return 0
+	}
+	// Every command prints its usage and flags for -h
+	return cmd.run([]string{"-h"})
+}
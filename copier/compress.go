@@ -0,0 +1,215 @@
+package copier
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"cpj/xz"
+	"cpj/zstd"
+)
+
+// compressor is a format -compress can write.
+type compressor struct {
+	// ext is appended to the name of each file compressed.
+	ext string
+	// minLevel and maxLevel bound -compress-level, and defaultLevel is
+	// used when it isn't given.
+	minLevel, maxLevel, defaultLevel int
+	writer                           func(w io.Writer, level int) (io.WriteCloser, error)
+}
+
+// compressors are the formats of -compress, by name.
+var compressors = map[string]compressor{
+	"gzip": {ext: ".gz", minLevel: gzip.BestSpeed, maxLevel: gzip.BestCompression, defaultLevel: gzip.DefaultCompression,
+		writer: func(w io.Writer, level int) (io.WriteCloser, error) { return gzip.NewWriterLevel(w, level) }},
+	"zstd": {ext: ".zst", minLevel: zstd.MinLevel, maxLevel: zstd.MaxLevel, defaultLevel: zstd.DefaultLevel,
+		writer: func(w io.Writer, level int) (io.WriteCloser, error) { return zstd.NewWriter(w, level) }},
+}
+
+// decompressor is a format -decompress reads.
+type decompressor struct {
+	// ext replaces the extension of each file decompressed, like .tar
+	// for .tgz.
+	ext    string
+	reader func(r io.Reader) (io.ReadCloser, error)
+}
+
+// decompressors are the formats of -decompress, by extension.
+var decompressors = map[string]decompressor{
+	".gz":   {"", gzipReader},
+	".tgz":  {".tar", gzipReader},
+	".bz2":  {"", bzip2Reader},
+	".tbz":  {".tar", bzip2Reader},
+	".zst":  {"", zstdReader},
+	".tzst": {".tar", zstdReader},
+	".xz":   {"", xzReader},
+	".txz":  {".tar", xzReader},
+}
+
+func gzipReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func bzip2Reader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(bzip2.NewReader(r)), nil
+}
+
+func zstdReader(r io.Reader) (io.ReadCloser, error) {
+	return zstd.NewReader(r)
+}
+
+func xzReader(r io.Reader) (io.ReadCloser, error) {
+	return xz.NewReader(r)
+}
+
+// defaultCompressSkip lists the extensions of files that are compressed
+// already, and which -compress copies as they are.
+const defaultCompressSkip = ".gz,.tgz,.bz2,.tbz2,.tbz,.xz,.txz,.zst,.tzst,.lz4,.lzma,.z,.zip,.7z,.rar,.jar,.apk,.jpg,.jpeg,.png,.gif,.webp,.heic,.mp3,.aac,.ogg,.opus,.flac,.mp4,.m4a,.m4v,.mkv,.mov,.avi,.webm,.pdf,.docx,.xlsx,.pptx,.odt,.ods,.epub"
+
+// compression holds the -compress flags, compressing each regular file as
+// it is written and appending the extension of the format to its name, and
+// -decompress, decompressing the files with the extension of one of
+// decompressors and taking it off. The zero value does neither.
+type compression struct {
+	format     compressFormat
+	level      int
+	skip       extList
+	decompress bool
+}
+
+// compressFormat is a flag.Value naming one of compressors.
+type compressFormat string
+
+func (f *compressFormat) String() string {
+	return string(*f)
+}
+
+func (f *compressFormat) Set(val string) error {
+	if _, ok := compressors[val]; !ok {
+		names := make([]string, 0, len(compressors))
+		for name := range compressors {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unsupported compression format %q, must be %s", val, strings.Join(names, " or "))
+	}
+	*f = compressFormat(val)
+	return nil
+}
+
+// extList is a flag.Value of comma separated file extensions, matched
+// regardless of case.
+type extList map[string]bool
+
+func (l *extList) String() string {
+	exts := make([]string, 0, len(*l))
+	for ext := range *l {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	return strings.Join(exts, ",")
+}
+
+func (l *extList) Set(val string) error {
+	*l = make(extList)
+	for _, ext := range strings.Split(val, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		(*l)[ext] = true
+	}
+	return nil
+}
+
+// validate checks -compress-level against the format.
+func (c *compression) validate() error {
+	if c.format != "" && c.decompress {
+		return errors.New("-compress and -decompress can't be used together")
+	}
+	if c.format == "" {
+		return nil
+	}
+	format := compressors[string(c.format)]
+	if c.level != 0 && (c.level < format.minLevel || c.level > format.maxLevel) {
+		return fmt.Errorf("-compress-level must be from %d to %d for %s", format.minLevel, format.maxLevel, c.format)
+	}
+	return nil
+}
+
+// compresses reports whether the source file src, described by info or
+// statted if nil, is compressed: it is a regular file without one of the
+// extensions of -compress-skip. One that can't be statted, like the source
+// of a link already moved, is taken to be a regular file.
+func (c *compression) compresses(src string, info os.FileInfo) bool {
+	if c.format == "" || c.skip[strings.ToLower(filepath.Ext(src))] {
+		return false
+	}
+	if info == nil {
+		var err error
+		if info, err = os.Lstat(src); err != nil {
+			return true
+		}
+	}
+	return info.Mode().IsRegular()
+}
+
+// decoder returns the cp.Options.Decode of the source file src, described by
+// info or statted if nil, or nil if it isn't decompressed.
+func (c *compression) decoder(src string, info os.FileInfo) func(r io.Reader) (io.ReadCloser, error) {
+	if !c.decompress {
+		return nil
+	}
+	ext := strings.ToLower(filepath.Ext(src))
+	format, ok := decompressors[ext]
+	if !ok {
+		return nil
+	}
+	if info == nil {
+		var err error
+		if info, err = os.Lstat(src); err != nil {
+			return format.reader
+		}
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	return format.reader
+}
+
+// rename returns dest, the destination of the source file src described by
+// info, with the extension of the format appended if it is compressed, or
+// that of its format replaced if it is decompressed.
+func (c *compression) rename(src, dest string, info os.FileInfo) string {
+	if c.compresses(src, info) {
+		return dest + compressors[string(c.format)].ext
+	}
+	if _, ok := decompressors[strings.ToLower(filepath.Ext(src))]; ok && c.decoder(src, info) != nil {
+		ext := filepath.Ext(src)
+		if strings.EqualFold(filepath.Ext(dest), ext) {
+			dest = dest[:len(dest)-len(ext)]
+		}
+		return dest + decompressors[strings.ToLower(ext)].ext
+	}
+	return dest
+}
+
+// encode is the cp.Options.Encode of the files compressed.
+func (c *compression) encode(w io.Writer) (io.WriteCloser, error) {
+	format := compressors[string(c.format)]
+	level := c.level
+	if level == 0 {
+		level = format.defaultLevel
+	}
+	return format.writer(w, level)
+}
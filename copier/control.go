@@ -0,0 +1,118 @@
+package copier
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// serveControl listens on the unix socket at path for -control, taking one
+// command a line and answering each with a line:
+//
+//	status      how far the copy has got, as SIGUSR1 prints
+//	pause       finish the copies in progress, then take no further files
+//	resume      carry on after a pause
+//	set-jobs N  let N workers copy at once, starting more if needed
+//	cancel      stop taking files, as the first SIGINT does
+//
+// Answers other than to status are ok, or start with "error: ". The returned
+// function stops listening and removes the socket.
+func serveControl(path string, opts *options) (stop func(), err error) {
+	// A socket left behind by a cpj that died can be replaced, but not one
+	// still in use
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("control socket %s is in use", path)
+	} else if errors.Is(err, syscall.ECONNREFUSED) {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Anyone who can connect can cancel the copy
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handleControl(conn, opts)
+		}
+	}()
+	return func() { l.Close() }, nil
+}
+
+// handleControl answers the commands sent on conn until it is closed.
+func handleControl(conn net.Conn, opts *options) {
+	defer conn.Close()
+	lines := bufio.NewScanner(conn)
+	for lines.Scan() {
+		args := strings.Fields(lines.Text())
+		if len(args) == 0 {
+			continue
+		}
+		trace("Control command", "command", lines.Text())
+		reply := "ok"
+		if err := controlCommand(args, opts, &reply); err != nil {
+			reply = "error: " + err.Error()
+		}
+		if _, err := fmt.Fprintln(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// controlCommand carries out args, setting reply if it has more to say than
+// ok.
+func controlCommand(args []string, opts *options, reply *string) error {
+	usage := func() error {
+		return errors.New("commands are status, pause, resume, set-jobs N and cancel")
+	}
+	switch args[0] {
+	case "status":
+		*reply = opts.dispatch.Load().report()
+		if opts.paused.Load() && opts.dispatch.Load() == nil {
+			*reply += ", paused"
+		}
+	case "pause", "resume":
+		setPaused(opts, args[0] == "pause")
+	case "set-jobs":
+		if len(args) != 2 {
+			return usage()
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid number of jobs %q", args[1])
+		}
+		if opts.adaptive {
+			return errors.New("the number of jobs is set by -adaptive")
+		}
+		// Later sources are copied with as many jobs
+		opts.jobsSet.Store(int64(n))
+		if d := opts.dispatch.Load(); d != nil {
+			if allowed := d.jobs.setJobs(n); allowed < n {
+				*reply = fmt.Sprintf("ok, %d jobs as the files have run out", allowed)
+			}
+		}
+	case "cancel":
+		slog.Warn("Cancelled, waiting for copies in progress to finish")
+		opts.cancelled.Store(true)
+		if d := opts.dispatch.Load(); d != nil {
+			d.jobs.interrupt()
+		}
+	default:
+		return usage()
+	}
+	return nil
+}
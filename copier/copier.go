@@ -0,0 +1,281 @@
+// Package copier copies files and directory trees in parallel, as the cpj
+// command does, for Go programs to embed instead of running cpj.
+//
+// A Copier copies one source to one destination, either of which may be a
+// local path, an s3://, gs:// or az:// URL or a [user@]host:path reached over
+// sftp, with the settings of its Options:
+//
+//	c := &copier.Copier{Src: "photos", Dest: "backup", Options: copier.Options{Recurse: true, Mkdir: true}}
+//	report, err := c.Run(ctx)
+//
+// Main runs the cpj command line itself.
+package copier
+
+import (
+	"bytes"
+	"context"
+	"cpj/cp"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Copier copies Src to Dest. As with cpj, the contents of a directory Src
+// are copied into the directory Dest, not into a directory named after Src
+// below it, and Dest must exist unless Options.Mkdir is set. A file Src is
+// copied into Dest if it is a directory, or else to Dest itself.
+type Copier struct {
+	Src, Dest string
+	Options   Options
+	Callbacks Callbacks
+}
+
+// Callbacks are told of the files of a run as it goes, for a program to show
+// its own progress. Any of them may be nil. They are called one at a time,
+// from the goroutines doing the copying, so they should return quickly.
+type Callbacks struct {
+	// OnFileStart is called as a file starts being copied.
+	OnFileStart func(FileEvent)
+	// OnFileDone is called once a file is copied, or skipped.
+	OnFileDone func(FileEvent)
+	// OnError is called for each file that fails, with why.
+	OnError func(FileEvent, error)
+	// OnProgress is called with the totals so far after each of the
+	// others but OnFileStart.
+	OnProgress func(Progress)
+}
+
+// FileEvent is a file of a run, as passed to Callbacks.
+type FileEvent struct {
+	Src, Dest string
+	// Size is the size of the file, if known.
+	Size int64
+	// Skipped is why the file was skipped, such as "existing", or empty
+	// if it wasn't.
+	Skipped string
+}
+
+// Progress is the totals of a run so far, counted as in a Report.
+type Progress Report
+
+// Options are the settings of a Copier. Each is named after the flag of cpj
+// copy it stands for, whose help says more, and the zero value of each is
+// the flag's default.
+type Options struct {
+	// Jobs is the number of files copied at once, or 0 to pick it from
+	// the CPU count and the kind of storage Src and Dest are on.
+	Jobs int
+	// Recurse copies the tree below a directory Src.
+	Recurse bool
+	// Mkdir creates Dest, and any missing parents, if it doesn't exist.
+	Mkdir bool
+	// Link hard links files instead of copying them, where able.
+	Link bool
+	// Links is what to do with symlinks: "preserve", the default,
+	// "follow" or "skip".
+	Links string
+	// Include and Exclude are glob patterns of the files to copy and of
+	// the paths to leave out.
+	Include, Exclude []string
+	// NoHidden leaves out names starting with a dot.
+	NoHidden bool
+	// MinSize and MaxSize bound the size of the files copied, 0 being no
+	// bound.
+	MinSize, MaxSize int64
+	// NewerThan and OlderThan bound the modification time of the files
+	// copied, the zero time being no bound.
+	NewerThan, OlderThan time.Time
+	// MaxDepth is how many levels below Src to copy, 0 being no limit.
+	MaxDepth int
+	// Filter, if set, decides on the paths the filters above leave in.
+	// Built in ones can be composed with All.
+	Filter Filter
+
+	PreservePerms, PreserveOwner, PreserveTimes bool
+	// SkipExisting skips files whose destination has the same size and
+	// modification time, and Checksum those with the same contents.
+	SkipExisting, Checksum bool
+	// Force, NoClobber and Atomic decide how existing destination files
+	// are replaced.
+	Force, NoClobber, Atomic bool
+	// Delete removes destination files not in the source once copied.
+	Delete bool
+	// DryRun only prints what would be done, to stdout.
+	DryRun bool
+	// Continue goes on copying past files that fail, Retries times each,
+	// waiting RetryDelay, doubled each time, between tries.
+	Continue   bool
+	Retries    int
+	RetryDelay time.Duration
+	// Manifest, if set, is the file to write a sha256sum manifest of the
+	// copied files to.
+	Manifest string
+	// Verify reads every copied file back once the copy is done, and
+	// compares it with its source, Run returning an ErrVerifyMismatch if
+	// any differ. It needs local paths.
+	Verify bool
+	// ExecBefore and ExecAfter are commands to run before and after
+	// copying each file, if they name {src} or {dest}, or else once
+	// before and after the copy. A file is only copied if ExecBefore
+	// succeeds, and counts as failed if ExecAfter doesn't.
+	ExecBefore, ExecAfter string
+}
+
+// Report is what a run of a Copier did.
+type Report struct {
+	// Copied files, of Bytes in all, and those Skipped, as unchanged or
+	// unreadable.
+	Copied, Skipped int
+	Bytes           int64
+	// Failed files, each of which was logged. With Verify, this includes
+	// those whose copy differs from the source.
+	Failed  int
+	Elapsed time.Duration
+}
+
+// Run copies Src to Dest, logging with the default slog.Logger. It returns
+// what was done even when it fails. Once ctx is done the walk stops, the
+// copies in progress are given up, their partial destinations removed, and
+// Run returns an error matching ctx.Err().
+func (c *Copier) Run(ctx context.Context) (Report, error) {
+	if err := ctx.Err(); err != nil {
+		return Report{}, err
+	}
+	opts, err := c.Options.options(c.Src, c.Dest)
+	if err != nil {
+		return Report{}, err
+	}
+	opts.ctx, opts.abort = context.WithCancelCause(ctx)
+	defer opts.abort(nil)
+	opts.events.hooks = c.Callbacks
+	var copied []fileEntry
+	if c.Options.Verify {
+		done := c.Callbacks.OnFileDone
+		opts.events.hooks.OnFileDone = func(f FileEvent) {
+			if f.Skipped == "" {
+				copied = append(copied, fileEntry{src: f.Src, dest: f.Dest, size: f.Size})
+			}
+			if done != nil {
+				done(f)
+			}
+		}
+	}
+	err = opts.withHooks(func() error {
+		return copyPair(c.Src, c.Dest, opts)
+	})
+	if err == nil && c.Options.Verify {
+		err = verifyCopies(copied, opts)
+	}
+	l := opts.events
+	return Report{Copied: l.files, Skipped: l.skips, Bytes: l.bytes, Failed: l.failures, Elapsed: time.Since(l.start)}, err
+}
+
+// options returns the options of a copy from src to dest with o.
+func (o *Options) options(src, dest string) (*options, error) {
+	opts := newOptions()
+	opts.jobs = jobCount(o.Jobs)
+	opts.recurse, opts.mkdir, opts.link = o.Recurse, o.Mkdir, o.Link
+	if o.Links != "" {
+		if err := opts.links.Set(o.Links); err != nil {
+			return nil, errorOf(ErrUsage, "%w", err)
+		}
+	}
+	opts.filter.include, opts.filter.exclude = o.Include, o.Exclude
+	opts.filter.noHidden = o.NoHidden
+	opts.filter.minSize, opts.filter.maxSize = byteSize(o.MinSize), byteSize(o.MaxSize)
+	opts.filter.newerThan.t, opts.filter.olderThan.t = o.NewerThan, o.OlderThan
+	opts.maxDepth = o.MaxDepth
+	if err := validateFilter(o.Filter); err != nil {
+		return nil, errorOf(ErrUsage, "%w", err)
+	}
+	opts.filter.custom = o.Filter
+	opts.preservePerms, opts.preserveOwner, opts.preserveTimes = o.PreservePerms, o.PreserveOwner, o.PreserveTimes
+	opts.skipExisting, opts.checksum = o.SkipExisting, o.Checksum
+	opts.force, opts.noClobber, opts.atomic = o.Force, o.NoClobber, o.Atomic
+	opts.delete, opts.dryRun = o.Delete, o.DryRun
+	opts.cont, opts.retries, opts.retryDelay = o.Continue, o.Retries, o.RetryDelay
+	if opts.retryDelay == 0 {
+		opts.retryDelay = time.Second
+	}
+	opts.manifest = o.Manifest
+	opts.exec = execHooks{before: o.ExecBefore, after: o.ExecAfter}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if o.Jobs < 0 {
+		return nil, errorOf(ErrUsage, "Jobs must not be negative")
+	}
+	if o.Verify && o.DryRun {
+		return nil, errorOf(ErrUsage, "Verify can't be used with DryRun, which copies nothing")
+	}
+	if o.Verify && (isBucketURL(src) || isBucketURL(dest) || isRemote(src) || isRemote(dest)) {
+		return nil, errorOf(ErrUsage, "Verify needs local paths")
+	}
+	if opts.jobs == 0 {
+		opts.jobs = jobCount(autoJobs(src, dest))
+	}
+	if !isRemote(src) && !isBucketURL(src) && probeStorage(existingParent(src)) == storageRotational {
+		opts.sequential = true
+	}
+	// The events of a run are counted and passed to its Callbacks, not written.
+	opts.events = newEventLog(io.Discard)
+	return opts, nil
+}
+
+// verifyCopies compares each regular file copied with its source, with the
+// jobs of opts, counting those that differ, or can't be read back, as
+// failed. It returns an ErrVerifyMismatch if any differ.
+func verifyCopies(copied []fileEntry, opts *options) error {
+	files := make(chan fileEntry)
+	var wg sync.WaitGroup
+	var differ atomic.Int64
+	for range max(int(opts.jobs), 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range files {
+				if err := verifyCopy(f, int(opts.bufferSize)); err != nil {
+					if errors.Is(err, ErrVerifyMismatch) {
+						differ.Add(1)
+					}
+					slog.Error("Copy failed verification", "src", f.src, "dest", f.dest, "error", err)
+					opts.events.fail(copyError{src: f.src, dest: f.dest, err: err})
+				}
+			}
+		}()
+	}
+	for _, f := range copied {
+		files <- f
+	}
+	close(files)
+	wg.Wait()
+	if n := differ.Load(); n > 0 {
+		return errorOf(ErrVerifyMismatch, "%d copied files differ from their source", n)
+	}
+	if n := opts.events.failures; n > 0 {
+		return errorOf(ErrPartial, "%d copied files could not be read back", n)
+	}
+	return nil
+}
+
+func verifyCopy(f fileEntry, bufSize int) error {
+	if info, err := os.Lstat(f.src); err != nil || !info.Mode().IsRegular() {
+		return err
+	}
+	want, err := cp.FileDigest(f.src, bufSize)
+	if err != nil {
+		return err
+	}
+	got, err := cp.FileDigest(f.dest, bufSize)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		return errorOf(ErrVerifyMismatch, "contents differ from the source")
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package copier
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestCopierContents checks that a directory Src has its contents copied into
+// an existing Dest, not a directory named after it, and that a missing Dest
+// needs Mkdir.
+func TestCopierContents(t *testing.T) {
+	dir := t.TempDir()
+	src, dest := filepath.Join(dir, "src"), filepath.Join(dir, "dest")
+	for _, d := range []string{filepath.Join(src, "a"), dest} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"f1", "a/f2"} {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &Copier{Src: src, Dest: dest, Options: Options{Recurse: true}}
+	report, err := c.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Copied != 2 {
+		t.Errorf("Run copied %d files, want 2", report.Copied)
+	}
+	for _, name := range []string{"f1", "a/f2"} {
+		if data, err := os.ReadFile(filepath.Join(dest, name)); err != nil || string(data) != name {
+			t.Errorf("dest/%s holds %q: %v", name, data, err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "src")); !os.IsNotExist(err) {
+		t.Errorf("Run copied src into dest/src: %v", err)
+	}
+
+	missing := filepath.Join(dir, "missing")
+	c = &Copier{Src: src, Dest: missing, Options: Options{Recurse: true}}
+	if _, err := c.Run(context.Background()); !errors.Is(err, ErrDestMissing) {
+		t.Errorf("Run to a missing Dest returned %v, want ErrDestMissing", err)
+	}
+	c.Options.Mkdir = true
+	if _, err := c.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(missing, "a", "f2")); err != nil {
+		t.Errorf("Run with Mkdir didn't copy into the new Dest: %v", err)
+	}
+}
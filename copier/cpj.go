@@ -0,0 +1,1559 @@
+package copier
+
+import (
+	"context"
+	"cpj/cp"
+	"cpj/s3"
+	"cpj/stack"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type copyJob struct {
+	// work carries the files to copy from the feeder to the workers, in
+	// the order they are to be copied. It is closed once they run out or
+	// the job stops.
+	work chan fileEntry
+	// quit is closed once -max-errors is reached or the copy is
+	// interrupted, so no further files are handed out.
+	quit chan struct{}
+	// queued and taken count the files handed to work and taken from it
+	// by the workers, done those copied and copied their bytes, and
+	// abandoned those given up once the copy was.
+	queued, taken, done int64
+	abandoned           int64
+	copied              int64
+	skipped             int64
+	manifest            *manifest
+	checkpoint          *checkpoint
+	failed              int64
+	// limit is the number of workers allowed to take files, which -adaptive
+	// moves. Workers with a higher id wait on wake until it grows, work is
+	// drained or the job is stopped. Changes to limit, and drained and
+	// interrupted, are guarded by mu.
+	mu          sync.Mutex
+	limit       int64
+	drained     bool
+	interrupted bool
+	wake        *sync.Cond
+	// spawn starts worker id, with mu held. started counts the workers
+	// started, and running those yet to finish.
+	spawn            func(id int)
+	started, running int
+	// files and busy count the copies finished and the time spent on them
+	// since -adaptive last looked.
+	files, busy int64
+	// ready, with -read-jobs or -write-jobs, carries the files the read pool
+	// has started reading to the workers, which then only write. It is
+	// closed once the read pool is done.
+	ready chan *transfer
+	// devices, if set, caps the copies in flight on each device.
+	devices *deviceLimits
+	events  *eventLog
+	dash    *dashboard
+	// paused is set while the copy is paused. Workers and readers hold on
+	// wake until it is cleared, each having finished the file it was on.
+	paused *atomic.Bool
+}
+
+// feed hands the files of source to the workers until it runs dry or the
+// job is stopped, then closes work.
+func (j *copyJob) feed(source fileSource) {
+	defer close(j.work)
+	defer j.dash.fed()
+	for {
+		f, ok := source.next()
+		if !ok {
+			return
+		}
+		select {
+		case j.work <- f:
+			atomic.AddInt64(&j.queued, 1)
+			j.events.queued(f)
+			j.dash.queued(f)
+		case <-j.quit:
+			return
+		}
+	}
+}
+
+// take returns the next file to copy. It is false once every file has been
+// handed out or the job is stopped.
+func (j *copyJob) take() (fileEntry, bool) {
+	j.hold()
+	if j.stopping() {
+		return fileEntry{}, false
+	}
+	select {
+	case f, ok := <-j.work:
+		if ok {
+			atomic.AddInt64(&j.taken, 1)
+		}
+		return f, ok
+	case <-j.quit:
+		return fileEntry{}, false
+	}
+}
+
+// admit holds worker id back while it is beyond the -adaptive limit, and
+// reports whether it may go on taking files.
+func (j *copyJob) admit(id int) bool {
+	if int64(id) < atomic.LoadInt64(&j.limit) {
+		return !j.stopping()
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for int64(id) >= j.limit && !j.stopping() && !j.drained {
+		j.wake.Wait()
+	}
+	return !j.stopping()
+}
+
+// hold waits while the copy is paused, until it is resumed or stopped.
+func (j *copyJob) hold() {
+	if j.paused == nil || !j.paused.Load() {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for j.paused.Load() && !j.stopping() {
+		j.wake.Wait()
+	}
+}
+
+// setJobs lets n workers take files, starting more if fewer were started,
+// unless the files have run out. It returns the number of workers allowed.
+func (j *copyJob) setJobs(n int) int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	// Without running workers the dispatcher may no longer wait for more
+	for j.started < n && j.running > 0 && !j.drained && !j.stopping() {
+		j.spawn(j.started)
+	}
+	limit := int64(min(n, j.started))
+	if limit != j.limit {
+		slog.Info("Setting active jobs", "from", j.limit, "to", limit)
+		atomic.StoreInt64(&j.limit, limit)
+		j.wake.Broadcast()
+	}
+	return int(limit)
+}
+
+// drain records that work has run dry, letting any held back workers finish.
+func (j *copyJob) drain() {
+	j.mu.Lock()
+	j.drained = true
+	j.wake.Broadcast()
+	j.mu.Unlock()
+}
+
+// fail reports a failed copy, stopping the job once -max-errors is reached.
+func (j *copyJob) fail(errorChan chan copyError, e copyError, opts *options) {
+	errorChan <- e
+	opts.events.fail(e)
+	j.dash.failed()
+	if failed := atomic.AddInt64(&j.failed, 1); opts.maxErrors > 0 && failed == int64(opts.maxErrors) {
+		slog.Debug("Reached -max-errors, stopping", "errors", opts.maxErrors)
+		j.halt()
+	}
+}
+
+// halt stops the job, as stop does, taking mu.
+func (j *copyJob) halt() {
+	j.mu.Lock()
+	j.stop()
+	j.mu.Unlock()
+}
+
+// stop makes the workers take no further files, waking those held back by
+// the -adaptive limit. It must be called with mu held.
+func (j *copyJob) stop() {
+	if !j.stopping() {
+		close(j.quit)
+	}
+	j.wake.Broadcast()
+}
+
+func (j *copyJob) stopping() bool {
+	select {
+	case <-j.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// defaultSplitSize is the -split-size above which a file is copied in ranges
+// by several jobs at once.
+const defaultSplitSize = 1 << 30
+
+// treeScan is the result of the pre-scan of the source tree.
+type treeScan struct {
+	files int
+	bytes int64
+	sizes map[string]int64
+	// infos holds what the walk found at each file, for the workers.
+	infos map[string]os.FileInfo
+	// inodes is only filled in when it is set, for -sequential.
+	inodes map[string]uint64
+}
+
+// options holds the command line settings shared by the walker and the copy workers.
+type options struct {
+	link, recurse, useful, cont, verbose     bool
+	progress, mkdir, dirsOnly, hardLinks     bool
+	dedup                                    bool
+	dropCache, skipExisting, checksum, delta bool
+	force, noClobber, interactive            bool
+	delete, dryRun, move, atomic, staged     bool
+	adaptive, sequential, sort               bool
+	order                                    fileOrder
+	readJobs, writeJobs, deviceJobs          int
+	maxQueued                                int
+	spillDir                                 string
+	noTargetDir, from0, parents              bool
+	extract                                  bool
+	oneFileSystem                            bool
+	filesFrom                                string
+	rename                                   renameRules
+	types                                    fileTypes
+	sanitize                                 sanitizer
+	targetDir                                string
+	preservePerms, preserveOwner             bool
+	numericIDs, preserveTimes, preserveAtime bool
+	jobs                                     jobCount
+	filter                                   pathFilter
+	links                                    linkPolicy
+	special                                  specialPolicy
+	reflink                                  cp.ReflinkMode
+	engine                                   cp.Engine
+	queueDepth                               int
+	bufferSize, splitSize                    byteSize
+	manifest, hashCachePath                  string
+	hashes                                   *hashCache
+	backup                                   backupSettings
+	linkDest                                 linkDests
+	compress                                 compression
+	zipStore                                 extList
+	s3                                       s3Settings
+	sshCommand                               string
+	exec                                     execHooks
+	crypt                                    encryption
+	checkpoint, resume                       string
+	failures, fromFailures                   string
+	failuresWritten                          bool
+	walkFailed                               int
+	skipUnreadable, json, quiet, tui         bool
+	logLevel                                 logLevel
+	logFormat                                logFormat
+	logFile                                  string
+	logMaxSize                               byteSize
+	logKeep                                  int
+	logCompress                              bool
+	color                                    colorMode
+	unreadable                               skipList
+	events                                   *eventLog
+	dash                                     *dashboard
+	dispatch                                 atomic.Pointer[dispatch]
+	paused, cancelled                        atomic.Bool
+	control                                  string
+	jobsSet                                  atomic.Int64
+	retries, maxErrors, maxDepth             int
+	retryDelay                               time.Duration
+	job                                      *checkpoint
+	// ctx is done once the copy is abandoned, which abort does: files in
+	// progress are given up and their partial destinations removed.
+	ctx   context.Context
+	abort context.CancelCauseFunc
+	// signals has SIGINT and SIGTERM stop the copy, as they do cpj's.
+	signals bool
+}
+
+// destRel returns the destination path for rel, a path relative to the
+// source root, after the -rename rules and -sanitize.
+func (o *options) destRel(rel string) string {
+	return o.sanitize.path(o.rename.apply(rel))
+}
+
+// copyOptions returns the subset of options that apply to a single file copy.
+func (o *options) copyOptions() cp.Options {
+	opts := cp.Options{
+		Hardlink:        o.link,
+		PreservePerms:   o.preservePerms,
+		PreserveOwner:   o.preserveOwner,
+		NumericIDs:      o.numericIDs,
+		PreserveTimes:   o.preserveTimes,
+		PreserveAtime:   o.preserveAtime,
+		PreserveLinks:   o.links == linksPreserve,
+		RecreateSpecial: o.special == specialRecreate,
+		Reflink:         o.reflink,
+		Engine:          o.engine,
+		QueueDepth:      o.queueDepth,
+		BufferSize:      int(o.bufferSize),
+		DropCache:       o.dropCache,
+		SkipUnchanged:   o.skipExisting,
+		Checksum:        o.checksum,
+		Delta:           o.delta,
+		Force:           o.force,
+		NoClobber:       o.noClobber,
+		Atomic:          o.atomic,
+		SplitSize:       int64(o.splitSize),
+		SplitJobs:       int(o.jobs),
+		Context:         o.ctx,
+	}
+	if o.interactive {
+		opts.Confirm = confirmOverwrite
+	}
+	if o.backup.enabled {
+		opts.Backup = o.backup.backup
+	}
+	if o.hashes != nil {
+		opts.Digest = o.hashes.digest
+	}
+	return opts
+}
+
+type copyError struct {
+	id        int
+	src, dest string
+	err       error
+}
+
+var debug bool
+
+// Main runs the cpj command line, args being its arguments without the
+// program name, and returns the process exit status.
+func Main(args []string) int {
+	if len(args) == 0 {
+		usage()
+		return 1
+	}
+	if cmd := lookupCommand(args[0]); cmd != nil {
+		return cmd.run(args[1:])
+	}
+	if args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+		usage()
+		return 0
+	}
+	// Without a subcommand cpj copies, as it always has
+	return copyMain(args)
+}
+
+// addCopyFlags registers the flags of copy and sync on flags.
+func addCopyFlags(flags *flag.FlagSet, opts *options) {
+	flags.BoolVar(&opts.link, "link", false, "Hard link copied files if able.")
+	flags.BoolVar(&opts.recurse, "recurse", false, "Recurse the supplied directory.")
+	flags.BoolVar(&opts.useful, "useful", false, "Log some useful statisitcs. Same as -log-level=info.")
+	flags.BoolVar(&opts.skipUnreadable, "skip-unreadable", false, "Leave out source files and directories we aren't permitted to read, listing them at the end, instead of failing.")
+	flags.BoolVar(&opts.json, "json", false, "Write newline delimited JSON events to stdout as files are queued, copied, skipped or fail, then a summary, instead of any other output there.")
+	flags.BoolVar(&opts.cont, "continue", false, "Continue parallel copy even if individual file errors occur.")
+	flags.BoolVar(&opts.quiet, "quiet", false, "Only report errors: no progress bar, lists of renamed or unreadable paths, or usage on missing operands. For scripts that only check the exit status.")
+	flags.BoolVar(&opts.verbose, "verbose", false, "Log every file copied. Same as -log-level=debug.")
+	flags.BoolVar(&debug, "debug", false, "Log debug messages. Same as -log-level=trace.")
+	flags.Var(&opts.logLevel, "log-level", "Log messages of this level and above: trace, debug, info, warn or error. Overrides -useful, -verbose and -debug.")
+	flags.Var(&opts.logFormat, "log-format", "How to write log messages: plain, text (logfmt) or json.")
+	flags.Var(&opts.color, "color", "Color errors, warnings and statistics: auto, when writing to a terminal and NO_COLOR isn't set, always or never.")
+	flags.StringVar(&opts.logFile, "log-file", "", "Write log messages to this file instead of stderr, rotating it by size.")
+	flags.Var(&opts.logMaxSize, "log-max-size", "Rotate the -log-file once it would grow past this size, e.g. 100M. 0 never rotates it.")
+	flags.IntVar(&opts.logKeep, "log-keep", 5, "Keep this many rotated -log-files, named FILE.1 for the newest and up.")
+	flags.BoolVar(&opts.logCompress, "log-compress", false, "Gzip rotated -log-files, as FILE.1.gz.")
+	flags.BoolVar(&opts.progress, "progress", false, "Show a progress bar with throughput and estimated time remaining.")
+	flags.StringVar(&opts.control, "control", "", "Listen on a unix socket at this path for the commands status, pause, resume, set-jobs N and cancel, one a line, to adjust a long copy without restarting it.")
+	flags.BoolVar(&opts.tui, "tui", false, "Show a full-screen dashboard with a progress bar for each worker, the file it is on, throughput, errors and estimated time remaining. Log messages are shown as they come and written out at the end. Needs a terminal, falling back to -progress without one.")
+	flags.BoolVar(&opts.mkdir, "mkdir", false, "Create the destination directory, including any missing parents, if it does not exist.")
+	flags.BoolVar(&opts.dirsOnly, "dirs-only", false, "Only replicate the directory structure, without copying any files.")
+	flags.BoolVar(&opts.preservePerms, "preserve-perms", false, "Give copied files and directories the same mode bits as the source.")
+	flags.BoolVar(&opts.preserveOwner, "preserve-owner", false, "Give copied files and directories the same owner and group as the source. Requires privileges.")
+	flags.BoolVar(&opts.numericIDs, "numeric-ids", false, "Accepted for compatibility. -preserve-owner always keeps the numeric uid/gid, as both ends share one user database.")
+	flags.BoolVar(&opts.preserveTimes, "preserve-times", false, "Give copied files and directories the same modification time as the source.")
+	flags.BoolVar(&opts.preserveAtime, "preserve-atime", false, "With -preserve-times, also restore the access time.")
+	flags.BoolVar(&opts.hardLinks, "hard-links", false, "Recreate hard links between source files at the destination instead of copying each name.")
+	flags.BoolVar(&opts.dedup, "dedup", false, "Copy each set of identical source files once, found by size and sha256 digest, and hard link the rest of the set to that copy at the destination.")
+	flags.BoolVar(&opts.dropCache, "drop-cache", false, "Keep copied files out of the page cache so large copies don't evict other data.")
+	flags.BoolVar(&opts.skipExisting, "skip-existing", false, "Skip files whose destination has the same size and modification time. Use with -preserve-times.")
+	flags.BoolVar(&opts.checksum, "checksum", false, "Skip files whose destination has identical contents, comparing sha256 digests instead of times.")
+	flags.BoolVar(&opts.delta, "delta", false, "Update existing destination files with rsync's algorithm, finding their blocks in the source by a rolling checksum and only writing the data between them. Files changed where they stand, like VM images and databases, are updated in place; once data is inserted or removed the rest goes to a new file, taking the moved blocks from the old one.")
+	flags.StringVar(&opts.hashCachePath, "hash-cache", "", "Keep the digests -checksum and -dedup compute in this file, and reuse them on later runs for files whose size, modification time and inode are unchanged, instead of reading them again.")
+	flags.Var(&opts.compress.format, "compress", "Compress each regular file as it is written, in this format, appending its extension to the name, .zst for zstd or .gz for gzip.")
+	flags.IntVar(&opts.compress.level, "compress-level", 0, "With -compress, the compression level, from 1, the fastest, to 19 for zstd or 9 for gzip, the smallest. 0 means the format's default, 3 for zstd and 6 for gzip.")
+	flags.Var(&opts.compress.skip, "compress-skip", "With -compress, copy files with these comma separated extensions as they are, being compressed already.")
+	flags.Var(&opts.zipStore, "zip-store", "When writing a .zip dest, store files with these comma separated extensions as they are, being compressed already, and deflate the rest at -compress-level.")
+	flags.BoolVar(&opts.compress.decompress, "decompress", false, "Decompress each file ending in .gz, .tgz, .zst, .tzst, .xz, .txz, .bz2 or .tbz as it is copied, taking the extension off its name, or turning it into .tar.")
+	flags.BoolVar(&opts.crypt.encrypt, "encrypt", false, "Encrypt each regular file as it is written, after any -compress, for every -recipient, appending .enc to its name.")
+	flags.Var(&opts.crypt.recipients, "recipient", "With -encrypt, a public key, as printed by cpj keygen, to encrypt files for. May be repeated, any of the keys decrypting them.")
+	flags.BoolVar(&opts.crypt.decrypt, "decrypt", false, "Decrypt each file ending in .enc as it is copied, before any -decompress, taking the extension off its name.")
+	flags.StringVar(&opts.crypt.identity, "identity", "", "With -decrypt, the file of secret keys written by cpj keygen.")
+	flags.BoolVar(&opts.force, "force", false, "Replace existing destination files unconditionally, removing them first if they can't be written.")
+	flags.BoolVar(&opts.noClobber, "no-clobber", false, "Never replace existing destination files.")
+	flags.BoolVar(&opts.interactive, "interactive", false, "Ask before replacing each existing destination file.")
+	flags.BoolVar(&opts.delete, "delete", false, "After copying, delete destination files that don't exist in the source. Skipped if any copy failed.")
+	flags.BoolVar(&opts.dryRun, "dry-run", false, "Only list what would be copied and deleted, without changing anything.")
+	flags.BoolVar(&opts.move, "move", false, "Remove each source file once it has been copied, and source directories left empty at the end.")
+	flags.BoolVar(&opts.atomic, "atomic", false, "Copy each file to a temporary name beside its destination and rename it into place once complete.")
+	flags.BoolVar(&opts.staged, "staged", false, "Copy the tree into a staging directory beside dest, then swap it into place replacing dest's previous contents, or roll back on failure.")
+	flags.StringVar(&opts.targetDir, "t", "", "Copy every argument into this directory, as SRC... are copied by cp -t.")
+	flags.BoolVar(&opts.noTargetDir, "T", false, "Treat dest as the exact path to copy to, never as a directory to copy into.")
+	flags.BoolVar(&opts.parents, "parents", false, "Recreate each source's path below the dest directory, or only the part after a /./ in it.")
+	flags.Var(&opts.rename, "rename", "Rewrite each destination path relative to dest with a sed style s/regexp/replacement/[gi] rule. May be repeated.")
+	flags.Var(&opts.sanitize.mode, "sanitize", "Replace characters in destination names that are invalid on a fat, ntfs or posix (portable names only) filesystem.")
+	flags.StringVar(&opts.sanitize.repl, "sanitize-char", "_", "Replacement for the characters removed by -sanitize.")
+	flags.BoolVar(&opts.extract, "extract", false, "Treat src as a tar or zip archive, possibly compressed as .tar.gz, .tgz, .tar.zst, .tzst, .tar.xz, .txz, .tar.bz2 or .tbz, and extract its entries into the dest directory.")
+	flags.StringVar(&opts.filesFrom, "files-from", "", "Copy only the paths below src listed in this file, or - for stdin, instead of walking src. With -delete, only listed paths missing from src are deleted.")
+	flags.BoolVar(&opts.from0, "from0", false, "Entries in the -files-from list are separated by NUL characters, as written by find -print0.")
+	flags.IntVar(&opts.retries, "retries", 0, "Retry each failed file copy up to this many times.")
+	flags.DurationVar(&opts.retryDelay, "retry-delay", time.Second, "Delay before the first retry, doubled for each further one, with jitter.")
+	flags.IntVar(&opts.maxErrors, "max-errors", 0, "With -continue, give up once this many files have failed. 0 means no limit.")
+	flags.BoolVar(&opts.adaptive, "adaptive", false, "Grow and shrink the number of active jobs, up to -jobs, following throughput and per-file latency, so a saturated destination is backed off from.")
+	flags.IntVar(&opts.readJobs, "read-jobs", 0, "Read files with this many jobs, handing their data through a bounded buffer to -write-jobs jobs that write it. 0 means -jobs.")
+	flags.IntVar(&opts.writeJobs, "write-jobs", 0, "With -read-jobs, write files with this many jobs. 0 means -jobs.")
+	flags.IntVar(&opts.deviceJobs, "device-jobs", 0, "Copy at most this many files at once from or to any one device. 0 picks a limit from the kind of each device, only limiting spinning disks, and -1 means no limit.")
+	flags.Var(&opts.order, "order", "Order in which to copy files: largest first, smallest first, natural, the order in which the walk finds them, or reverse, the opposite. Other than natural, it takes precedence over -sequential.")
+	flags.BoolVar(&opts.sort, "sort", false, "Copy files in lexicographic order of their paths, and list failures in that order, so runs over the same tree can be compared. Takes precedence over -sequential.")
+	flags.BoolVar(&opts.sequential, "sequential", false, "Copy files in inode order, so a spinning disk reads them with little seeking. On by default when src is on a rotational disk.")
+	flags.IntVar(&opts.maxQueued, "max-queued", 0, fmt.Sprintf("Queue at most this many files found by the walk ahead of the copy workers, so memory stays bounded however large the tree. The walk waits for the workers, or spills to -spill-dir. 0 means %d, without ruling out options that list every file first.", streamBuffer))
+	flags.StringVar(&opts.spillDir, "spill-dir", "", "Once -max-queued files are queued, keep walking and queue further files in a temporary file in this directory.")
+	flags.Var(&opts.jobs, "jobs", "Specify the number of jobs to run in parallel, or auto, the default, to pick it from the CPU count and the kind of storage src and dest are on.")
+	flags.Var(&opts.reflink, "reflink", "Clone files on copy-on-write filesystems: auto, always or never.")
+	flags.Var(&opts.engine, "engine", "Copy engine: default, or the experimental iouring.")
+	flags.IntVar(&opts.queueDepth, "queue-depth", cp.DefaultQueueDepth, "Number of reads and writes each job keeps in flight with -engine=iouring.")
+	flags.Var(&opts.splitSize, "split-size", "Copy files larger than this in ranges of this size, with -jobs ranges at once, then compare the copy with the source. 0 never splits files.")
+	flags.Var(&opts.bufferSize, "buffer-size", "Size of each job's copy buffer, e.g. 64K or 4M.")
+	flags.StringVar(&opts.manifest, "manifest", "", "Write a sha256sum compatible manifest of the copied files to this file. Disables in-kernel copies and reflinks.")
+	flags.Var(&opts.backup, "backup", "Rename destination files about to be replaced by appending a suffix, \"~\" unless given as -backup=SUFFIX.")
+	flags.Var(&opts.backup.mode, "backup-mode", "How to name backups: simple, numbered (FILE.~N~) or existing (numbered only if numbered backups exist). Implies -backup.")
+	flags.StringVar(&opts.backup.dir, "backup-dir", "", "Move backups into this directory, mirroring the destination tree. A relative directory is relative to dest, as with rsync --backup-dir. Implies -backup.")
+	flags.Var(&opts.linkDest.dirs, "link-dest", "Hard link files unchanged since an earlier backup in this directory, by size and modification time, instead of copying them, as with rsync --link-dest. A relative directory is relative to dest. May be repeated, the first match winning. Use with -preserve-times.")
+	flags.StringVar(&opts.s3.endpoint, "s3-endpoint", "", "URL of the S3 compatible store of s3://bucket/prefix paths, like http://localhost:9000 for MinIO, addressing buckets in the path. Defaults to $AWS_ENDPOINT_URL_S3 or $AWS_ENDPOINT_URL, or else AWS.")
+	flags.StringVar(&opts.s3.region, "s3-region", "", "Region of s3:// paths. Defaults to $AWS_REGION, or the region of the AWS profile, or us-east-1.")
+	flags.Var(&opts.s3.partSize, "s3-part-size", "Upload and download files of s3://, gs:// and az:// paths in parts of this size, -jobs parts at once. At least 5M.")
+	flags.StringVar(&opts.sshCommand, "ssh-command", "ssh", "Command, with any flags of its own, run to reach the sftp server of [user@]host:path operands, like \"ssh -p 2222 -i key\". Each job has its own connection.")
+	flags.StringVar(&opts.exec.before, "exec-before", "", "Run this command, split on spaces, before copying each file if it names {src} or {dest}, which are replaced by the file's paths, or else once before the copy. A file is only copied if it succeeds, e.g. -exec-before \"clamscan --no-summary {src}\".")
+	flags.StringVar(&opts.exec.after, "exec-after", "", "Run this command, split on spaces, after copying each file if it names {src} or {dest}, or else once after the copy, e.g. -exec-after \"chown backup {dest}\". A file whose command fails counts as failed.")
+	flags.StringVar(&opts.checkpoint, "checkpoint", "", "Periodically save the state of a recursive copy to this file so it can be resumed. Removed once the copy succeeds.")
+	flags.StringVar(&opts.resume, "resume", "", "Resume the copy saved in this checkpoint file. Other flags given override the saved ones.")
+	flags.StringVar(&opts.failures, "failures", "", "Write the files that could not be copied to this file, one JSON object per line. Use with -continue.")
+	flags.StringVar(&opts.fromFailures, "from-failures", "", "Retry exactly the copies listed in a file written by -failures, instead of copying src to dest.")
+	addWalkFlags(flags, opts)
+}
+
+// addWalkFlags registers the flags deciding which paths below src are
+// visited, shared by copy, sync and stats.
+func addWalkFlags(flags *flag.FlagSet, opts *options) {
+	flags.Var(&opts.filter.exclude, "exclude", "Skip paths matching this glob pattern. May be repeated.")
+	flags.Var(&opts.filter.include, "include", "Only copy files matching this glob pattern. May be repeated.")
+	flags.BoolVar(&opts.filter.noHidden, "no-hidden", false, "Skip files and directories whose names start with a dot.")
+	flags.Var(&opts.filter.excludeRe, "exclude-re", "Skip paths whose path relative to src matches this regular expression. May be repeated.")
+	flags.Var(&opts.filter.includeRe, "include-re", "Only copy files whose path relative to src matches this regular expression. May be repeated.")
+	flags.Var(&opts.filter.minSize, "min-size", "Only copy files of at least this size, e.g. 10K.")
+	flags.Var(&opts.filter.maxSize, "max-size", "Only copy files of at most this size, e.g. 2G.")
+	flags.Var(&opts.filter.newerThan, "newer-than", "Only copy files modified after this time, given as a date like 2006-01-02, an RFC 3339 time or an age like 24h or 7d.")
+	flags.Var(&opts.filter.olderThan, "older-than", "Only copy files modified before this time, given like -newer-than.")
+	flags.Var(&opts.filter.filterFiles, "filter-from", "Skip paths matching the gitignore style patterns in this file, or rsync style \"- pattern\" and \"+ pattern\" rules. May be repeated.")
+	flags.StringVar(&opts.filter.dirFilter, "dir-filter", "", "Read filter rules from the file with this name, such as .gitignore, in every directory and apply them below it.")
+	flags.BoolVar(&opts.oneFileSystem, "x", false, "Stay on the filesystem of src: mount points below it are created empty rather than copied.")
+	flags.BoolVar(&opts.oneFileSystem, "one-file-system", false, "Same as -x.")
+	flags.Var(&opts.types, "type", "Only copy these kinds of file, as find -type letters: f, l, d, p, s, c or b. Separate several with commas.")
+	flags.IntVar(&opts.maxDepth, "max-depth", 0, "Only copy this many levels below src, 1 being its direct entries. 0 means no limit.")
+	flags.Var(&opts.links, "links", "What to do with symlinks found while recursing: preserve, follow or skip.")
+	flags.Var(&opts.special, "special", "What to do with FIFOs, sockets and devices found while recursing: skip, fail or recreate.")
+}
+
+// newOptions returns the options of a copy given no flags.
+func newOptions() *options {
+	opts := &options{links: linksPreserve, special: specialSkip, reflink: cp.ReflinkAuto, engine: cp.EngineDefault, bufferSize: cp.DefaultBufferSize, splitSize: defaultSplitSize, order: orderNatural, s3: s3Settings{partSize: defaultS3PartSize},
+		logLevel: logLevel(slog.LevelWarn), logFormat: "plain", logMaxSize: defaultLogMaxSize, color: colorAuto}
+	opts.compress.skip.Set(defaultCompressSkip)
+	opts.zipStore.Set(defaultCompressSkip)
+	opts.ctx, opts.abort = context.WithCancelCause(context.Background())
+	return opts
+}
+
+// runCopy implements copy and sync, which differ only in the flags they turn
+// on by default. It returns the process exit status.
+func runCopy(name string, defaults []string, cmdLine []string) int {
+	cmd := lookupCommand(name)
+	var opts *options
+	var flags *flag.FlagSet
+	// parse parses the command lines in turn into new flags, so that none
+	// is applied twice, or returns the exit status if they are bad
+	parse := func(cmdLines ...[]string) (status int, ok bool) {
+		opts = newOptions()
+		opts.signals = true
+		flags = flag.NewFlagSet(name, flag.ContinueOnError)
+		addCopyFlags(flags, opts)
+		for _, flagName := range defaults {
+			flags.Set(flagName, "true")
+			flags.Lookup(flagName).DefValue = "true"
+		}
+		flags.Usage = func() {
+			cmd.printUsage()
+			fmt.Printf("Exit status is 0 on success, %d for bad flags or operands, %d when an operand isn't a directory, %d when the destination is missing, %d when some files could not be copied, %d when interrupted, or 1 on any other error.\n",
+				exitUsage, exitNotDirectory, exitDestMissing, exitPartial, exitInterrupted)
+			flags.PrintDefaults()
+		}
+		if err := applyEnv(flags); err != nil {
+			log.Print(err)
+			return exitUsage, false
+		}
+		for _, args := range cmdLines {
+			if err := flags.Parse(args); err != nil {
+				return parseStatus(err), false
+			}
+		}
+		return 0, true
+	}
+	if status, ok := parse(cmdLine); !ok {
+		return status
+	}
+
+	args := flags.Args()
+	if opts.resume != "" {
+		job, err := loadCheckpoint(opts.resume)
+		if err != nil {
+			log.Print(err)
+			return exitFailure
+		}
+		// Replay the saved command line, then the new one so its flags win
+		if status, ok := parse(job.Args, cmdLine); !ok {
+			return status
+		}
+		// The saved dest is already resolved
+		args = []string{job.Src, job.Dest}
+		opts.targetDir, opts.noTargetDir = "", true
+		opts.job = job
+	} else if opts.checkpoint != "" {
+		opts.job = newCheckpoint(opts.checkpoint, name, cmdLine)
+	}
+
+	// -quiet, -useful, -verbose and -debug are shorthands for log levels
+	levelSet := false
+	flags.Visit(func(f *flag.Flag) {
+		levelSet = levelSet || f.Name == "log-level"
+	})
+	if opts.quiet && (levelSet || debug || opts.verbose || opts.useful) {
+		log.Print("-quiet can't be used with -log-level, -useful, -verbose or -debug")
+		return exitUsage
+	}
+	if !levelSet {
+		switch {
+		case opts.quiet:
+			opts.logLevel = logLevel(slog.LevelError)
+		case debug:
+			opts.logLevel = logLevel(levelTrace)
+		case opts.verbose:
+			opts.logLevel = logLevel(slog.LevelDebug)
+		case opts.useful:
+			opts.logLevel = logLevel(slog.LevelInfo)
+		}
+	}
+	level := slog.Level(opts.logLevel)
+	debug, opts.verbose, opts.useful = level <= levelTrace, level <= slog.LevelDebug, level <= slog.LevelInfo
+	var logOut io.Writer = os.Stderr
+	logColor := opts.color
+	if opts.tui && !opts.quiet && isTerminal(os.Stderr) {
+		opts.dash = newDashboard(os.Stderr, opts.color.enabled(os.Stderr), opts.atomic, &opts.paused)
+		// The dashboard holds the log back, but it ends up on the terminal
+		logOut, logColor = opts.dash, colorNever
+		if opts.dash.color {
+			logColor = colorAlways
+		}
+	}
+	if opts.logFile != "" {
+		if opts.logKeep < 0 {
+			log.Print("-log-keep must not be negative")
+			return exitUsage
+		}
+		file, err := openLogFile(opts.logFile, int64(opts.logMaxSize), opts.logKeep, opts.logCompress)
+		if err != nil {
+			log.Print(err)
+			return exitFailure
+		}
+		defer file.Close()
+		logOut = file
+	}
+	setupLogging(logOut, level, opts.logFormat, logColor)
+
+	if len(args) < 2 && opts.fromFailures == "" && !(opts.targetDir != "" && len(args) > 0) {
+		if opts.quiet {
+			slog.Error("missing operands, see -h")
+			return exitUsage
+		}
+		flags.Usage()
+		return exitUsage
+	}
+
+	if err := opts.validate(); err != nil {
+		return usageError(err)
+	}
+	if opts.filesFrom != "" && (opts.targetDir != "" || len(args) != 2) {
+		return usageError("-files-from needs exactly one src and one dest")
+	}
+	// Nobody is watching a quiet copy
+	if opts.quiet {
+		opts.progress, opts.tui = false, false
+	}
+	if opts.tui {
+		if opts.dash == nil {
+			slog.Warn("-tui needs a terminal, showing -progress instead")
+		}
+		opts.progress = opts.dash == nil
+	}
+	if opts.json {
+		opts.events = newEventLog(os.Stdout)
+	}
+	// Only the directory skeleton is selected
+	if opts.types == "d" {
+		opts.dirsOnly = true
+	}
+	if err := opts.sanitize.validate(); err != nil {
+		return usageError(err)
+	}
+	if opts.targetDir != "" && opts.noTargetDir {
+		return usageError("-t and -T cannot be used together")
+	}
+	if opts.noTargetDir && len(args) > 2 {
+		return usageErrorf("extra operand %s with -T", args[2])
+	}
+	if opts.parents && opts.noTargetDir {
+		return usageError("-parents and -T cannot be used together")
+	}
+	// More than two operands always means copying into a directory, as
+	// does -parents
+	if opts.targetDir == "" && (len(args) > 2 || opts.parents && len(args) > 1) {
+		opts.targetDir, args = args[len(args)-1], args[:len(args)-1]
+	}
+	if (opts.targetDir != "" || opts.filesFrom != "" || opts.fromFailures != "") && (isBucketURL(opts.targetDir) || slices.ContainsFunc(args, isBucketURL)) {
+		return usageError("s3://, gs:// and az:// paths need exactly one src and one dest")
+	}
+	if (opts.targetDir != "" || opts.filesFrom != "" || opts.fromFailures != "") && (isRemote(opts.targetDir) || slices.ContainsFunc(args, isRemote)) {
+		return usageError("remote paths need exactly one src and one dest")
+	}
+	if opts.job != nil && opts.targetDir != "" && len(args) > 1 {
+		return usageError("-checkpoint can only be used with a single source")
+	}
+
+	// A spinning source disk is read in inode order unless told otherwise,
+	// or the queue is bounded, which sorting the files would defeat
+	sequentialSet := false
+	flags.Visit(func(f *flag.Flag) {
+		sequentialSet = sequentialSet || f.Name == "sequential"
+	})
+	bounded := opts.maxQueued > 0 || opts.spillDir != ""
+	if bounded && opts.recurse && opts.filesFrom == "" && !canStream(opts) {
+		return usageError("-max-queued and -spill-dir can't be used with -order, -sort, -sequential, -checkpoint, -dry-run or -type=d, which list every file first")
+	}
+	if !sequentialSet && !bounded && !opts.sort && opts.fromFailures == "" && !isRemote(args[0]) && !isBucketURL(args[0]) && probeStorage(existingParent(args[0])) == storageRotational {
+		slog.Debug("Copying in inode order: the source is on a rotational disk", "src", args[0])
+		opts.sequential = true
+	}
+	if opts.jobs == 0 {
+		paths := args
+		if opts.targetDir != "" {
+			paths = append(paths, opts.targetDir)
+		}
+		if opts.fromFailures != "" {
+			paths = nil
+		}
+		opts.jobs = jobCount(autoJobs(paths...))
+	}
+
+	if opts.hashCachePath != "" && !opts.dryRun {
+		hashes, err := loadHashCache(opts.hashCachePath, int(opts.bufferSize))
+		if err != nil {
+			slog.Error(err.Error())
+			return exitFailure
+		}
+		opts.hashes = hashes
+		defer func() {
+			if err := hashes.save(); err != nil {
+				slog.Error("Could not save the hash cache", "error", err)
+			}
+			slog.Info("Hash cache", "reused", hashes.hits, "hashed", hashes.misses)
+		}()
+	}
+	if opts.control != "" {
+		stop, err := serveControl(opts.control, opts)
+		if err != nil {
+			slog.Error(err.Error())
+			return exitFailure
+		}
+		defer stop()
+	}
+	opts.dash.show(name + " " + strings.Join(args, " "))
+	defer handleStatusRequests(opts)()
+	defer handlePauseRequests(opts)()
+	err := opts.withHooks(func() error {
+		if opts.fromFailures != "" {
+			return copyFailures(opts.fromFailures, opts)
+		} else if opts.filesFrom != "" {
+			return copyFileList(args[0], args[1], opts)
+		} else if opts.targetDir != "" {
+			return copyIntoDir(args, opts.targetDir, opts)
+		}
+		return copyPair(args[0], args[1], opts)
+	})
+	opts.dash.close()
+	if opts.json {
+		// The events have named every file skipped or renamed
+		opts.events.finish(err)
+	} else if !opts.quiet {
+		opts.sanitize.report()
+		opts.unreadable.report(opts.color.enabled(os.Stdout))
+	}
+	if err != nil {
+		slog.Error(err.Error())
+	}
+	return exitStatus(err)
+}
+
+// countTrue returns how many of flags are set.
+func countTrue(flags ...bool) int {
+	n := 0
+	for _, f := range flags {
+		if f {
+			n++
+		}
+	}
+	return n
+}
+
+// validate checks that the settings of o, whether from flags or a Copier,
+// can be used together, returning an ErrUsage error if not.
+func (o *options) validate() error {
+	if err := o.filter.validate(); err != nil {
+		return errorOf(ErrUsage, "%w", err)
+	}
+	if o.bufferSize <= 0 {
+		return errorOf(ErrUsage, "-buffer-size must be positive")
+	}
+	if err := o.backup.normalize(); err != nil {
+		return errorOf(ErrUsage, "%w", err)
+	}
+	if o.retries < 0 {
+		return errorOf(ErrUsage, "-retries must not be negative")
+	}
+	if o.maxErrors < 0 {
+		return errorOf(ErrUsage, "-max-errors must not be negative")
+	}
+	if o.maxDepth < 0 {
+		return errorOf(ErrUsage, "-max-depth must not be negative")
+	}
+	if o.deviceJobs < -1 {
+		return errorOf(ErrUsage, "-device-jobs must be -1 or more")
+	}
+	if o.readJobs < 0 || o.writeJobs < 0 {
+		return errorOf(ErrUsage, "-read-jobs and -write-jobs must not be negative")
+	}
+	if o.maxQueued < 0 {
+		return errorOf(ErrUsage, "-max-queued must not be negative")
+	}
+	if countTrue(o.force, o.noClobber, o.interactive) > 1 {
+		return errorOf(ErrUsage, "only one of -force, -no-clobber and -interactive may be given")
+	}
+	if o.extract && (o.filesFrom != "" || o.fromFailures != "") {
+		return errorOf(ErrUsage, "-extract can't be used with -files-from or -from-failures")
+	}
+	if o.s3.partSize < s3.MinPartSize {
+		return errorOf(ErrUsage, "-s3-part-size must be at least 5M")
+	}
+	if o.filesFrom != "" && (o.order != orderNatural || o.sort) {
+		return errorOf(ErrUsage, "-order and -sort can't be used with -files-from, whose files are copied as they are read")
+	}
+	if o.delta && o.atomic {
+		return errorOf(ErrUsage, "-delta can't be used with -atomic, which writes each file anew")
+	}
+	if o.hashCachePath != "" && !o.checksum && !o.dedup {
+		return errorOf(ErrUsage, "-hash-cache needs -checksum or -dedup")
+	}
+	if err := o.compress.validate(); err != nil {
+		return errorOf(ErrUsage, "%w", err)
+	}
+	if err := o.crypt.validate(); err != nil {
+		return errorOf(ErrUsage, "%w", err)
+	}
+	if err := o.exec.validate(); err != nil {
+		return errorOf(ErrUsage, "%w", err)
+	}
+	encodes := o.compress.format != "" || o.crypt.encrypt
+	if (encodes || o.compress.decompress || o.crypt.decrypt) && (o.checksum || o.delta) {
+		return errorOf(ErrUsage, "-compress, -decompress, -encrypt and -decrypt can't be used with -checksum or -delta, which compare the destination with the source")
+	}
+	if encodes && o.manifest != "" {
+		return errorOf(ErrUsage, "-compress and -encrypt can't be used with -manifest, which would record the contents before they are encoded")
+	}
+	if len(o.linkDest.dirs) > 0 && o.manifest != "" {
+		return errorOf(ErrUsage, "-link-dest can't be used with -manifest, which reads every file instead of linking it")
+	}
+	if o.sort && o.order != orderNatural {
+		return errorOf(ErrUsage, "-sort and -order can't be used together")
+	}
+	if o.json && (o.dryRun || o.interactive) {
+		return errorOf(ErrUsage, "-json can't be used with -dry-run or -interactive, which write to stdout")
+	}
+	if o.quiet && (o.dryRun || o.interactive) {
+		return errorOf(ErrUsage, "-quiet can't be used with -dry-run or -interactive, which write to stdout")
+	}
+	if o.tui && (o.dryRun || o.interactive) {
+		return errorOf(ErrUsage, "-tui can't be used with -dry-run or -interactive, which write to the terminal")
+	}
+	return nil
+}
+
+// copyPair copies src to dest, through the filesystems of package vfs if
+// either is remote.
+func copyPair(src, dest string, opts *options) error {
+	if isBucketURL(src) || isBucketURL(dest) || isRemote(src) || isRemote(dest) {
+		return remoteCopy(src, dest, opts)
+	}
+	return parallelCopy(src, dest, opts)
+}
+
+func parallelCopy(src, dest string, opts *options) (err error) {
+	var srcFiles, dirs stack.Stack[string]
+	scan := treeScan{sizes: make(map[string]int64)}
+
+	// Get the absolute paths to src and dest. If src is a single file, just call cp.CopyFile
+	srcAbs, err := cp.AbsolutePath(src)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(srcAbs)
+	if err != nil {
+		return err
+	}
+	destAbs, err := cp.AbsolutePath(dest)
+	if err != nil {
+		return err
+	}
+	if opts.extract {
+		if info.IsDir() {
+			return errorOf(ErrUsage, "%s is a directory, not an archive to -extract", src)
+		}
+		return extractArchive(srcAbs, dest, destAbs, opts)
+	}
+	if !info.IsDir() {
+		if destAbs, err = fileDest(srcAbs, dest, destAbs, opts); err != nil {
+			return err
+		}
+		opts.backup.root = filepath.Dir(destAbs)
+		opts.linkDest.start(opts.backup.root, opts.preservePerms)
+		return copySingleFile(srcAbs, destAbs, opts)
+	}
+	srcInfo := info
+	// We know the supplied source is a directory, but did the user intend that?
+	if !opts.recurse {
+		return errorOf(ErrUsage, "source is a directory, but you did not provide -recurse")
+	}
+	if _, _, ok := archiveDest(destAbs); ok {
+		return archiveTree(srcAbs, destAbs, opts)
+	}
+	// Check to see if dest exists. If it does, check to see if it's a directory.
+	// If it's not a directory then abort. With -mkdir a missing dest is created.
+	opts.backup.root = destAbs
+	opts.linkDest.start(destAbs, opts.preservePerms)
+	info, err = os.Lstat(destAbs)
+	if os.IsNotExist(err) && opts.mkdir {
+		trace("Creating destination directory", "dest", destAbs)
+		if opts.dryRun {
+			fmt.Printf("Would create directory %s.\n", destAbs)
+			info, err = srcInfo, nil
+		} else {
+			if err = os.MkdirAll(destAbs, 0755); err != nil {
+				return err
+			}
+			info, err = os.Lstat(destAbs)
+		}
+	}
+	if os.IsNotExist(err) {
+		return &kindError{ErrDestMissing, err}
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errorOf(ErrNotDirectory, "source is a directory but destination is not")
+	}
+	opts.events.scan(srcAbs, destAbs)
+	// With -staged the tree is copied into a staging directory, and only
+	// replaces dest once everything has been copied.
+	finalAbs := destAbs
+	if opts.staged && !opts.dryRun {
+		resumed := opts.job != nil && opts.job.resumed
+		var staging string
+		if staging, err = startStaging(finalAbs, resumed); err != nil {
+			return err
+		}
+		destAbs, opts.backup.root, opts.linkDest.root = staging, staging, staging
+		keep := opts.job != nil || opts.move
+		defer func() {
+			err = finishStaging(staging, finalAbs, err, keep)
+		}()
+	}
+
+	// allFiles also holds the files a resumed run had already copied
+	var allFiles stack.Stack[string]
+	// Unreadable paths are counted for each source
+	opts.walkFailed = 0
+	var links *hardLinks
+	if opts.hardLinks || opts.dedup {
+		links = newHardLinks()
+	}
+	if canStream(opts) {
+		return streamCopy(srcAbs, destAbs, links, opts)
+	}
+	if job := opts.job; job != nil && job.resumed {
+		// The saved walk is reused, minus the files copied before the stop
+		srcFiles, dirs, scan.sizes = job.remaining(), job.Dirs, job.Sizes
+		allFiles = job.Files
+		if links != nil {
+			links.links = job.hardLinks()
+		}
+		slog.Info("Resuming", "left", len(srcFiles), "files", len(job.Files))
+	} else {
+		// We need to build a stack containing the source file tree so we can call
+		// CopyFile in separate threads
+		scan.infos = make(map[string]os.FileInfo)
+		if opts.sequential {
+			scan.inodes = make(map[string]uint64)
+		}
+		srcFiles, dirs, err = recurseFileTree(srcAbs, &scan, links, opts)
+		if err != nil {
+			return err
+		}
+		trace("Walked the source", "files", scan.files, "bytes", scan.bytes)
+		if opts.dedup {
+			srcFiles = dedupFiles(srcFiles, &scan, links, opts)
+		}
+		sortFiles(srcFiles, &scan, opts)
+		allFiles = srcFiles
+	}
+	numFiles := len(srcFiles)
+
+	// Hard linked duplicates aren't copied, so total up the files that are
+	var totalBytes int64
+	for _, file := range srcFiles {
+		totalBytes += scan.sizes[file]
+	}
+
+	if opts.useful {
+		attrs := []any{"dirs", len(dirs)}
+		if !opts.dirsOnly {
+			attrs = append(attrs, "files", numFiles, "bytes", totalBytes)
+			if links != nil {
+				attrs = append(attrs, "links", len(links.links))
+			}
+		}
+		slog.Info("To be created", attrs...)
+	}
+	if !strings.HasSuffix(srcAbs, "/") {
+		srcAbs = strings.Join([]string{srcAbs, "/"}, "")
+	}
+	trace("Source", "srcAbs", srcAbs)
+	if !strings.HasSuffix(destAbs, "/") {
+		destAbs = strings.Join([]string{destAbs, "/"}, "")
+	}
+	trace("Destination", "destAbs", destAbs)
+	// Pair every source file with its mirror below dest
+	files := make([]fileEntry, len(srcFiles))
+	for i, file := range srcFiles {
+		files[i] = fileEntry{src: file, dest: fileDestPath(srcAbs, destAbs, file, scan.infos[file], opts), size: scan.sizes[file], info: scan.infos[file]}
+	}
+	var linked []hardLink
+	if links != nil {
+		linked = links.links
+	}
+	if opts.dryRun {
+		for _, dir := range dirs {
+			if opts.types.selects(os.ModeDir) {
+				fmt.Printf("Would create directory %s.\n", destPath(srcAbs, destAbs, dir, opts))
+			}
+		}
+		if !opts.dirsOnly {
+			for _, f := range files {
+				fmt.Printf("Would copy %s to %s.\n", f.src, f.dest)
+			}
+			for _, link := range linked {
+				fmt.Printf("Would link %s to %s.\n", fileDestPath(srcAbs, destAbs, link.src, nil, opts), fileDestPath(srcAbs, destAbs, link.target, nil, opts))
+			}
+		}
+		if err := walkIncomplete(opts); err != nil {
+			if opts.delete {
+				slog.Warn("Not deleting extraneous files because parts of the source could not be read")
+			}
+			return err
+		}
+		if opts.delete {
+			return deleteExtraneous(srcAbs, destAbs, allFiles, dirs, linked, opts)
+		}
+		return nil
+	}
+	if job := opts.job; job != nil {
+		job.record(strings.TrimSuffix(srcAbs, "/"), finalAbs, dirs, srcFiles, scan.sizes, linked)
+		if err := job.save(); err != nil {
+			return err
+		}
+		// A finished copy leaves nothing to resume
+		defer func() {
+			if err == nil {
+				err = os.Remove(job.path)
+			}
+		}()
+	}
+	// Create the directory skeleton first so empty directories are replicated
+	// too. Without d in -type, only the directories holding files are created.
+	if opts.types.selects(os.ModeDir) {
+		if err := createDirectories(srcAbs, destAbs, dirs, opts); err != nil {
+			return err
+		}
+	}
+	// Last of all, as copying and deleting change the directories
+	restore := restoreDirectories(srcAbs, destAbs, dirs, opts)
+	defer func() {
+		if rerr := restore(); err == nil {
+			err = rerr
+		}
+	}()
+	if !opts.dirsOnly {
+		if err := copyFiles(srcAbs, destAbs, files, totalBytes, linked, opts); err != nil {
+			if opts.delete {
+				slog.Warn("Not deleting extraneous files because of copy errors")
+			}
+			return err
+		}
+	}
+	if opts.move {
+		removeEmptyDirs(srcAbs, dirs)
+	}
+	if err := walkIncomplete(opts); err != nil {
+		if opts.delete {
+			slog.Warn("Not deleting extraneous files because parts of the source could not be read")
+		}
+		return err
+	}
+	// Only delete once everything has been copied, so an interrupted run
+	// never leaves the destination with less than it started with.
+	if opts.delete {
+		return deleteExtraneous(srcAbs, destAbs, allFiles, dirs, linked, opts)
+	}
+	return nil
+}
+
+// removeEmptyDirs removes the source directories emptied by -move, deepest
+// first, finishing with the source root. Directories that still hold files,
+// such as ones that failed to copy or were filtered out, are left alone.
+func removeEmptyDirs(srcAbs string, dirs stack.Stack[string]) {
+	for i := len(dirs) - 1; i >= -1; i-- {
+		dir := srcAbs
+		if i >= 0 {
+			dir = dirs[i]
+		}
+		if err := os.Remove(dir); err == nil {
+			slog.Debug("Removed directory", "dir", dir)
+		}
+	}
+}
+
+// copyFiles copies every file to its destination in parallel, then recreates
+// the hard links between them.
+func copyFiles(srcAbs, destAbs string, files []fileEntry, totalBytes int64, links []hardLink, opts *options) (err error) {
+	var m *manifest
+	if opts.manifest != "" {
+		if m, err = createManifest(opts.manifest, destAbs); err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := m.close(); err == nil {
+				err = cerr
+			}
+		}()
+	}
+	// Now we have lists of source and destination strings that we can copy in parallel
+	// We should build the copyJob object then start up dispatch.
+	if debug {
+		for n, f := range files {
+			trace("File", "n", n, "src", f.src, "dest", f.dest)
+		}
+	}
+	errs, err := jobDispatcher(files, totalBytes, nil, m, opts)
+	if err := dispatchErrors(errs, err, opts); err != nil {
+		return err
+	}
+	return createHardLinks(srcAbs, destAbs, links, opts)
+}
+
+// copySingleFile copies a single source file, recording it in the manifest
+// and removing the source for -move.
+func copySingleFile(srcAbs, destAbs string, opts *options) (err error) {
+	if opts.dryRun {
+		fmt.Printf("Would copy %s to %s.\n", srcAbs, destAbs)
+		return nil
+	}
+	var m *manifest
+	var h hash.Hash
+	if opts.manifest != "" {
+		if m, err = createManifest(opts.manifest, filepath.Dir(destAbs)); err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := m.close(); err == nil {
+				err = cerr
+			}
+		}()
+		h = sha256.New()
+	}
+	if opts.events != nil {
+		if info, err := os.Stat(srcAbs); err == nil {
+			opts.events.started(fileEntry{src: srcAbs, dest: destAbs, size: info.Size()})
+		}
+	}
+	var res cp.Result
+	err = opts.beforeFile(srcAbs, destAbs)
+	if err == nil {
+		res, err = copyWithRetry(srcAbs, destAbs, nil, opts, h, nil)
+	}
+	if err == nil && !res.Skipped {
+		err = opts.afterFile(srcAbs, destAbs)
+	}
+	if err != nil {
+		opts.events.fail(copyError{src: srcAbs, dest: destAbs, err: err})
+		return err
+	}
+	if res.Skipped {
+		opts.events.skipped(srcAbs, destAbs, "existing")
+	} else if opts.events != nil {
+		if info, err := os.Stat(destAbs); err == nil {
+			opts.events.copied(fileEntry{src: srcAbs, dest: destAbs, size: info.Size()})
+		}
+	}
+	if res.Hashed {
+		m.add(destAbs, h.Sum(nil))
+	}
+	if opts.move && !res.Skipped {
+		return os.Remove(srcAbs)
+	}
+	return nil
+}
+
+// recurseFileTree walks directory, returning the files to copy and the
+// directories to create, and recording the files in scan.
+func recurseFileTree(directory string, scan *treeScan, links *hardLinks, opts *options) (stack.Stack[string], stack.Stack[string], error) {
+	var files, dirs stack.Safe[string]
+	err := walkTree(directory, opts, visitDirectory(directory, &files, &dirs, links, scan, opts))
+	return files.Drain(), dirs.Drain(), err
+}
+
+// fileDestPath is destPath for a file, described by info or statted if nil,
+// as renameFile has it.
+func fileDestPath(srcAbs, destAbs, path string, info os.FileInfo, opts *options) string {
+	return opts.renameFile(path, destPath(srcAbs, destAbs, path, opts), info)
+}
+
+// destPath maps a path below srcAbs to the same relative path below destAbs,
+// as rewritten by destRel. Both roots must end in a separator.
+func destPath(srcAbs, destAbs, path string, opts *options) string {
+	return strings.Join([]string{destAbs, opts.destRel(strings.TrimPrefix(path, srcAbs))}, "")
+}
+
+// createDirectories mirrors every directory found by the walk below destAbs.
+// Walk order guarantees parents are created before their children.
+func createDirectories(srcAbs, destAbs string, dirs stack.Stack[string], opts *options) error {
+	for _, dir := range dirs {
+		target := destPath(srcAbs, destAbs, dir, opts)
+		slog.Debug("Creating directory", "dir", target)
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreDirectories returns a function giving the directories found by the
+// walk the owner, mode and times of their source below destAbs, deepest
+// first, as -preserve-owner, -preserve-perms and -preserve-times have it for
+// files. It is to be called once nothing more is written in them, as writing
+// in a directory changes its modification time. The sources are statted now, before
+// -move removes them. A directory the copy didn't create, without d in
+// -type, is passed over.
+func restoreDirectories(srcAbs, destAbs string, dirs stack.Stack[string], opts *options) func() error {
+	attrs := cp.Options{PreserveOwner: opts.preserveOwner, PreservePerms: opts.preservePerms, PreserveTimes: opts.preserveTimes, PreserveAtime: opts.preserveAtime}
+	if !attrs.PreserveOwner && !attrs.PreservePerms && !attrs.PreserveTimes {
+		return func() error { return nil }
+	}
+	infos := make([]os.FileInfo, len(dirs))
+	for i, dir := range dirs {
+		// One removed since the walk has nothing to give
+		infos[i], _ = os.Stat(dir)
+	}
+	return func() error {
+		for i := len(dirs) - 1; i >= 0; i-- {
+			if infos[i] == nil {
+				continue
+			}
+			err := cp.PreserveAttributes(destPath(srcAbs, destAbs, dirs[i], opts), infos[i], attrs)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func visitDirectory(root string, files, dirs *stack.Safe[string], links *hardLinks, scan *treeScan, opts *options) fs.WalkDirFunc {
+	return func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return walkFailure(path, err, opts)
+		}
+		if d.IsDir() {
+			trace("Found directory", "path", path)
+			if path != root {
+				dirs.Push(path)
+			}
+			return nil
+		}
+		trace("Found file", "path", path)
+		info, err := d.Info()
+		if err != nil {
+			return walkFailure(path, err, opts)
+		}
+		if links != nil && links.add(path, info) {
+			return nil
+		}
+		files.Push(path)
+		scan.files++
+		scan.bytes += info.Size()
+		scan.sizes[path] = info.Size()
+		scan.infos[path] = info
+		if scan.inodes != nil {
+			if id, _, ok := cp.Identity(info); ok {
+				scan.inodes[path] = id.Ino
+			}
+		}
+		return nil
+	}
+}
+
+func copyRoutine(jobs *copyJob, errorChan chan copyError, progress chan<- int64, opts *options, id int) {
+	// Process jobs until none remain or an error occurs.
+	// If cont = true then continue even if errors are encountered.
+	var h hash.Hash
+	if jobs.manifest != nil {
+		h = sha256.New()
+	}
+
+	trace("Started worker", "worker", id)
+
+	for jobs.admit(id) {
+		var f fileEntry
+		var stream *transfer
+		var ok bool
+		if jobs.ready != nil {
+			if stream, ok = <-jobs.ready; ok {
+				f = stream.fileEntry
+			}
+		} else {
+			f, ok = jobs.take()
+		}
+		if !ok {
+			trace("Worker out of files", "worker", id)
+			jobs.drain()
+			return
+		}
+		src, dest, size := f.src, f.dest, f.size
+		jobs.dash.working(id, f)
+		opts.events.started(f)
+		trace("Copying", "worker", id, "src", src, "dest", dest)
+		release := func() {}
+		if jobs.devices != nil {
+			release = jobs.devices.acquire(src, dest)
+		}
+		start := time.Now()
+		var res cp.Result
+		err := opts.beforeFile(src, dest)
+		if err == nil {
+			res, err = copyWithRetry(src, dest, f.info, opts, h, stream)
+		} else if stream != nil {
+			stream.close()
+		}
+		if err == nil && !res.Skipped {
+			err = opts.afterFile(src, dest)
+		}
+		release()
+		jobs.dash.idle(id)
+		if err != nil && opts.ctx.Err() != nil {
+			slog.Warn("Abandoned copy in progress", "worker", id, "src", src, "dest", dest)
+			atomic.AddInt64(&jobs.abandoned, 1)
+			return
+		}
+		if err != nil && opts.skipUnreadable && unreadable(err, src) {
+			slog.Debug("Skipped unreadable file", "worker", id, "src", src)
+			opts.unreadable.add(src)
+			opts.events.skipped(src, dest, "unreadable")
+			jobs.dash.skipped()
+			continue
+		}
+		if err != nil {
+			jobs.fail(errorChan, copyError{id: id, err: err, src: src, dest: dest}, opts)
+			if !opts.cont {
+				// Workers held back by -adaptive would wait on a limit
+				// that no longer moves
+				jobs.halt()
+				return
+			}
+			continue
+		}
+		if res.Hashed {
+			jobs.manifest.add(dest, h.Sum(nil))
+		}
+		if jobs.checkpoint != nil {
+			jobs.checkpoint.markDone(src)
+		}
+		if res.Skipped {
+			slog.Debug("Skipped existing file", "worker", id, "src", src, "dest", dest)
+			atomic.AddInt64(&jobs.skipped, 1)
+			opts.events.skipped(src, dest, "existing")
+			jobs.dash.skipped()
+		} else {
+			took := time.Since(start)
+			if res.Delta {
+				slog.Debug("Updated from a delta", "worker", id, "src", src, "dest", dest, "bytes", size, "rewritten", res.Rewritten, "duration", took)
+			} else {
+				slog.Debug("Copied", "worker", id, "src", src, "dest", dest, "bytes", size, "duration", took)
+			}
+			opts.events.copied(f)
+			opts.hashes.copied(src, dest)
+			jobs.dash.copied(size)
+			atomic.AddInt64(&jobs.copied, size)
+			atomic.AddInt64(&jobs.done, 1)
+			atomic.AddInt64(&jobs.files, 1)
+			atomic.AddInt64(&jobs.busy, int64(took))
+			// Only a file that was really copied may be removed, never one
+			// that was skipped or is the destination itself.
+			if opts.move {
+				if err := os.Remove(src); err != nil {
+					jobs.fail(errorChan, copyError{id: id, err: err, src: src, dest: dest}, opts)
+					if !opts.cont {
+						jobs.halt()
+						return
+					}
+				}
+			}
+		}
+		if progress != nil {
+			progress <- size
+		}
+	}
+}
+
+// dispatchErrors writes the failed copies to the -failures file and folds them
+// and the dispatcher's own error into a single error.
+func dispatchErrors(errs []copyError, err error, opts *options) error {
+	if opts.sort {
+		// The workers report failures in whatever order they hit them
+		slices.SortStableFunc(errs, func(a, b copyError) int {
+			return strings.Compare(a.src, b.src)
+		})
+	}
+	if opts.failures != "" {
+		// With several sources the later ones add to the file
+		if err := writeFailures(opts.failures, errs, opts.failuresWritten); err != nil {
+			return err
+		}
+		opts.failuresWritten = true
+	}
+	if err != nil {
+		return err
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	if len(errs) == 1 {
+		return &kindError{ErrPartial, errs[0].err}
+	}
+	if opts.cont && opts.maxErrors > 0 && len(errs) >= opts.maxErrors {
+		return errorOf(ErrPartial, "gave up after %d files could not be copied, first error: %w", len(errs), errs[0].err)
+	}
+	return errorOf(ErrPartial, "%d files could not be copied, first error: %w", len(errs), errs[0].err)
+}
+
+// jobDispatcher copies files, or those streamed from feed if it is set, with
+// opts.jobs workers taking them from a shared queue.
+func jobDispatcher(files []fileEntry, totalBytes int64, feed fileSource, manifest *manifest, opts *options) ([]copyError, error) {
+	// The dispatcher builds the copyJob shared by the workers
+	// Then it spools up the desired number of jobs
+	// It passes the struct to the jobs and waits for errors or completion
+	streamed := feed != nil
+	size := len(files)
+	if !streamed {
+		if size == 0 {
+			return nil, nil
+		}
+		feed = &fileSlice{files: files}
+	}
+	copyLock := copyJob{work: make(chan fileEntry, streamBuffer), quit: make(chan struct{}), manifest: manifest, checkpoint: opts.job, events: opts.events, dash: opts.dash, paused: &opts.paused}
+	jobs, cont := int(opts.jobs), opts.cont
+	// set-jobs on the control socket overrides -jobs
+	if n := opts.jobsSet.Load(); n > 0 {
+		jobs = int(n)
+	}
+	var ret []copyError
+	if opts.useful {
+		defer func() {
+			attrs := []any{"bytes", atomic.LoadInt64(&copyLock.copied)}
+			// The total isn't known up front for a streamed list
+			if !streamed {
+				attrs = append(attrs, "total", totalBytes)
+			}
+			if skipped := atomic.LoadInt64(&copyLock.skipped); skipped > 0 {
+				attrs = append(attrs, "skipped", skipped)
+			}
+			slog.Info("Finished copying", attrs...)
+		}()
+	}
+	if jobs > size && !streamed {
+		jobs = size
+	}
+	trace("Starting workers", "jobs", jobs)
+	copyLock.wake = sync.NewCond(&copyLock.mu)
+	if opts.readJobs > 0 || opts.writeJobs > 0 {
+		// The workers started below are the write pool
+		readers := opts.readJobs
+		if readers == 0 {
+			readers = int(opts.jobs)
+		}
+		if opts.writeJobs > 0 {
+			jobs = opts.writeJobs
+		}
+		if !streamed {
+			readers, jobs = min(readers, size), min(jobs, size)
+		}
+		trace("Starting readers", "jobs", readers)
+		copyLock.ready = make(chan *transfer, jobs)
+		bufferSize := int(opts.bufferSize)
+		buffers := &sync.Pool{New: func() any {
+			buf := make([]byte, bufferSize)
+			return &buf
+		}}
+		var wg sync.WaitGroup
+		for i := 0; i < readers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				readRoutine(&copyLock, buffers)
+			}()
+		}
+		go func() {
+			wg.Wait()
+			close(copyLock.ready)
+		}()
+	}
+	opts.dash.begin(size, totalBytes, jobs, streamed)
+	go copyLock.feed(feed)
+	copyLock.limit = int64(jobs)
+	if jobs > 1 && opts.deviceJobs >= 0 {
+		copyLock.devices = newDeviceLimits(opts.deviceJobs)
+	}
+	if opts.adaptive && jobs > 1 {
+		// Start in the middle so the controller can move either way
+		copyLock.limit = int64(jobs+1) / 2
+		stop := make(chan struct{})
+		go copyLock.adapt(int64(jobs), stop)
+		defer close(stop)
+	}
+	var errChannel chan copyError
+	if cont {
+		errChannel = make(chan copyError, jobs*2)
+	} else {
+		errChannel = make(chan copyError, jobs)
+	}
+	// Workers report the size of every completed file to the progress printer.
+	var progress chan int64
+	if opts.progress {
+		progress = make(chan int64, jobs)
+		progressDone := make(chan struct{})
+		go runProgress(os.Stderr, size, totalBytes, progress, progressDone)
+		defer func() {
+			close(progress)
+			<-progressDone
+		}()
+	}
+	if opts.job != nil {
+		stop, saved := make(chan struct{}), make(chan struct{})
+		go opts.job.run(stop, saved)
+		defer func() {
+			close(stop)
+			<-saved
+		}()
+	}
+	if opts.signals {
+		defer handleInterrupts(copyLock.interrupt, opts)()
+	}
+	// An abandoned copy hands out no further files
+	defer context.AfterFunc(opts.ctx, copyLock.interrupt)()
+	var workers sync.WaitGroup
+	copyLock.spawn = func(id int) {
+		copyLock.started++
+		copyLock.running++
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			copyRoutine(&copyLock, errChannel, progress, opts, id)
+			trace("Worker finished", "worker", id)
+			copyLock.mu.Lock()
+			copyLock.running--
+			copyLock.mu.Unlock()
+		}()
+	}
+	copyLock.mu.Lock()
+	for i := 0; i < jobs; i++ {
+		copyLock.spawn(i)
+	}
+	copyLock.mu.Unlock()
+	opts.dispatch.Store(&dispatch{jobs: &copyLock, total: size, totalBytes: totalBytes, start: time.Now()})
+	defer opts.dispatch.Store(nil)
+	// A cancel may have come in before the dispatch could be found
+	if opts.cancelled.Load() {
+		copyLock.interrupt()
+	}
+	go func() {
+		workers.Wait()
+		close(errChannel)
+	}()
+	for err := range errChannel {
+		// Without -continue the worker exits after reporting its error
+		slog.Debug("Copy failed", "worker", err.id, "src", err.src, "dest", err.dest, "error", err.err, "continuing", cont)
+		ret = append(ret, err)
+	}
+	// Workers that gave up on an error may leave files unfed
+	copyLock.mu.Lock()
+	interrupted := copyLock.interrupted
+	copyLock.stop()
+	copyLock.mu.Unlock()
+	// Files the read pool handed over that no worker took are let go, and
+	// the readers waited for, so none is left holding its source open
+	if copyLock.ready != nil {
+		for t := range copyLock.ready {
+			t.close()
+		}
+	}
+	if interrupted {
+		slog.Warn(interruptSummary(&copyLock, size))
+		if err := opts.aborted(); err != nil {
+			return ret, err
+		}
+		return ret, errInterrupted
+	}
+	return ret, nil
+}
@@ -0,0 +1,501 @@
+package copier
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Encrypted files are written in the manner of age: a random file key is
+// wrapped for each recipient with a key agreed by X25519 with an ephemeral
+// key, and the contents are sealed with AES-256-GCM, under a key derived
+// from the file key, in chunks whose nonces count them and mark the last, so
+// chunks can't be dropped, reordered or truncated unnoticed. The header is
+// authenticated by an HMAC-SHA256 under another key derived from the file
+// key, checked before any of the payload is opened, so its stanzas can't be
+// changed unnoticed either. The layout is
+//
+//	magic | recipients (1 byte) | (ephemeral public key | wrapped file key)... | payload nonce | header MAC | chunks...
+const (
+	cryptMagic      = "cpjenc2\n"
+	cryptChunkSize  = 64 * 1024
+	cryptNonceSize  = 16
+	cryptMACSize    = sha256.Size
+	wrappedKeySize  = 32 + 16
+	publicKeyPrefix = "cpjpk-"
+	secretKeyPrefix = "cpjsk-"
+)
+
+// encryptedExt is appended to the names of the files encrypted.
+const encryptedExt = ".enc"
+
+// encryption holds the -encrypt and -decrypt flags.
+type encryption struct {
+	encrypt, decrypt bool
+	recipients       recipientList
+	identity         string
+	// keys are the secret keys read from identity.
+	keys []*ecdh.PrivateKey
+}
+
+// recipientList is a flag.Value collecting the public keys of -recipient.
+type recipientList []*ecdh.PublicKey
+
+func (r *recipientList) String() string {
+	keys := make([]string, len(*r))
+	for i, key := range *r {
+		keys[i] = publicKeyPrefix + base64.RawURLEncoding.EncodeToString(key.Bytes())
+	}
+	return strings.Join(keys, ",")
+}
+
+func (r *recipientList) Set(val string) error {
+	key, err := parsePublicKey(val)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, key)
+	return nil
+}
+
+func parsePublicKey(s string) (*ecdh.PublicKey, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, publicKeyPrefix))
+	if err != nil || !strings.HasPrefix(s, publicKeyPrefix) {
+		return nil, fmt.Errorf("invalid public key %q, must be %s... as printed by cpj keygen", s, publicKeyPrefix)
+	}
+	return ecdh.X25519().NewPublicKey(raw)
+}
+
+// readIdentity reads the secret keys of an identity file written by cpj
+// keygen, one a line. Blank lines and lines starting with # are ignored.
+func readIdentity(path string) ([]*ecdh.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []*ecdh.PrivateKey
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		raw, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(line, secretKeyPrefix))
+		if err != nil || !strings.HasPrefix(line, secretKeyPrefix) {
+			return nil, fmt.Errorf("%s: invalid secret key line", path)
+		}
+		key, err := ecdh.X25519().NewPrivateKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s holds no secret keys", path)
+	}
+	return keys, nil
+}
+
+// validate checks the flags go together and reads the -identity file.
+func (e *encryption) validate() (err error) {
+	switch {
+	case e.encrypt && e.decrypt:
+		return errors.New("-encrypt and -decrypt can't be used together")
+	case e.encrypt && len(e.recipients) == 0:
+		return errors.New("-encrypt needs at least one -recipient")
+	case e.encrypt && len(e.recipients) > 255:
+		return errors.New("-encrypt takes at most 255 recipients")
+	case e.decrypt && e.identity == "":
+		return errors.New("-decrypt needs an -identity file")
+	case e.decrypt:
+		e.keys, err = readIdentity(e.identity)
+	}
+	return err
+}
+
+// deriveKey derives a 32 byte key from secret with HKDF-SHA256.
+func deriveKey(secret, salt []byte, info string) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(info))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrapKey returns the AEAD wrapping the file key for recipient, keyed by
+// the X25519 agreement of secret and peer, one of which is the ephemeral key
+// whose public half is ephPub.
+func wrapKey(secret *ecdh.PrivateKey, peer *ecdh.PublicKey, ephPub, recipient []byte) (cipher.AEAD, error) {
+	shared, err := secret.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	return newGCM(deriveKey(shared, append(append([]byte(nil), ephPub...), recipient...), "cpj file key"))
+}
+
+// encryptTo is the cp.Options.Encode of -encrypt.
+func (e *encryption) encryptTo(w io.Writer) (io.WriteCloser, error) {
+	fileKey := make([]byte, 32)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, err
+	}
+	header := bytes.NewBufferString(cryptMagic)
+	header.WriteByte(byte(len(e.recipients)))
+	var zero [12]byte
+	for _, recipient := range e.recipients {
+		eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		ephPub := eph.PublicKey().Bytes()
+		aead, err := wrapKey(eph, recipient, ephPub, recipient.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		header.Write(ephPub)
+		// Each wrapping key is used once, so a fixed nonce is safe
+		header.Write(aead.Seal(nil, zero[:], fileKey, nil))
+	}
+	nonce := make([]byte, cryptNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header.Write(nonce)
+	header.Write(headerMAC(fileKey, header.Bytes()))
+	aead, err := newGCM(deriveKey(fileKey, nonce, "cpj payload"))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return nil, err
+	}
+	return &sealWriter{w: w, aead: aead, buf: make([]byte, 0, cryptChunkSize)}, nil
+}
+
+// headerMAC returns the MAC of header, all of it up to the MAC, under the
+// file key.
+func headerMAC(fileKey, header []byte) []byte {
+	mac := hmac.New(sha256.New, deriveKey(fileKey, nil, "cpj header"))
+	mac.Write(header)
+	return mac.Sum(nil)
+}
+
+// chunkNonce is the nonce of chunk n, the last one flagged.
+func chunkNonce(n uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], n)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// sealWriter seals what is written to it a chunk at a time. A full chunk is
+// only sealed once more is written, as the last one is flagged on Close.
+type sealWriter struct {
+	w    io.Writer
+	aead cipher.AEAD
+	buf  []byte
+	n    uint64
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(s.buf) == cryptChunkSize {
+			if err := s.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(s.buf[len(s.buf):cryptChunkSize], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (s *sealWriter) seal(last bool) error {
+	_, err := s.w.Write(s.aead.Seal(nil, chunkNonce(s.n, last), s.buf, nil))
+	s.n++
+	s.buf = s.buf[:0]
+	return err
+}
+
+func (s *sealWriter) Close() error {
+	return s.seal(true)
+}
+
+// decryptFrom is the cp.Options.Decode of -decrypt.
+func (e *encryption) decryptFrom(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReaderSize(r, cryptChunkSize+16+1)
+	magic := make([]byte, len(cryptMagic)+1)
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic[:len(cryptMagic)]) != cryptMagic {
+		return nil, errors.New("not encrypted by cpj")
+	}
+	stanzas := make([]byte, int(magic[len(cryptMagic)])*(32+wrappedKeySize))
+	if _, err := io.ReadFull(br, stanzas); err != nil {
+		return nil, err
+	}
+	var fileKey []byte
+	var zero [12]byte
+	for i := 0; i < len(stanzas) && fileKey == nil; i += 32 + wrappedKeySize {
+		ephPub, wrapped := stanzas[i:i+32], stanzas[i+32:i+32+wrappedKeySize]
+		eph, err := ecdh.X25519().NewPublicKey(ephPub)
+		if err != nil {
+			continue
+		}
+		for _, key := range e.keys {
+			aead, err := wrapKey(key, eph, ephPub, key.PublicKey().Bytes())
+			if err != nil {
+				continue
+			}
+			if fileKey, err = aead.Open(nil, zero[:], wrapped, nil); err == nil {
+				break
+			}
+		}
+	}
+	if fileKey == nil {
+		return nil, errors.New("not encrypted for any key of -identity")
+	}
+	nonceMAC := make([]byte, cryptNonceSize+cryptMACSize)
+	if _, err := io.ReadFull(br, nonceMAC); err != nil {
+		return nil, err
+	}
+	nonce, mac := nonceMAC[:cryptNonceSize], nonceMAC[cryptNonceSize:]
+	header := append(append(append([]byte(nil), magic...), stanzas...), nonce...)
+	if !hmac.Equal(mac, headerMAC(fileKey, header)) {
+		return nil, errHeaderMAC
+	}
+	aead, err := newGCM(deriveKey(fileKey, nonce, "cpj payload"))
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(&openReader{r: br, aead: aead, chunk: make([]byte, cryptChunkSize+aead.Overhead())}), nil
+}
+
+// openReader opens the chunks read from r, checking the last is flagged.
+type openReader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	chunk []byte
+	plain []byte
+	n     uint64
+	done  bool
+}
+
+var (
+	errTruncated = errors.New("encrypted file is truncated or corrupt")
+	errHeaderMAC = errors.New("encrypted file header is corrupt")
+)
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.plain) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(o.r, o.chunk)
+		if err == io.EOF || (err == nil || err == io.ErrUnexpectedEOF) && n < o.aead.Overhead() {
+			return 0, errTruncated
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		// Only a chunk followed by nothing is the last
+		last := err == io.ErrUnexpectedEOF
+		if !last {
+			if _, err := o.r.Peek(1); err == io.EOF {
+				last = true
+			}
+		}
+		if o.plain, err = o.aead.Open(o.chunk[:0], chunkNonce(o.n, last), o.chunk[:n], nil); err != nil {
+			return 0, errTruncated
+		}
+		o.n++
+		o.done = last
+	}
+	n := copy(p, o.plain)
+	o.plain = o.plain[n:]
+	return n, nil
+}
+
+// encoder returns the cp.Options.Encode of the source file src, described
+// by info or statted if nil: compressing it for -compress, then encrypting
+// it for -encrypt. It is nil if neither applies.
+func (o *options) encoder(src string, info os.FileInfo) func(w io.Writer) (io.WriteCloser, error) {
+	if info == nil && (o.compress.format != "" || o.crypt.encrypt) {
+		info, _ = os.Lstat(src)
+	}
+	compress := o.compress.compresses(src, info)
+	encrypt := o.crypt.encrypt && (info == nil || info.Mode().IsRegular())
+	switch {
+	case compress && encrypt:
+		return func(w io.Writer) (io.WriteCloser, error) {
+			enc, err := o.crypt.encryptTo(w)
+			if err != nil {
+				return nil, err
+			}
+			comp, err := o.compress.encode(enc)
+			if err != nil {
+				return nil, err
+			}
+			return chainCloser{comp, enc}, nil
+		}
+	case compress:
+		return o.compress.encode
+	case encrypt:
+		return o.crypt.encryptTo
+	}
+	return nil
+}
+
+// decoder returns the cp.Options.Decode of the source file src, described
+// by info or statted if nil: decrypting it for -decrypt if its name ends in
+// .enc, then decompressing it for -decompress. It is nil if neither applies.
+func (o *options) decoder(src string, info os.FileInfo) func(r io.Reader) (io.ReadCloser, error) {
+	if info == nil && (o.compress.decompress || o.crypt.decrypt) {
+		info, _ = os.Lstat(src)
+	}
+	decrypt := o.crypt.decrypt && strings.EqualFold(filepath.Ext(src), encryptedExt) && (info == nil || info.Mode().IsRegular())
+	if decrypt {
+		src = src[:len(src)-len(encryptedExt)]
+	}
+	decompress := o.compress.decoder(src, info)
+	switch {
+	case decrypt && decompress != nil:
+		return func(r io.Reader) (io.ReadCloser, error) {
+			dec, err := o.crypt.decryptFrom(r)
+			if err != nil {
+				return nil, err
+			}
+			plain, err := decompress(dec)
+			if err != nil {
+				return nil, err
+			}
+			return chainCloser{plain, dec}, nil
+		}
+	case decrypt:
+		return o.crypt.decryptFrom
+	}
+	return decompress
+}
+
+// renameFile returns dest, the destination of the source file src described
+// by info or statted if nil, as -compress, -decompress, -encrypt and
+// -decrypt rename it.
+func (o *options) renameFile(src, dest string, info os.FileInfo) string {
+	if info == nil && (o.compress.format != "" || o.compress.decompress || o.crypt.encrypt || o.crypt.decrypt) {
+		info, _ = os.Lstat(src)
+	}
+	regular := info == nil || info.Mode().IsRegular()
+	if o.crypt.decrypt && regular && strings.EqualFold(filepath.Ext(src), encryptedExt) {
+		src = src[:len(src)-len(encryptedExt)]
+		if strings.EqualFold(filepath.Ext(dest), encryptedExt) {
+			dest = dest[:len(dest)-len(encryptedExt)]
+		}
+	}
+	dest = o.compress.rename(src, dest, info)
+	if o.crypt.encrypt && regular {
+		dest += encryptedExt
+	}
+	return dest
+}
+
+// chainCloser writes to or reads from the first of a chain of encoders or
+// decoders, closing each in turn.
+type chainCloser struct {
+	first io.Closer
+	next  io.Closer
+}
+
+func (c chainCloser) Write(p []byte) (int, error) {
+	return c.first.(io.Writer).Write(p)
+}
+
+func (c chainCloser) Read(p []byte) (int, error) {
+	return c.first.(io.Reader).Read(p)
+}
+
+func (c chainCloser) Close() error {
+	err := c.first.Close()
+	if cerr := c.next.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// keygenMain implements `cpj keygen`, generating a key pair for -encrypt and
+// -decrypt.
+func keygenMain(args []string) int {
+	cmd := lookupCommand("keygen")
+	var out string
+	flags := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	flags.StringVar(&out, "o", "", "Write the identity to this file, which must not exist, instead of stdout, and print the public key.")
+	flags.Usage = func() {
+		cmd.printUsage()
+		flags.PrintDefaults()
+	}
+	if err := applyEnv(flags); err != nil {
+		log.Print(err)
+		return exitUsage
+	}
+	if err := flags.Parse(args); err != nil {
+		return parseStatus(err)
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return exitUsage
+	}
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		log.Print(err)
+		return exitFailure
+	}
+	public := publicKeyPrefix + base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes())
+	identity := fmt.Sprintf("# created: %s\n# public key: %s\n%s%s\n", time.Now().Format(time.RFC3339), public,
+		secretKeyPrefix, base64.RawURLEncoding.EncodeToString(key.Bytes()))
+	if out == "" {
+		fmt.Print(identity)
+		return 0
+	}
+	file, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Print(err)
+		return exitFailure
+	}
+	if _, err = file.WriteString(identity); err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		log.Print(err)
+		return exitFailure
+	}
+	fmt.Printf("Public key: %s\n", public)
+	return 0
+}
@@ -0,0 +1,83 @@
+package copier
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+// encryptFor returns plain encrypted by -encrypt for the public halves of
+// keys, and the length of its header.
+func encryptFor(t *testing.T, plain []byte, keys ...*ecdh.PrivateKey) (data []byte, header int) {
+	t.Helper()
+	e := &encryption{encrypt: true}
+	for _, key := range keys {
+		e.recipients = append(e.recipients, key.PublicKey())
+	}
+	var b bytes.Buffer
+	w, err := e.encryptTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header = b.Len()
+	if _, err := w.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes(), header
+}
+
+func newKey(t *testing.T) *ecdh.PrivateKey {
+	t.Helper()
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestCryptRoundTrip(t *testing.T) {
+	key := newKey(t)
+	for _, size := range []int{0, 1, cryptChunkSize, 3*cryptChunkSize + 5} {
+		plain := bytes.Repeat([]byte("cpj"), size/3+1)[:size]
+		data, _ := encryptFor(t, plain, newKey(t), key)
+		r, err := (&encryption{decrypt: true, keys: []*ecdh.PrivateKey{key}}).decryptFrom(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("%d bytes decrypted to %d differing bytes", size, len(got))
+		}
+	}
+}
+
+// TestCryptHeaderModified checks that a change to any byte of the header,
+// even to the stanza of another recipient, which doesn't hold the file key
+// for this one, is refused before the payload is opened.
+func TestCryptHeaderModified(t *testing.T) {
+	key := newKey(t)
+	data, header := encryptFor(t, []byte("secret contents"), key, newKey(t))
+	e := &encryption{decrypt: true, keys: []*ecdh.PrivateKey{key}}
+	for i := len(cryptMagic); i < header; i++ {
+		bad := bytes.Clone(data)
+		bad[i] ^= 1
+		if _, err := e.decryptFrom(bytes.NewReader(bad)); err == nil {
+			t.Errorf("a header with byte %d of %d changed was taken", i, header)
+		}
+	}
+	// The other recipient's stanza follows this one's
+	other := len(cryptMagic) + 1 + 32 + wrappedKeySize
+	bad := bytes.Clone(data)
+	bad[other] ^= 1
+	if _, err := e.decryptFrom(bytes.NewReader(bad)); err != errHeaderMAC {
+		t.Errorf("a changed stanza of another recipient gave %v, want %v", err, errHeaderMAC)
+	}
+}
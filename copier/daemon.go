@@ -0,0 +1,650 @@
+package copier
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// keepFinished is how many finished jobs the daemon remembers.
+const keepFinished = 100
+
+// The states of a daemon job.
+const (
+	jobScheduled = "scheduled"
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// daemonJob is a copy submitted to the daemon.
+type daemonJob struct {
+	ID int `json:"id"`
+	// Args are the command, copy or sync, and its flags and operands, which
+	// are relative to Dir.
+	Args      []string   `json:"args"`
+	Dir       string     `json:"dir"`
+	State     string     `json:"state"`
+	Status    int        `json:"status,omitempty"`
+	Submitted time.Time  `json:"submitted"`
+	Started   *time.Time `json:"started,omitempty"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	// Progress is the status line of a running job, as SIGUSR1 prints.
+	Progress string `json:"progress,omitempty"`
+	// Log is the file the job's output goes to.
+	Log string `json:"log"`
+	// Schedule makes the job recur, as parseSchedule reads it. A scheduled
+	// job waits until Next to be queued again, its other fields describing
+	// its last run.
+	Schedule string     `json:"schedule,omitempty"`
+	Next     *time.Time `json:"next,omitempty"`
+}
+
+// over reports whether job has finished for good, and may be forgotten.
+func (job *daemonJob) over() bool {
+	return job.Finished != nil && job.State != jobScheduled
+}
+
+// daemon runs the jobs submitted on its socket, at most maxJobs at once,
+// keeping the queue in its state directory so that it survives a restart.
+type daemon struct {
+	dir     string
+	maxJobs int
+	mu      sync.Mutex
+	next    int
+	jobs    []*daemonJob
+	// procs holds the processes of the running jobs, by id.
+	procs map[int]*exec.Cmd
+	// wake is signalled whenever a job is queued or finishes.
+	wake     chan struct{}
+	stopping bool
+}
+
+// daemonState is what is saved in jobs.json.
+type daemonState struct {
+	Next int          `json:"next"`
+	Jobs []*daemonJob `json:"jobs"`
+}
+
+// defaultDaemonSocket is where the daemon listens unless told otherwise.
+func defaultDaemonSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "cpj.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("cpj-%d.sock", os.Getuid()))
+}
+
+// defaultDaemonDir is where the daemon keeps its queue and the logs of its
+// jobs unless told otherwise.
+func defaultDaemonDir() string {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "cpj")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".local", "state", "cpj")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("cpj-%d", os.Getuid()))
+}
+
+// daemonMain implements `cpj daemon`.
+func daemonMain(args []string) int {
+	cmd := lookupCommand("daemon")
+	d := &daemon{procs: map[int]*exec.Cmd{}, wake: make(chan struct{}, 1)}
+	var socket, httpAddr, httpToken string
+	flags := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	flags.StringVar(&socket, "socket", defaultDaemonSocket(), "Listen for jobs on the unix socket at this path.")
+	flags.StringVar(&httpAddr, "http", "", "Also serve a REST API for jobs on this address, e.g. localhost:8080, and the gRPC service cpj.Jobs over unencrypted HTTP/2.")
+	flags.StringVar(&httpToken, "http-token", "", fmt.Sprintf("Require this bearer token on every request to the REST API or gRPC service. Best given as %s, out of sight of ps. Without one, a token is made up and written to http-token in the state directory.", envName("http-token")))
+	flags.StringVar(&d.dir, "state-dir", defaultDaemonDir(), "Keep the job queue and the output of each job in this directory.")
+	flags.IntVar(&d.maxJobs, "max-jobs", 1, "Run at most this many jobs at once. Each copies with its own -jobs.")
+	flags.Usage = func() {
+		cmd.printUsage()
+		flags.PrintDefaults()
+	}
+	if err := applyEnv(flags); err != nil {
+		log.Print(err)
+		return exitUsage
+	}
+	if err := flags.Parse(args); err != nil {
+		return parseStatus(err)
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return exitUsage
+	}
+	if d.maxJobs < 1 {
+		log.Print("-max-jobs must be at least 1")
+		return exitUsage
+	}
+	if err := os.MkdirAll(d.dir, 0700); err != nil {
+		log.Print(err)
+		return exitFailure
+	}
+	if err := d.load(); err != nil {
+		log.Print(err)
+		return exitFailure
+	}
+	if conn, err := net.Dial("unix", socket); err == nil {
+		conn.Close()
+		log.Printf("a daemon is already listening on %s", socket)
+		return exitFailure
+	} else if errors.Is(err, syscall.ECONNREFUSED) {
+		os.Remove(socket)
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		log.Print(err)
+		return exitFailure
+	}
+	defer l.Close()
+	if err := os.Chmod(socket, 0600); err != nil {
+		log.Print(err)
+		return exitFailure
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+	log.Printf("Listening on %s, running up to %d jobs at once", socket, d.maxJobs)
+	if httpAddr != "" {
+		if httpToken == "" {
+			if httpToken, err = d.newToken(); err != nil {
+				log.Print(err)
+				return exitFailure
+			}
+		}
+		srv, err := d.serveHTTP(httpAddr, httpToken)
+		if err != nil {
+			log.Print(err)
+			return exitFailure
+		}
+		defer srv.Close()
+		log.Printf("Serving the REST API and gRPC service on %s", httpAddr)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		d.schedule()
+		close(done)
+	}()
+	<-signals
+	log.Print("Stopping, running jobs will be queued again")
+	d.stop()
+	<-done
+	return 0
+}
+
+// load reads the saved queue. Jobs that were running when the daemon last
+// stopped are queued again, to start over.
+func (d *daemon) load() error {
+	data, err := os.ReadFile(filepath.Join(d.dir, "jobs.json"))
+	if os.IsNotExist(err) {
+		d.next = 1
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state daemonState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("%s: %w", filepath.Join(d.dir, "jobs.json"), err)
+	}
+	d.next, d.jobs = state.Next, state.Jobs
+	for _, job := range d.jobs {
+		if job.State == jobRunning {
+			job.State, job.Started = jobQueued, nil
+		}
+	}
+	return nil
+}
+
+// save writes the queue to jobs.json, replacing it atomically. It must be
+// called with mu held.
+func (d *daemon) save() {
+	// Forget the oldest finished jobs
+	finished := 0
+	for _, job := range d.jobs {
+		if job.over() {
+			finished++
+		}
+	}
+	kept := make([]*daemonJob, 0, len(d.jobs))
+	for _, job := range d.jobs {
+		if job.over() && finished > keepFinished {
+			finished--
+			os.Remove(job.Log)
+			continue
+		}
+		kept = append(kept, job)
+	}
+	d.jobs = kept
+	data, err := json.MarshalIndent(daemonState{Next: d.next, Jobs: d.jobs}, "", "  ")
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	path := filepath.Join(d.dir, "jobs.json")
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		log.Print(err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		log.Print(err)
+	}
+}
+
+// notify wakes the scheduler.
+func (d *daemon) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// schedule starts queued jobs, oldest first, whenever fewer than maxJobs are
+// running, until the daemon stops and its running jobs have finished.
+// Scheduled jobs are queued when their time comes.
+func (d *daemon) schedule() {
+	for {
+		d.mu.Lock()
+		if d.stopping && len(d.procs) == 0 {
+			d.mu.Unlock()
+			return
+		}
+		now := time.Now()
+		var wait time.Duration
+		for _, job := range d.jobs {
+			if job.State != jobScheduled {
+				continue
+			}
+			if until := job.Next.Sub(now); until > 0 {
+				if wait == 0 || until < wait {
+					wait = until
+				}
+				continue
+			}
+			log.Printf("Job %d queued, as scheduled", job.ID)
+			job.State, job.Next = jobQueued, nil
+			d.save()
+		}
+		for _, job := range d.jobs {
+			if d.stopping || len(d.procs) >= d.maxJobs {
+				break
+			}
+			if job.State == jobQueued {
+				d.start(job)
+			}
+		}
+		d.mu.Unlock()
+		if wait == 0 {
+			<-d.wake
+			continue
+		}
+		select {
+		case <-d.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// start runs job in a cpj process of its own, with its output going to the
+// job's log and a control socket to ask it how far it has got. It must be
+// called with mu held.
+func (d *daemon) start(job *daemonJob) {
+	now := time.Now()
+	job.Started, job.Log = &now, filepath.Join(d.dir, fmt.Sprintf("%d.log", job.ID))
+	fail := func(err error) {
+		log.Printf("Job %d: %v", job.ID, err)
+		job.State, job.Status, job.Finished = jobFailed, exitFailure, &now
+		// A run that couldn't start doesn't end the schedule either
+		if job.Schedule != "" {
+			d.plan(job, now)
+		}
+		d.save()
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		fail(err)
+		return
+	}
+	out, err := os.OpenFile(job.Log, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		fail(err)
+		return
+	}
+	args := append([]string{job.Args[0], "-control", d.control(job)}, job.Args[1:]...)
+	proc := exec.Command(exe, args...)
+	proc.Dir, proc.Stdout, proc.Stderr = job.Dir, out, out
+	if err := proc.Start(); err != nil {
+		out.Close()
+		fail(err)
+		return
+	}
+	log.Printf("Job %d started: %s", job.ID, strings.Join(job.Args, " "))
+	job.State = jobRunning
+	d.procs[job.ID] = proc
+	d.save()
+	go func() {
+		err := proc.Wait()
+		out.Close()
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.procs, job.ID)
+		now := time.Now()
+		// Cancelling a scheduled job ends its schedule, however the run ends
+		cancelled := job.State == jobCancelled
+		job.Status = proc.ProcessState.ExitCode()
+		switch {
+		case d.stopping && err != nil:
+			// Run it again next time
+			job.State, job.Started, job.Status = jobQueued, nil, 0
+		case err == nil:
+			job.State, job.Finished = jobDone, &now
+		case job.State == jobCancelled || job.Status == exitInterrupted:
+			job.State, job.Finished = jobCancelled, &now
+		default:
+			job.State, job.Finished = jobFailed, &now
+		}
+		job.Progress = ""
+		if job.State == jobQueued {
+			log.Printf("Job %d stopped, to be run again", job.ID)
+		} else {
+			log.Printf("Job %d %s with status %d", job.ID, job.State, job.Status)
+		}
+		if job.Schedule != "" && !cancelled && (job.State == jobDone || job.State == jobFailed) {
+			d.plan(job, now)
+		}
+		d.save()
+		d.notify()
+	}()
+}
+
+// newToken makes up a bearer token for the REST API, writing it to the
+// http-token file of the state directory for clients to read.
+func (d *daemon) newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	path := filepath.Join(d.dir, "http-token")
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	log.Printf("The REST API token is in %s", path)
+	return token, nil
+}
+
+// control returns the path of the control socket of job.
+func (d *daemon) control(job *daemonJob) string {
+	return filepath.Join(d.dir, fmt.Sprintf("%d.sock", job.ID))
+}
+
+// stop interrupts the running jobs, and starts no more.
+func (d *daemon) stop() {
+	d.mu.Lock()
+	d.stopping = true
+	for _, proc := range d.procs {
+		proc.Process.Signal(os.Interrupt)
+	}
+	d.mu.Unlock()
+	d.notify()
+}
+
+// serve answers the requests sent on conn until it is closed. Each is a
+// line holding a verb and its argument, and is answered with a line of JSON:
+//
+//	submit {"dir": ..., "args": [...], "schedule": ...}
+//	                                    queue a job, or schedule it, answered
+//	                                    with the job
+//	jobs                                list every job, answered with an array
+//	status ID                           describe one job
+//	cancel ID                           cancel a queued or running job
+//
+// Errors are answered with {"error": ...}.
+func (d *daemon) serve(conn net.Conn) {
+	defer conn.Close()
+	lines := bufio.NewScanner(conn)
+	enc := json.NewEncoder(conn)
+	for lines.Scan() {
+		verb, arg, _ := strings.Cut(strings.TrimSpace(lines.Text()), " ")
+		if verb == "" {
+			continue
+		}
+		reply, err := d.request(verb, arg)
+		if err != nil {
+			reply = map[string]string{"error": err.Error()}
+		}
+		if err := enc.Encode(reply); err != nil {
+			return
+		}
+	}
+}
+
+// errNoJob is returned for a job id the daemon doesn't know.
+var errNoJob = errors.New("no such job")
+
+// request carries out one request, returning the reply.
+func (d *daemon) request(verb, arg string) (any, error) {
+	switch verb {
+	case "submit":
+		var job daemonJob
+		if err := json.Unmarshal([]byte(arg), &job); err != nil {
+			return nil, fmt.Errorf("invalid job: %w", err)
+		}
+		return d.submit(job.Dir, job.Args, job.Schedule)
+	case "jobs":
+		return d.list(), nil
+	case "status", "cancel":
+		id, err := strconv.Atoi(strings.TrimSpace(arg))
+		if err != nil {
+			return nil, fmt.Errorf("invalid job id %q", arg)
+		}
+		return d.find(id, verb == "cancel")
+	}
+	return nil, errors.New("requests are submit, jobs, status ID and cancel ID")
+}
+
+// list returns every job, with the progress of those running.
+func (d *daemon) list() []daemonJob {
+	d.mu.Lock()
+	jobs := make([]daemonJob, len(d.jobs))
+	for i, job := range d.jobs {
+		jobs[i] = *job
+	}
+	d.mu.Unlock()
+	for i := range jobs {
+		d.progress(&jobs[i])
+	}
+	return jobs
+}
+
+// find returns the job with id, cancelling it first if cancel is set.
+func (d *daemon) find(id int, cancel bool) (daemonJob, error) {
+	d.mu.Lock()
+	var found *daemonJob
+	for _, job := range d.jobs {
+		if job.ID == id {
+			found = job
+		}
+	}
+	if found == nil {
+		d.mu.Unlock()
+		return daemonJob{}, fmt.Errorf("%w: %d", errNoJob, id)
+	}
+	if cancel {
+		d.cancel(found)
+	}
+	job := *found
+	d.mu.Unlock()
+	d.progress(&job)
+	return job, nil
+}
+
+// submit queues a job, or with a schedule, sets it to run when that says.
+func (d *daemon) submit(dir string, args []string, spec string) (daemonJob, error) {
+	if len(args) == 0 || args[0] != "copy" && args[0] != "sync" {
+		return daemonJob{}, errors.New("a job must be a copy or sync command")
+	}
+	if !filepath.IsAbs(dir) {
+		return daemonJob{}, fmt.Errorf("the directory of a job must be absolute, not %q", dir)
+	}
+	if err := checkJobFlags(args); err != nil {
+		return daemonJob{}, err
+	}
+	if spec != "" {
+		if _, err := parseSchedule(spec); err != nil {
+			return daemonJob{}, err
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	job := &daemonJob{ID: d.next, Args: args, Dir: dir, State: jobQueued, Submitted: time.Now(), Schedule: spec}
+	d.next++
+	d.jobs = append(d.jobs, job)
+	if spec != "" {
+		log.Printf("Job %d scheduled %s: %s", job.ID, spec, strings.Join(args, " "))
+		d.plan(job, job.Submitted)
+	} else {
+		log.Printf("Job %d queued: %s", job.ID, strings.Join(args, " "))
+	}
+	d.save()
+	d.notify()
+	return *job, nil
+}
+
+// daemonAllowed are the flags a job may be given. Any other, such as
+// -exec-before, -ssh-command or -manifest, would let whoever submits it run
+// commands or write files beside its operands as the daemon's user.
+var daemonAllowed = []string{
+	"link", "recurse", "useful", "skip-unreadable", "json", "continue", "quiet", "verbose", "debug",
+	"log-level", "log-format", "color", "progress", "mkdir", "dirs-only",
+	"preserve-perms", "preserve-owner", "numeric-ids", "preserve-times", "preserve-atime",
+	"hard-links", "dedup", "drop-cache", "skip-existing", "checksum", "delta",
+	"compress", "compress-level", "compress-skip", "zip-store", "decompress",
+	"encrypt", "recipient", "decrypt", "identity",
+	"force", "no-clobber", "delete", "dry-run", "move", "atomic", "staged",
+	"t", "T", "parents", "rename", "sanitize", "sanitize-char", "extract", "files-from", "from0",
+	"retries", "retry-delay", "max-errors", "adaptive", "read-jobs", "write-jobs", "device-jobs",
+	"order", "sort", "sequential", "max-queued", "jobs", "reflink", "engine", "queue-depth",
+	"split-size", "buffer-size", "backup", "backup-mode", "link-dest", "s3-region", "s3-part-size",
+	"from-failures",
+	"exclude", "include", "no-hidden", "exclude-re", "include-re", "min-size", "max-size",
+	"newer-than", "older-than", "filter-from", "dir-filter", "x", "one-file-system", "type",
+	"max-depth", "links", "special",
+}
+
+// checkJobFlags returns an error if the flags of the job args, up to its
+// first operand as the flag package parses them, include one that isn't in
+// daemonAllowed.
+func checkJobFlags(args []string) error {
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	addCopyFlags(flags, newOptions())
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") || arg == "-" {
+			return nil
+		}
+		name, _, hasVal := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-"), "=")
+		f := flags.Lookup(name)
+		if f == nil {
+			return fmt.Errorf("%s has no flag -%s", args[0], name)
+		}
+		if !slices.Contains(daemonAllowed, name) {
+			return fmt.Errorf("a job can't be given -%s", name)
+		}
+		// The value of a flag other than a boolean may be the next argument
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !hasVal && (!ok || !b.IsBoolFlag()) {
+			i++
+		}
+	}
+	return nil
+}
+
+// plan sets job to run next when its schedule says, after from. It must be
+// called with mu held.
+func (d *daemon) plan(job *daemonJob, from time.Time) {
+	s, err := parseSchedule(job.Schedule)
+	if err != nil {
+		// Only a schedule that is never due again gets here
+		log.Printf("Job %d: %v", job.ID, err)
+		return
+	}
+	next := s.next(from)
+	job.State, job.Next = jobScheduled, &next
+	log.Printf("Job %d runs next at %s", job.ID, next.Format(time.DateTime))
+}
+
+// cancel drops job from the queue, or asks it to stop once the copies it
+// has in progress finish. It must be called with mu held.
+func (d *daemon) cancel(job *daemonJob) {
+	switch job.State {
+	case jobQueued, jobScheduled:
+		now := time.Now()
+		job.State, job.Finished, job.Next = jobCancelled, &now, nil
+		d.save()
+	case jobRunning:
+		job.State = jobCancelled
+		if _, err := controlRequest(d.control(job), "cancel"); err != nil {
+			d.procs[job.ID].Process.Signal(os.Interrupt)
+		}
+	}
+}
+
+// progress fills in how far job has got, if it is running.
+func (d *daemon) progress(job *daemonJob) {
+	if job.State != jobRunning {
+		return
+	}
+	if status, err := controlRequest(d.control(job), "status"); err == nil {
+		job.Progress = status
+	}
+}
+
+// controlRequest sends command to the -control socket at path, returning the
+// answer.
+func controlRequest(path, command string) (string, error) {
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fmt.Fprintln(conn, command); err != nil {
+		return "", err
+	}
+	answer, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	answer = strings.TrimSuffix(answer, "\n")
+	if msg, ok := strings.CutPrefix(answer, "error: "); ok {
+		return "", errors.New(msg)
+	}
+	return answer, nil
+}
@@ -0,0 +1,33 @@
+package copier
+
+import (
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// TestScheduledStartFails checks that a scheduled job whose run can't start
+// is planned again, rather than falling off its schedule.
+func TestScheduledStartFails(t *testing.T) {
+	dir := t.TempDir()
+	d := &daemon{dir: dir, maxJobs: 1, next: 1, procs: map[int]*exec.Cmd{}, wake: make(chan struct{}, 1)}
+	// The job can't be started in a directory that doesn't exist
+	job, err := d.submit(filepath.Join(dir, "missing"), []string{"copy", "src", "dest"}, "every 1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	queued := d.jobs[0]
+	queued.State, queued.Next = jobQueued, nil
+	d.start(queued)
+	if len(d.procs) != 0 {
+		t.Fatalf("job %d started in a missing directory", job.ID)
+	}
+	if queued.State != jobScheduled || queued.Next == nil {
+		t.Errorf("job %d is %s after failing to start, want %s again", job.ID, queued.State, jobScheduled)
+	}
+	if queued.Status != exitFailure {
+		t.Errorf("job %d has status %d, want %d", job.ID, queued.Status, exitFailure)
+	}
+}
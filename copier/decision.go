@@ -0,0 +1,148 @@
+package copier
+
+import (
+	"io/fs"
+	"path/filepath"
+	"time"
+)
+
+// Decision is what a Filter decides about a path.
+type Decision int
+
+const (
+	// Include copies a file, or descends into a directory.
+	Include Decision = iota
+	// Exclude leaves out a file. A directory is still descended into, so
+	// the files below it are decided on their own.
+	Exclude
+	// Prune leaves out a file, or a directory with everything below it.
+	Prune
+)
+
+// Filter decides which paths below the Src of a Copier are copied, along
+// with the filters of its Options. Decide is passed the path relative to
+// Src, slash separated, and what the walk found there. A directory only
+// implied by the paths below it, such as a prefix of the keys of a bucket,
+// has a size of 0 and no modification time. Decide is called from several
+// goroutines at once.
+type Filter interface {
+	Decide(path string, info fs.FileInfo) Decision
+}
+
+// FilterFunc is a function used as a Filter.
+type FilterFunc func(path string, info fs.FileInfo) Decision
+
+func (f FilterFunc) Decide(path string, info fs.FileInfo) Decision {
+	return f(path, info)
+}
+
+// All returns a Filter taking the furthest reaching decision of filters:
+// Prune over Exclude over Include.
+func All(filters ...Filter) Filter {
+	return allFilter(filters)
+}
+
+type allFilter []Filter
+
+func (a allFilter) Decide(path string, info fs.FileInfo) Decision {
+	d := Include
+	for _, f := range a {
+		if d = max(d, f.Decide(path, info)); d == Prune {
+			break
+		}
+	}
+	return d
+}
+
+func (a allFilter) validate() error {
+	for _, f := range a {
+		if err := validateFilter(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExcludeGlob returns a Filter pruning the paths matching any of patterns,
+// as Options.Exclude does.
+func ExcludeGlob(patterns ...string) Filter {
+	return globFilter{patterns: patterns, exclude: true}
+}
+
+// IncludeGlob returns a Filter excluding the files matching none of
+// patterns, as Options.Include does. Directories are always included.
+func IncludeGlob(patterns ...string) Filter {
+	return globFilter{patterns: patterns}
+}
+
+type globFilter struct {
+	patterns stringList
+	exclude  bool
+}
+
+func (g globFilter) Decide(path string, info fs.FileInfo) Decision {
+	matched := matchAny(g.patterns, filepath.FromSlash(path))
+	switch {
+	case g.exclude && matched:
+		return Prune
+	case !g.exclude && !matched && !info.IsDir():
+		return Exclude
+	}
+	return Include
+}
+
+func (g globFilter) validate() error {
+	for _, pattern := range g.patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SizeBetween returns a Filter excluding the regular files smaller than min
+// or larger than max, as Options.MinSize and MaxSize do, 0 being no bound.
+func SizeBetween(min, max int64) Filter {
+	return limitFilter{&pathFilter{minSize: byteSize(min), maxSize: byteSize(max)}}
+}
+
+// ModifiedBetween returns a Filter excluding the regular files not modified
+// between after and before, as Options.NewerThan and OlderThan do, the zero
+// time being no bound.
+func ModifiedBetween(after, before time.Time) Filter {
+	return limitFilter{&pathFilter{newerThan: timeBound{t: after}, olderThan: timeBound{t: before}}}
+}
+
+// limitFilter is the size and modification time limits of a pathFilter.
+type limitFilter struct {
+	f *pathFilter
+}
+
+func (l limitFilter) Decide(path string, info fs.FileInfo) Decision {
+	if info.Mode().IsRegular() && !l.f.selects(info) {
+		return Exclude
+	}
+	return Include
+}
+
+func (l limitFilter) validate() error {
+	return l.f.validate()
+}
+
+// validateFilter checks the settings of the built in filters among f, as
+// those of Options are checked, so a typo doesn't silently match nothing.
+func validateFilter(f Filter) error {
+	if v, ok := f.(interface{ validate() error }); ok {
+		return v.validate()
+	}
+	return nil
+}
+
+// decide returns what the Filter of a Copier decides about rel, described
+// by info, or Include without one.
+func (f *pathFilter) decide(rel string, info fs.FileInfo) Decision {
+	if f.custom == nil {
+		return Include
+	}
+	return f.custom.Decide(filepath.ToSlash(rel), info)
+}
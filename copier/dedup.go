@@ -0,0 +1,392 @@
+package copier
+
+import (
+	"cpj/cp"
+	"cpj/stack"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"log/slog"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// dedupFiles finds the files with identical contents among files, by size
+// and then by sha256 digest, for -dedup. The first of each set in files
+// stays to be copied, and the others are taken out of files and added to
+// links, to be hard linked to its copy. Empty files and those that aren't
+// regular are left alone. Files that can't be read are copied as they are,
+// the copy reporting the error.
+func dedupFiles(files stack.Stack[string], scan *treeScan, links *hardLinks, opts *options) stack.Stack[string] {
+	bySize := make(map[int64][]string)
+	for _, file := range files {
+		info := dedupInfo(file, scan)
+		if info == nil || !info.Mode().IsRegular() || info.Size() == 0 {
+			continue
+		}
+		bySize[info.Size()] = append(bySize[info.Size()], file)
+	}
+	var candidates []string
+	for _, same := range bySize {
+		if len(same) > 1 {
+			candidates = append(candidates, same...)
+		}
+	}
+	if len(candidates) == 0 {
+		return files
+	}
+
+	// Hash the candidates with as many jobs as copy
+	digests := hashFiles(candidates, int(opts.jobs), func(file string) ([]byte, error) {
+		if opts.hashes != nil {
+			return opts.hashes.digest(file, dedupInfo(file, scan))
+		}
+		return cp.FileDigest(file, int(opts.bufferSize))
+	}, func(file string, err error) {
+		slog.Debug("Not deduplicating", "src", file, "error", err)
+	})
+
+	// The first of each set, in the order of files, is the one copied
+	first := make(map[string]string)
+	kept := make(stack.Stack[string], 0, len(files))
+	var saved int64
+	for _, file := range files {
+		digest, ok := digests[file]
+		if !ok {
+			kept = append(kept, file)
+			continue
+		}
+		if target, seen := first[digest]; seen {
+			links.links = append(links.links, hardLink{src: file, target: target})
+			saved += scan.sizes[file]
+			continue
+		}
+		first[digest] = file
+		kept = append(kept, file)
+	}
+	if opts.useful {
+		slog.Info("Deduplicated", "files", len(files)-len(kept), "bytes", saved)
+	}
+	return kept
+}
+
+// hashFiles returns the sha256 digests of files by name, computed by digest
+// with jobs goroutines. Files whose digest fails are left out, and passed to
+// failed with the error.
+func hashFiles(files []string, jobs int, digest func(file string) ([]byte, error), failed func(file string, err error)) map[string]string {
+	digests := make(map[string]string, len(files))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	work := make(chan string)
+	for i := 0; i < max(jobs, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range work {
+				sum, err := digest(file)
+				mu.Lock()
+				if err != nil {
+					failed(file, err)
+				} else {
+					digests[file] = string(sum)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, file := range files {
+		work <- file
+	}
+	close(work)
+	wg.Wait()
+	return digests
+}
+
+// dedupInfo returns what the walk found at file, or stats it.
+func dedupInfo(file string, scan *treeScan) os.FileInfo {
+	if info := scan.infos[file]; info != nil {
+		return info
+	}
+	info, _ := os.Lstat(file)
+	return info
+}
+
+// dupFile is a file of the tree `cpj dedup` scans. paths holds the names
+// found for it, several when it is already hard linked.
+type dupFile struct {
+	paths []string
+	info  os.FileInfo
+	nlink uint64
+}
+
+// dupKey groups the files that can replace each other. Hard linked files
+// share their mode and owner too, so those must match.
+type dupKey struct {
+	dev      uint64
+	size     int64
+	digest   string
+	perm     os.FileMode
+	uid, gid int
+}
+
+// dedupMain implements `cpj dedup`, replacing the files of an existing tree
+// that are identical to another of its files by hard links to it, or by
+// clones with -reflink, and reporting the space reclaimed.
+func dedupMain(args []string) int {
+	cmd := lookupCommand("dedup")
+	opts := options{links: linksPreserve, special: specialSkip}
+	var jobs int
+	var reflink bool
+	flags := flag.NewFlagSet("dedup", flag.ContinueOnError)
+	flags.IntVar(&jobs, "jobs", runtime.NumCPU(), "Specify the number of files to hash in parallel.")
+	flags.BoolVar(&reflink, "reflink", false, "Replace duplicates by clones sharing the data of the file kept, on copy-on-write filesystems such as btrfs, XFS and APFS, rather than by hard links. Clones keep their own mode, owner and times, and stay separate files if changed later.")
+	flags.BoolVar(&opts.dryRun, "dry-run", false, "Only list the duplicates and the space replacing them would reclaim, without changing anything.")
+	flags.BoolVar(&opts.verbose, "verbose", false, "List every duplicate replaced.")
+	flags.StringVar(&opts.hashCachePath, "hash-cache", "", "Keep the digests computed in this file, and reuse them on later runs for files whose size, modification time and inode are unchanged.")
+	addWalkFlags(flags, &opts)
+	flags.Usage = func() {
+		cmd.printUsage()
+		flags.PrintDefaults()
+	}
+	if err := applyEnv(flags); err != nil {
+		log.Print(err)
+		return exitUsage
+	}
+	if err := flags.Parse(args); err != nil {
+		return parseStatus(err)
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return exitUsage
+	}
+	if err := opts.filter.validate(); err != nil {
+		log.Print(err)
+		return exitUsage
+	}
+	if opts.maxDepth < 0 {
+		log.Print("-max-depth must not be negative")
+		return exitUsage
+	}
+	root, err := cp.AbsolutePath(flags.Arg(0))
+	if err != nil {
+		log.Print(err)
+		return exitFailure
+	}
+	if info, err := os.Stat(root); err != nil {
+		log.Print(err)
+		return exitFailure
+	} else if !info.IsDir() {
+		log.Printf("%s is not a directory", root)
+		return exitNotDirectory
+	}
+	if opts.hashCachePath != "" {
+		if opts.hashes, err = loadHashCache(opts.hashCachePath, cp.DefaultBufferSize); err != nil {
+			log.Print(err)
+			return exitFailure
+		}
+		defer func() {
+			if err := opts.hashes.save(); err != nil {
+				log.Print(err)
+			}
+		}()
+	}
+
+	// Find the files, one per inode
+	var files []*dupFile
+	byID := make(map[cp.FileID]*dupFile)
+	status := 0
+	err = walkTree(root, &opts, func(path string, d fs.DirEntry, err error) error {
+		var info os.FileInfo
+		if err == nil && d.Type().IsRegular() {
+			info, err = d.Info()
+		}
+		if err != nil {
+			log.Print(err)
+			status = exitPartial
+			return nil
+		}
+		if info == nil || info.Size() == 0 {
+			return nil
+		}
+		id, nlink, ok := cp.Identity(info)
+		if ok {
+			if file := byID[id]; file != nil {
+				file.paths = append(file.paths, path)
+				return nil
+			}
+		}
+		file := &dupFile{paths: []string{path}, info: info, nlink: nlink}
+		if ok {
+			byID[id] = file
+		}
+		files = append(files, file)
+		return nil
+	})
+	if err != nil {
+		log.Print(err)
+		return exitFailure
+	}
+
+	// Only files of the same size on the same filesystem can be duplicates
+	// to replace
+	type sizeKey struct {
+		dev  uint64
+		size int64
+	}
+	bySize := make(map[sizeKey][]*dupFile)
+	for _, file := range files {
+		// Replacing one name of a hard linked file by a clone would
+		// leave its other names behind
+		if reflink && file.nlink > 1 {
+			continue
+		}
+		id, _, _ := cp.Identity(file.info)
+		key := sizeKey{id.Dev, file.info.Size()}
+		bySize[key] = append(bySize[key], file)
+	}
+	var candidates []string
+	for _, same := range bySize {
+		if len(same) > 1 {
+			for _, file := range same {
+				candidates = append(candidates, file.paths[0])
+			}
+		}
+	}
+	digests := hashFiles(candidates, jobs, func(path string) ([]byte, error) {
+		if opts.hashes != nil {
+			return opts.hashes.digest(path, nil)
+		}
+		return cp.FileDigest(path, cp.DefaultBufferSize)
+	}, func(path string, err error) {
+		log.Print(err)
+		status = exitPartial
+	})
+
+	groups := make(map[dupKey][]*dupFile)
+	var keys []dupKey
+	for _, same := range bySize {
+		for _, file := range same {
+			digest, ok := digests[file.paths[0]]
+			if !ok {
+				continue
+			}
+			id, _, _ := cp.Identity(file.info)
+			key := dupKey{dev: id.Dev, size: file.info.Size(), digest: digest}
+			if !reflink {
+				key.perm = file.info.Mode().Perm()
+				key.uid, key.gid, _ = cp.Owner(file.info)
+			}
+			if groups[key] == nil {
+				keys = append(keys, key)
+			}
+			groups[key] = append(groups[key], file)
+		}
+	}
+
+	// Keep the file with the most names, then the first by name, and
+	// replace the others of each group by it
+	var replaced int
+	var reclaimed int64
+	for _, key := range keys {
+		group := groups[key]
+		if len(group) < 2 {
+			continue
+		}
+		sort.Slice(group, func(i, j int) bool {
+			if len(group[i].paths) != len(group[j].paths) {
+				return len(group[i].paths) > len(group[j].paths)
+			}
+			return group[i].paths[0] < group[j].paths[0]
+		})
+		keep := group[0]
+		for _, dup := range group[1:] {
+			all := true
+			for _, path := range dup.paths {
+				if opts.verbose || opts.dryRun {
+					fmt.Printf("%s => %s\n", path, keep.paths[0])
+				}
+				if opts.dryRun {
+					replaced++
+					continue
+				}
+				if err := replaceDuplicate(path, dup.info, keep.paths[0], keep.info, reflink); err != nil {
+					log.Print(err)
+					status = exitPartial
+					all = false
+					continue
+				}
+				opts.hashes.copied(keep.paths[0], path)
+				replaced++
+			}
+			// The space of a hard linked file is only freed once all
+			// its names are replaced
+			if all && (reflink || uint64(len(dup.paths)) >= dup.nlink) {
+				reclaimed += dup.info.Size()
+			}
+		}
+	}
+
+	if opts.dryRun {
+		fmt.Printf("Duplicate files: %d\n", replaced)
+		fmt.Printf("Space to reclaim: %s\n", formatBytes(reclaimed))
+	} else {
+		fmt.Printf("Duplicates replaced: %d\n", replaced)
+		fmt.Printf("Space reclaimed: %s\n", formatBytes(reclaimed))
+	}
+	return status
+}
+
+// replaceDuplicate replaces the file at path, described by info as it was
+// hashed, by a hard link to keep, or a clone of it, atomically through a
+// temporary name beside it. Either file having changed since it was hashed
+// is an error.
+func replaceDuplicate(path string, info os.FileInfo, keep string, keepInfo os.FileInfo, reflink bool) error {
+	for _, f := range []struct {
+		path string
+		info os.FileInfo
+	}{{path, info}, {keep, keepInfo}} {
+		now, err := os.Lstat(f.path)
+		if err != nil {
+			return err
+		}
+		if !now.Mode().IsRegular() || now.Size() != f.info.Size() || !now.ModTime().Equal(f.info.ModTime()) {
+			return errors.New(f.path + " changed while deduplicating, not replacing " + path)
+		}
+	}
+	tmp := cp.TempPath(path)
+	os.Remove(tmp)
+	var err error
+	if reflink {
+		err = cloneDuplicate(keep, tmp, info)
+	} else {
+		err = os.Link(keep, tmp)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// cloneDuplicate clones keep to tmp, giving the clone the mode, owner and
+// times of the duplicate it replaces, described by info.
+func cloneDuplicate(keep, tmp string, info os.FileInfo) error {
+	if err := cp.Reflink(keep, tmp); err != nil {
+		return err
+	}
+	if uid, gid, ok := cp.Owner(info); ok {
+		if err := os.Lchown(tmp, uid, gid); err != nil && !(errors.Is(err, os.ErrPermission) && os.Geteuid() != 0) {
+			return err
+		}
+	}
+	if err := os.Chmod(tmp, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(tmp, info.ModTime(), info.ModTime())
+}
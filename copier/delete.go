@@ -0,0 +1,114 @@
+package copier
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// deleteListed removes dest, the destination of a path of a -files-from list
+// missing from the source, to which -delete is limited there. Kinds of file
+// the copy leaves out, backups and the manifest are protected, as from
+// deleteExtraneous. It reports whether dest was there to delete.
+func (o *options) deleteListed(dest string) (bool, error) {
+	info, err := os.Lstat(dest)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if o.typeSkipped(info.Mode()) || o.backup.protects(dest) {
+		return false, nil
+	}
+	if manifestAbs, _ := filepath.Abs(o.manifest); o.manifest != "" && dest == manifestAbs {
+		return false, nil
+	}
+	if o.dryRun {
+		fmt.Printf("Would delete %s.\n", dest)
+		return true, nil
+	}
+	slog.Debug("Deleting", "path", dest)
+	return true, os.RemoveAll(dest)
+}
+
+// deleteExtraneous removes everything below destAbs that has no counterpart
+// in the source walk, making the destination a mirror of the source. Paths
+// excluded by the filters or below -max-depth, kinds of file the walk leaves
+// out, backups, and whatever -skip-unreadable left out of the copy are
+// protected. With -dry-run the deletions are only listed. Both
+// roots must end in a separator.
+func deleteExtraneous(srcAbs, destAbs string, files, dirs []string, links []hardLink, opts *options) error {
+	keep := make(map[string]bool, len(files)+len(dirs)+len(links))
+	for _, path := range files {
+		keep[opts.renameFile(path, opts.destRel(strings.TrimPrefix(path, srcAbs)), nil)] = true
+	}
+	for _, path := range dirs {
+		keep[opts.destRel(strings.TrimSuffix(strings.TrimPrefix(path, srcAbs), string(os.PathSeparator)))] = true
+	}
+	for _, link := range links {
+		keep[opts.renameFile(link.src, opts.destRel(strings.TrimPrefix(link.src, srcAbs)), nil)] = true
+	}
+	// What we could not read is left alone, with everything below it
+	skipped := make(map[string]bool)
+	for _, rel := range opts.unreadable.below(srcAbs) {
+		skipped[opts.destRel(rel)] = true
+	}
+	manifestAbs, _ := filepath.Abs(opts.manifest)
+	root := strings.TrimSuffix(destAbs, string(os.PathSeparator))
+
+	var deleted int
+	err := filepath.WalkDir(root, opts.filter.wrap(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// A destination created by -mkdir -dry-run doesn't exist yet
+			if path == root && opts.dryRun && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		// The walk of the source went no deeper than -max-depth
+		if opts.maxDepth > 0 && pathDepth(root, path) > opts.maxDepth {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// Nor did it take what -links, -type or -special leave out
+		if opts.typeSkipped(d.Type()) {
+			return nil
+		}
+		rel := strings.TrimPrefix(path, destAbs)
+		if skipped[rel] {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if keep[rel] || path == manifestAbs || opts.backup.protects(path) {
+			return nil
+		}
+		deleted++
+		if opts.dryRun {
+			fmt.Printf("Would delete %s.\n", path)
+		} else {
+			slog.Debug("Deleting", "path", path)
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+		}
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}))
+	if !opts.dryRun {
+		slog.Info("Deleted extraneous files and directories", "count", deleted)
+	}
+	return err
+}
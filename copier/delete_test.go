@@ -0,0 +1,82 @@
+package copier
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestSyncKeepsTypesLeftOut checks that sync -type f doesn't delete the
+// symlinks of the destination, which the walk of the source never took.
+func TestSyncKeepsTypesLeftOut(t *testing.T) {
+	dir := t.TempDir()
+	src, dest := filepath.Join(dir, "src"), filepath.Join(dir, "dest")
+	for _, d := range []string{src, dest} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(src, "kept"), []byte("kept"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dest, "extra"), []byte("extra"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("kept", filepath.Join(dest, "link")); err != nil {
+		t.Skip("can't create symlinks:", err)
+	}
+
+	if status := runCopy("sync", syncDefaults, []string{"-quiet", "-type", "f", src + "/", dest}); status != 0 {
+		t.Fatalf("sync exited with status %d", status)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "kept")); err != nil {
+		t.Errorf("the source file wasn't copied: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "link")); err != nil {
+		t.Errorf("the symlink left out by -type f was deleted: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "extra")); !os.IsNotExist(err) {
+		t.Errorf("the extraneous file wasn't deleted: %v", err)
+	}
+}
+
+// TestFilesFromDelete checks that sync -files-from deletes the listed paths
+// missing from the source, and nothing it wasn't given.
+func TestFilesFromDelete(t *testing.T) {
+	dir := t.TempDir()
+	src, dest := filepath.Join(dir, "src"), filepath.Join(dir, "dest")
+	for _, d := range []string{src, filepath.Join(dest, "gone-dir")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for path, data := range map[string]string{
+		filepath.Join(src, "kept"):  "newer",
+		filepath.Join(dest, "kept"): "old",
+		filepath.Join(dest, "gone"): "gone",
+		filepath.Join(dest, "left"): "left",
+	} {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := filepath.Join(dir, "list")
+	if err := os.WriteFile(list, []byte("kept\ngone\ngone-dir\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := runCopy("sync", syncDefaults, []string{"-quiet", "-files-from", list, src, dest}); status != 0 {
+		t.Fatalf("sync exited with status %d", status)
+	}
+	if data, err := os.ReadFile(filepath.Join(dest, "kept")); err != nil || string(data) != "newer" {
+		t.Errorf("the listed file wasn't copied: %q, %v", data, err)
+	}
+	for _, name := range []string{"gone", "gone-dir"} {
+		if _, err := os.Lstat(filepath.Join(dest, name)); !os.IsNotExist(err) {
+			t.Errorf("%s, listed but missing from the source, wasn't deleted: %v", name, err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "left")); err != nil {
+		t.Errorf("the file left out of the list was deleted: %v", err)
+	}
+}
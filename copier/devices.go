@@ -0,0 +1,101 @@
+package copier
+
+import (
+	"cpj/cp"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// deviceLimits caps the number of copies in flight that read from or write to
+// each device, so several sources copied to one disk don't oversubscribe it.
+// Devices are told apart by the device numbers of the directories involved.
+type deviceLimits struct {
+	// limit is the cap for every device. 0 picks one from the kind of each
+	// device: rotationalJobs for spinning disks, and none otherwise.
+	limit int
+
+	mu   sync.Mutex
+	devs map[string]uint64
+	// slots holds a semaphore for each limited device, and nil for the others.
+	slots map[uint64]chan struct{}
+}
+
+func newDeviceLimits(limit int) *deviceLimits {
+	return &deviceLimits{limit: limit, devs: make(map[string]uint64), slots: make(map[uint64]chan struct{})}
+}
+
+// acquire waits for a free slot on the devices of src and dest, and returns
+// the function that gives them back. Slots are always taken in device order
+// so that two copies can't each hold the slot the other waits for.
+func (d *deviceLimits) acquire(src, dest string) (release func()) {
+	var held []chan struct{}
+	for _, slot := range d.slotsFor(src, dest) {
+		slot <- struct{}{}
+		held = append(held, slot)
+	}
+	return func() {
+		for i := len(held) - 1; i >= 0; i-- {
+			<-held[i]
+		}
+	}
+}
+
+// slotsFor returns the semaphores of the limited devices holding src and
+// dest, in device order and without duplicates.
+func (d *deviceLimits) slotsFor(paths ...string) []chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var devs []uint64
+	for _, path := range paths {
+		dev, ok := d.device(filepath.Dir(path))
+		if !ok {
+			continue
+		}
+		if !slices.Contains(devs, dev) {
+			devs = append(devs, dev)
+		}
+	}
+	slices.Sort(devs)
+	var slots []chan struct{}
+	for _, dev := range devs {
+		if slot := d.slots[dev]; slot != nil {
+			slots = append(slots, slot)
+		}
+	}
+	return slots
+}
+
+// device returns the device number of dir, or of its closest existing
+// ancestor, and sets up the device's semaphore when it is first seen. It
+// must be called with mu held.
+func (d *deviceLimits) device(dir string) (uint64, bool) {
+	if dev, ok := d.devs[dir]; ok {
+		return dev, true
+	}
+	existing := existingParent(dir)
+	info, err := os.Stat(existing)
+	if err != nil {
+		return 0, false
+	}
+	id, _, ok := cp.Identity(info)
+	if !ok {
+		return 0, false
+	}
+	d.devs[dir] = id.Dev
+	if _, seen := d.slots[id.Dev]; !seen {
+		limit := d.limit
+		if limit == 0 && probeStorage(existing) == storageRotational {
+			limit = rotationalJobs
+		}
+		var slot chan struct{}
+		if limit > 0 {
+			slot = make(chan struct{}, limit)
+			slog.Debug("Limiting copies on a device", "limit", limit, "path", existing)
+		}
+		d.slots[id.Dev] = slot
+	}
+	return id.Dev, true
+}
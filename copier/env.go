@@ -0,0 +1,52 @@
+package copier
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// envPrefix starts the name of the environment variable that sets each flag,
+// so CPJ_BUFFER_SIZE sets -buffer-size.
+const envPrefix = "CPJ_"
+
+// noEnv are the flags not read from the environment. -t and -T would both be
+// CPJ_T, and name operands rather than tune the copy anyway.
+var noEnv = map[string]bool{"t": true, "T": true}
+
+// envName returns the environment variable for the flag called name.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnv sets the flags of flags from their environment variables. It must
+// run before the command line is parsed so that flags given there win.
+// Repeatable flags such as -exclude take a list separated like PATH, which
+// the command line adds to.
+func applyEnv(flags *flag.FlagSet) error {
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if err != nil || noEnv[f.Name] {
+			return
+		}
+		name := envName(f.Name)
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		values := []string{val}
+		switch f.Value.(type) {
+		case *stringList, *regexpList, *renameRules:
+			values = filepath.SplitList(val)
+		}
+		for _, v := range values {
+			if serr := flags.Set(f.Name, v); serr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %w", v, name, serr)
+				return
+			}
+		}
+	})
+	return err
+}
@@ -0,0 +1,150 @@
+package copier
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// eventLog writes the newline delimited JSON events of -json, one object per
+// line, for programs driving cpj, and calls the Callbacks of a Copier. A nil
+// *eventLog does nothing, so callers don't need to check for either.
+type eventLog struct {
+	mu    sync.Mutex
+	enc   *json.Encoder
+	start time.Time
+	// The totals for the summary, across every source.
+	files, skips, failures int
+	bytes                  int64
+	// hooks are called with mu held, so one at a time.
+	hooks Callbacks
+}
+
+// event is one line of -json output. Event is scan, queued, copied, skipped
+// or failed. Fields that don't apply to it are left out.
+type event struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Src   string    `json:"src,omitempty"`
+	Dest  string    `json:"dest,omitempty"`
+	Bytes int64     `json:"bytes,omitempty"`
+	// Reason says why a file was skipped: existing or unreadable.
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// summary is the last line of -json output.
+type summary struct {
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	Copied  int       `json:"copied"`
+	Bytes   int64     `json:"bytes"`
+	Skipped int       `json:"skipped"`
+	Failed  int       `json:"failed"`
+	Seconds float64   `json:"seconds"`
+	Status  int       `json:"status"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func newEventLog(w io.Writer) *eventLog {
+	return &eventLog{enc: json.NewEncoder(w), start: time.Now()}
+}
+
+func (l *eventLog) emit(e event) {
+	e.Time = time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.enc.Encode(e)
+}
+
+// scan reports that the walk of src, to be copied to dest, has started.
+func (l *eventLog) scan(src, dest string) {
+	if l != nil {
+		l.emit(event{Event: "scan", Src: src, Dest: dest})
+	}
+}
+
+// started reports that a worker has taken f up, for OnFileStart. It has no
+// event of its own.
+func (l *eventLog) started(f fileEntry) {
+	if l == nil || l.hooks.OnFileStart == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hooks.OnFileStart(FileEvent{Src: f.src, Dest: f.dest, Size: f.size})
+}
+
+// progress calls OnProgress with the totals so far. It must be called with
+// mu held.
+func (l *eventLog) progress() {
+	if l.hooks.OnProgress != nil {
+		l.hooks.OnProgress(Progress{Copied: l.files, Bytes: l.bytes, Skipped: l.skips, Failed: l.failures, Elapsed: time.Since(l.start)})
+	}
+}
+
+// queued reports that f has been handed to the workers.
+func (l *eventLog) queued(f fileEntry) {
+	if l != nil {
+		l.emit(event{Event: "queued", Src: f.src, Dest: f.dest, Bytes: f.size})
+	}
+}
+
+func (l *eventLog) copied(f fileEntry) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.files++
+	l.bytes += f.size
+	if l.hooks.OnFileDone != nil {
+		l.hooks.OnFileDone(FileEvent{Src: f.src, Dest: f.dest, Size: f.size})
+	}
+	l.progress()
+	l.mu.Unlock()
+	l.emit(event{Event: "copied", Src: f.src, Dest: f.dest, Bytes: f.size})
+}
+
+func (l *eventLog) skipped(src, dest, reason string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.skips++
+	if l.hooks.OnFileDone != nil {
+		l.hooks.OnFileDone(FileEvent{Src: src, Dest: dest, Skipped: reason})
+	}
+	l.progress()
+	l.mu.Unlock()
+	l.emit(event{Event: "skipped", Src: src, Dest: dest, Reason: reason})
+}
+
+func (l *eventLog) fail(e copyError) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.failures++
+	if l.hooks.OnError != nil {
+		l.hooks.OnError(FileEvent{Src: e.src, Dest: e.dest}, e.err)
+	}
+	l.progress()
+	l.mu.Unlock()
+	l.emit(event{Event: "failed", Src: e.src, Dest: e.dest, Error: e.err.Error()})
+}
+
+// finish writes the summary of the run, which ended with err.
+func (l *eventLog) finish(err error) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := summary{Event: "summary", Time: time.Now(), Copied: l.files, Bytes: l.bytes, Skipped: l.skips, Failed: l.failures,
+		Seconds: time.Since(l.start).Seconds(), Status: exitStatus(err)}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	l.enc.Encode(s)
+}
@@ -0,0 +1,112 @@
+package copier
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+)
+
+// Exit statuses of copy and sync, so that scripts can tell failures apart
+// without parsing the log. Anything not listed exits with exitFailure.
+const (
+	exitFailure = 1
+	// exitUsage is for bad flags and operands, as the flag package uses.
+	exitUsage = 2
+	// exitNotDirectory is for an operand that must be a directory but isn't.
+	exitNotDirectory = 3
+	// exitDestMissing is for a destination directory that doesn't exist
+	// without -mkdir.
+	exitDestMissing = 4
+	// exitPartial is for a copy that ran but left some files behind, as
+	// with -continue or parts of the source that could not be read.
+	exitPartial = 5
+	// exitVerifyMismatch is for a copy whose files differ from their
+	// source once read back.
+	exitVerifyMismatch = 6
+	// exitInterrupted is for a copy stopped by SIGINT or SIGTERM, as a
+	// shell reports a process killed by SIGINT.
+	exitInterrupted = 130
+)
+
+// The kinds of error a copy ends with, which decide the exit status of cpj
+// and which callers of Copier.Run can tell apart with errors.Is. Their own
+// messages are never shown: see kindError.
+var (
+	// ErrUsage is for flags, operands or Options that can't be used
+	// together.
+	ErrUsage = errors.New("usage")
+	// ErrNotDirectory is for an operand that must be a directory but
+	// isn't.
+	ErrNotDirectory = errors.New("not a directory")
+	// ErrDestMissing is for a destination directory that doesn't exist
+	// without -mkdir.
+	ErrDestMissing = errors.New("destination missing")
+	// ErrPartial is for a copy that ran but left some files behind.
+	ErrPartial = errors.New("partial copy")
+	// ErrVerifyMismatch is for a copy that ran but whose files, read
+	// back, differ from their source.
+	ErrVerifyMismatch = errors.New("verify mismatch")
+)
+
+// kindError marks err as being of kind, one of the errors above, without
+// changing its message.
+type kindError struct {
+	kind, err error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Unwrap() []error {
+	return []error{e.kind, e.err}
+}
+
+// errorOf returns an error of kind with the message of fmt.Errorf.
+func errorOf(kind error, format string, args ...any) error {
+	return &kindError{kind, fmt.Errorf(format, args...)}
+}
+
+// exitStatus returns the exit status for the error a copy ended with.
+func exitStatus(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, errInterrupted):
+		return exitInterrupted
+	case errors.Is(err, ErrVerifyMismatch):
+		return exitVerifyMismatch
+	case errors.Is(err, ErrPartial):
+		return exitPartial
+	case errors.Is(err, ErrUsage):
+		return exitUsage
+	case errors.Is(err, ErrNotDirectory):
+		return exitNotDirectory
+	case errors.Is(err, ErrDestMissing):
+		return exitDestMissing
+	}
+	return exitFailure
+}
+
+// usageError logs an error about bad flags or operands and returns
+// exitUsage.
+func usageError(v ...any) int {
+	slog.Error(fmt.Sprint(v...))
+	return exitUsage
+}
+
+// usageErrorf is usageError with a format.
+func usageErrorf(format string, v ...any) int {
+	slog.Error(fmt.Sprintf(format, v...))
+	return exitUsage
+}
+
+// parseStatus returns the exit status after flags failed to parse with err,
+// having printed why: 0 for -h, which asked for the usage, or exitUsage.
+func parseStatus(err error) int {
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	return exitUsage
+}
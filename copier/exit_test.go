@@ -0,0 +1,53 @@
+package copier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExitStatus(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want int
+	}{
+		{nil, 0},
+		{errors.New("other"), exitFailure},
+		{errorOf(ErrUsage, "bad flag"), exitUsage},
+		{errorOf(ErrNotDirectory, "not a directory"), exitNotDirectory},
+		{errorOf(ErrDestMissing, "missing"), exitDestMissing},
+		{fmt.Errorf("wrapped: %w", errorOf(ErrPartial, "some files")), exitPartial},
+		{errorOf(ErrVerifyMismatch, "differs"), exitVerifyMismatch},
+		{errInterrupted, exitInterrupted},
+	} {
+		if got := exitStatus(tc.err); got != tc.want {
+			t.Errorf("exitStatus(%v) = %d, want %d", tc.err, got, tc.want)
+		}
+	}
+}
+
+// TestVerifyMismatch checks that Verify ends with ErrVerifyMismatch, and not
+// ErrPartial, when a copy changes before it is read back.
+func TestVerifyMismatch(t *testing.T) {
+	dir := t.TempDir()
+	src, dest := filepath.Join(dir, "src"), filepath.Join(dir, "dest")
+	if err := os.WriteFile(src, []byte("source"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &Copier{Src: src, Dest: dest, Options: Options{Verify: true}}
+	c.Callbacks.OnFileDone = func(f FileEvent) {
+		if err := os.WriteFile(f.Dest, []byte("changed"), 0644); err != nil {
+			t.Error(err)
+		}
+	}
+	report, err := c.Run(context.Background())
+	if !errors.Is(err, ErrVerifyMismatch) || errors.Is(err, ErrPartial) {
+		t.Fatalf("Run returned %v, want an ErrVerifyMismatch", err)
+	}
+	if report.Failed != 1 {
+		t.Errorf("Run reported %d failed files, want 1", report.Failed)
+	}
+}
@@ -0,0 +1,457 @@
+package copier
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"cpj/cp"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// extractEntry is an entry of the archive being extracted, and where it
+// goes.
+type extractEntry struct {
+	// name is the path of the entry in the archive, cleaned and slash
+	// separated, and src the archive path joined with it, naming it in
+	// messages.
+	name, src string
+	dest      string
+	info      os.FileInfo
+	// link is the target of a symlink, or with hard set the name of the
+	// entry a hard link links to.
+	link string
+	hard bool
+}
+
+// extractJob is a regular file of the archive for a worker to write. open is
+// the cp.Options.Open of its contents; for a tar archive they are read into t
+// by the reader of the archive.
+type extractJob struct {
+	extractEntry
+	open func(string) (io.ReadCloser, error)
+	t    *transfer
+}
+
+// extractor extracts an archive below destAbs. The reader of the archive
+// hands its regular files to -jobs workers and keeps the rest, which are
+// created once the files are.
+type extractor struct {
+	workerPool
+	archive, destAbs string
+	m                *manifest
+	buffers          *sync.Pool
+	work             chan extractJob
+	wg               sync.WaitGroup
+	waited           sync.Once
+	// links and dirs hold the links and directories read, for finish.
+	links, dirs []extractEntry
+}
+
+// extractArchive extracts the tar or zip archive srcAbs, the source of
+// -extract, into the directory destAbs. Its entries are filtered as a walk of
+// a tree would be, and its files extracted by -jobs workers with the
+// overwrite policy of a copy. A tar archive is read once, in order, handing
+// each file's data to the worker writing it.
+func extractArchive(srcAbs, dest, destAbs string, opts *options) (err error) {
+	if err := rejectFlags("with -extract", []setFlag{
+		{opts.delete, "-delete"}, {opts.move, "-move"}, {opts.staged, "-staged"}, {opts.checkpoint != "", "-checkpoint"},
+		{len(opts.linkDest.dirs) > 0, "-link-dest"}, {opts.delta, "-delta"}, {opts.dedup, "-dedup"},
+		{opts.checksum, "-checksum"}, {opts.filter.dirFilter != "", "-dir-filter"},
+		{opts.compress.format != "", "-compress"}, {opts.compress.decompress, "-decompress"},
+		{opts.crypt.encrypt, "-encrypt"}, {opts.crypt.decrypt, "-decrypt"},
+	}); err != nil {
+		return err
+	}
+	if err := ensureDestDir(dest, destAbs, opts); err != nil {
+		return err
+	}
+	opts.backup.root = destAbs
+	opts.events.scan(srcAbs, destAbs)
+
+	ex := &extractor{workerPool: workerPool{opts: opts}, archive: srcAbs, destAbs: destAbs, work: make(chan extractJob)}
+	ex.buffers = &sync.Pool{New: func() any {
+		buf := make([]byte, opts.bufferSize)
+		return &buf
+	}}
+	if opts.manifest != "" && !opts.dryRun {
+		if ex.m, err = createManifest(opts.manifest, destAbs); err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := ex.m.close(); err == nil {
+				err = cerr
+			}
+		}()
+	}
+	for i := 0; i < max(int(opts.jobs), 1); i++ {
+		ex.wg.Add(1)
+		go ex.worker()
+	}
+	if opts.signals {
+		defer handleInterrupts(ex.interrupt, opts)()
+	}
+	if strings.EqualFold(filepath.Ext(srcAbs), ".zip") {
+		err = ex.readZip()
+	} else {
+		err = ex.readTar()
+	}
+	ex.wait()
+	if err == nil {
+		err = ex.err
+	}
+	if err == nil {
+		err = ex.finish()
+	}
+	if err != nil {
+		return err
+	}
+	slog.Info("Extracted", "archive", srcAbs, "files", ex.files, "bytes", ex.bytes)
+	if len(ex.failed) > 0 {
+		return errorOf(ErrPartial, "%d entries could not be extracted, first error: %w", len(ex.failed), ex.failed[0])
+	}
+	return nil
+}
+
+// readZip goes through the entries of the zip archive, handing its files to
+// the workers, which open their contents themselves, as a zip archive can be read anywhere at once.
+func (ex *extractor) readZip() error {
+	r, err := zip.OpenReader(ex.archive)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	// The workers read from r, so they must be done before it is closed
+	defer ex.wait()
+	for _, f := range r.File {
+		if ex.stopping() {
+			break
+		}
+		info := f.FileInfo()
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = readZipLink(f); err != nil {
+				ex.fail(extractEntry{name: f.Name, src: ex.archive + "/" + f.Name}, err)
+				continue
+			}
+		}
+		e, ok := ex.entry(f.Name, info, link, false)
+		if !ok || !info.Mode().IsRegular() {
+			continue
+		}
+		ex.queue(extractJob{extractEntry: e, open: func(string) (io.ReadCloser, error) { return f.Open() }})
+	}
+	return nil
+}
+
+// readZipLink returns the target of the symlink f, stored as its contents.
+func readZipLink(f *zip.File) (string, error) {
+	r, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	target, err := io.ReadAll(io.LimitReader(r, 4096))
+	return string(target), err
+}
+
+// readTar goes through the entries of the tar archive, decompressed as its
+// extension says, handing its files to the workers. It reads the contents of each file into a transfer
+// for the worker writing it, so the archive is only read once.
+func (ex *extractor) readTar() error {
+	f, err := os.Open(ex.archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = bufio.NewReaderSize(f, int(ex.opts.bufferSize))
+	if format, ok := decompressors[strings.ToLower(filepath.Ext(ex.archive))]; ok {
+		dr, err := format.reader(r)
+		if err != nil {
+			return fmt.Errorf("%s: %w", ex.archive, err)
+		}
+		defer dr.Close()
+		r = dr
+	}
+	tr := tar.NewReader(r)
+	for !ex.stopping() {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", ex.archive, err)
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		hard := hdr.Typeflag == tar.TypeLink
+		e, ok := ex.entry(hdr.Name, hdr.FileInfo(), hdr.Linkname, hard)
+		if !ok || hard || !e.info.Mode().IsRegular() {
+			continue
+		}
+		t := &transfer{fileEntry: fileEntry{src: e.src, dest: e.dest, size: hdr.Size, info: e.info},
+			chunks: make(chan chunk, pipeChunks), buffers: ex.buffers, done: make(chan struct{})}
+		ex.queue(extractJob{extractEntry: e, open: t.open, t: t})
+		t.fillFrom(tr)
+	}
+	return nil
+}
+
+// entry works out where the entry name of the archive goes, and whether it
+// is extracted at all. Directories are created, and links kept for finish,
+// right away; regular files are left to the caller.
+func (ex *extractor) entry(name string, info os.FileInfo, link string, hard bool) (extractEntry, bool) {
+	opts := ex.opts
+	e := extractEntry{name: path.Clean(name), info: info, link: link, hard: hard}
+	e.src = ex.archive + "/" + e.name
+	rel := filepath.FromSlash(e.name)
+	if !filepath.IsLocal(rel) {
+		ex.fail(e, fmt.Errorf("%s: entry name %q is outside the destination", ex.archive, name))
+		return e, false
+	}
+	if hard {
+		target := filepath.FromSlash(path.Clean(link))
+		if !filepath.IsLocal(target) {
+			ex.fail(e, fmt.Errorf("%s: hard link target %q is outside the destination", e.src, link))
+			return e, false
+		}
+		e.link = filepath.Join(ex.destAbs, opts.destRel(target))
+	}
+	mode := info.Mode()
+	if hard {
+		mode = 0
+	}
+	if !entrySelected(rel, mode, info, opts) {
+		return e, false
+	}
+	e.dest = filepath.Join(ex.destAbs, opts.destRel(rel))
+	switch {
+	case mode.IsDir():
+		if opts.dryRun {
+			return e, true
+		}
+		if err := os.MkdirAll(e.dest, 0755); err != nil {
+			ex.fail(e, err)
+			return e, false
+		}
+		ex.dirs = append(ex.dirs, e)
+	case hard || mode&os.ModeSymlink != 0:
+		if opts.dryRun {
+			fmt.Printf("Would link %s to %s.\n", e.dest, link)
+			return e, true
+		}
+		ex.links = append(ex.links, e)
+	case cp.IsSpecial(mode):
+		if opts.special == specialFail {
+			ex.fail(e, fmt.Errorf("special file %s (%q)", e.src, mode.String()))
+		} else {
+			slog.Warn("Skipping special file", "path", e.src, "mode", mode.String())
+		}
+		return e, false
+	case opts.dryRun:
+		fmt.Printf("Would extract %s to %s.\n", e.src, e.dest)
+		return e, false
+	}
+	return e, true
+}
+
+// entrySelected reports whether the archive entry or object at rel, of the
+// given mode and described by info, passes the walk flags, as the same path
+// below a source directory would. Paths are excluded with any of their
+// parents, as the walk would not descend into those, the Filter of a Copier
+// seeing them as directories known only by name. -dir-filter, which reads
+// the source tree, doesn't apply.
+func entrySelected(rel string, mode os.FileMode, info os.FileInfo, opts *options) bool {
+	parts := strings.Split(rel, string(filepath.Separator))
+	if opts.maxDepth > 0 && len(parts) > opts.maxDepth {
+		return false
+	}
+	f := &opts.filter
+	for i := range parts {
+		dir := filepath.Join(parts[:i+1]...)
+		isDir := i < len(parts)-1 || mode.IsDir()
+		if f.excluded(dir) || f.ignored("", dir, isDir) {
+			return false
+		}
+		if i < len(parts)-1 && f.decide(dir, prefixInfo(parts[i])) == Prune {
+			return false
+		}
+	}
+	switch f.decide(rel, info) {
+	case Prune:
+		return false
+	case Exclude:
+		if !mode.IsDir() {
+			return false
+		}
+	}
+	if mode.IsDir() {
+		return true
+	}
+	if opts.dirsOnly || !f.included(rel) || !opts.types.selects(mode) {
+		return false
+	}
+	if mode&os.ModeSymlink != 0 && opts.links == linksSkip {
+		return false
+	}
+	return !mode.IsRegular() || !f.limited() || f.selects(info)
+}
+
+// queue hands job to a worker.
+func (ex *extractor) queue(job extractJob) {
+	ex.work <- job
+}
+
+// wait closes work and waits for the workers to finish.
+func (ex *extractor) wait() {
+	ex.waited.Do(func() {
+		close(ex.work)
+		ex.wg.Wait()
+	})
+}
+
+// worker extracts the files handed to it until work is closed. Once the
+// extraction has stopped it only lets go of them.
+func (ex *extractor) worker() {
+	defer ex.wg.Done()
+	for job := range ex.work {
+		if ex.stopping() {
+			if job.t != nil {
+				job.t.close()
+			}
+			continue
+		}
+		ex.extract(job)
+	}
+}
+
+// extract writes the regular file of job to its destination.
+func (ex *extractor) extract(job extractJob) {
+	if job.t != nil {
+		defer job.t.close()
+	}
+	copyOpts := ex.opts.copyOptions()
+	copyOpts.Hardlink, copyOpts.Reflink, copyOpts.SplitSize = false, cp.ReflinkNever, 0
+	copyOpts.SrcInfo = job.info
+	copyOpts.Open = job.open
+	var h hash.Hash
+	if ex.m != nil {
+		h = sha256.New()
+	}
+	ex.opts.events.started(fileEntry{src: job.src, dest: job.dest, size: job.info.Size()})
+	var res cp.Result
+	err := ex.opts.beforeFile(job.src, job.dest)
+	if err == nil {
+		res, err = cp.CopyFileDigest(job.src, job.dest, copyOpts, h)
+	}
+	if err == nil && !res.Skipped {
+		err = ex.opts.afterFile(job.src, job.dest)
+	}
+	if err != nil {
+		ex.fail(job.extractEntry, err)
+		return
+	}
+	if res.Skipped {
+		ex.opts.events.skipped(job.src, job.dest, "existing")
+		return
+	}
+	if res.Hashed {
+		ex.m.add(job.dest, h.Sum(nil))
+	}
+	slog.Debug("Extracted", "name", job.name, "dest", job.dest, "bytes", job.info.Size())
+	ex.opts.events.copied(fileEntry{src: job.src, dest: job.dest, size: job.info.Size()})
+	ex.count(job.info.Size())
+}
+
+// fail records the failure of e, stopping the extraction unless -continue
+// is set.
+func (ex *extractor) fail(e extractEntry, err error) {
+	ex.workerPool.fail(copyError{src: e.src, dest: e.dest, err: err}, "Could not extract entry")
+}
+
+// finish creates the links once the files they may point to are there, hard
+// links first so none is made to a symlink's target, then gives the
+// directories their modes and times, the deepest first.
+func (ex *extractor) finish() error {
+	for _, e := range ex.links {
+		if e.hard {
+			ex.link(e)
+		}
+	}
+	for _, e := range ex.links {
+		if !e.hard {
+			ex.link(e)
+		}
+	}
+	if ex.err != nil {
+		return ex.err
+	}
+	for i := len(ex.dirs) - 1; i >= 0; i-- {
+		e := ex.dirs[i]
+		if ex.opts.preservePerms {
+			if err := os.Chmod(e.dest, e.info.Mode().Perm()); err != nil {
+				ex.fail(e, err)
+			}
+		}
+		if ex.opts.preserveTimes {
+			if err := os.Chtimes(e.dest, time.Time{}, e.info.ModTime()); err != nil {
+				ex.fail(e, err)
+			}
+		}
+	}
+	return ex.err
+}
+
+// link creates the symlink or hard link of e. An existing destination is
+// kept if it is the same link already, or with -no-clobber, and replaced
+// otherwise unless it is a directory.
+func (ex *extractor) link(e extractEntry) {
+	if ex.stopping() {
+		return
+	}
+	if dfi, err := os.Lstat(e.dest); err == nil {
+		same := false
+		if e.hard {
+			tfi, err := os.Lstat(e.link)
+			same = err == nil && os.SameFile(tfi, dfi)
+		} else if target, err := os.Readlink(e.dest); err == nil {
+			same = target == e.link
+		}
+		if same || ex.opts.noClobber {
+			ex.opts.events.skipped(e.src, e.dest, "existing")
+			return
+		}
+		if dfi.IsDir() {
+			ex.fail(e, fmt.Errorf("cannot overwrite directory %s with a link", e.dest))
+			return
+		}
+		if err := os.Remove(e.dest); err != nil {
+			ex.fail(e, err)
+			return
+		}
+	} else if err := os.MkdirAll(filepath.Dir(e.dest), 0755); err != nil {
+		ex.fail(e, err)
+		return
+	}
+	var err error
+	if e.hard {
+		err = os.Link(e.link, e.dest)
+	} else {
+		err = os.Symlink(e.link, e.dest)
+	}
+	if err != nil {
+		ex.fail(e, err)
+		return
+	}
+	slog.Debug("Linked", "name", e.name, "dest", e.dest, "target", e.link)
+}
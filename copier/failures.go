@@ -0,0 +1,95 @@
+package copier
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+)
+
+// failure is one line of the -failures file: a JSON object naming a copy that
+// failed and why. The file is read back by -from-failures.
+type failure struct {
+	Src   string `json:"src"`
+	Dest  string `json:"dest"`
+	Error string `json:"error"`
+}
+
+// writeFailures replaces path with the list of failed copies, or adds to it if
+// appending. An empty file means everything was copied.
+func writeFailures(path string, errs []copyError, appending bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appending {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	file, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+	for _, e := range errs {
+		if err := enc.Encode(failure{Src: e.src, Dest: e.dest, Error: e.err.Error()}); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func readFailures(path string) ([]failure, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var failures []failure
+	dec := json.NewDecoder(file)
+	for dec.More() {
+		var f failure
+		if err := dec.Decode(&f); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		failures = append(failures, f)
+	}
+	return failures, nil
+}
+
+// copyFailures retries exactly the copies listed in a -failures file written
+// by an earlier run. Missing destination directories are created as needed.
+func copyFailures(path string, opts *options) error {
+	failures, err := readFailures(path)
+	if err != nil {
+		return err
+	}
+	files := make([]fileEntry, len(failures))
+	var totalBytes int64
+	for i, f := range failures {
+		files[i] = fileEntry{src: f.Src, dest: f.Dest}
+		if info, err := os.Stat(f.Src); err == nil {
+			files[i].size = info.Size()
+			totalBytes += info.Size()
+		}
+	}
+	if opts.sort {
+		slices.SortStableFunc(files, func(a, b fileEntry) int {
+			return strings.Compare(a.src, b.src)
+		})
+	}
+	slog.Info("To be retried", "files", len(failures))
+	if opts.dryRun {
+		for _, f := range files {
+			fmt.Printf("Would copy %s to %s.\n", f.src, f.dest)
+		}
+		return nil
+	}
+	errs, err := jobDispatcher(files, totalBytes, nil, nil, opts)
+	return dispatchErrors(errs, err, opts)
+}
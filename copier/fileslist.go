@@ -0,0 +1,222 @@
+package copier
+
+import (
+	"bufio"
+	"bytes"
+	"cpj/cp"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fileList streams the entries of a -files-from list to the copy workers, so
+// copying starts before the whole list has been read. Entries are paths
+// relative to the source root. Listed directories are created at the
+// destination but not recursed into, as with rsync --files-from. With
+// -delete, listed paths missing from the source are deleted from the
+// destination, and nothing else is.
+type fileList struct {
+	r               io.ReadCloser
+	scanner         *bufio.Scanner
+	srcAbs, destAbs string
+	filter          *pathFilter
+	types           fileTypes
+	destRel         func(rel string) string
+	renameFile      func(src, dest string, info os.FileInfo) string
+	dryRun          bool
+	// deleteListed is options.deleteListed with -delete, or else nil.
+	deleteListed func(dest string) (bool, error)
+	// handed is the number of files handed out so far, and deleted the
+	// number of paths deleted.
+	handed, deleted int
+}
+
+func openFileList(path string, nul bool, srcAbs, destAbs string, opts *options) (*fileList, error) {
+	var r io.ReadCloser = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		r = file
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	if nul {
+		scanner.Split(scanNul)
+	}
+	l := &fileList{r: r, scanner: scanner, srcAbs: srcAbs, destAbs: destAbs,
+		filter: &opts.filter, types: opts.types, destRel: opts.destRel, renameFile: opts.renameFile, dryRun: opts.dryRun}
+	if opts.delete {
+		l.deleteListed = opts.deleteListed
+	}
+	return l, nil
+}
+
+// scanNul is a bufio.SplitFunc for NUL terminated entries, as written by
+// find -print0.
+func scanNul(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// next returns the next file to copy. Bad entries are reported and skipped.
+// It is not safe for concurrent use.
+func (l *fileList) next() (fileEntry, bool) {
+	for l.scanner.Scan() {
+		entry := strings.TrimSuffix(l.scanner.Text(), "\r")
+		if entry == "" {
+			continue
+		}
+		rel, err := l.relative(entry)
+		if err != nil {
+			slog.Warn(err.Error())
+			continue
+		}
+		src := filepath.Join(l.srcAbs, rel)
+		dest := filepath.Join(l.destAbs, l.destRel(rel))
+		info, err := os.Lstat(src)
+		if os.IsNotExist(err) && l.deleteListed != nil && !l.filter.excluded(rel) {
+			l.deleteMissing(src, dest)
+			continue
+		}
+		if err != nil {
+			slog.Warn(err.Error())
+			continue
+		}
+		if l.filter.excluded(rel) || l.filter.ignored(l.srcAbs, rel, info.IsDir()) {
+			continue
+		}
+		decision := l.filter.decide(rel, info)
+		if decision == Prune {
+			continue
+		}
+		if info.IsDir() {
+			if !l.types.selects(info.Mode()) {
+				continue
+			}
+			if l.dryRun {
+				fmt.Printf("Would create directory %s.\n", dest)
+			} else {
+				slog.Debug("Creating directory", "dir", dest)
+				if err := os.MkdirAll(dest, 0755); err != nil {
+					slog.Warn(err.Error())
+				}
+			}
+			continue
+		}
+		if !l.filter.included(rel) || !l.filter.selects(info) || !l.types.selects(info.Mode()) || decision == Exclude {
+			continue
+		}
+		l.handed++
+		return fileEntry{src: src, dest: l.renameFile(src, dest, info), size: info.Size(), info: info}, true
+	}
+	if err := l.scanner.Err(); err != nil {
+		slog.Warn("Could not read the whole file list", "error", err)
+	}
+	return fileEntry{}, false
+}
+
+// deleteMissing deletes dest, the destination of the listed path src that is
+// missing from the source, under its own name or the one renameFile gives a
+// file.
+func (l *fileList) deleteMissing(src, dest string) {
+	deleted, err := l.deleteListed(dest)
+	if renamed := l.renameFile(src, dest, nil); !deleted && err == nil && renamed != dest {
+		deleted, err = l.deleteListed(renamed)
+	}
+	if err != nil {
+		slog.Warn(err.Error())
+	}
+	if deleted {
+		l.deleted++
+	}
+}
+
+// relative turns a list entry into a path below the source root. Absolute
+// entries must lie inside it.
+func (l *fileList) relative(entry string) (string, error) {
+	rel := entry
+	if filepath.IsAbs(entry) {
+		var err error
+		if rel, err = filepath.Rel(l.srcAbs, entry); err != nil {
+			return "", err
+		}
+	}
+	rel = filepath.Clean(rel)
+	if rel == "." || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("file list entry %q is not below %s", entry, l.srcAbs)
+	}
+	return rel, nil
+}
+
+func (l *fileList) count() int {
+	return l.handed
+}
+
+func (l *fileList) close() error {
+	if l.r == os.Stdin {
+		return nil
+	}
+	return l.r.Close()
+}
+
+// copyFileList copies the files named by the -files-from list from below src
+// to the same paths below dest, without walking src.
+func copyFileList(src, dest string, opts *options) (err error) {
+	srcAbs, err := cp.AbsolutePath(src)
+	if err != nil {
+		return err
+	}
+	destAbs, err := cp.AbsolutePath(dest)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(srcAbs); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return errorOf(ErrNotDirectory, "-files-from needs a source directory")
+	}
+	list, err := openFileList(opts.filesFrom, opts.from0, srcAbs, destAbs, opts)
+	if err != nil {
+		return err
+	}
+	defer list.close()
+	opts.events.scan(srcAbs, destAbs)
+	opts.backup.root = destAbs
+	opts.linkDest.start(destAbs, opts.preservePerms)
+	if opts.dryRun {
+		for {
+			f, ok := list.next()
+			if !ok {
+				return nil
+			}
+			fmt.Printf("Would copy %s to %s.\n", f.src, f.dest)
+		}
+	}
+	var m *manifest
+	if opts.manifest != "" {
+		if m, err = createManifest(opts.manifest, destAbs); err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := m.close(); err == nil {
+				err = cerr
+			}
+		}()
+	}
+	errs, err := jobDispatcher(nil, 0, list, m, opts)
+	slog.Info("Listed", "files", list.count())
+	if opts.delete {
+		slog.Info("Deleted listed files and directories missing from the source", "count", list.deleted)
+	}
+	return dispatchErrors(errs, err, opts)
+}
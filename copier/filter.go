@@ -0,0 +1,266 @@
+package copier
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// stringList is a flag.Value collecting every occurrence of a repeatable flag.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(val string) error {
+	*s = append(*s, val)
+	return nil
+}
+
+// regexpList is a flag.Value collecting the regular expressions of a
+// repeatable flag, compiled as they are set.
+type regexpList []*regexp.Regexp
+
+func (r *regexpList) String() string {
+	exprs := make([]string, len(*r))
+	for i, re := range *r {
+		exprs[i] = re.String()
+	}
+	return strings.Join(exprs, ",")
+}
+
+func (r *regexpList) Set(val string) error {
+	re, err := regexp.Compile(val)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, re)
+	return nil
+}
+
+// matches reports whether any expression matches rel, as a slash separated path.
+func (r regexpList) matches(rel string) bool {
+	rel = filepath.ToSlash(rel)
+	for _, re := range r {
+		if re.MatchString(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathFilter decides which paths below the source root get copied. Patterns use
+// filepath.Match syntax. A pattern containing a '/' is matched against the path
+// relative to the source root, otherwise it is matched against the last element.
+// Regular expressions are matched against the slash separated relative path,
+// and gitignore style filter files can be given too.
+type pathFilter struct {
+	include, exclude     stringList
+	includeRe, excludeRe regexpList
+	// noHidden excludes dotfiles, and everything below dot-directories.
+	noHidden bool
+	// filterFiles are the -filter-from files, applied from the root down.
+	filterFiles stringList
+	// dirFilter names a filter file, such as .gitignore, read from every
+	// directory and applied to everything below it.
+	dirFilter string
+	// minSize and maxSize bound the size of the files copied. Zero means no
+	// bound.
+	minSize, maxSize byteSize
+	// newerThan and olderThan bound the modification time of the files
+	// copied.
+	newerThan, olderThan timeBound
+	// custom is the Filter of a Copier, if any.
+	custom Filter
+
+	lists    []*ignoreList
+	mu       sync.Mutex
+	dirLists map[string]*ignoreList
+}
+
+// validate checks every pattern for syntax errors up front so a typo doesn't
+// silently match nothing, and reads the -filter-from files.
+func (f *pathFilter) validate() error {
+	if f.maxSize > 0 && f.minSize > f.maxSize {
+		return errors.New("-min-size is larger than -max-size")
+	}
+	if f.newerThan.isSet() && f.olderThan.isSet() && !f.newerThan.t.Before(f.olderThan.t) {
+		return errors.New("no file can be both -newer-than and -older-than those times")
+	}
+	for _, path := range f.filterFiles {
+		list, err := readIgnoreFile(path, false)
+		if err != nil {
+			return err
+		}
+		f.lists = append(f.lists, list)
+	}
+	for _, patterns := range []stringList{f.include, f.exclude} {
+		for _, pattern := range patterns {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func matchAny(patterns stringList, rel string) bool {
+	for _, pattern := range patterns {
+		name := rel
+		if !strings.Contains(pattern, "/") {
+			name = filepath.Base(rel)
+		}
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// excluded reports whether rel matches any -exclude or -exclude-re pattern,
+// or is hidden with -no-hidden.
+func (f *pathFilter) excluded(rel string) bool {
+	return matchAny(f.exclude, rel) || f.excludeRe.matches(rel) || f.noHidden && hidden(rel)
+}
+
+// hidden reports whether any element of rel starts with a dot.
+func hidden(rel string) bool {
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		if strings.HasPrefix(name, ".") && name != "." && name != ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// ignored reports whether the filter files exclude rel, the path of a file
+// below root. The lists are consulted from the most general to the most
+// specific, and the last one with a matching rule decides.
+func (f *pathFilter) ignored(root, rel string, isDir bool) bool {
+	excluded := false
+	for _, list := range f.lists {
+		if matched, ex := list.match(rel, isDir); matched {
+			excluded = ex
+		}
+	}
+	if f.dirFilter == "" {
+		return excluded
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	for i := range parts {
+		list := f.dirList(filepath.Join(root, filepath.Join(parts[:i]...)))
+		if matched, ex := list.match(filepath.Join(parts[i:]...), isDir); matched {
+			excluded = ex
+		}
+	}
+	return excluded
+}
+
+// dirList returns the rules of the -dir-filter file in dir, reading it on
+// first use.
+func (f *pathFilter) dirList(dir string) *ignoreList {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if list, ok := f.dirLists[dir]; ok {
+		return list
+	}
+	list, err := readIgnoreFile(filepath.Join(dir, f.dirFilter), true)
+	if err != nil {
+		slog.Warn("Ignoring filter file", "error", err)
+		list = &ignoreList{}
+	}
+	if f.dirLists == nil {
+		f.dirLists = make(map[string]*ignoreList)
+	}
+	f.dirLists[dir] = list
+	return list
+}
+
+// included reports whether a file passes the -include and -include-re
+// patterns. With no include patterns every file is included.
+func (f *pathFilter) included(rel string) bool {
+	if len(f.include) == 0 && len(f.includeRe) == 0 {
+		return true
+	}
+	return matchAny(f.include, rel) || f.includeRe.matches(rel)
+}
+
+// limited reports whether any size or modification time limit is set.
+func (f *pathFilter) limited() bool {
+	return f.minSize > 0 || f.maxSize > 0 || f.newerThan.isSet() || f.olderThan.isSet()
+}
+
+// selects reports whether the file described by info passes the size and
+// modification time limits.
+func (f *pathFilter) selects(info os.FileInfo) bool {
+	if f.minSize > 0 && info.Size() < int64(f.minSize) {
+		return false
+	}
+	if f.maxSize > 0 && info.Size() > int64(f.maxSize) {
+		return false
+	}
+	if f.newerThan.isSet() && !info.ModTime().After(f.newerThan.t) {
+		return false
+	}
+	return !f.olderThan.isSet() || info.ModTime().Before(f.olderThan.t)
+}
+
+// wrap returns a WalkDirFunc that only hands fn the paths accepted by the
+// filter. Excluded directories are pruned rather than descended into. Include
+// patterns only apply to files so that matching files in subdirectories are
+// still found. Files are only statted when a size or time limit needs it.
+func (f *pathFilter) wrap(root string, fn fs.WalkDirFunc) fs.WalkDirFunc {
+	return func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == root {
+			return fn(path, d, err)
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if f.excluded(rel) || f.ignored(root, rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if f.custom != nil {
+			info, err := d.Info()
+			if err != nil {
+				return fn(path, d, err)
+			}
+			switch f.decide(rel, info) {
+			case Prune:
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			case Exclude:
+				if !d.IsDir() {
+					return nil
+				}
+			}
+		}
+		if !d.IsDir() {
+			if !f.included(rel) {
+				return nil
+			}
+			if f.limited() {
+				info, err := d.Info()
+				if err != nil {
+					return fn(path, d, err)
+				}
+				if !f.selects(info) {
+					return nil
+				}
+			}
+		}
+		return fn(path, d, nil)
+	}
+}
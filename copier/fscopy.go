@@ -0,0 +1,625 @@
+package copier
+
+import (
+	"context"
+	"cpj/cp"
+	"cpj/sftp"
+	"cpj/vfs"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// remoteCopy copies where src or dest, or both, aren't local. Between a
+// bucket and the local disk, bucketCopy splits files into parts; every other
+// copy goes through the filesystems of both sides, as copyTrees does.
+func remoteCopy(src, dest string, opts *options) error {
+	if !opts.extract && isBucketURL(src) != isBucketURL(dest) && !isRemote(src) && !isRemote(dest) {
+		return bucketCopy(src, dest, opts)
+	}
+	return copyTrees(src, dest, opts)
+}
+
+// tree is one side of a copy between filesystems: a local directory, a
+// remote one, a prefix of a bucket, or an archive.
+type tree struct {
+	fs vfs.FS
+	// wfs writes to the tree; an archive has none.
+	wfs vfs.WriteFS
+	// label returns how messages name name.
+	label func(name string) string
+	close func() error
+}
+
+// openTree returns the tree the operand arg names, or, with archive set, the
+// local archive it names.
+func openTree(arg string, opts *options, archive bool) (*tree, error) {
+	if u, ok := parseBucketURL(arg); ok {
+		if u.bucket == "" {
+			return nil, errorOf(ErrUsage, "%s:// paths must name a bucket", u.scheme)
+		}
+		store, err := openStore(u.scheme, opts)
+		if err != nil {
+			return nil, errorOf(ErrUsage, "%w", err)
+		}
+		b := newBucketFS(store, u, int64(opts.s3.partSize))
+		return &tree{fs: b, wfs: b, label: b.label, close: func() error { return nil }}, nil
+	}
+	if r, ok := parseRemote(arg); ok {
+		return openRemote(r, opts)
+	}
+	abs, err := cp.AbsolutePath(arg)
+	if err != nil {
+		return nil, err
+	}
+	if archive {
+		a, err := openArchive(abs, opts)
+		if err != nil {
+			return nil, err
+		}
+		label := func(name string) string {
+			if name == "." {
+				return abs
+			}
+			return abs + "/" + name
+		}
+		return &tree{fs: a, label: label, close: a.Close}, nil
+	}
+	d := vfs.Dir(abs)
+	return &tree{fs: d, wfs: d, label: d.Path, close: func() error { return nil }}, nil
+}
+
+// splitOperand returns the operand naming the directory arg is in, and the
+// name of arg in it.
+func splitOperand(arg string) (dir, name string) {
+	if u, ok := parseBucketURL(arg); ok {
+		key := strings.TrimSuffix(u.key, "/")
+		u.key = strings.TrimSuffix(key, path.Base(key))
+		return u.String(), path.Base(key)
+	}
+	if r, ok := parseRemote(arg); ok {
+		name = path.Base(r.path)
+		r.path = path.Dir(r.path)
+		return r.String(), name
+	}
+	return filepath.Dir(arg), filepath.Base(arg)
+}
+
+// treeCopy copies a tree, or a single file, from one filesystem to another.
+// The walk of the source lists the files, making the directories below the
+// dest as it goes, and -jobs workers copy the files.
+type treeCopy struct {
+	workerPool
+	src, dst *tree
+	m        *manifest
+	progress chan<- int64
+	work     chan treeFile
+	wg       sync.WaitGroup
+}
+
+// treeFile is a file to copy, named as in the source and dest trees.
+type treeFile struct {
+	src, dest string
+	// info describes src, or what it links to if followed.
+	info fs.FileInfo
+	// link is the target of a symlink recreated at dest.
+	link string
+}
+
+// copyTrees copies src to dest through the filesystems of both, each file
+// written under a temporary name renamed into place once complete, unless
+// the dest only shows files once complete anyway. With -extract, src is an
+// archive to extract into dest.
+func copyTrees(src, dest string, opts *options) (err error) {
+	remoteDest := isBucketURL(dest) || isRemote(dest)
+	if err := rejectFlags("with remote paths", []setFlag{
+		{opts.delete, "-delete"}, {opts.move, "-move"}, {opts.staged, "-staged"}, {opts.checkpoint != "", "-checkpoint"},
+		{len(opts.linkDest.dirs) > 0, "-link-dest"}, {opts.delta, "-delta"}, {opts.dedup, "-dedup"},
+		{opts.checksum, "-checksum"}, {opts.hardLinks, "-hard-links"}, {opts.link, "-link"},
+		{opts.interactive, "-interactive"}, {opts.filter.dirFilter != "", "-dir-filter"},
+		{opts.preserveOwner, "-preserve-owner"}, {opts.backup.enabled && remoteDest, "-backup"},
+		{opts.compress.format != "", "-compress"}, {opts.compress.decompress, "-decompress"},
+		{opts.crypt.encrypt, "-encrypt"}, {opts.crypt.decrypt, "-decrypt"},
+	}); err != nil {
+		return err
+	}
+	if opts.extract && (isBucketURL(src) || isRemote(src)) {
+		return errorOf(ErrUsage, "-extract needs a local archive, not %s", src)
+	}
+	from, err := openTree(src, opts, opts.extract)
+	if err != nil {
+		return err
+	}
+	defer from.close()
+	to, err := openTree(dest, opts, false)
+	if err != nil {
+		return err
+	}
+	x := &treeCopy{workerPool: workerPool{opts: opts}, src: from, dst: to, work: make(chan treeFile)}
+	defer func() { x.dst.close() }()
+	info, err := from.fs.Stat(".")
+	if err != nil {
+		return err
+	}
+	opts.events.scan(from.label("."), to.label("."))
+	var files []treeFile
+	if info.IsDir() {
+		files, err = x.scanTree()
+	} else {
+		files, err = x.scanFile(info, dest)
+	}
+	if err != nil {
+		return err
+	}
+
+	if opts.manifest != "" && !opts.dryRun {
+		if x.m, err = createManifest(opts.manifest, ""); err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := x.m.close(); err == nil {
+				err = cerr
+			}
+		}()
+	}
+	jobs := max(int(opts.jobs), 1)
+	if opts.progress && !opts.dryRun {
+		var total int64
+		for _, f := range files {
+			total += f.size()
+		}
+		progress := make(chan int64, jobs)
+		progressDone := make(chan struct{})
+		go runProgress(os.Stderr, len(files), total, progress, progressDone)
+		x.progress = progress
+		defer func() {
+			close(progress)
+			<-progressDone
+		}()
+	}
+	for i := 0; i < jobs; i++ {
+		x.wg.Add(1)
+		go x.worker()
+	}
+	if opts.signals {
+		defer handleInterrupts(x.interrupt, opts)()
+	}
+	for _, f := range files {
+		if x.stopping() {
+			break
+		}
+		if opts.dryRun {
+			fmt.Printf("Would copy %s to %s.\n", x.src.label(f.src), x.dst.label(f.dest))
+			continue
+		}
+		x.work <- f
+	}
+	close(x.work)
+	x.wg.Wait()
+	if x.err != nil {
+		return x.err
+	}
+	slog.Info("Copied", "files", x.files, "bytes", x.bytes)
+	if len(x.failed) > 0 {
+		return errorOf(ErrPartial, "%d files could not be copied, first error: %w", len(x.failed), x.failed[0])
+	}
+	return walkIncomplete(opts)
+}
+
+// size is the size of the data copied for f: none for a symlink.
+func (f treeFile) size() int64 {
+	if f.link != "" {
+		return 0
+	}
+	return f.info.Size()
+}
+
+// scanFile returns the copy of the source, a single file described by info.
+// Without -T, a dest that is a directory or ends in a slash means the file
+// goes inside it; otherwise the dest is the file, written in the directory
+// it is in.
+func (x *treeCopy) scanFile(info fs.FileInfo, dest string) ([]treeFile, error) {
+	destInfo, err := x.dst.wfs.Stat(".")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	isDir := err == nil && destInfo.IsDir()
+	if x.opts.noTargetDir && isDir {
+		return nil, errorOf(ErrUsage, "cannot overwrite directory %s with non-directory %s", x.dst.label("."), x.src.label("."))
+	}
+	f := treeFile{src: ".", info: info}
+	intoDir := !x.opts.noTargetDir && (isDir || strings.HasSuffix(dest, "/") || strings.HasSuffix(dest, string(filepath.Separator)))
+	if intoDir {
+		if !isDir && !vfs.IsAtomic(x.dst.wfs) {
+			if err := x.mkdirRoot(); err != nil {
+				return nil, err
+			}
+		}
+		f.dest = info.Name()
+		return []treeFile{f}, nil
+	}
+	parent, name := splitOperand(dest)
+	to, err := openTree(parent, x.opts, false)
+	if err != nil {
+		return nil, err
+	}
+	x.dst.close()
+	x.dst, f.dest = to, name
+	return []treeFile{f}, nil
+}
+
+// mkdirRoot creates the dest directory, missing, if -mkdir allows, as
+// ensureDestDir does.
+func (x *treeCopy) mkdirRoot() error {
+	if x.opts.dryRun {
+		if x.opts.mkdir {
+			fmt.Printf("Would create directory %s.\n", x.dst.label("."))
+		}
+		return nil
+	}
+	if !x.opts.mkdir {
+		return errorOf(ErrDestMissing, "destination directory %s does not exist", x.dst.label("."))
+	}
+	return x.dst.wfs.MkdirAll(".", 0755)
+}
+
+// scanTree walks the source, a directory, creating the directories below the
+// dest, and returns the files to copy.
+func (x *treeCopy) scanTree() ([]treeFile, error) {
+	if !x.opts.recurse && !x.opts.extract {
+		return nil, errorOf(ErrUsage, "source is a directory, but you did not provide -recurse")
+	}
+	destInfo, err := x.dst.wfs.Stat(".")
+	switch {
+	case err == nil && !destInfo.IsDir():
+		return nil, errorOf(ErrNotDirectory, "destination %s is not a directory", x.dst.label("."))
+	case errors.Is(err, fs.ErrNotExist):
+		// A bucket has no directories to make
+		if !vfs.IsAtomic(x.dst.wfs) {
+			if err := x.mkdirRoot(); err != nil {
+				return nil, err
+			}
+		}
+	case err != nil:
+		return nil, err
+	}
+	x.opts.walkFailed = 0
+	var ancestors []string
+	if r, ok := x.src.fs.(vfs.RealPathFS); ok && x.opts.links == linksFollow {
+		top, err := r.RealPath(".")
+		if err != nil {
+			return nil, err
+		}
+		ancestors = []string{top}
+	}
+	var files []treeFile
+	if err := x.walk(".", ancestors, &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// walk adds the files of the source directory dir, and below it, to files.
+// ancestors are the real paths of dir and those above it, which a followed
+// symlink isn't descended into again.
+func (x *treeCopy) walk(dir string, ancestors []string, files *[]treeFile) error {
+	entries, err := x.src.fs.ReadDir(dir)
+	if err != nil {
+		return walkFailure(x.src.label(dir), err, x.opts)
+	}
+	for _, entry := range entries {
+		name := path.Join(dir, entry.Name())
+		info, err := entry.Info()
+		if err != nil {
+			if err := walkFailure(x.src.label(name), err, x.opts); err != nil {
+				return err
+			}
+			continue
+		}
+		mode := info.Mode()
+		followed := false
+		if mode&fs.ModeSymlink != 0 && x.opts.links == linksFollow {
+			target, err := x.src.fs.Stat(name)
+			if errors.Is(err, fs.ErrNotExist) {
+				slog.Warn("Skipping broken symlink", "path", x.src.label(name))
+				continue
+			}
+			if err != nil {
+				if err := walkFailure(x.src.label(name), err, x.opts); err != nil {
+					return err
+				}
+				continue
+			}
+			info, mode, followed = target, target.Mode(), true
+		}
+		rel := filepath.FromSlash(name)
+		if !entrySelected(rel, mode, info, x.opts) {
+			continue
+		}
+		dest := filepath.ToSlash(x.opts.destRel(rel))
+		switch {
+		case mode.IsDir():
+			below := ancestors
+			r, ok := x.src.fs.(vfs.RealPathFS)
+			if followed && !ok {
+				slog.Warn("Not following symlink to a directory", "path", x.src.label(name))
+				continue
+			}
+			if ok && x.opts.links == linksFollow {
+				real, err := r.RealPath(name)
+				if err != nil {
+					if err := walkFailure(x.src.label(name), err, x.opts); err != nil {
+						return err
+					}
+					continue
+				}
+				if slices.Contains(ancestors, real) {
+					slog.Warn("Not following symlink to a directory above it", "path", x.src.label(name))
+					continue
+				}
+				below = append(ancestors, real)
+			}
+			if !x.opts.dryRun {
+				slog.Debug("Creating directory", "dir", x.dst.label(dest))
+				if err := x.dst.wfs.MkdirAll(dest, 0755); err != nil {
+					return err
+				}
+			}
+			if err := x.walk(name, below, files); err != nil {
+				return err
+			}
+		case mode&fs.ModeSymlink != 0:
+			target, err := x.src.fs.ReadLink(name)
+			if err != nil {
+				if err := walkFailure(x.src.label(name), err, x.opts); err != nil {
+					return err
+				}
+				continue
+			}
+			*files = append(*files, treeFile{src: name, dest: dest, info: info, link: target})
+		case mode.IsRegular():
+			*files = append(*files, treeFile{src: name, dest: dest, info: info})
+		default:
+			slog.Warn("Skipping file that isn't regular", "path", x.src.label(name), "mode", mode.String())
+		}
+	}
+	return nil
+}
+
+// worker copies the files handed to it until work is closed.
+func (x *treeCopy) worker() {
+	defer x.wg.Done()
+	for f := range x.work {
+		if x.stopping() {
+			continue
+		}
+		src, dest := x.src.label(f.src), x.dst.label(f.dest)
+		x.opts.events.started(fileEntry{src: src, dest: dest, size: f.size()})
+		err := x.opts.beforeFile(src, dest)
+		if err == nil {
+			err = x.retry(func() error { return x.copy(f) })
+		}
+		if err != nil {
+			x.fail(f, err)
+		}
+	}
+}
+
+// copy copies f, through a temporary file renamed into place once complete
+// unless the dest only shows files once complete anyway. A symlink the dest
+// can't have is copied as what it links to.
+func (x *treeCopy) copy(f treeFile) error {
+	dst := x.dst.wfs
+	exists := false
+	if info, err := dst.Lstat(f.dest); err == nil {
+		if info.IsDir() {
+			return fmt.Errorf("cannot overwrite directory %s with %s", x.dst.label(f.dest), x.src.label(f.src))
+		}
+		if x.keep(f, info) {
+			return nil
+		}
+		exists = true
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if f.link != "" {
+		err := x.replace(f.dest, exists)
+		if err == nil {
+			err = dst.Symlink(f.link, f.dest)
+		}
+		if !errors.Is(err, errors.ErrUnsupported) {
+			if err == nil {
+				err = x.done(f, nil)
+			}
+			return err
+		}
+		info, err := x.src.fs.Stat(f.src)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			slog.Warn("Skipping symlink to a file that isn't regular, which the destination can't have", "path", x.src.label(f.src))
+			return nil
+		}
+		f.info, f.link = info, ""
+	}
+	in, err := x.src.fs.Open(f.src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := f.dest
+	if !vfs.IsAtomic(dst) {
+		tmp = path.Join(path.Dir(f.dest), ".cpj-"+path.Base(f.dest)+".tmp")
+	}
+	perm := fs.FileMode(0644)
+	if x.opts.preservePerms {
+		perm = f.info.Mode().Perm()
+	}
+	out, err := dst.Create(tmp, perm)
+	if err != nil {
+		return err
+	}
+	h := x.hash()
+	n, err := copyData(x.opts.ctx, out, in, h)
+	if a, ok := out.(vfs.Aborter); ok && err != nil {
+		a.Abort()
+	} else if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n != f.info.Size() {
+		err = fmt.Errorf("%s changed while being copied: read %d bytes of %d", x.src.label(f.src), n, f.info.Size())
+	}
+	if err == nil && x.opts.preservePerms {
+		// Create left out the bits the umask masks
+		err = unsupported(dst.Chmod(tmp, f.info.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)))
+	}
+	if err == nil && x.opts.preserveTimes {
+		err = unsupported(dst.Chtimes(tmp, f.info.ModTime()))
+	}
+	if tmp != f.dest {
+		if err == nil {
+			err = x.replace(f.dest, exists)
+		}
+		if err == nil {
+			err = dst.Rename(tmp, f.dest)
+		}
+		if err != nil && !errors.Is(err, sftp.ErrConnectionLost) {
+			dst.Remove(tmp)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return x.done(f, h)
+}
+
+// copyData copies in to out, hashing it with h unless nil, until ctx is
+// done. Neither the hash nor the check of ctx may hide what keeps the
+// requests of a remote file in flight: a remote out reads through them with
+// its ReaderFrom, and the WriterTo of a remote in writes through them to a
+// local out.
+func copyData(ctx context.Context, out io.Writer, in io.Reader, h hash.Hash) (int64, error) {
+	if rf, ok := out.(io.ReaderFrom); ok {
+		if _, local := out.(*os.File); !local {
+			in = cp.ContextReader(ctx, in)
+			if h != nil {
+				in = io.TeeReader(in, h)
+			}
+			return rf.ReadFrom(in)
+		}
+	}
+	out = cp.ContextWriter(ctx, out)
+	if h != nil {
+		out = io.MultiWriter(out, h)
+	}
+	return io.Copy(out, in)
+}
+
+// unsupported returns err, unless it is only that the dest can't do what
+// was asked, such as set the times of an object, which is left undone.
+func unsupported(err error) error {
+	if errors.Is(err, errors.ErrUnsupported) {
+		slog.Debug("Not supported by the destination", "error", err)
+		return nil
+	}
+	return err
+}
+
+// replace moves the file at dest, if it exists, out of the way of the file
+// replacing it: into its backup with -backup, or else, for a symlink, which
+// nothing renames over, removed.
+func (x *treeCopy) replace(dest string, exists bool) error {
+	if !exists {
+		return nil
+	}
+	if d, ok := x.dst.wfs.(vfs.Dir); ok && x.opts.backup.enabled {
+		return x.opts.backup.backup(d.Path(dest))
+	}
+	return nil
+}
+
+// keep reports whether the file at the dest of f, described by info, stays:
+// always with -no-clobber, or with -skip-existing if it has the size of f
+// and its modification time, to the second sftp keeps. An object can't have
+// its time set, but is uploaded after the file it was uploaded from last
+// changed.
+func (x *treeCopy) keep(f treeFile, info fs.FileInfo) bool {
+	modified := f.info.ModTime().Truncate(time.Second)
+	same := info.Size() == f.size() && info.ModTime().Truncate(time.Second).Equal(modified)
+	if vfs.IsAtomic(x.dst.wfs) {
+		same = info.Size() == f.size() && !info.ModTime().Before(modified)
+	}
+	if !x.opts.noClobber && !(x.opts.skipExisting && same) {
+		return false
+	}
+	x.opts.events.skipped(x.src.label(f.src), x.dst.label(f.dest), "existing")
+	if x.progress != nil {
+		x.progress <- f.size()
+	}
+	return true
+}
+
+// hash returns the hash of a file copied for the manifest, or nil without
+// one.
+func (x *treeCopy) hash() hash.Hash {
+	if x.m == nil {
+		return nil
+	}
+	return sha256.New()
+}
+
+// done records that f was copied, with h its digest for the manifest, once
+// its -exec-after command succeeds.
+func (x *treeCopy) done(f treeFile, h hash.Hash) error {
+	src, dest := x.src.label(f.src), x.dst.label(f.dest)
+	if err := x.opts.afterFile(src, dest); err != nil {
+		return err
+	}
+	if h != nil {
+		x.m.add(filepath.FromSlash(f.dest), h.Sum(nil))
+	}
+	slog.Debug("Copied", "src", src, "dest", dest, "bytes", f.size())
+	x.opts.events.copied(fileEntry{src: src, dest: dest, size: f.size()})
+	if x.progress != nil {
+		x.progress <- f.size()
+	}
+	x.count(f.size())
+	return nil
+}
+
+// retry calls fn until it succeeds, fails for good, or -retries is used up,
+// backing off as copyWithRetry does.
+func (x *treeCopy) retry(fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= x.opts.retries || !sftpRetryable(err) || !storeRetryable(err) || x.opts.ctx.Err() != nil {
+			return err
+		}
+		delay := backoff(x.opts.retryDelay, attempt)
+		slog.Debug("Copy failed, retrying", "error", err, "attempt", attempt+1, "delay", delay.Round(time.Millisecond))
+		if !sleep(x.opts.ctx, delay) {
+			return err
+		}
+	}
+}
+
+// fail records the failure of f, stopping the copy unless -continue is set.
+func (x *treeCopy) fail(f treeFile, err error) {
+	src, dest := x.src.label(f.src), x.dst.label(f.dest)
+	if errors.Is(err, sftp.ErrConnectionLost) {
+		err = fmt.Errorf("%s: %w", src, err)
+	}
+	x.workerPool.fail(copyError{src: src, dest: dest, err: err}, "Could not copy file")
+}
@@ -0,0 +1,364 @@
+package copier
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// grpcServicePrefix is the path of the methods of the Jobs service.
+const grpcServicePrefix = "/cpj.Jobs/"
+
+const grpcContentType = "application/grpc"
+
+// The status codes of gRPC that calls end with.
+const (
+	grpcOK               = 0
+	grpcUnknown          = 2
+	grpcInvalidArgument  = 3
+	grpcNotFound         = 5
+	grpcPermissionDenied = 7
+	grpcUnimplemented    = 12
+	grpcUnauthenticated  = 16
+)
+
+// A message is framed by a byte of flags and its length.
+const (
+	grpcFrameHeader = 5
+	grpcCompressed  = 1
+)
+
+// How often Watch checks its job unless told otherwise, and most often.
+const (
+	grpcDefaultInterval = time.Second
+	grpcMinInterval     = 100 * time.Millisecond
+)
+
+// The wire types of protobuf fields.
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+const protoMaxField = 1<<29 - 1
+
+// errGRPC is a call that fails with a gRPC status code.
+type errGRPC struct {
+	code int
+	msg  string
+}
+
+func (e *errGRPC) Error() string { return e.msg }
+
+func grpcErrorf(code int, format string, args ...any) error {
+	return &errGRPC{code, fmt.Sprintf(format, args...)}
+}
+
+// isGRPC reports whether r is a gRPC call rather than a REST request.
+func isGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), grpcContentType)
+}
+
+// serveGRPC answers the calls of the gRPC service of jobs.proto, which is
+// served with the REST API. Only Watch answers with more than one message.
+func (d *daemon) serveGRPC(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 {
+		httpError(w, http.StatusHTTPVersionNotSupported, "gRPC needs HTTP/2")
+		return
+	}
+	w.Header().Set("Content-Type", grpcContentType)
+	w.WriteHeader(http.StatusOK)
+	in, err := readGRPCMessage(http.MaxBytesReader(w, r.Body, maxRequestSize+grpcFrameHeader))
+	if err == nil {
+		switch strings.TrimPrefix(r.URL.Path, grpcServicePrefix) {
+		case "Submit":
+			var req submitRequest
+			if err = req.unmarshal(in); err == nil {
+				var job daemonJob
+				if job, err = d.submit(req.dir, req.args, req.schedule); err != nil {
+					err = grpcErrorf(grpcInvalidArgument, "%v", err)
+				} else {
+					err = writeGRPCMessage(w, marshalJob(job))
+				}
+			}
+		case "Watch":
+			var req jobRequest
+			if err = req.unmarshal(in); err == nil {
+				err = d.grpcWatch(w, r, req)
+			}
+		case "Cancel":
+			var req jobRequest
+			if err = req.unmarshal(in); err == nil {
+				var job daemonJob
+				if job, err = d.grpcFind(req.id, true); err == nil {
+					err = writeGRPCMessage(w, marshalJob(job))
+				}
+			}
+		default:
+			err = grpcErrorf(grpcUnimplemented, "unknown method %s", r.URL.Path)
+		}
+	}
+	grpcStatus(w, err)
+}
+
+// grpcWatch sends the job of req whenever it changes, until it is over or
+// the call is cancelled.
+func (d *daemon) grpcWatch(w http.ResponseWriter, r *http.Request, req jobRequest) error {
+	interval := grpcDefaultInterval
+	if req.intervalMS != 0 {
+		interval = time.Duration(req.intervalMS) * time.Millisecond
+		if interval < grpcMinInterval {
+			return grpcErrorf(grpcInvalidArgument, "interval_ms must be at least %d", grpcMinInterval.Milliseconds())
+		}
+	}
+	job, err := d.grpcFind(req.id, false)
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last []byte
+	for {
+		if msg := marshalJob(job); !bytes.Equal(msg, last) {
+			if err := writeGRPCMessage(w, msg); err != nil {
+				return err
+			}
+			last = msg
+		}
+		if job.over() {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			return r.Context().Err()
+		}
+		if job, err = d.grpcFind(req.id, false); err != nil {
+			return err
+		}
+	}
+}
+
+// grpcFind is find, failing with the gRPC status of its error.
+func (d *daemon) grpcFind(id int64, cancel bool) (daemonJob, error) {
+	job, err := d.find(int(id), cancel)
+	if errors.Is(err, errNoJob) {
+		return job, grpcErrorf(grpcNotFound, "%v", err)
+	}
+	return job, err
+}
+
+// grpcStatus ends a call with the status of err, in the trailers of the
+// response.
+func grpcStatus(w http.ResponseWriter, err error) {
+	code, msg := grpcOK, ""
+	if err != nil {
+		code, msg = grpcUnknown, err.Error()
+		var status *errGRPC
+		if errors.As(err, &status) {
+			code = status.code
+		}
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcEscape(msg))
+	}
+}
+
+// grpcRefuse answers a call that is refused before it is read with code,
+// the status in the headers without any message.
+func grpcRefuse(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", grpcContentType)
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", grpcEscape(msg))
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcEscape percent-encodes msg as the Grpc-Message header carries it.
+func grpcEscape(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// readGRPCMessage reads the single message of a call, which must not be
+// compressed, as the service doesn't accept any encoding.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var hdr [grpcFrameHeader]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "reading the request: %v", err)
+	}
+	if hdr[0]&grpcCompressed != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "compressed requests are not supported")
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > maxRequestSize {
+		return nil, grpcErrorf(grpcInvalidArgument, "the request is over %d bytes", maxRequestSize)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "reading the request: %v", err)
+	}
+	return msg, nil
+}
+
+// writeGRPCMessage sends msg, and flushes it to the client.
+func writeGRPCMessage(w http.ResponseWriter, msg []byte) error {
+	var hdr [grpcFrameHeader]byte
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(msg)))
+	if _, err := w.Write(append(hdr[:], msg...)); err != nil {
+		return err
+	}
+	return http.NewResponseController(w).Flush()
+}
+
+// submitRequest is the SubmitRequest message of jobs.proto.
+type submitRequest struct {
+	dir      string
+	args     []string
+	schedule string
+}
+
+func (req *submitRequest) unmarshal(b []byte) error {
+	return protoFields(b, func(num int, v uint64, data []byte) {
+		switch num {
+		case 1:
+			req.dir = string(data)
+		case 2:
+			req.args = append(req.args, string(data))
+		case 3:
+			req.schedule = string(data)
+		}
+	})
+}
+
+// jobRequest is the WatchRequest or CancelRequest message of jobs.proto,
+// the latter having no interval.
+type jobRequest struct {
+	id         int64
+	intervalMS uint32
+}
+
+func (req *jobRequest) unmarshal(b []byte) error {
+	return protoFields(b, func(num int, v uint64, data []byte) {
+		switch num {
+		case 1:
+			req.id = int64(v)
+		case 2:
+			req.intervalMS = uint32(v)
+		}
+	})
+}
+
+// protoFields calls field with each field of the protobuf message b: its
+// number, and its value, an integer or, for a length-delimited field, data.
+func protoFields(b []byte, field func(num int, v uint64, data []byte)) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 || key>>3 == 0 || key>>3 > protoMaxField {
+			return grpcErrorf(grpcInvalidArgument, "invalid request")
+		}
+		b = b[n:]
+		var v uint64
+		var data []byte
+		switch key & 7 {
+		case protoVarint:
+			if v, n = binary.Uvarint(b); n <= 0 {
+				return grpcErrorf(grpcInvalidArgument, "invalid request")
+			}
+		case protoFixed64:
+			if n = 8; len(b) >= n {
+				v = binary.LittleEndian.Uint64(b)
+			}
+		case protoFixed32:
+			if n = 4; len(b) >= n {
+				v = uint64(binary.LittleEndian.Uint32(b))
+			}
+		case protoBytes:
+			size, m := binary.Uvarint(b)
+			if m <= 0 || size > uint64(len(b)-m) {
+				return grpcErrorf(grpcInvalidArgument, "invalid request")
+			}
+			data, n = b[m:m+int(size)], m+int(size)
+		default:
+			return grpcErrorf(grpcInvalidArgument, "invalid request")
+		}
+		if n > len(b) {
+			return grpcErrorf(grpcInvalidArgument, "invalid request")
+		}
+		field(int(key>>3), v, data)
+		b = b[n:]
+	}
+	return nil
+}
+
+// marshalJob encodes job as the Job message of jobs.proto.
+func marshalJob(job daemonJob) []byte {
+	var b []byte
+	b = appendProtoVarint(b, 1, uint64(job.ID))
+	for _, arg := range job.Args {
+		b = appendProtoBytes(b, 2, []byte(arg))
+	}
+	b = appendProtoString(b, 3, job.Dir)
+	b = appendProtoString(b, 4, job.State)
+	// An int32 is sign-extended, a negative one taking ten bytes
+	b = appendProtoVarint(b, 5, uint64(int64(int32(job.Status))))
+	b = appendProtoTime(b, 6, &job.Submitted)
+	b = appendProtoTime(b, 7, job.Started)
+	b = appendProtoTime(b, 8, job.Finished)
+	b = appendProtoString(b, 9, job.Progress)
+	b = appendProtoString(b, 10, job.Log)
+	b = appendProtoString(b, 11, job.Schedule)
+	b = appendProtoTime(b, 12, job.Next)
+	return b
+}
+
+// appendProtoVarint appends the integer field num, unless it is 0, which
+// proto3 leaves out.
+func appendProtoVarint(b []byte, num int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(num)<<3|protoVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendProtoBytes(b []byte, num int, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(num)<<3|protoBytes)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// appendProtoString appends the string field num, unless it is empty.
+func appendProtoString(b []byte, num int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return appendProtoBytes(b, num, []byte(s))
+}
+
+// appendProtoTime appends t as the google.protobuf.Timestamp field num,
+// unless it is nil.
+func appendProtoTime(b []byte, num int, t *time.Time) []byte {
+	if t == nil {
+		return b
+	}
+	var ts []byte
+	ts = appendProtoVarint(ts, 1, uint64(t.Unix()))
+	ts = appendProtoVarint(ts, 2, uint64(t.Nanosecond()))
+	return appendProtoBytes(b, num, ts)
+}
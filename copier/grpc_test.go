@@ -0,0 +1,122 @@
+package copier
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"os/exec"
+	"testing"
+)
+
+// grpcCall calls method of the Jobs service with the request message req,
+// returning the messages answered and the status, as a client would.
+func grpcCall(t *testing.T, addr, token, method string, req []byte) (msgs [][]byte, status string) {
+	t.Helper()
+	var body bytes.Buffer
+	body.Write(binary.BigEndian.AppendUint32([]byte{0}, uint32(len(req))))
+	body.Write(req)
+	r, err := http.NewRequest("POST", "http://"+addr+grpcServicePrefix+method, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "application/grpc+proto")
+	r.Header.Set("TE", "trailers")
+	r.Header.Set("Authorization", "Bearer "+token)
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	resp, err := (&http.Client{Transport: &http.Transport{Protocols: protocols}}).Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s answered %s over %s", method, resp.Status, resp.Proto)
+	}
+	for len(data) > 0 {
+		if len(data) < grpcFrameHeader {
+			t.Fatalf("%s answered a truncated message", method)
+		}
+		n := int(binary.BigEndian.Uint32(data[1:])) + grpcFrameHeader
+		msgs = append(msgs, data[grpcFrameHeader:n])
+		data = data[n:]
+	}
+	if status = resp.Header.Get("Grpc-Status"); status == "" {
+		status = resp.Trailer.Get("Grpc-Status")
+	}
+	return msgs, status
+}
+
+// jobState returns the id and state of the Job message msg.
+func jobState(t *testing.T, msg []byte) (id int64, state string) {
+	t.Helper()
+	err := protoFields(msg, func(num int, v uint64, data []byte) {
+		switch num {
+		case 1:
+			id = int64(v)
+		case 4:
+			state = string(data)
+		}
+	})
+	if err != nil {
+		t.Fatalf("invalid job: %v", err)
+	}
+	return id, state
+}
+
+// TestGRPC checks that a job can be submitted, cancelled and watched over
+// gRPC, and that calls without the token are refused.
+func TestGRPC(t *testing.T) {
+	dir := t.TempDir()
+	d := &daemon{dir: dir, maxJobs: 1, next: 1, procs: map[int]*exec.Cmd{}, wake: make(chan struct{}, 1)}
+	srv, err := d.serveHTTP("127.0.0.1:0", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	var submit []byte
+	submit = appendProtoString(submit, 1, dir)
+	for _, arg := range []string{"copy", "-recurse", "src", "dest"} {
+		submit = appendProtoString(submit, 2, arg)
+	}
+	msgs, status := grpcCall(t, srv.Addr, "secret", "Submit", submit)
+	if status != "0" || len(msgs) != 1 {
+		t.Fatalf("Submit answered %d messages with status %s", len(msgs), status)
+	}
+	id, state := jobState(t, msgs[0])
+	if state != jobQueued {
+		t.Errorf("submitted job is %s, not %s", state, jobQueued)
+	}
+
+	msgs, status = grpcCall(t, srv.Addr, "secret", "Cancel", appendProtoVarint(nil, 1, uint64(id)))
+	if status != "0" || len(msgs) != 1 {
+		t.Fatalf("Cancel answered %d messages with status %s", len(msgs), status)
+	}
+	if _, state := jobState(t, msgs[0]); state != jobCancelled {
+		t.Errorf("cancelled job is %s, not %s", state, jobCancelled)
+	}
+
+	// The job is over, so watching it sends it once and ends
+	msgs, status = grpcCall(t, srv.Addr, "secret", "Watch", appendProtoVarint(nil, 1, uint64(id)))
+	if status != "0" || len(msgs) != 1 {
+		t.Fatalf("Watch answered %d messages with status %s", len(msgs), status)
+	}
+	if watched, state := jobState(t, msgs[0]); watched != id || state != jobCancelled {
+		t.Errorf("Watch sent job %d %s, not %d %s", watched, state, id, jobCancelled)
+	}
+
+	if _, status := grpcCall(t, srv.Addr, "secret", "Watch", appendProtoVarint(nil, 1, uint64(id+1))); status != "5" {
+		t.Errorf("watching an unknown job ended with status %s, not 5", status)
+	}
+	if _, status := grpcCall(t, srv.Addr, "secret", "Submit", []byte{0xff}); status != "3" {
+		t.Errorf("an invalid request ended with status %s, not 3", status)
+	}
+	if _, status := grpcCall(t, srv.Addr, "wrong", "Cancel", appendProtoVarint(nil, 1, uint64(id))); status != "16" {
+		t.Errorf("a call with the wrong token ended with status %s, not 16", status)
+	}
+}
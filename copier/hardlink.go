@@ -0,0 +1,63 @@
+package copier
+
+import (
+	"cpj/cp"
+	"log/slog"
+	"os"
+)
+
+// hardLink is a source file that shares its inode with target, an earlier
+// file in the walk.
+type hardLink struct {
+	src, target string
+}
+
+// hardLinks tracks multiply linked source files so the link groups can be
+// recreated at the destination instead of copying the data once per name.
+type hardLinks struct {
+	first map[cp.FileID]string
+	links []hardLink
+}
+
+func newHardLinks() *hardLinks {
+	return &hardLinks{first: make(map[cp.FileID]string)}
+}
+
+// add records the file at path, and reports whether it is another name for an
+// inode already seen. Such files are linked rather than copied.
+func (h *hardLinks) add(path string, info os.FileInfo) bool {
+	id, nlink, ok := cp.Identity(info)
+	if !ok || nlink < 2 {
+		return false
+	}
+	if target, seen := h.first[id]; seen {
+		h.links = append(h.links, hardLink{src: path, target: target})
+		return true
+	}
+	h.first[id] = path
+	return false
+}
+
+// createHardLinks links every recorded file to the destination copy of its
+// target. It must run after the targets have been copied.
+func createHardLinks(srcAbs, destAbs string, links []hardLink, opts *options) error {
+	for _, link := range links {
+		dest := fileDestPath(srcAbs, destAbs, link.src, nil, opts)
+		target := fileDestPath(srcAbs, destAbs, link.target, nil, opts)
+		slog.Debug("Linking", "dest", dest, "target", target)
+		err := os.Remove(dest)
+		if err == nil || os.IsNotExist(err) {
+			err = os.Link(target, dest)
+		}
+		if err == nil && opts.move {
+			err = os.Remove(link.src)
+		}
+		if err != nil {
+			if !opts.cont {
+				return err
+			}
+			slog.Warn(err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package copier
+
+import (
+	"cpj/cp"
+	"encoding/gob"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// hashCache keeps the sha256 digests -checksum and -dedup compute from one
+// run to the next, in the file of -hash-cache, so files that haven't changed aren't
+// read again. A digest is trusted while the file has the same size,
+// modification time and inode as when it was hashed. A nil *hashCache does
+// nothing.
+type hashCache struct {
+	path       string
+	bufferSize int
+	mu         sync.Mutex
+	entries    map[string]hashEntry
+	// used holds the paths looked up or hashed in this run.
+	used map[string]bool
+	// hits and misses count the digests found in the cache and computed.
+	hits, misses int
+}
+
+type hashEntry struct {
+	Size, ModTime int64
+	Dev, Ino      uint64
+	Sum           []byte
+}
+
+// newHashEntry describes the file info with the digest sum.
+func newHashEntry(info os.FileInfo, sum []byte) hashEntry {
+	id, _, _ := cp.Identity(info)
+	return hashEntry{Size: info.Size(), ModTime: info.ModTime().UnixNano(), Dev: id.Dev, Ino: id.Ino, Sum: sum}
+}
+
+// loadHashCache reads the cache at path, or starts an empty one if there
+// is none yet.
+func loadHashCache(path string, bufferSize int) (*hashCache, error) {
+	abs, err := cp.AbsolutePath(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &hashCache{path: abs, bufferSize: bufferSize, entries: make(map[string]hashEntry), used: make(map[string]bool)}
+	file, err := os.Open(abs)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if err := gob.NewDecoder(file).Decode(&c.entries); err != nil {
+		return nil, errors.New("-hash-cache " + path + " is not a hash cache: " + err.Error())
+	}
+	return c, nil
+}
+
+// digest returns the sha256 digest of the file at path, described by info,
+// from the cache if the file is unchanged since it was hashed. It is a
+// cp.Options.Digest.
+func (c *hashCache) digest(path string, info os.FileInfo) ([]byte, error) {
+	if info == nil {
+		var err error
+		if info, err = os.Stat(path); err != nil {
+			return nil, err
+		}
+	}
+	want := newHashEntry(info, nil)
+	c.mu.Lock()
+	c.used[path] = true
+	if entry, ok := c.entries[path]; ok && entry.Size == want.Size && entry.ModTime == want.ModTime && entry.Dev == want.Dev && entry.Ino == want.Ino {
+		c.hits++
+		c.mu.Unlock()
+		return entry.Sum, nil
+	}
+	c.misses++
+	c.mu.Unlock()
+	sum, err := cp.FileDigest(path, c.bufferSize)
+	if err != nil {
+		return nil, err
+	}
+	want.Sum = sum
+	c.mu.Lock()
+	c.entries[path] = want
+	c.mu.Unlock()
+	return sum, nil
+}
+
+// copied records that dest now holds the contents of src, so it has the
+// same digest, if that of src was known this run and src hasn't changed
+// since, while it was copied say.
+func (c *hashCache) copied(src, dest string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	entry, ok := c.entries[src]
+	ok = ok && c.used[src]
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	if info, err := os.Stat(src); err != nil || newHashEntry(info, nil).ModTime != entry.ModTime || info.Size() != entry.Size {
+		return
+	}
+	info, err := os.Stat(dest)
+	if err != nil || info.Size() != entry.Size {
+		return
+	}
+	c.mu.Lock()
+	c.entries[dest] = newHashEntry(info, entry.Sum)
+	c.used[dest] = true
+	c.mu.Unlock()
+}
+
+// save writes the cache back, replacing the file atomically. Entries for
+// files that are gone are dropped.
+func (c *hashCache) save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for path := range c.entries {
+		if c.used[path] {
+			continue
+		}
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			delete(c.entries, path)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(file).Encode(c.entries); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
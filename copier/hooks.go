@@ -0,0 +1,102 @@
+package copier
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strings"
+)
+
+// execHooks are the commands of -exec-before and -exec-after. Each is split
+// on spaces and run directly, as -ssh-command is, not through a shell. One
+// naming {src} or {dest} is run for each file, with them replaced by its
+// paths, and any other once, before the first file or after the last.
+type execHooks struct {
+	before, after string
+}
+
+func (h execHooks) validate() error {
+	if h.before != "" && len(strings.Fields(h.before)) == 0 {
+		return fmt.Errorf("-exec-before is empty")
+	}
+	if h.after != "" && len(strings.Fields(h.after)) == 0 {
+		return fmt.Errorf("-exec-after is empty")
+	}
+	return nil
+}
+
+// perFile reports whether command is run for each file rather than once.
+func perFile(command string) bool {
+	return strings.Contains(command, "{src}") || strings.Contains(command, "{dest}")
+}
+
+// beforeFile runs the -exec-before command for the file src, about to be
+// copied to dest, if it is run per file. The file is only copied if it
+// succeeds.
+func (o *options) beforeFile(src, dest string) error {
+	if !perFile(o.exec.before) {
+		return nil
+	}
+	return o.runHook("-exec-before", o.exec.before, src, dest)
+}
+
+// afterFile runs the -exec-after command for the file src, just copied to
+// dest, if it is run per file. The file counts as failed if it doesn't
+// succeed.
+func (o *options) afterFile(src, dest string) error {
+	if !perFile(o.exec.after) {
+		return nil
+	}
+	return o.runHook("-exec-after", o.exec.after, src, dest)
+}
+
+// withHooks calls copy between the -exec-before and -exec-after commands
+// that are run once. The one after is run if the copy ran, even if some
+// files failed, but not once it is abandoned. Neither is run for -dry-run.
+func (o *options) withHooks(copy func() error) error {
+	if o.dryRun {
+		return copy()
+	}
+	if o.exec.before != "" && !perFile(o.exec.before) {
+		if err := o.runHook("-exec-before", o.exec.before, "", ""); err != nil {
+			return err
+		}
+	}
+	err := copy()
+	ran := err == nil || errors.Is(err, ErrPartial)
+	if o.exec.after != "" && !perFile(o.exec.after) && ran && o.ctx.Err() == nil {
+		if herr := o.runHook("-exec-after", o.exec.after, "", ""); herr != nil {
+			if err != nil {
+				slog.Error(herr.Error())
+			} else {
+				err = herr
+			}
+		}
+	}
+	return err
+}
+
+// runHook runs command, the setting of flag, for the file src copied to
+// dest. Its output is logged, its stdout being kept for -json.
+func (o *options) runHook(flag, command, src, dest string) error {
+	args := strings.Fields(command)
+	subst := strings.NewReplacer("{src}", src, "{dest}", dest)
+	for i, arg := range args {
+		args[i] = subst.Replace(arg)
+	}
+	cmd := exec.CommandContext(o.ctx, args[0], args[1:]...)
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	err := cmd.Run()
+	output := strings.TrimSpace(out.String())
+	if err != nil {
+		if output != "" {
+			return fmt.Errorf("%s %s: %w: %s", flag, args[0], err, output)
+		}
+		return fmt.Errorf("%s %s: %w", flag, args[0], err)
+	}
+	slog.Debug("Ran "+flag, "command", strings.Join(args, " "), "output", output)
+	return nil
+}
@@ -0,0 +1,143 @@
+package copier
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ignoreRule is one pattern of a gitignore style filter file.
+type ignoreRule struct {
+	re *regexp.Regexp
+	// include re-includes matching paths, from a "!" or rsync "+ " prefix.
+	include bool
+	dirOnly bool
+}
+
+// ignoreList holds the rules of one filter file. Gitignore files let the last
+// matching rule win. Files written in rsync filter syntax, with every rule
+// starting "- " or "+ ", let the first matching rule win instead.
+type ignoreList struct {
+	rules      []ignoreRule
+	firstMatch bool
+}
+
+// readIgnoreFile parses the filter file at path. A missing file is returned
+// as an empty list when optional is set.
+func readIgnoreFile(path string, optional bool) (*ignoreList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if optional && os.IsNotExist(err) {
+			return &ignoreList{}, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	var list ignoreList
+	rsyncStyle := true
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var rule ignoreRule
+		switch {
+		case strings.HasPrefix(line, "- "):
+			line = line[2:]
+		case strings.HasPrefix(line, "+ "):
+			line, rule.include = line[2:], true
+		default:
+			rsyncStyle = false
+			if strings.HasPrefix(line, "!") {
+				line, rule.include = line[1:], true
+			}
+		}
+		if rule.re, rule.dirOnly, err = compileIgnorePattern(line); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		list.rules = append(list.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	list.firstMatch = rsyncStyle && len(list.rules) > 0
+	return &list, nil
+}
+
+// compileIgnorePattern turns a gitignore pattern into a regexp matching slash
+// separated paths relative to the directory of the filter file. A pattern
+// with a '/' other than a trailing one is anchored to that directory, others
+// match at any depth.
+func compileIgnorePattern(pattern string) (re *regexp.Regexp, dirOnly bool, err error) {
+	// Trailing spaces are ignored unless escaped
+	if trimmed := strings.TrimRight(pattern, " "); !strings.HasSuffix(trimmed, "\\") {
+		pattern = trimmed
+	}
+	pattern = strings.TrimPrefix(pattern, "\\")
+	if strings.HasSuffix(pattern, "/") {
+		pattern, dirOnly = strings.TrimSuffix(pattern, "/"), true
+	}
+	if pattern == "" {
+		return nil, false, fmt.Errorf("empty pattern")
+	}
+	var expr strings.Builder
+	if strings.Contains(pattern, "/") {
+		pattern = strings.TrimPrefix(pattern, "/")
+		expr.WriteString("^")
+	} else {
+		expr.WriteString("^(?:.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			expr.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return nil, false, fmt.Errorf("unterminated [ in %q", pattern)
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + class + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(pattern):
+			expr.WriteString(regexp.QuoteMeta(pattern[i+1 : i+2]))
+			i++
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	re, err = regexp.Compile(expr.String())
+	return re, dirOnly, err
+}
+
+// match reports whether any rule matches rel, and if so whether the deciding
+// rule excludes it.
+func (l *ignoreList) match(rel string, isDir bool) (matched, excluded bool) {
+	rel = filepath.ToSlash(rel)
+	for _, rule := range l.rules {
+		if rule.dirOnly && !isDir || !rule.re.MatchString(rel) {
+			continue
+		}
+		matched, excluded = true, !rule.include
+		if l.firstMatch {
+			break
+		}
+	}
+	return matched, excluded
+}
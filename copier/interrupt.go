@@ -0,0 +1,158 @@
+package copier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+var errInterrupted = errors.New("interrupted")
+
+// handleInterrupts calls interrupt on the first SIGINT or SIGTERM, which
+// must stop further files being copied, letting the copies in flight finish.
+// A second signal aborts the copy, giving those up and removing their partly
+// written destinations, or with atomic copies their temporary files. A third
+// kills the process, as it would without the handler. The returned function
+// stops listening for signals.
+func handleInterrupts(interrupt func(), opts *options) (stop func()) {
+	signals := make(chan os.Signal, 3)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-signals:
+		case <-done:
+			return
+		}
+		slog.Warn("Interrupted, waiting for copies in progress to finish. Interrupt again to abort them.")
+		interrupt()
+		select {
+		case <-signals:
+		case <-done:
+			return
+		}
+		slog.Warn("Aborting copies in progress. Interrupt again to exit at once.")
+		opts.abort(errInterrupted)
+		var sig os.Signal
+		select {
+		case sig = <-signals:
+		case <-done:
+			return
+		}
+		// Give the terminal back before dying of the signal, as without
+		// this handler
+		opts.dash.close()
+		if opts.job != nil {
+			opts.job.logSave()
+		}
+		signal.Reset(os.Interrupt, syscall.SIGTERM)
+		if p, err := os.FindProcess(os.Getpid()); err == nil && p.Signal(sig) == nil {
+			return
+		}
+		slog.Warn("Interrupt again to exit at once.")
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// aborted returns the error of a copy abandoned through its context, which
+// is an errInterrupted, or nil if it wasn't.
+func (o *options) aborted() error {
+	if o.ctx.Err() == nil {
+		return nil
+	}
+	cause := context.Cause(o.ctx)
+	if errors.Is(cause, errInterrupted) {
+		return cause
+	}
+	return &kindError{errInterrupted, cause}
+}
+
+// workerPool is what the workers of treeCopy, bucketTransfer and extractor
+// share to stop together: the error stopping the copy, the errors of the
+// files left out with -continue, and the files and bytes copied.
+type workerPool struct {
+	opts *options
+	// mu guards what the workers update.
+	mu     sync.Mutex
+	failed []error
+	err    error
+	files  int
+	bytes  int64
+}
+
+// interrupt stops the copy as a failure does, letting the files in progress
+// finish.
+func (p *workerPool) interrupt() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = errInterrupted
+	}
+}
+
+// stopping reports whether no more files should be copied.
+func (p *workerPool) stopping() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// An abandoned copy stops as a failed one does
+	if p.err == nil {
+		p.err = p.opts.aborted()
+	}
+	return p.err != nil
+}
+
+// fail records the failure e of a file, stopping the copy unless -continue
+// is set, in which case it logs msg.
+func (p *workerPool) fail(e copyError, msg string) {
+	// Once the copy is abandoned, that is why anything fails
+	if p.stopping() && p.opts.ctx.Err() != nil {
+		return
+	}
+	p.opts.events.fail(e)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.opts.cont {
+		if p.err == nil {
+			p.err = e.err
+		}
+		return
+	}
+	slog.Warn(msg, "src", e.src, "error", e.err)
+	p.failed = append(p.failed, e.err)
+}
+
+// count counts a file of size bytes copied.
+func (p *workerPool) count(size int64) {
+	p.mu.Lock()
+	p.files++
+	p.bytes += size
+	p.mu.Unlock()
+}
+
+// interrupt stops jobs from taking further files, as the first SIGINT does.
+func (j *copyJob) interrupt() {
+	j.mu.Lock()
+	j.interrupted = true
+	j.stop()
+	j.mu.Unlock()
+}
+
+// interruptSummary describes how far an interrupted job got. total is the
+// number of files to copy, or 0 when they were streamed.
+func interruptSummary(jobs *copyJob, total int) string {
+	// Files abandoned midway weren't copied either
+	taken := int(atomic.LoadInt64(&jobs.taken) - atomic.LoadInt64(&jobs.abandoned))
+	if total == 0 {
+		return fmt.Sprintf("Interrupted after %d files.", taken)
+	}
+	return fmt.Sprintf("Interrupted with %d of %d files not copied.", total-taken, total)
+}
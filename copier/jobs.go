@@ -0,0 +1,127 @@
+package copier
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+)
+
+// jobCount is a flag.Value holding the number of parallel jobs. auto, or 0,
+// leaves it to autoJobs.
+type jobCount int
+
+func (j *jobCount) String() string {
+	if *j == 0 {
+		return "auto"
+	}
+	return strconv.Itoa(int(*j))
+}
+
+func (j *jobCount) Set(val string) error {
+	if val == "auto" {
+		*j = 0
+		return nil
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid job count %q, must be a number or auto", val)
+	}
+	*j = jobCount(n)
+	return nil
+}
+
+// storageKind is a rough class of the device holding a path.
+type storageKind int
+
+const (
+	storageUnknown storageKind = iota
+	// storageSolid is a local device without seek cost, such as an SSD.
+	storageSolid
+	// storageRotational is a spinning disk, where parallel access makes the
+	// heads seek back and forth.
+	storageRotational
+	// storageNetwork is a network filesystem, where each file costs round
+	// trips that only parallel requests hide.
+	storageNetwork
+)
+
+func (k storageKind) String() string {
+	switch k {
+	case storageSolid:
+		return "solid state"
+	case storageRotational:
+		return "rotational"
+	case storageNetwork:
+		return "network"
+	}
+	return "unknown"
+}
+
+// Job counts picked by autoJobs for each kind of storage.
+const (
+	rotationalJobs = 2
+	networkJobs    = 16
+	maxLocalJobs   = 16
+)
+
+// autoJobs picks the number of jobs for a copy between paths. Local copies
+// get one job per CPU, within limits. The slowest kind of device wins: one
+// spinning disk keeps the job count low, a network mount raises it.
+func autoJobs(paths ...string) int {
+	jobs := min(max(runtime.NumCPU(), 4), maxLocalJobs)
+	reason := fmt.Sprintf("%d CPUs", runtime.NumCPU())
+	rotational := false
+	for _, path := range paths {
+		// Neither is a local path to probe
+		if isBucketURL(path) {
+			if !rotational {
+				jobs = max(jobs, networkJobs)
+				reason = fmt.Sprintf("%s is in object storage", path)
+			}
+			continue
+		}
+		if isRemote(path) {
+			if !rotational {
+				jobs = max(jobs, networkJobs)
+				reason = fmt.Sprintf("%s is on a remote host", path)
+			}
+			continue
+		}
+		kind := probeStorage(existingParent(path))
+		switch {
+		case kind == storageRotational:
+			rotational = true
+			reason = fmt.Sprintf("%s is on a rotational disk", path)
+		case kind == storageNetwork && !rotational:
+			jobs = max(jobs, networkJobs)
+			reason = fmt.Sprintf("%s is on a network filesystem", path)
+		}
+	}
+	if rotational {
+		jobs = rotationalJobs
+	}
+	slog.Debug("Picked the number of jobs", "jobs", jobs, "reason", reason)
+	return jobs
+}
+
+// existingParent returns path, or its closest ancestor that exists, so a
+// destination about to be created with -mkdir can be probed.
+func existingParent(path string) string {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
@@ -0,0 +1,53 @@
+package copier
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// networkFilesystems are the statfs magic numbers of network filesystems.
+var networkFilesystems = map[int64]bool{
+	unix.NFS_SUPER_MAGIC:  true,
+	unix.SMB_SUPER_MAGIC:  true,
+	unix.SMB2_SUPER_MAGIC: true,
+	unix.CIFS_SUPER_MAGIC: true,
+	unix.AFS_SUPER_MAGIC:  true,
+	unix.CEPH_SUPER_MAGIC: true,
+	unix.V9FS_MAGIC:       true,
+}
+
+// probeStorage classifies the device holding path from its filesystem type
+// and the rotational flag the kernel keeps for block devices.
+func probeStorage(path string) storageKind {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(path, &fs); err != nil {
+		return storageUnknown
+	}
+	if networkFilesystems[int64(fs.Type)] {
+		return storageNetwork
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return storageUnknown
+	}
+	dev, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/block/%d:%d", unix.Major(uint64(st.Dev)), unix.Minor(uint64(st.Dev))))
+	if err != nil {
+		return storageUnknown
+	}
+	// Partitions don't have a queue of their own, their disk does
+	for _, queue := range []string{filepath.Join(dev, "queue"), filepath.Join(dev, "..", "queue")} {
+		data, err := os.ReadFile(filepath.Join(queue, "rotational"))
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(data)) == "1" {
+			return storageRotational
+		}
+		return storageSolid
+	}
+	return storageUnknown
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package copier
+
+// probeStorage can't tell devices apart on this platform.
+func probeStorage(path string) storageKind {
+	return storageUnknown
+}
@@ -0,0 +1,68 @@
+package copier
+
+import (
+	"cpj/cp"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// linkDests holds the earlier backups of -link-dest, which unchanged files
+// are hard linked from instead of being copied again, as with rsync
+// --link-dest.
+type linkDests struct {
+	dirs stringList
+	// root is the destination root that each of the resolved dirs mirrors.
+	root     string
+	resolved []string
+	perms    bool
+}
+
+// start resolves the directories against dest, the destination root, as
+// rsync does for relative ones. Those missing, like the previous backup on
+// the very first run, are left out with a warning. perms is set when file
+// modes are preserved, so a file must have the same mode to be linked.
+func (l *linkDests) start(dest string, perms bool) {
+	l.root, l.perms, l.resolved = dest, perms, nil
+	for _, given := range l.dirs {
+		dir := filepath.Join(dest, given)
+		if filepath.IsAbs(given) || strings.HasPrefix(given, "~") {
+			var err error
+			if dir, err = cp.AbsolutePath(given); err != nil {
+				slog.Warn("Not linking from -link-dest", "dir", given, "error", err)
+				continue
+			}
+		}
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			slog.Warn("Not linking from a -link-dest that isn't a directory", "dir", dir)
+			continue
+		}
+		l.resolved = append(l.resolved, dir)
+	}
+}
+
+// find returns the file in an earlier backup that dst can be linked to, the
+// first with the same size and modification time as the source file
+// described by info, or "" to copy it.
+func (l *linkDests) find(dst string, info os.FileInfo) string {
+	if len(l.resolved) == 0 || info == nil || !info.Mode().IsRegular() {
+		return ""
+	}
+	rel, err := filepath.Rel(l.root, dst)
+	if err != nil || !filepath.IsLocal(rel) {
+		return ""
+	}
+	for _, dir := range l.resolved {
+		prev := filepath.Join(dir, rel)
+		pinfo, err := os.Lstat(prev)
+		if err != nil || !pinfo.Mode().IsRegular() || pinfo.Size() != info.Size() || !pinfo.ModTime().Equal(info.ModTime()) {
+			continue
+		}
+		if l.perms && pinfo.Mode().Perm() != info.Mode().Perm() {
+			continue
+		}
+		return prev
+	}
+	return ""
+}
@@ -0,0 +1,137 @@
+package copier
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// defaultLogMaxSize is the size at which -log-file is rotated, unless
+// -log-max-size says otherwise.
+const defaultLogMaxSize = 10 << 20
+
+// logFile is the -log-file, rotated once it would grow past maxSize. The
+// rotated logs are named path.1, path.2 and so on, newest first, and only the
+// newest keep are kept. With compress they are gzipped, as path.1.gz.
+type logFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	keep     int
+	compress bool
+	file     *os.File
+	size     int64
+}
+
+// openLogFile opens path for appending. A maxSize of 0 never rotates it.
+func openLogFile(path string, maxSize int64, keep int, compress bool) (*logFile, error) {
+	l := &logFile{path: path, maxSize: maxSize, keep: keep, compress: compress}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *logFile) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+// Write writes a whole log record, rotating the log first if the record
+// would take it past maxSize. A record is never split between two files.
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(p)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return 0, fmt.Errorf("rotating %s: %w", l.path, err)
+		}
+	}
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotated returns the name of the nth rotated log.
+func (l *logFile) rotated(n int) string {
+	name := fmt.Sprintf("%s.%d", l.path, n)
+	if l.compress {
+		name += ".gz"
+	}
+	return name
+}
+
+// rotate moves the current log to path.1, shifting the older ones along and
+// dropping the oldest, and starts a new one.
+func (l *logFile) rotate() (err error) {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	// Whatever goes wrong, logging carries on in path
+	defer func() {
+		if oerr := l.open(); err == nil {
+			err = oerr
+		}
+	}()
+	if l.keep == 0 {
+		return os.Remove(l.path)
+	}
+	if err := os.Remove(l.rotated(l.keep)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for n := l.keep - 1; n > 0; n-- {
+		if err := os.Rename(l.rotated(n), l.rotated(n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if l.compress {
+		return gzipFile(l.path, l.rotated(1))
+	}
+	return os.Rename(l.path, l.rotated(1))
+}
+
+// gzipFile compresses src into dst, then removes src.
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+func (l *logFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,186 @@
+package copier
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// levelTrace is below slog.LevelDebug, for -debug's messages about the
+// workings of cpj itself rather than the files it copies.
+const levelTrace = slog.LevelDebug - 4
+
+// logLevel is the -log-level flag. Warnings and errors are logged by
+// default, info adds the statistics of -useful, debug every file as with
+// -verbose, and trace everything -debug prints.
+type logLevel slog.Level
+
+func (l *logLevel) String() string {
+	if slog.Level(*l) == levelTrace {
+		return "trace"
+	}
+	return strings.ToLower(slog.Level(*l).String())
+}
+
+func (l *logLevel) Set(val string) error {
+	if strings.EqualFold(val, "trace") {
+		*l = logLevel(levelTrace)
+		return nil
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(val)); err != nil {
+		return fmt.Errorf("invalid log level %q, must be trace, debug, info, warn or error", val)
+	}
+	*l = logLevel(level)
+	return nil
+}
+
+// logHandlers make the handlers -log-format can choose, by name.
+var logHandlers = map[string]func(w io.Writer, opts *slog.HandlerOptions) slog.Handler{
+	"plain": func(w io.Writer, opts *slog.HandlerOptions) slog.Handler {
+		return &plainHandler{mu: &sync.Mutex{}, w: w, level: opts.Level}
+	},
+	"text": func(w io.Writer, opts *slog.HandlerOptions) slog.Handler {
+		return slog.NewTextHandler(w, opts)
+	},
+	"json": func(w io.Writer, opts *slog.HandlerOptions) slog.Handler {
+		return slog.NewJSONHandler(w, opts)
+	},
+}
+
+// logFormat is the -log-format flag, naming one of logHandlers.
+type logFormat string
+
+func (f *logFormat) String() string {
+	return string(*f)
+}
+
+func (f *logFormat) Set(val string) error {
+	if _, ok := logHandlers[val]; !ok {
+		names := make([]string, 0, len(logHandlers))
+		for name := range logHandlers {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return fmt.Errorf("invalid log format %q, must be one of %s", val, strings.Join(names, ", "))
+	}
+	*f = logFormat(val)
+	return nil
+}
+
+// setupLogging sends the log to w through the handler named by format,
+// keeping messages below level. Anything still written with the log package
+// is logged as a warning. Only the plain format is colored.
+func setupLogging(w io.Writer, level slog.Level, format logFormat, color colorMode) {
+	opts := &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.LevelKey && len(groups) == 0 && a.Value.Any() == levelTrace {
+				a.Value = slog.StringValue("TRACE")
+			}
+			return a
+		},
+	}
+	handler := logHandlers[string(format)](w, opts)
+	if plain, ok := handler.(*plainHandler); ok {
+		plain.color = color.enabled(w)
+	}
+	slog.SetDefault(slog.New(handler))
+	slog.SetLogLoggerLevel(slog.LevelWarn)
+	log.SetFlags(0)
+}
+
+// plainHandler writes each record as a line in the style of the log
+// package, the message followed by its attributes as key=value pairs. With
+// color set, the messages of errors are red, of warnings yellow, and of the
+// statistics logged at info green.
+type plainHandler struct {
+	mu    *sync.Mutex
+	w     io.Writer
+	level slog.Leveler
+	color bool
+	// attrs holds the attributes added by WithAttrs, already formatted,
+	// and group the prefix WithGroup gives the keys of later ones.
+	attrs []byte
+	group string
+}
+
+func (h *plainHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *plainHandler) Handle(_ context.Context, r slog.Record) error {
+	buf := r.Time.AppendFormat(nil, "2006/01/02 15:04:05 ")
+	msg := r.Message
+	switch {
+	case r.Level >= slog.LevelError:
+		msg = paint(msg, ansiRed, h.color)
+	case r.Level >= slog.LevelWarn:
+		msg = paint(msg, ansiYellow, h.color)
+	case r.Level >= slog.LevelInfo:
+		msg = paint(msg, ansiGreen, h.color)
+	}
+	buf = append(buf, msg...)
+	buf = append(buf, h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		buf = appendAttr(buf, h.group, a)
+		return true
+	})
+	buf = append(buf, '\n')
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.w.Write(buf)
+	return err
+}
+
+func (h *plainHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = slices.Clip(h.attrs)
+	for _, a := range attrs {
+		h2.attrs = appendAttr(h2.attrs, h.group, a)
+	}
+	return &h2
+}
+
+func (h *plainHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.group += name + "."
+	return &h2
+}
+
+// appendAttr appends a to buf as " key=value", quoting values that would
+// be ambiguous, with the keys of groups prefixed by the group name.
+func appendAttr(buf []byte, prefix string, a slog.Attr) []byte {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return buf
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			buf = appendAttr(buf, prefix, ga)
+		}
+		return buf
+	}
+	val := a.Value.String()
+	if val == "" || strings.ContainsAny(val, " =\"\n\t") {
+		val = strconv.Quote(val)
+	}
+	return fmt.Appendf(buf, " %s%s=%s", prefix, a.Key, val)
+}
+
+// trace logs at levelTrace, for -debug.
+func trace(msg string, args ...any) {
+	slog.Log(context.Background(), levelTrace, msg, args...)
+}
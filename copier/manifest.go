@@ -0,0 +1,61 @@
+package copier
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// manifest writes a sha256sum compatible list of copied files. Paths are
+// relative to the destination root, so `sha256sum -c` can be run from there.
+type manifest struct {
+	mu   sync.Mutex
+	root string
+	file *os.File
+	w    *bufio.Writer
+	err  error
+}
+
+func createManifest(path, root string) (*manifest, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(root, string(filepath.Separator)) {
+		root += string(filepath.Separator)
+	}
+	return &manifest{root: root, file: file, w: bufio.NewWriter(file)}, nil
+}
+
+// add records the digest of the file copied to dest. It is safe to call from
+// several workers at once. Write errors are reported by close.
+func (m *manifest) add(dest string, digest []byte) {
+	name := filepath.ToSlash(strings.TrimPrefix(dest, m.root))
+	// Like sha256sum, escape awkward names and flag the line with a backslash
+	prefix := ""
+	if strings.ContainsAny(name, "\\\n\r") {
+		prefix = "\\"
+		name = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "\\r").Replace(name)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := fmt.Fprintf(m.w, "%s%x  %s\n", prefix, digest, name); err != nil && m.err == nil {
+		m.err = err
+	}
+}
+
+// close flushes the manifest and returns the first error hit while writing it.
+func (m *manifest) close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.w.Flush(); err != nil && m.err == nil {
+		m.err = err
+	}
+	if err := m.file.Close(); err != nil && m.err == nil {
+		m.err = err
+	}
+	return m.err
+}
@@ -0,0 +1,72 @@
+package copier
+
+import (
+	"cpj/stack"
+	"fmt"
+	"slices"
+)
+
+// fileOrder selects the order in which the workers take files.
+type fileOrder string
+
+const (
+	// orderNatural leaves the files in the order of the walk, or of their
+	// inodes with -sequential.
+	orderNatural fileOrder = "natural"
+	// orderLargest starts the largest files first, so no worker is left
+	// copying one big file long after the others have finished.
+	orderLargest fileOrder = "largest"
+	// orderSmallest starts the smallest files first.
+	orderSmallest fileOrder = "smallest"
+	// orderReverse copies the files of the walk last first, as cpj did
+	// when the workers popped them off a stack.
+	orderReverse fileOrder = "reverse"
+)
+
+func (o *fileOrder) String() string {
+	return string(*o)
+}
+
+func (o *fileOrder) Set(val string) error {
+	switch order := fileOrder(val); order {
+	case orderNatural, orderLargest, orderSmallest, orderReverse:
+		*o = order
+		return nil
+	}
+	return fmt.Errorf("invalid order %q, must be largest, smallest, reverse or natural", val)
+}
+
+// sortFiles orders files as chosen by -sort, -order and -sequential. The workers are
+// handed them from the start of the list.
+func sortFiles(files stack.Stack[string], scan *treeScan, opts *options) {
+	switch {
+	case opts.sort:
+		slices.Sort(files)
+	case opts.order == orderLargest:
+		slices.SortStableFunc(files, func(a, b string) int {
+			return -cmpInt(scan.sizes[a], scan.sizes[b])
+		})
+	case opts.order == orderSmallest:
+		slices.SortStableFunc(files, func(a, b string) int {
+			return cmpInt(scan.sizes[a], scan.sizes[b])
+		})
+	case opts.order == orderReverse:
+		slices.Reverse(files)
+	case opts.sequential:
+		// Ascending inode order is close to the order of the data on disk
+		// on most filesystems, so a spinning disk seeks less.
+		slices.SortStableFunc(files, func(a, b string) int {
+			return cmpInt(scan.inodes[a], scan.inodes[b])
+		})
+	}
+}
+
+func cmpInt[T int64 | uint64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
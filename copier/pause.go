@@ -0,0 +1,57 @@
+package copier
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+)
+
+// handlePauseRequests pauses the copy on the first of pauseSignals and
+// resumes it on the next, and so on. Paused workers finish the file they are
+// on and then take no further files, so nothing is lost and the disks are
+// left alone until the copy is resumed. SIGTSTP is left to stop cpj at once,
+// as ^Z should. The returned function stops listening for the signals.
+func handlePauseRequests(opts *options) (stop func()) {
+	if len(pauseSignals) == 0 {
+		return func() {}
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, pauseSignals...)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-signals:
+				setPaused(opts, !opts.paused.Load())
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// setPaused pauses or resumes the copy, telling the user which.
+func setPaused(opts *options, paused bool) {
+	if paused == opts.paused.Load() {
+		return
+	}
+	if paused {
+		fmt.Fprintln(statusOut(opts), "Pausing once the copies in progress finish")
+	} else {
+		fmt.Fprintln(statusOut(opts), "Resuming")
+	}
+	d := opts.dispatch.Load()
+	if d == nil {
+		opts.paused.Store(paused)
+		return
+	}
+	// Under mu, so no held worker misses the wake up
+	d.jobs.mu.Lock()
+	opts.paused.Store(paused)
+	d.jobs.wake.Broadcast()
+	d.jobs.mu.Unlock()
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package copier
+
+import "os"
+
+// pauseSignals is empty, as there are no signals to pause the copy with on
+// this platform.
+var pauseSignals []os.Signal
@@ -0,0 +1,11 @@
+//go:build unix
+
+package copier
+
+import (
+	"os"
+	"syscall"
+)
+
+// pauseSignals pause and resume the copy in turn.
+var pauseSignals = []os.Signal{syscall.SIGUSR2}
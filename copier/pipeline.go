@@ -0,0 +1,146 @@
+package copier
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// pipeChunks is how many chunks of a file the read pool may read ahead of
+// its writer. With -read-jobs and -write-jobs, at most this many chunks plus
+// two are held for each file in flight, and at most -read-jobs plus twice
+// -write-jobs files are in flight.
+const pipeChunks = 8
+
+// transfer is a file handed from the read pool to the write pool. The reader
+// sends its contents over chunks, in order, then closes it, leaving any read
+// error in err first. Files that aren't regular are not read ahead, and have
+// no chunks.
+type transfer struct {
+	fileEntry
+	chunks  chan chunk
+	err     error
+	buffers *sync.Pool
+	// done is closed by the writer once it no longer wants the data, as
+	// when the file was skipped, linked or failed.
+	done  chan struct{}
+	taken bool
+}
+
+// chunk is one buffer of file data, of which the first n bytes are used.
+type chunk struct {
+	buf *[]byte
+	n   int
+}
+
+// readRoutine is a worker of the read pool. It takes files from jobs, hands
+// each to the write pool over jobs.ready, and reads it into chunks for the
+// writer that picks it up.
+func readRoutine(jobs *copyJob, buffers *sync.Pool) {
+	for {
+		f, ok := jobs.take()
+		if !ok {
+			return
+		}
+		t := &transfer{fileEntry: f, buffers: buffers, done: make(chan struct{})}
+		if info, err := f.stat(); err == nil && info.Mode().IsRegular() {
+			t.chunks = make(chan chunk, pipeChunks)
+		}
+		select {
+		case jobs.ready <- t:
+		case <-jobs.quit:
+			return
+		}
+		if t.chunks != nil {
+			t.fill()
+		}
+	}
+}
+
+// fill reads the source file into chunks until the end, an error, or the
+// writer giving up on it.
+func (t *transfer) fill() {
+	file, err := os.Open(t.src)
+	if err != nil {
+		t.err = err
+		close(t.chunks)
+		return
+	}
+	defer file.Close()
+	t.fillFrom(file)
+}
+
+// fillFrom is fill reading the data from r.
+func (t *transfer) fillFrom(r io.Reader) {
+	defer close(t.chunks)
+	for {
+		buf := t.buffers.Get().(*[]byte)
+		n, err := io.ReadFull(r, *buf)
+		if n > 0 {
+			select {
+			case t.chunks <- chunk{buf: buf, n: n}:
+			case <-t.done:
+				return
+			}
+		} else {
+			t.buffers.Put(buf)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return
+		}
+		if err != nil {
+			t.err = err
+			return
+		}
+	}
+}
+
+// open is the cp.Options.Open of the file. The first call reads the data
+// already read by the read pool. Retries read the file again themselves.
+func (t *transfer) open(src string) (io.ReadCloser, error) {
+	if t.taken || t.chunks == nil {
+		return os.Open(src)
+	}
+	t.taken = true
+	return &chunkReader{t: t}, nil
+}
+
+// close tells the reader the data is no longer wanted.
+func (t *transfer) close() {
+	close(t.done)
+}
+
+// chunkReader reads a file from the chunks of its transfer.
+type chunkReader struct {
+	t    *transfer
+	cur  *[]byte
+	rest []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.rest) == 0 {
+		if r.cur != nil {
+			r.t.buffers.Put(r.cur)
+			r.cur = nil
+		}
+		c, ok := <-r.t.chunks
+		if !ok {
+			if r.t.err != nil {
+				return 0, r.t.err
+			}
+			return 0, io.EOF
+		}
+		r.cur, r.rest = c.buf, (*c.buf)[:c.n]
+	}
+	n := copy(p, r.rest)
+	r.rest = r.rest[n:]
+	return n, nil
+}
+
+func (r *chunkReader) Close() error {
+	if r.cur != nil {
+		r.t.buffers.Put(r.cur)
+		r.cur = nil
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package copier
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// progressInterval is how often the progress line is redrawn.
+const progressInterval = 200 * time.Millisecond
+
+// progress tracks completed work reported by the copy workers and renders a
+// single self-overwriting status line.
+type progress struct {
+	out        io.Writer
+	total      int
+	totalBytes int64
+	files      int
+	bytes      int64
+	start      time.Time
+}
+
+// runProgress consumes per-file byte counts from updates until it is closed,
+// redrawing the status line periodically. done is closed once the final line
+// has been printed.
+func runProgress(out io.Writer, total int, totalBytes int64, updates <-chan int64, done chan<- struct{}) {
+	p := progress{out: out, total: total, totalBytes: totalBytes, start: time.Now()}
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	defer close(done)
+	for {
+		select {
+		case n, ok := <-updates:
+			if !ok {
+				p.render()
+				fmt.Fprintln(p.out)
+				return
+			}
+			p.files++
+			p.bytes += n
+		case <-ticker.C:
+			p.render()
+		}
+	}
+}
+
+// fraction returns how much of the work is done, by bytes when the total size
+// is known and by files otherwise.
+func (p *progress) fraction() float64 {
+	switch {
+	case p.totalBytes > 0:
+		return float64(p.bytes) / float64(p.totalBytes)
+	case p.total > 0:
+		return float64(p.files) / float64(p.total)
+	}
+	return 0
+}
+
+func (p *progress) render() {
+	elapsed := time.Since(p.start)
+	done := p.fraction()
+	var rate float64
+	if elapsed > 0 {
+		rate = float64(p.bytes) / elapsed.Seconds()
+	}
+	eta := "--"
+	if done > 0 && done < 1 {
+		remaining := time.Duration(float64(elapsed) * (1 - done) / done)
+		eta = remaining.Round(time.Second).String()
+	}
+	fmt.Fprintf(p.out, "\r%s %d/%d files %s of %s (%5.1f%%) %s/s ETA %s\033[K",
+		progressBar(done*100, 30), p.files, p.total, formatBytes(p.bytes), formatBytes(p.totalBytes),
+		done*100, formatBytes(int64(rate)), eta)
+}
+
+func progressBar(percent float64, width int) string {
+	filled := int(percent / 100 * float64(width))
+	bar := make([]byte, width)
+	for i := range bar {
+		if i < filled {
+			bar[i] = '#'
+		} else {
+			bar[i] = '.'
+		}
+	}
+	return "[" + string(bar) + "]"
+}
+
+// formatBytes renders n using binary units, e.g. 1.5 GiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,24 @@
+package copier
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	promptMu sync.Mutex
+	stdin    = bufio.NewReader(os.Stdin)
+)
+
+// confirmOverwrite asks whether dst may be replaced, reading the answer from
+// stdin. Prompts from parallel jobs are asked one at a time.
+func confirmOverwrite(dst string) bool {
+	promptMu.Lock()
+	defer promptMu.Unlock()
+	fmt.Fprintf(os.Stderr, "cpj: overwrite %s? (y/n) ", dst)
+	answer, _ := stdin.ReadString('\n')
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(answer)), "y")
+}
@@ -0,0 +1,145 @@
+package copier
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// renameRule is a sed style substitution, s/regexp/replacement/[gi], applied
+// to the slash separated path of each file relative to the source root.
+type renameRule struct {
+	expr   string
+	re     *regexp.Regexp
+	repl   string
+	global bool
+}
+
+// renameRules is a flag.Value collecting the -rename rules, which are applied
+// in order.
+type renameRules []renameRule
+
+func (r *renameRules) String() string {
+	exprs := make([]string, len(*r))
+	for i, rule := range *r {
+		exprs[i] = rule.expr
+	}
+	return strings.Join(exprs, ",")
+}
+
+func (r *renameRules) Set(val string) error {
+	rule, err := parseRenameRule(val)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, rule)
+	return nil
+}
+
+func parseRenameRule(expr string) (renameRule, error) {
+	if len(expr) < 4 || expr[0] != 's' {
+		return renameRule{}, fmt.Errorf("invalid rename rule %q, must be s/regexp/replacement/", expr)
+	}
+	parts := splitUnescaped(expr[2:], expr[1])
+	if len(parts) != 3 {
+		return renameRule{}, fmt.Errorf("invalid rename rule %q, must be s/regexp/replacement/", expr)
+	}
+	pattern, flags := parts[0], parts[2]
+	global := false
+	for _, flag := range flags {
+		switch flag {
+		case 'g':
+			global = true
+		case 'i':
+			pattern = "(?i)" + pattern
+		default:
+			return renameRule{}, fmt.Errorf("invalid rename rule %q: unknown flag %q", expr, flag)
+		}
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return renameRule{}, fmt.Errorf("invalid rename rule %q: %w", expr, err)
+	}
+	return renameRule{expr: expr, re: re, repl: sedReplacement(parts[1]), global: global}, nil
+}
+
+// splitUnescaped splits s at every delim not preceded by a backslash, and
+// unescapes the escaped ones.
+func splitUnescaped(s string, delim byte) []string {
+	var parts []string
+	var part strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == delim:
+			part.WriteByte(delim)
+			i++
+		case s[i] == '\\' && i+1 < len(s):
+			part.WriteString(s[i : i+2])
+			i++
+		case s[i] == delim:
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteByte(s[i])
+		}
+	}
+	return append(parts, part.String())
+}
+
+// sedReplacement converts a sed replacement, using \1 and &, to the ${1}
+// syntax of regexp.Expand.
+func sedReplacement(repl string) string {
+	var b strings.Builder
+	for i := 0; i < len(repl); i++ {
+		switch c := repl[i]; {
+		case c == '\\' && i+1 < len(repl) && repl[i+1] >= '0' && repl[i+1] <= '9':
+			fmt.Fprintf(&b, "${%c}", repl[i+1])
+			i++
+		case c == '\\' && i+1 < len(repl):
+			b.WriteByte(repl[i+1])
+			i++
+		case c == '&':
+			b.WriteString("${0}")
+		case c == '$':
+			b.WriteString("$$")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func (rule renameRule) apply(path string) string {
+	if rule.global {
+		return rule.re.ReplaceAllString(path, rule.repl)
+	}
+	loc := rule.re.FindStringSubmatchIndex(path)
+	if loc == nil {
+		return path
+	}
+	out := rule.re.ExpandString(nil, rule.repl, path, loc)
+	return path[:loc[0]] + string(out) + path[loc[1]:]
+}
+
+// apply rewrites rel, a path relative to the source root. A rewrite that
+// would leave the destination root is ignored with a warning.
+func (r renameRules) apply(rel string) string {
+	if len(r) == 0 {
+		return rel
+	}
+	path := filepath.ToSlash(rel)
+	for _, rule := range r {
+		path = rule.apply(path)
+	}
+	renamed := filepath.FromSlash(path)
+	if renamed == rel {
+		return rel
+	}
+	if !filepath.IsLocal(renamed) {
+		slog.Warn("Ignoring rename outside the destination", "path", rel, "renamed", renamed)
+		return rel
+	}
+	return renamed
+}
@@ -0,0 +1,81 @@
+package copier
+
+import (
+	"context"
+	"cpj/cp"
+	"errors"
+	"hash"
+	"io/fs"
+	"log/slog"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// maxRetryDelay caps the exponential backoff between attempts.
+const maxRetryDelay = time.Minute
+
+// copyWithRetry copies src to dst, retrying up to opts.retries times when the
+// copy fails. Attempt n waits a random time between half and all of
+// retryDelay*2^n, so workers hitting the same flaky server spread out. A
+// non-nil stream supplies the data the read pool has read ahead, and a
+// non-nil info what the walk found at src, which only the first attempt
+// trusts.
+func copyWithRetry(src, dst string, info os.FileInfo, opts *options, h hash.Hash, stream *transfer) (res cp.Result, err error) {
+	copyOpts := opts.copyOptions()
+	copyOpts.SrcInfo = info
+	copyOpts.LinkFrom = opts.linkDest.find(dst, info)
+	copyOpts.Encode = opts.encoder(src, info)
+	copyOpts.Decode = opts.decoder(src, info)
+	if stream != nil {
+		defer stream.close()
+		copyOpts.Open = stream.open
+	}
+	for attempt := 0; ; attempt++ {
+		if h != nil {
+			h.Reset()
+		}
+		res, err = cp.CopyFileDigest(src, dst, copyOpts, h)
+		if err == nil || attempt >= opts.retries || !retryable(err) || opts.ctx.Err() != nil {
+			return res, err
+		}
+		copyOpts.SrcInfo = nil
+		delay := backoff(opts.retryDelay, attempt)
+		slog.Debug("Copy failed, retrying", "src", src, "error", err, "attempt", attempt+1, "delay", delay.Round(time.Millisecond))
+		if !sleep(opts.ctx, delay) {
+			return res, err
+		}
+	}
+}
+
+// retryable reports whether err might go away on another attempt. Missing
+// files and denied permissions won't.
+func retryable(err error) bool {
+	return !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, fs.ErrPermission)
+}
+
+// sleep waits for d, reporting false if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func backoff(base time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 0; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,148 @@
+package copier
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// sanitizeMode selects the filesystem whose naming rules -sanitize enforces.
+type sanitizeMode string
+
+const (
+	// sanitizeFAT and sanitizeNTFS share the Windows rules: no control
+	// characters or <>:"\|?*, no trailing dots or spaces, and no reserved
+	// device names such as CON or LPT1.
+	sanitizeFAT  sanitizeMode = "fat"
+	sanitizeNTFS sanitizeMode = "ntfs"
+	// sanitizePOSIX only allows the POSIX portable filename characters,
+	// letters, digits, '.', '_' and '-'.
+	sanitizePOSIX sanitizeMode = "posix"
+)
+
+func (m *sanitizeMode) String() string {
+	return string(*m)
+}
+
+func (m *sanitizeMode) Set(val string) error {
+	switch mode := sanitizeMode(val); mode {
+	case sanitizeFAT, sanitizeNTFS, sanitizePOSIX:
+		*m = mode
+		return nil
+	}
+	return fmt.Errorf("invalid sanitize mode %q, must be fat, ntfs or posix", val)
+}
+
+// windowsReserved are the device names Windows won't use as a file name,
+// with or without an extension.
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizer rewrites destination names that are invalid on the target
+// filesystem, remembering every rename for the summary.
+type sanitizer struct {
+	mode sanitizeMode
+	repl string
+
+	mu      sync.Mutex
+	renamed map[string]string
+	// taken maps each sanitized path back to the first path renamed to it,
+	// to warn when two files collide.
+	taken map[string]string
+}
+
+// validate checks that the replacement is itself valid in names.
+func (s *sanitizer) validate() error {
+	if s.mode != "" && (s.repl == "" || strings.IndexFunc(s.repl, s.invalid) >= 0) {
+		return fmt.Errorf("-sanitize-char %q is not valid for %s", s.repl, s.mode)
+	}
+	return nil
+}
+
+// path sanitizes every element of rel, a path relative to the destination root.
+func (s *sanitizer) path(rel string) string {
+	if s.mode == "" {
+		return rel
+	}
+	names := strings.Split(rel, string(filepath.Separator))
+	for i, name := range names {
+		names[i] = s.name(name)
+	}
+	clean := strings.Join(names, string(filepath.Separator))
+	if clean == rel {
+		return rel
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.renamed == nil {
+		s.renamed, s.taken = make(map[string]string), make(map[string]string)
+	}
+	if _, ok := s.renamed[rel]; !ok {
+		s.renamed[rel] = clean
+		if first, ok := s.taken[clean]; ok {
+			slog.Warn("Two paths are renamed to the same name", "first", first, "second", rel, "renamed", clean)
+		} else {
+			s.taken[clean] = rel
+		}
+	}
+	return clean
+}
+
+func (s *sanitizer) name(name string) string {
+	if name == "" || name == "." || name == ".." {
+		return name
+	}
+	var b strings.Builder
+	for _, r := range name {
+		if s.invalid(r) {
+			b.WriteString(s.repl)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	clean := b.String()
+	if s.mode == sanitizePOSIX {
+		return clean
+	}
+	if trimmed := strings.TrimRight(clean, ". "); trimmed != clean {
+		clean = trimmed + strings.Repeat(s.repl, len(clean)-len(trimmed))
+	}
+	base := strings.ToUpper(strings.TrimSpace(strings.SplitN(clean, ".", 2)[0]))
+	if windowsReserved[base] {
+		clean = s.repl + clean
+	}
+	return clean
+}
+
+func (s *sanitizer) invalid(r rune) bool {
+	if s.mode == sanitizePOSIX {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-')
+	}
+	return r < 32 || strings.ContainsRune(`<>:"\|?*`, r)
+}
+
+// report lists the renames made, if any.
+func (s *sanitizer) report() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.renamed) == 0 {
+		return
+	}
+	fmt.Printf("Renamed %d paths to suit %s:\n", len(s.renamed), s.mode)
+	paths := make([]string, 0, len(s.renamed))
+	for path := range s.renamed {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		fmt.Printf("  %s -> %s\n", path, s.renamed[path])
+	}
+}
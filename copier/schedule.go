@@ -0,0 +1,149 @@
+package copier
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schedule is when a recurring daemon job runs: either every so often, or
+// at the times matched by a cron expression.
+type schedule struct {
+	every time.Duration
+	// The fields of a cron expression, as bit sets of the values matched.
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny are set for a day of month or week starting with
+	// a *, stepped or not. As in cron, when neither does a day matching
+	// either will do.
+	domAny, dowAny bool
+}
+
+// scheduleAliases are the cron shorthands understood.
+var scheduleAliases = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+// parseSchedule parses "every DURATION", e.g. every 6h, or a cron expression
+// of minute, hour, day of month, month and day of week, each a *, a value, a
+// range or a list of those, optionally with a /step, e.g. "30 2 * * 1-5".
+func parseSchedule(spec string) (*schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if every, ok := strings.CutPrefix(spec, "every "); ok {
+		d, err := time.ParseDuration(strings.TrimSpace(every))
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %w", spec, err)
+		}
+		if d < time.Minute {
+			return nil, fmt.Errorf("invalid schedule %q: must be at least a minute apart", spec)
+		}
+		return &schedule{every: d}, nil
+	}
+	expr := spec
+	if alias, ok := scheduleAliases[spec]; ok {
+		expr = alias
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q: want every DURATION or a cron expression of 5 fields", spec)
+	}
+	s := &schedule{domAny: strings.HasPrefix(fields[2], "*"), dowAny: strings.HasPrefix(fields[4], "*")}
+	for i, f := range []struct {
+		bits     *uint64
+		min, max int
+	}{{&s.minute, 0, 59}, {&s.hour, 0, 23}, {&s.dom, 1, 31}, {&s.month, 1, 12}, {&s.dow, 0, 7}} {
+		bits, err := parseCronField(fields[i], f.min, f.max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %w", spec, err)
+		}
+		*f.bits = bits
+	}
+	// 7 is Sunday too
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	if s.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("invalid schedule %q: never runs", spec)
+	}
+	return s, nil
+}
+
+// parseCronField returns the values between min and max matched by field.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepText)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			first, last, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(first); err != nil {
+				return 0, fmt.Errorf("invalid value %q", first)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(last); err != nil {
+					return 0, fmt.Errorf("invalid value %q", last)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of the range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	if bits == 0 {
+		return 0, errors.New("empty field")
+	}
+	return bits, nil
+}
+
+// next returns when s next runs after t, in t's time zone, or the zero time
+// if it never does.
+func (s *schedule) next(t time.Time) time.Time {
+	if s.every > 0 {
+		return t.Add(s.every)
+	}
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, t.Location())
+	// Skip a unit at a time, from the largest that doesn't match. A date
+	// that doesn't exist, like 30 February, gives up after a few years.
+	for limit := t.Year() + 5; t.Year() <= limit; {
+		switch {
+		case s.month&(1<<t.Month()) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *schedule) matchesDay(t time.Time) bool {
+	dom, dow := s.dom&(1<<t.Day()) != 0, s.dow&(1<<t.Weekday()) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
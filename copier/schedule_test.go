@@ -0,0 +1,70 @@
+package copier
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	// A Wednesday
+	from := time.Date(2026, time.March, 4, 10, 30, 15, 0, time.UTC)
+	for _, tc := range []struct {
+		spec string
+		want time.Time
+	}{
+		{"every 6h", from.Add(6 * time.Hour)},
+		{"* * * * *", time.Date(2026, time.March, 4, 10, 31, 0, 0, time.UTC)},
+		{"30 2 * * *", time.Date(2026, time.March, 5, 2, 30, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, time.March, 4, 10, 45, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2026, time.March, 4, 13, 0, 0, 0, time.UTC)},
+		{"0,45 10 * * *", time.Date(2026, time.March, 4, 10, 45, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2026, time.March, 4, 11, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2026, time.April, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2027, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 1-5", time.Date(2026, time.March, 5, 0, 0, 0, 0, time.UTC)},
+		// 7 is Sunday too
+		{"0 0 * * 7", time.Date(2026, time.March, 8, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		// With both days restricted, either will do: the 10th or a Friday
+		{"0 0 10 * 5", time.Date(2026, time.March, 6, 0, 0, 0, 0, time.UTC)},
+		// A stepped * counts as unrestricted, so both must match: an odd
+		// day that is a Monday, and a 4th that is a Sunday, Tuesday,
+		// Thursday or Saturday
+		{"0 0 */2 * 1", time.Date(2026, time.March, 9, 0, 0, 0, 0, time.UTC)},
+		{"0 0 4 * */2", time.Date(2026, time.April, 4, 0, 0, 0, 0, time.UTC)},
+	} {
+		s, err := parseSchedule(tc.spec)
+		if err != nil {
+			t.Errorf("%s: %v", tc.spec, err)
+			continue
+		}
+		if got := s.next(from); !got.Equal(tc.want) {
+			t.Errorf("%s: next run at %v, want %v", tc.spec, got, tc.want)
+		}
+	}
+}
+
+func TestScheduleInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"every",
+		"every 30s",
+		"every soon",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"0 0 30 2 *",
+		"@never",
+	} {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Errorf("%q was taken", spec)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package copier
+
+import (
+	"cpj/sftp"
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// remotePath is a [user@]host:path operand, as scp takes them. An empty
+// path is the home directory.
+type remotePath struct {
+	host, path string
+}
+
+func (r remotePath) String() string {
+	host := r.host
+	// An IPv6 address is bracketed, to tell its colons from the path's
+	if user, addr, ok := strings.Cut(host, "@"); ok && strings.Contains(addr, ":") {
+		host = user + "@[" + addr + "]"
+	} else if !ok && strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return host + ":" + r.path
+}
+
+// parseRemote reports whether arg is a remote operand, and what it names.
+// Like scp, an operand is remote if it has a colon before any slash, so
+// ./a:b is a local file. A bucket URL or a Windows drive letter isn't.
+func parseRemote(arg string) (remotePath, bool) {
+	if isBucketURL(arg) || filepath.VolumeName(arg) != "" {
+		return remotePath{}, false
+	}
+	i := strings.IndexAny(arg, ":/[\\")
+	if i < 0 || arg[i] == '/' || arg[i] == filepath.Separator {
+		return remotePath{}, false
+	}
+	var r remotePath
+	switch arg[i] {
+	case ':':
+		r.host, r.path = arg[:i], arg[i+1:]
+	case '[':
+		end := strings.Index(arg, "]:")
+		if end < i || strings.ContainsAny(arg[:end], "/"+string(filepath.Separator)) {
+			return remotePath{}, false
+		}
+		r.host, r.path = arg[:i]+arg[i+1:end], arg[end+2:]
+	default:
+		return remotePath{}, false
+	}
+	// A host starting with a dash would be taken by ssh for a flag
+	if r.host == "" || strings.HasPrefix(r.host, "-") || strings.HasSuffix(r.host, "@") {
+		return remotePath{}, false
+	}
+	if r.path == "" {
+		r.path = "."
+	}
+	return r, true
+}
+
+// isRemote reports whether arg is a [user@]host:path operand.
+func isRemote(arg string) bool {
+	_, ok := parseRemote(arg)
+	return ok
+}
+
+// openRemote returns the tree below the remote r. Its connections are
+// made with -ssh-command, as many as are used at once, and again once lost.
+func openRemote(r remotePath, opts *options) (*tree, error) {
+	command := strings.Fields(opts.sshCommand)
+	if len(command) == 0 {
+		return nil, errorOf(ErrUsage, "-ssh-command is empty")
+	}
+	// Connections are made one at a time, as sshd drops those beyond a
+	// few still authenticating
+	var dialing sync.Mutex
+	f := sftp.NewFS(r.path, func() (*sftp.Client, error) {
+		dialing.Lock()
+		defer dialing.Unlock()
+		slog.Debug("Connecting", "host", r.host, "command", strings.Join(command, " "))
+		return sftp.Dial(command, r.host)
+	})
+	label := func(name string) string {
+		return remotePath{r.host, f.Path(name)}.String()
+	}
+	return &tree{fs: f, wfs: f, label: label, close: f.Close}, nil
+}
+
+// sftpRetryable reports whether err might go away on another attempt: the
+// connection was lost or couldn't be made, or a local file failed as
+// retryable has it. What the server refused stays refused.
+func sftpRetryable(err error) bool {
+	var serr *sftp.StatusError
+	if errors.As(err, &serr) {
+		return false
+	}
+	return retryable(err)
+}
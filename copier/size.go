@@ -0,0 +1,55 @@
+package copier
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// sizeUnits maps the accepted size suffixes to their multipliers. Bare and
+// "iB" suffixes are binary; "B" suffixes are decimal, as in coreutils.
+var sizeUnits = map[string]int64{
+	"": 1, "B": 1,
+	"K": 1 << 10, "KIB": 1 << 10, "KB": 1e3,
+	"M": 1 << 20, "MIB": 1 << 20, "MB": 1e6,
+	"G": 1 << 30, "GIB": 1 << 30, "GB": 1e9,
+	"T": 1 << 40, "TIB": 1 << 40, "TB": 1e12,
+	"P": 1 << 50, "PIB": 1 << 50, "PB": 1e15,
+}
+
+// parseSize parses a human readable size such as 512, 64K, 1.5G or 10MB.
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+	unit, ok := sizeUnits[strings.ToUpper(strings.TrimSpace(s[i:]))]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q: unknown unit", s)
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// byteSize is a flag.Value holding a size in bytes, set from a human readable
+// size such as 64K or 4M.
+type byteSize int64
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(val string) error {
+	n, err := parseSize(val)
+	if err != nil {
+		return err
+	}
+	*b = byteSize(n)
+	return nil
+}
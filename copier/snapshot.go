@@ -0,0 +1,197 @@
+package copier
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// snapshotLayout names each snapshot by the time it was taken.
+const snapshotLayout = "2006-01-02T15:04:05"
+
+// latestSnapshot is the symlink to the newest complete snapshot.
+const latestSnapshot = "latest"
+
+// retention is a policy for which snapshots to keep, like "7 daily, 4
+// weekly": the newest snapshot of each of the last 7 days that have one, and
+// of the last 4 weeks.
+type retention []keepRule
+
+type keepRule struct {
+	count int
+	// period returns the hour, day, week, month or year t falls in.
+	period func(t time.Time) string
+}
+
+// snapshotPeriods are the units of a retention policy.
+var snapshotPeriods = map[string]func(t time.Time) string{
+	"hourly": func(t time.Time) string { return t.Format("2006-01-02T15") },
+	"daily":  func(t time.Time) string { return t.Format(time.DateOnly) },
+	"weekly": func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	},
+	"monthly": func(t time.Time) string { return t.Format("2006-01") },
+	"yearly":  func(t time.Time) string { return t.Format("2006") },
+}
+
+func (r *retention) String() string {
+	return ""
+}
+
+func (r *retention) Set(val string) error {
+	*r = nil
+	for _, rule := range strings.Split(val, ",") {
+		fields := strings.Fields(rule)
+		if len(fields) != 2 {
+			return fmt.Errorf("invalid rule %q, want e.g. 7 daily", strings.TrimSpace(rule))
+		}
+		count, err := strconv.Atoi(fields[0])
+		if err != nil || count < 1 {
+			return fmt.Errorf("invalid count %q", fields[0])
+		}
+		period, ok := snapshotPeriods[fields[1]]
+		if !ok {
+			return fmt.Errorf("invalid period %q, must be hourly, daily, weekly, monthly or yearly", fields[1])
+		}
+		*r = append(*r, keepRule{count, period})
+	}
+	return nil
+}
+
+// keeps returns which of the snapshots taken at times, newest first, r
+// keeps. The newest is always kept.
+func (r retention) keeps(times []time.Time) []bool {
+	keep := make([]bool, len(times))
+	if len(times) > 0 {
+		keep[0] = true
+	}
+	for _, rule := range r {
+		last, kept := "", 0
+		for i, t := range times {
+			if kept == rule.count {
+				break
+			}
+			if p := rule.period(t); p != last {
+				last = p
+				kept++
+				keep[i] = true
+			}
+		}
+	}
+	return keep
+}
+
+// snapshotMain implements `cpj snapshot`, syncing src into a new directory
+// of dest named by the time, with the files unchanged since the latest
+// snapshot hard linked from it, then pointing dest/latest at it and pruning
+// the snapshots -keep doesn't keep.
+func snapshotMain(args []string) int {
+	cmd := lookupCommand("snapshot")
+	var keep retention
+	flags := flag.NewFlagSet("snapshot", flag.ContinueOnError)
+	flags.Var(&keep, "keep", `Once the snapshot is taken, remove those older than it but the newest of each of the periods given, e.g. "7 daily, 4 weekly, 12 monthly". Periods are hourly, daily, weekly, monthly and yearly. By default every snapshot is kept.`)
+	flags.Usage = func() {
+		cmd.printUsage()
+		flags.PrintDefaults()
+	}
+	if err := applyEnv(flags); err != nil {
+		log.Print(err)
+		return exitUsage
+	}
+	syncArgs, err := cutFlags(flags, args)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		log.Print(err)
+		return exitUsage
+	}
+	n := len(syncArgs)
+	if n < 2 || strings.HasPrefix(syncArgs[n-2], "-") || strings.HasPrefix(syncArgs[n-1], "-") {
+		flags.Usage()
+		return exitUsage
+	}
+	src, dest := syncArgs[n-2], syncArgs[n-1]
+	syncFlags := syncArgs[: n-2 : n-2]
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		log.Print(err)
+		return exitFailure
+	}
+	name := time.Now().Format(snapshotLayout)
+	if _, err := os.Lstat(filepath.Join(dest, name)); err == nil {
+		log.Printf("snapshot %s already exists", filepath.Join(dest, name))
+		return exitFailure
+	}
+	// The snapshot only appears once complete, so latest always points at
+	// one that is
+	syncFlags = append(syncFlags, "-staged")
+	if prev, err := os.Readlink(filepath.Join(dest, latestSnapshot)); err == nil {
+		syncFlags = append(syncFlags, "-link-dest", filepath.Join("..", prev))
+	}
+	if status := runCopy("sync", syncDefaults, append(syncFlags, src, filepath.Join(dest, name))); status != 0 {
+		return status
+	}
+	if err := pointLatest(dest, name); err != nil {
+		slog.Error(err.Error())
+		return exitFailure
+	}
+	if err := pruneSnapshots(dest, keep); err != nil {
+		slog.Error(err.Error())
+		return exitFailure
+	}
+	return 0
+}
+
+// pointLatest points the latest symlink in dest at the snapshot name,
+// replacing it atomically.
+func pointLatest(dest, name string) error {
+	tmp := filepath.Join(dest, "."+latestSnapshot+".tmp")
+	os.Remove(tmp)
+	if err := os.Symlink(name, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dest, latestSnapshot))
+}
+
+// pruneSnapshots removes the snapshots in dest that keep doesn't keep. With
+// no policy every snapshot is kept. Other entries of dest are left alone.
+func pruneSnapshots(dest string, keep retention) error {
+	if len(keep) == 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(dest)
+	if err != nil {
+		return err
+	}
+	var names []string
+	var times []time.Time
+	// Names sort by time, and the newest come first
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		t, err := time.ParseInLocation(snapshotLayout, entry.Name(), time.Local)
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		names, times = append(names, entry.Name()), append(times, t)
+	}
+	var errs []error
+	for i, kept := range keep.keeps(times) {
+		if kept {
+			continue
+		}
+		slog.Info("Removing old snapshot", "snapshot", names[i])
+		if err := os.RemoveAll(filepath.Join(dest, names[i])); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
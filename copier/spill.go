@@ -0,0 +1,125 @@
+package copier
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// spillQueue is the queue of files between the walk and the workers. It holds
+// at most limit entries in memory. Beyond that, push waits for the workers
+// to catch up, or with a spill file appends the entries to it, to be read
+// back in order once the ones in memory are taken. Spilled entries lose
+// their FileInfo.
+type spillQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	mem    []fileEntry
+	closed bool
+
+	// path is the spill file, written through w and read through r. spilled
+	// counts the entries written to it and not read back yet.
+	path    string
+	w, r    *os.File
+	bw      *bufio.Writer
+	br      *bufio.Reader
+	spilled int
+	err     error
+}
+
+// newSpillQueue creates a queue holding limit entries in memory. If dir is
+// not empty, further entries spill to a temporary file in it.
+func newSpillQueue(limit int, dir string) (*spillQueue, error) {
+	q := &spillQueue{limit: limit}
+	q.cond = sync.NewCond(&q.mu)
+	if dir == "" {
+		return q, nil
+	}
+	w, err := os.CreateTemp(dir, ".cpj-spill-*")
+	if err != nil {
+		return nil, err
+	}
+	r, err := os.Open(w.Name())
+	if err != nil {
+		w.Close()
+		os.Remove(w.Name())
+		return nil, err
+	}
+	q.path, q.w, q.r = w.Name(), w, r
+	q.bw, q.br = bufio.NewWriter(w), bufio.NewReader(r)
+	return q, nil
+}
+
+// push adds e to the queue, waiting while it is full unless it can spill.
+func (q *spillQueue) push(e fileEntry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.w == nil && len(q.mem) >= q.limit {
+		q.cond.Wait()
+	}
+	// Once entries have spilled, later ones follow them to keep the order
+	if q.spilled == 0 && len(q.mem) < q.limit {
+		q.mem = append(q.mem, e)
+	} else if q.err == nil {
+		// Paths can't contain NUL
+		_, q.err = q.bw.WriteString(e.src + "\x00" + e.dest + "\x00" + strconv.FormatInt(e.size, 10) + "\x00")
+		q.spilled++
+	}
+	q.cond.Broadcast()
+}
+
+// close marks the end of the entries.
+func (q *spillQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// pop takes the oldest entry, waiting for one to be pushed. It is false once
+// the queue is closed and empty, or the spill file failed.
+func (q *spillQueue) pop() (fileEntry, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.mem) == 0 && q.spilled == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.mem) > 0 {
+		e := q.mem[0]
+		q.mem = q.mem[1:]
+		q.cond.Broadcast()
+		return e, true
+	}
+	if q.spilled == 0 || q.err != nil {
+		return fileEntry{}, false
+	}
+	if q.err = q.bw.Flush(); q.err != nil {
+		return fileEntry{}, false
+	}
+	var fields [3]string
+	for i := range fields {
+		field, err := q.br.ReadString(0)
+		if err != nil {
+			q.err = err
+			return fileEntry{}, false
+		}
+		fields[i] = strings.TrimSuffix(field, "\x00")
+	}
+	q.spilled--
+	size, _ := strconv.ParseInt(fields[2], 10, 64)
+	return fileEntry{src: fields[0], dest: fields[1], size: size}, true
+}
+
+// cleanup removes the spill file and returns any error it had.
+func (q *spillQueue) cleanup() error {
+	if q.w == nil {
+		return nil
+	}
+	q.w.Close()
+	q.r.Close()
+	os.Remove(q.path)
+	return q.err
+}
@@ -0,0 +1,79 @@
+package copier
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// errExchangeUnsupported is returned by exchangeDirs where there is no atomic
+// exchange.
+var errExchangeUnsupported = errors.New("atomic exchange not supported")
+
+// stagingPath returns the hidden directory beside dest that -staged copies
+// into. Being a sibling keeps it on the same filesystem, so it can be renamed
+// over dest.
+func stagingPath(dest string) string {
+	return filepath.Join(filepath.Dir(dest), ".cpj-staging-"+filepath.Base(dest))
+}
+
+// startStaging prepares the staging directory for dest and returns its path.
+// A leftover from an earlier failed run is cleared, unless that run is being
+// resumed.
+func startStaging(dest string, resumed bool) (string, error) {
+	staging := stagingPath(dest)
+	if !resumed {
+		if err := os.RemoveAll(staging); err != nil {
+			return "", err
+		}
+	}
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		return "", err
+	}
+	return staging, nil
+}
+
+// finishStaging swaps the staging directory into place if the copy succeeded,
+// and removes the previous contents of dest. A failed copy is rolled back by
+// removing the staging directory, leaving dest untouched. It is kept instead
+// when keep is set, as it holds files a resumed run or a -move needs.
+func finishStaging(staging, dest string, err error, keep bool) error {
+	if err != nil {
+		if keep {
+			slog.Warn("Keeping staging directory", "dir", staging)
+		} else {
+			os.RemoveAll(staging)
+		}
+		return err
+	}
+	if err := swapDirs(staging, dest); err != nil {
+		if !keep {
+			os.RemoveAll(staging)
+		}
+		return fmt.Errorf("swapping %s into place: %w", staging, err)
+	}
+	slog.Debug("Swapped staging directory into place", "dest", dest)
+	// The staging name now holds the old tree
+	return os.RemoveAll(staging)
+}
+
+// swapDirs exchanges the directories staging and dest. Where the platform
+// can't exchange them atomically, dest is renamed aside first, leaving a
+// moment in which it doesn't exist.
+func swapDirs(staging, dest string) error {
+	err := exchangeDirs(staging, dest)
+	if err != errExchangeUnsupported {
+		return err
+	}
+	old := filepath.Join(filepath.Dir(dest), ".cpj-old-"+filepath.Base(dest))
+	if err := os.Rename(dest, old); err != nil {
+		return err
+	}
+	if err := os.Rename(staging, dest); err != nil {
+		os.Rename(old, dest)
+		return err
+	}
+	return os.Rename(old, staging)
+}
@@ -0,0 +1,19 @@
+package copier
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// exchangeDirs atomically swaps a and b with renameat2(RENAME_EXCHANGE).
+func exchangeDirs(a, b string) error {
+	err := unix.Renameat2(unix.AT_FDCWD, a, unix.AT_FDCWD, b, unix.RENAME_EXCHANGE)
+	switch err {
+	case nil:
+		return nil
+	case unix.ENOSYS, unix.EINVAL:
+		return errExchangeUnsupported
+	}
+	return &os.LinkError{Op: "renameat2", Old: a, New: b, Err: err}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package copier
+
+// exchangeDirs can't swap directories atomically on this platform.
+func exchangeDirs(a, b string) error {
+	return errExchangeUnsupported
+}
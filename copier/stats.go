@@ -0,0 +1,118 @@
+package copier
+
+import (
+	"cpj/cp"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+)
+
+// treeStats is what `cpj stats` counts while walking a tree.
+type treeStats struct {
+	dirs, files, symlinks, special int
+	bytes                          int64
+	largest                        string
+	largestSize                    int64
+}
+
+// statsMain implements `cpj stats`, summarising the tree a recursive copy of
+// src would see, after the same filters and policies, without copying it.
+func statsMain(args []string) int {
+	cmd := lookupCommand("stats")
+	opts := options{links: linksPreserve, special: specialSkip}
+	flags := flag.NewFlagSet("stats", flag.ContinueOnError)
+	flags.BoolVar(&opts.hardLinks, "hard-links", false, "Count further names of an already seen file as hard links rather than files.")
+	addWalkFlags(flags, &opts)
+	flags.Usage = func() {
+		cmd.printUsage()
+		flags.PrintDefaults()
+	}
+	if err := applyEnv(flags); err != nil {
+		log.Print(err)
+		return 1
+	}
+	if err := flags.Parse(args); err != nil {
+		return parseStatus(err)
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 1
+	}
+	if err := opts.filter.validate(); err != nil {
+		log.Print(err)
+		return 1
+	}
+	if opts.maxDepth < 0 {
+		log.Print("-max-depth must not be negative")
+		return 1
+	}
+	root, err := cp.AbsolutePath(flags.Arg(0))
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	if info, err := os.Stat(root); err != nil {
+		log.Print(err)
+		return 1
+	} else if !info.IsDir() {
+		log.Printf("%s is not a directory", root)
+		return 1
+	}
+	var links *hardLinks
+	if opts.hardLinks {
+		links = newHardLinks()
+	}
+	var stats treeStats
+	err = walkTree(root, &opts, func(path string, d fs.DirEntry, err error) error {
+		var info os.FileInfo
+		if err == nil && d.Type().IsRegular() {
+			info, err = d.Info()
+		}
+		if err != nil {
+			// Count what can be read rather than giving up
+			log.Print(err)
+			return nil
+		}
+		switch {
+		case d.IsDir():
+			if path != root {
+				stats.dirs++
+			}
+		case d.Type()&os.ModeSymlink != 0:
+			stats.symlinks++
+		case cp.IsSpecial(d.Type()):
+			stats.special++
+		case links != nil && links.add(path, info):
+		default:
+			stats.files++
+			stats.bytes += info.Size()
+			if stats.largest == "" || info.Size() > stats.largestSize {
+				stats.largest, stats.largestSize = path, info.Size()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	fmt.Printf("Number of directories: %d\n", stats.dirs)
+	fmt.Printf("Number of files: %d\n", stats.files)
+	fmt.Printf("Total size: %s\n", formatBytes(stats.bytes))
+	if stats.largest != "" {
+		fmt.Printf("Largest file: %s (%s)\n", stats.largest, formatBytes(stats.largestSize))
+	}
+	if stats.symlinks > 0 {
+		fmt.Printf("Number of symlinks: %d\n", stats.symlinks)
+	}
+	if stats.special > 0 {
+		fmt.Printf("Number of special files: %d\n", stats.special)
+	}
+	if links != nil {
+		fmt.Printf("Number of hard links: %d\n", len(links.links))
+	}
+	return 0
+}
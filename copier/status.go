@@ -0,0 +1,90 @@
+package copier
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// dispatch is a jobDispatcher at work, for status reports. total and
+// totalBytes are what it has to copy, or 0 when the files are streamed.
+type dispatch struct {
+	jobs       *copyJob
+	total      int
+	totalBytes int64
+	start      time.Time
+}
+
+// handleStatusRequests prints a snapshot of the current dispatch on each of
+// statusSignals, like dd, so a copy running quietly in the background can be
+// asked how far it has got. The signals are caught for the whole run, so
+// they are never fatal. The returned function stops listening for them.
+func handleStatusRequests(opts *options) (stop func()) {
+	if len(statusSignals) == 0 {
+		return func() {}
+	}
+	out := statusOut(opts)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, statusSignals...)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-signals:
+				fmt.Fprintln(out, opts.dispatch.Load().report())
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// statusOut returns where to write messages for the user that aren't log
+// messages, like status reports. The dashboard has the terminal, and shows
+// them with the log.
+func statusOut(opts *options) io.Writer {
+	if opts.dash != nil {
+		return opts.dash
+	}
+	return os.Stderr
+}
+
+// report describes how far d has got. A nil d has not started copying.
+func (d *dispatch) report() string {
+	if d == nil {
+		return "Not copying yet, looking for files"
+	}
+	jobs := d.jobs
+	var b strings.Builder
+	files, bytes := atomic.LoadInt64(&jobs.done), atomic.LoadInt64(&jobs.copied)
+	if d.total > 0 {
+		fmt.Fprintf(&b, "Copied %d of %d files, %s of %s", files, d.total, formatBytes(bytes), formatBytes(d.totalBytes))
+	} else {
+		jobs.mu.Lock()
+		drained := jobs.drained
+		jobs.mu.Unlock()
+		found := "found so far"
+		if drained {
+			found = "found"
+		}
+		fmt.Fprintf(&b, "Copied %d of %d files %s, %s", files, atomic.LoadInt64(&jobs.queued), found, formatBytes(bytes))
+	}
+	elapsed := time.Since(d.start)
+	fmt.Fprintf(&b, " in %s, %s/s", elapsed.Round(100*time.Millisecond), formatBytes(int64(float64(bytes)/elapsed.Seconds())))
+	if skipped := atomic.LoadInt64(&jobs.skipped); skipped > 0 {
+		fmt.Fprintf(&b, ", %d skipped", skipped)
+	}
+	fmt.Fprintf(&b, ", %d failed, %d jobs", atomic.LoadInt64(&jobs.failed), atomic.LoadInt64(&jobs.limit))
+	if jobs.paused != nil && jobs.paused.Load() {
+		b.WriteString(", paused")
+	}
+	return b.String()
+}
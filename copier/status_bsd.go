@@ -0,0 +1,11 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package copier
+
+import (
+	"os"
+	"syscall"
+)
+
+// statusSignals ask for a progress snapshot. SIGINFO is sent by ^T.
+var statusSignals = []os.Signal{syscall.SIGUSR1, syscall.SIGINFO}
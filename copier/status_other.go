@@ -0,0 +1,9 @@
+//go:build !unix
+
+package copier
+
+import "os"
+
+// statusSignals is empty, as there are no signals to ask for a progress
+// snapshot with on this platform.
+var statusSignals []os.Signal
@@ -0,0 +1,11 @@
+//go:build unix && !(darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package copier
+
+import (
+	"os"
+	"syscall"
+)
+
+// statusSignals ask for a progress snapshot.
+var statusSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,220 @@
+package copier
+
+import (
+	"cpj/stack"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// streamBuffer is how many files the walk may find ahead of the workers,
+// unless -max-queued says otherwise.
+const streamBuffer = 1024
+
+// fileSource streams the files to copy to the workers, which start copying
+// before the whole list is known.
+type fileSource interface {
+	// next returns the next file to copy. It is not safe for concurrent use.
+	next() (fileEntry, bool)
+	// count returns the number of files handed out so far.
+	count() int
+}
+
+// fileSlice is a fileSource handing out files known up front, in order.
+type fileSlice struct {
+	files  []fileEntry
+	handed int
+}
+
+func (s *fileSlice) next() (fileEntry, bool) {
+	if len(s.files) == 0 {
+		return fileEntry{}, false
+	}
+	f := s.files[0]
+	s.files[0] = fileEntry{}
+	s.files = s.files[1:]
+	s.handed++
+	return f, true
+}
+
+func (s *fileSlice) count() int {
+	return s.handed
+}
+
+// fileEntry is a file handed to the copy workers.
+type fileEntry struct {
+	src, dest string
+	size      int64
+	// info is what the walk found at src, sparing the worker from statting
+	// it again. It is nil when unknown, as for files resumed from a
+	// checkpoint or read back from a spill file.
+	info os.FileInfo
+}
+
+// stat returns the FileInfo of what src refers to, following symlinks, and
+// reusing the walk's where it can.
+func (f fileEntry) stat() (os.FileInfo, error) {
+	if f.info != nil && f.info.Mode()&os.ModeSymlink == 0 {
+		return f.info, nil
+	}
+	return os.Stat(f.src)
+}
+
+// treeStream walks the source tree in the background, handing each file to
+// the workers as soon as it is found, so copying starts at once and the tree
+// is never held in memory. The walk waits once -max-queued files are queued,
+// or spills them to -spill-dir and carries on. Directories are created as the
+// walk reaches them, before any of the files in them are handed out.
+type treeStream struct {
+	queue  *spillQueue
+	handed int
+	// The walker sets err before closing the queue. dirs is kept for -move
+	// and -delete, files for -delete only.
+	err   error
+	dirs  stack.Safe[string]
+	files stack.Safe[string]
+}
+
+// streamTree starts walking root. srcAbs and destAbs are root and the
+// destination, both ending in a separator.
+func streamTree(root, srcAbs, destAbs string, links *hardLinks, opts *options) (*treeStream, error) {
+	limit := opts.maxQueued
+	if limit == 0 {
+		limit = streamBuffer
+	}
+	queue, err := newSpillQueue(limit, opts.spillDir)
+	if err != nil {
+		return nil, err
+	}
+	s := &treeStream{queue: queue}
+	go func() {
+		defer queue.close()
+		s.err = walkTree(root, opts, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return walkFailure(path, err, opts)
+			}
+			if d.IsDir() {
+				if path == root {
+					return nil
+				}
+				s.dirs.Push(path)
+				if !opts.types.selects(os.ModeDir) {
+					return nil
+				}
+				target := destPath(srcAbs, destAbs, path, opts)
+				slog.Debug("Creating directory", "dir", target)
+				return os.MkdirAll(target, 0755)
+			}
+			info, err := d.Info()
+			if err != nil {
+				return walkFailure(path, err, opts)
+			}
+			if links != nil && links.add(path, info) {
+				return nil
+			}
+			if opts.delete {
+				s.files.Push(path)
+			}
+			queue.push(fileEntry{src: path, dest: fileDestPath(srcAbs, destAbs, path, info, opts), size: info.Size(), info: info})
+			return nil
+		})
+	}()
+	return s, nil
+}
+
+func (s *treeStream) next() (fileEntry, bool) {
+	e, ok := s.queue.pop()
+	if ok {
+		s.handed++
+	}
+	return e, ok
+}
+
+func (s *treeStream) count() int {
+	return s.handed
+}
+
+// canStream reports whether a recursive copy can start before the walk is
+// complete. Sorting the files, saving them to a checkpoint, listing them
+// for -dry-run and finding duplicates for -dedup all need the whole list
+// first.
+func canStream(opts *options) bool {
+	return opts.order == orderNatural && !opts.sort && !opts.sequential && opts.job == nil && !opts.dryRun && !opts.dirsOnly && !opts.dedup
+}
+
+// streamCopy copies the tree below srcAbs to destAbs while it is still being
+// walked.
+func streamCopy(srcAbs, destAbs string, links *hardLinks, opts *options) (err error) {
+	root := srcAbs
+	if !strings.HasSuffix(srcAbs, "/") {
+		srcAbs += "/"
+	}
+	if !strings.HasSuffix(destAbs, "/") {
+		destAbs += "/"
+	}
+	var m *manifest
+	if opts.manifest != "" {
+		if m, err = createManifest(opts.manifest, destAbs); err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := m.close(); err == nil {
+				err = cerr
+			}
+		}()
+	}
+	tree, err := streamTree(root, srcAbs, destAbs, links, opts)
+	if err != nil {
+		return err
+	}
+	errs, err := jobDispatcher(nil, 0, tree, m, opts)
+	if err == nil {
+		err = tree.err
+	}
+	if qerr := tree.queue.cleanup(); err == nil && qerr != nil {
+		err = fmt.Errorf("spill file: %w", qerr)
+	}
+	if err := dispatchErrors(errs, err, opts); err != nil {
+		if opts.delete {
+			slog.Warn("Not deleting extraneous files because of copy errors")
+		}
+		return err
+	}
+	dirs := tree.dirs.Drain()
+	// Last of all, as copying and deleting change the directories
+	restore := restoreDirectories(srcAbs, destAbs, dirs, opts)
+	defer func() {
+		if rerr := restore(); err == nil {
+			err = rerr
+		}
+	}()
+	var linked []hardLink
+	if links != nil {
+		linked = links.links
+	}
+	if opts.useful {
+		attrs := []any{"dirs", len(dirs), "files", tree.count()}
+		if links != nil {
+			attrs = append(attrs, "links", len(linked))
+		}
+		slog.Info("Found", attrs...)
+	}
+	if err := createHardLinks(srcAbs, destAbs, linked, opts); err != nil {
+		return err
+	}
+	if opts.move {
+		removeEmptyDirs(srcAbs, dirs)
+	}
+	if err := walkIncomplete(opts); err != nil {
+		if opts.delete {
+			slog.Warn("Not deleting extraneous files because parts of the source could not be read")
+		}
+		return err
+	}
+	if opts.delete {
+		return deleteExtraneous(srcAbs, destAbs, tree.files.Drain(), dirs, linked, opts)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package copier
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// daemonRequest sends a request to the daemon listening on socket and
+// decodes its answer into reply.
+func daemonRequest(socket, verb, arg string, reply any) error {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return fmt.Errorf("no daemon listening: %w", err)
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintf(conn, "%s %s\n", verb, arg); err != nil {
+		return err
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	var failed struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(line, &failed) == nil && failed.Error != "" {
+		return errors.New(failed.Error)
+	}
+	return json.Unmarshal(line, reply)
+}
+
+// submitMain implements `cpj submit`, queueing a copy or sync with the
+// daemon, or scheduling it to recur. Its operands are relative to the
+// current directory.
+func submitMain(args []string) int {
+	cmd := lookupCommand("submit")
+	var socket, spec string
+	flags := flag.NewFlagSet("submit", flag.ContinueOnError)
+	flags.StringVar(&socket, "socket", defaultDaemonSocket(), "The socket the daemon listens on.")
+	flags.StringVar(&spec, "schedule", "", `Run the job again and again, "every DURATION" apart, e.g. "every 6h", or at the times of a cron expression, e.g. "30 2 * * *" or @daily, in the daemon's time zone. Each run starts once the last has finished.`)
+	flags.Usage = func() {
+		cmd.printUsage()
+		flags.PrintDefaults()
+	}
+	if err := applyEnv(flags); err != nil {
+		log.Print(err)
+		return exitUsage
+	}
+	if err := flags.Parse(args); err != nil {
+		return parseStatus(err)
+	}
+	if flags.NArg() < 2 || flags.Arg(0) != "copy" && flags.Arg(0) != "sync" {
+		flags.Usage()
+		return exitUsage
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		log.Print(err)
+		return exitFailure
+	}
+	if spec != "" {
+		// Catch a bad schedule before it is sent
+		if _, err := parseSchedule(spec); err != nil {
+			log.Print(err)
+			return exitUsage
+		}
+	}
+	data, err := json.Marshal(daemonJob{Dir: dir, Args: flags.Args(), Schedule: spec})
+	if err != nil {
+		log.Print(err)
+		return exitFailure
+	}
+	var job daemonJob
+	if err := daemonRequest(socket, "submit", string(data), &job); err != nil {
+		log.Print(err)
+		return exitFailure
+	}
+	fmt.Println(job.ID)
+	return 0
+}
+
+// jobsMain implements `cpj jobs`, listing the daemon's jobs or describing or
+// cancelling one.
+func jobsMain(args []string) int {
+	cmd := lookupCommand("jobs")
+	var socket string
+	var cancel bool
+	flags := flag.NewFlagSet("jobs", flag.ContinueOnError)
+	flags.StringVar(&socket, "socket", defaultDaemonSocket(), "The socket the daemon listens on.")
+	flags.BoolVar(&cancel, "cancel", false, "Cancel the job given, letting the copies it has in progress finish.")
+	flags.Usage = func() {
+		cmd.printUsage()
+		flags.PrintDefaults()
+	}
+	if err := applyEnv(flags); err != nil {
+		log.Print(err)
+		return exitUsage
+	}
+	if err := flags.Parse(args); err != nil {
+		return parseStatus(err)
+	}
+	if flags.NArg() > 1 || cancel && flags.NArg() == 0 {
+		flags.Usage()
+		return exitUsage
+	}
+	if flags.NArg() == 0 {
+		var jobs []daemonJob
+		if err := daemonRequest(socket, "jobs", "", &jobs); err != nil {
+			log.Print(err)
+			return exitFailure
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tSTATE\tSUBMITTED\tCOMMAND")
+		for _, job := range jobs {
+			state := job.State
+			if job.Finished != nil && job.Started != nil {
+				state += " (" + strconv.Itoa(job.Status) + ")"
+			}
+			if job.Next != nil {
+				state += ", next " + job.Next.Format(time.DateTime)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", job.ID, state, job.Submitted.Format(time.DateTime), strings.Join(job.Args, " "))
+		}
+		w.Flush()
+		return 0
+	}
+	if _, err := strconv.Atoi(flags.Arg(0)); err != nil {
+		log.Printf("invalid job id %q", flags.Arg(0))
+		return exitUsage
+	}
+	verb := "status"
+	if cancel {
+		verb = "cancel"
+	}
+	var job daemonJob
+	if err := daemonRequest(socket, verb, flags.Arg(0), &job); err != nil {
+		log.Print(err)
+		return exitFailure
+	}
+	fmt.Printf("Job %d: %s\n", job.ID, strings.Join(job.Args, " "))
+	fmt.Printf("  in %s\n", job.Dir)
+	if job.Schedule != "" {
+		fmt.Printf("  scheduled %s", job.Schedule)
+		if job.Next != nil {
+			fmt.Printf(", next at %s", job.Next.Format(time.DateTime))
+		}
+		fmt.Println()
+	}
+	fmt.Printf("  %s", job.State)
+	if job.Finished != nil && job.Started != nil {
+		fmt.Printf(" with status %d", job.Status)
+	}
+	fmt.Printf(", submitted %s", job.Submitted.Format(time.DateTime))
+	if job.Started != nil {
+		fmt.Printf(", started %s", job.Started.Format(time.DateTime))
+	}
+	if job.Finished != nil {
+		fmt.Printf(", finished %s", job.Finished.Format(time.DateTime))
+	}
+	fmt.Println()
+	if job.Progress != "" {
+		fmt.Printf("  %s\n", job.Progress)
+	}
+	if job.Log != "" {
+		fmt.Printf("  output in %s\n", job.Log)
+	}
+	return 0
+}
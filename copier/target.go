@@ -0,0 +1,135 @@
+package copier
+
+import (
+	"cpj/cp"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// copyIntoDir copies each source into the directory target, like cp -t: a
+// file becomes target/NAME and a directory's contents go to target/NAME/.
+// With -parents NAME is the whole source path, see parentsPath.
+func copyIntoDir(sources []string, target string, opts *options) error {
+	targetAbs, err := cp.AbsolutePath(target)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(targetAbs)
+	if os.IsNotExist(err) && opts.mkdir {
+		if opts.dryRun {
+			fmt.Printf("Would create directory %s.\n", targetAbs)
+		} else if err = os.MkdirAll(targetAbs, 0755); err == nil {
+			info, err = os.Stat(targetAbs)
+		}
+	}
+	if os.IsNotExist(err) && !opts.dryRun {
+		return &kindError{ErrDestMissing, err}
+	}
+	if err != nil && !(opts.dryRun && os.IsNotExist(err)) {
+		return err
+	}
+	if info != nil && !info.IsDir() {
+		return errorOf(ErrNotDirectory, "target %s is not a directory", target)
+	}
+	// Directory sources get their own directory below target
+	opts.mkdir = true
+	failed := 0
+	for _, src := range sources {
+		srcAbs, err := cp.AbsolutePath(src)
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(srcAbs)
+		if opts.parents {
+			if name, err = parentsPath(src); err != nil {
+				return err
+			}
+		}
+		if err := parallelCopy(src, filepath.Join(targetAbs, name), opts); err != nil {
+			if !opts.cont {
+				return err
+			}
+			slog.Warn("Could not copy source", "src", src, "error", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return errorOf(ErrPartial, "%d of %d sources could not be copied", failed, len(sources))
+	}
+	return nil
+}
+
+// ensureDestDir checks that destAbs, the dest operand, is a directory,
+// creating it with -mkdir. A dry run only says it would.
+func ensureDestDir(dest, destAbs string, opts *options) error {
+	info, err := os.Stat(destAbs)
+	if os.IsNotExist(err) && opts.mkdir {
+		if opts.dryRun {
+			fmt.Printf("Would create directory %s.\n", destAbs)
+		} else if err = os.MkdirAll(destAbs, 0755); err == nil {
+			info, err = os.Stat(destAbs)
+		}
+	}
+	if os.IsNotExist(err) && !opts.dryRun {
+		return &kindError{ErrDestMissing, err}
+	}
+	if err != nil && !(opts.dryRun && os.IsNotExist(err)) {
+		return err
+	}
+	if info != nil && !info.IsDir() {
+		return errorOf(ErrNotDirectory, "destination %s is not a directory", dest)
+	}
+	return nil
+}
+
+// fileDest returns where a single file source goes. Without -T, a dest that
+// is a directory or ends in a separator means the file goes inside it, named
+// as renameFile has it.
+func fileDest(srcAbs, dest, destAbs string, opts *options) (string, error) {
+	info, err := os.Stat(destAbs)
+	isDir := err == nil && info.IsDir()
+	if opts.noTargetDir {
+		if isDir {
+			return "", errorOf(ErrUsage, "cannot overwrite directory %s with non-directory %s", dest, srcAbs)
+		}
+		return destAbs, nil
+	}
+	if isDir {
+		return opts.renameFile(srcAbs, filepath.Join(destAbs, filepath.Base(srcAbs)), nil), nil
+	}
+	if !strings.HasSuffix(dest, string(filepath.Separator)) && !strings.HasSuffix(dest, "/") {
+		return destAbs, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", errorOf(ErrNotDirectory, "%s is not a directory", dest)
+	}
+	if !opts.mkdir {
+		return "", errorOf(ErrDestMissing, "destination directory %s does not exist", dest)
+	}
+	if !opts.dryRun {
+		if err := os.MkdirAll(destAbs, 0755); err != nil {
+			return "", err
+		}
+	}
+	return opts.renameFile(srcAbs, filepath.Join(destAbs, filepath.Base(srcAbs)), nil), nil
+}
+
+// parentsPath returns the part of the source path src that -parents recreates
+// below the target directory. Like rsync -R, a "/./" in src marks where that
+// part starts; otherwise it is all of src, less any leading separator.
+func parentsPath(src string) (string, error) {
+	rel := filepath.ToSlash(src)
+	if i := strings.Index(rel, "/./"); i >= 0 {
+		rel = rel[i+3:]
+	}
+	rel = filepath.Clean(filepath.FromSlash(rel))
+	rel = strings.TrimPrefix(rel, filepath.VolumeName(rel))
+	rel = strings.TrimLeft(rel, string(filepath.Separator))
+	if rel == "" || rel == "." || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("cannot use -parents with %s", src)
+	}
+	return rel, nil
+}
@@ -0,0 +1,66 @@
+package copier
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeLayouts are the absolute time formats accepted by timeBound, tried in
+// order. Times without a zone are local.
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// timeBound is a flag.Value holding a point in time, set either from an
+// absolute time such as 2024-05-01 or 2024-05-01T12:00:00Z, or from an age
+// such as 90m, 24h or 7d counted back from now.
+type timeBound struct {
+	t    time.Time
+	text string
+}
+
+func (b *timeBound) String() string {
+	return b.text
+}
+
+func (b *timeBound) Set(val string) error {
+	val = strings.TrimSpace(val)
+	if age, err := parseAge(val); err == nil {
+		b.t, b.text = time.Now().Add(-age), val
+		return nil
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, val, time.Local); err == nil {
+			b.t, b.text = t, val
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid time %q, must be a date like 2006-01-02, an RFC 3339 time or an age like 24h or 7d", val)
+}
+
+func (b *timeBound) isSet() bool {
+	return !b.t.IsZero()
+}
+
+// parseAge parses a duration, also accepting a number of days such as 7d.
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err == nil && d < 0 {
+		err = fmt.Errorf("invalid age %q", s)
+	}
+	return d, err
+}
@@ -0,0 +1,360 @@
+package copier
+
+import (
+	"cpj/cp"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// logLines is how many of the latest log messages -tui shows.
+const logLines = 5
+
+// dashboard is the full-screen view of -tui: a bar for the whole copy and one
+// for each worker with the file it is on, the throughput, the errors so far
+// and the time remaining. While it is up, log messages written to it are held
+// back, the latest shown beneath the workers, and written out once it closes.
+// A nil *dashboard does nothing, so callers don't need to check for -tui.
+type dashboard struct {
+	out    *os.File
+	color  bool
+	atomic bool
+	paused *atomic.Bool
+	mu     sync.Mutex
+	// up is set while the dashboard has the screen, from show until close.
+	up      bool
+	title   string
+	start   time.Time
+	held    []string
+	closing sync.Once
+	stop    chan struct{}
+	stopped chan struct{}
+	// The totals of the current dispatch. While a streamed tree is still
+	// being walked, walking is set and found counts the files queued so far.
+	total, found, files, skips, failures int
+	totalBytes, foundBytes, bytes        int64
+	walking                              bool
+	workers                              []workerSlot
+	// rate is the smoothed throughput, from the bytes written by the last
+	// redraw, at last.
+	rate      float64
+	lastBytes int64
+	last      time.Time
+}
+
+// workerSlot is what a worker is copying, if anything.
+type workerSlot struct {
+	file  fileEntry
+	busy  bool
+	start time.Time
+}
+
+// newDashboard returns a dashboard to draw on out, a terminal. Files are
+// written to their temporary path first when atomic is set, and the copy is
+// shown as paused while paused is set.
+func newDashboard(out *os.File, color, atomic bool, paused *atomic.Bool) *dashboard {
+	return &dashboard{out: out, color: color, atomic: atomic, paused: paused}
+}
+
+// Write holds back whole lines of log while the dashboard is up, and passes
+// them through to the terminal otherwise.
+func (d *dashboard) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	if !d.up {
+		d.mu.Unlock()
+		return d.out.Write(p)
+	}
+	defer d.mu.Unlock()
+	d.held = append(d.held, strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// show takes over the screen, redrawing it until close.
+func (d *dashboard) show(title string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.up, d.title, d.start = true, title, time.Now()
+	d.mu.Unlock()
+	d.stop, d.stopped = make(chan struct{}), make(chan struct{})
+	// Switch to the alternate screen, leaving the shell's alone, and hide
+	// the cursor
+	fmt.Fprint(d.out, "\033[?1049h\033[?25l")
+	go func() {
+		defer close(d.stopped)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			d.draw()
+			select {
+			case <-ticker.C:
+			case <-d.stop:
+				return
+			}
+		}
+	}()
+}
+
+// close gives the screen back and writes out the log held back meanwhile. It
+// may be called more than once, and from any goroutine.
+func (d *dashboard) close() {
+	if d == nil || d.stop == nil {
+		return
+	}
+	d.closing.Do(func() {
+		close(d.stop)
+		<-d.stopped
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		fmt.Fprint(d.out, "\033[?25h\033[?1049l")
+		for _, line := range d.held {
+			fmt.Fprintln(d.out, line)
+		}
+		d.up, d.held = false, nil
+	})
+}
+
+// begin starts the totals for a dispatch of total files of totalBytes, or of
+// a streamed tree when streamed is set, copied by workers.
+func (d *dashboard) begin(total int, totalBytes int64, workers int, streamed bool) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.total, d.totalBytes, d.walking = total, totalBytes, streamed
+	d.found, d.foundBytes, d.files, d.bytes, d.skips, d.failures = 0, 0, 0, 0, 0, 0
+	d.workers = make([]workerSlot, workers)
+	d.rate, d.lastBytes, d.last = 0, 0, time.Now()
+}
+
+// queued counts f as found, for a streamed tree.
+func (d *dashboard) queued(f fileEntry) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.found++
+	d.foundBytes += f.size
+	d.mu.Unlock()
+}
+
+// fed records that every file has been queued, so the totals are known.
+func (d *dashboard) fed() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.walking = false
+	d.mu.Unlock()
+}
+
+// working records that worker id has started on f.
+func (d *dashboard) working(id int, f fileEntry) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	// Workers started by set-jobs come after those begin knew of
+	for id >= len(d.workers) {
+		d.workers = append(d.workers, workerSlot{})
+	}
+	d.workers[id] = workerSlot{file: f, busy: true, start: time.Now()}
+	d.mu.Unlock()
+}
+
+// idle records that worker id is done with its file, however it went.
+func (d *dashboard) idle(id int) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	if id < len(d.workers) {
+		d.workers[id] = workerSlot{}
+	}
+	d.mu.Unlock()
+}
+
+func (d *dashboard) copied(size int64) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.files++
+	d.bytes += size
+	d.mu.Unlock()
+}
+
+func (d *dashboard) skipped() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.skips++
+	d.mu.Unlock()
+}
+
+func (d *dashboard) failed() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.failures++
+	d.mu.Unlock()
+}
+
+// written returns how much of the file in slot has been written so far, by
+// the size of its destination. A split copy preallocates it, so shows as
+// written from the start.
+func (d *dashboard) written(slot workerSlot) int64 {
+	dest := slot.file.dest
+	if d.atomic {
+		dest = cp.TempPath(dest)
+	}
+	info, err := os.Stat(dest)
+	if err != nil {
+		return 0
+	}
+	return min(info.Size(), slot.file.size)
+}
+
+// draw redraws the whole screen.
+func (d *dashboard) draw() {
+	d.mu.Lock()
+	workers := append([]workerSlot(nil), d.workers...)
+	d.mu.Unlock()
+	// Stat the files being written without holding up the workers
+	partial := make([]int64, len(workers))
+	var inFlight int64
+	for i, slot := range workers {
+		if slot.busy {
+			partial[i] = d.written(slot)
+			inFlight += partial[i]
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	width, height := terminalSize(d.out)
+	now := time.Now()
+	done := d.bytes + inFlight
+	if dt := now.Sub(d.last).Seconds(); dt > 0 && done >= d.lastBytes {
+		current := float64(done-d.lastBytes) / dt
+		if d.rate == 0 {
+			d.rate = current
+		} else {
+			d.rate = 0.9*d.rate + 0.1*current
+		}
+	}
+	d.lastBytes, d.last = done, now
+
+	total, totalBytes, more := d.total, d.totalBytes, ""
+	if d.found > total {
+		total, totalBytes = d.found, d.foundBytes
+	}
+	if d.walking {
+		more = "+"
+	}
+	var fraction float64
+	switch {
+	case totalBytes > 0:
+		fraction = float64(done) / float64(totalBytes)
+	case total > 0:
+		fraction = float64(d.files) / float64(total)
+	}
+	fraction = min(fraction, 1)
+	eta := "--"
+	if !d.walking && d.rate > 0 && totalBytes > done {
+		eta = time.Duration(float64(totalBytes-done) / d.rate * float64(time.Second)).Round(time.Second).String()
+	}
+	errors := fmt.Sprintf("Errors %d", d.failures)
+	if d.failures > 0 {
+		errors = paint(errors, ansiRed, d.color)
+	}
+
+	title := fmt.Sprintf("%s   elapsed %s", d.title, now.Sub(d.start).Round(time.Second))
+	if d.paused.Load() {
+		title += "   " + paint("PAUSED", ansiYellow, d.color)
+	}
+	lines := []string{
+		title,
+		"",
+		fmt.Sprintf("%s %5.1f%%", progressBar(fraction*100, max(width-10, 10)), fraction*100),
+		fmt.Sprintf("Files  %d/%d%s   %s of %s%s", d.files, total, more, formatBytes(done), formatBytes(totalBytes), more),
+		fmt.Sprintf("Speed  %s/s   ETA %s   Skipped %d   %s", formatBytes(int64(d.rate)), eta, d.skips, errors),
+		"",
+		fmt.Sprintf("Workers %d", len(workers)),
+	}
+	var logs []string
+	if len(d.held) > 0 {
+		logs = append([]string{"", "Log"}, d.held[max(len(d.held)-logLines, 0):]...)
+	}
+	rows := max(height-len(lines)-len(logs), 1)
+	for i, slot := range workers {
+		if i == rows-1 && len(workers) > rows {
+			lines = append(lines, fmt.Sprintf("... and %d more", len(workers)-i))
+			break
+		}
+		if !slot.busy {
+			lines = append(lines, fmt.Sprintf("%3d idle", i))
+			continue
+		}
+		var percent float64
+		if slot.file.size > 0 {
+			percent = float64(partial[i]) / float64(slot.file.size) * 100
+		}
+		prefix := fmt.Sprintf("%3d %s %5.1f%% %10s %6s  ", i, progressBar(percent, 20), percent,
+			formatBytes(slot.file.size), now.Sub(slot.start).Round(time.Second))
+		lines = append(lines, prefix+shortenPath(slot.file.src, width-len(prefix)))
+	}
+	lines = append(lines, logs...)
+
+	var buf strings.Builder
+	buf.WriteString("\033[H")
+	for i, line := range lines[:min(len(lines), height)] {
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		buf.WriteString(fit(line, width))
+		buf.WriteString("\033[K")
+	}
+	buf.WriteString("\033[J")
+	d.out.WriteString(buf.String())
+}
+
+// fit cuts s to width columns. ANSI escapes, which are assumed to be colors,
+// take none, and the color is reset if s is cut.
+func fit(s string, width int) string {
+	cols, escape := 0, false
+	for i, r := range s {
+		switch {
+		case escape:
+			escape = r != 'm'
+		case r == '\033':
+			escape = true
+		default:
+			if cols == width {
+				return s[:i] + ansiReset
+			}
+			cols++
+		}
+	}
+	return s
+}
+
+// shortenPath cuts the start off path to fit it in width columns, keeping the
+// file name.
+func shortenPath(path string, width int) string {
+	runes := []rune(path)
+	if len(runes) <= width {
+		return path
+	}
+	if width < 2 {
+		return ""
+	}
+	return "…" + string(runes[len(runes)-width+1:])
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package copier
+
+import "os"
+
+// terminalSize assumes an 80 by 24 terminal, as it can't ask on this
+// platform.
+func terminalSize(f *os.File) (int, int) {
+	return 80, 24
+}
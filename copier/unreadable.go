@@ -0,0 +1,65 @@
+package copier
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"sync"
+)
+
+// skipList records the source paths -skip-unreadable left out of the copy
+// because reading them was not permitted.
+type skipList struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func (s *skipList) add(path string) {
+	s.mu.Lock()
+	s.paths = append(s.paths, path)
+	s.mu.Unlock()
+}
+
+// has reports whether any path was skipped.
+func (s *skipList) has() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.paths) > 0
+}
+
+// below returns the skipped paths below srcAbs, relative to it. srcAbs must
+// end in a separator.
+func (s *skipList) below(srcAbs string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rels []string
+	for _, path := range s.paths {
+		if len(path) > len(srcAbs) && path[:len(srcAbs)] == srcAbs {
+			rels = append(rels, path[len(srcAbs):])
+		}
+	}
+	return rels
+}
+
+// report lists the paths skipped, if any, under a heading colored as a
+// warning if color is set.
+func (s *skipList) report(color bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.paths) == 0 {
+		return
+	}
+	sort.Strings(s.paths)
+	fmt.Println(paint(fmt.Sprintf("Skipped %d unreadable paths:", len(s.paths)), ansiYellow, color))
+	for _, path := range s.paths {
+		fmt.Printf("  %s\n", path)
+	}
+}
+
+// unreadable reports whether err is src being denied to us, as opposed to a
+// failure to write the destination.
+func unreadable(err error, src string) bool {
+	var pathErr *fs.PathError
+	return errors.As(err, &pathErr) && pathErr.Path == src && errors.Is(err, fs.ErrPermission)
+}
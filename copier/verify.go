@@ -0,0 +1,225 @@
+package copier
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Exit status bits of the verify subcommand. They are OR'd together when a
+// tree has several kinds of problems.
+const (
+	verifyCorrupt = 2
+	verifyMissing = 4
+	verifyExtra   = 8
+)
+
+// manifestEntry is one line of a sha256sum manifest.
+type manifestEntry struct {
+	name   string
+	digest []byte
+}
+
+// verifyResult is the outcome of checking one manifest entry.
+type verifyResult struct {
+	name string
+	err  error
+	ok   bool
+}
+
+// verifyMain implements `cpj verify`, checking a destination tree against a
+// manifest written by -manifest. It returns the process exit status.
+func verifyMain(args []string) int {
+	var manifestPath string
+	var jobs int
+	var verbose bool
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	flags.StringVar(&manifestPath, "manifest", "", "The sha256sum compatible manifest to verify against.")
+	flags.IntVar(&jobs, "jobs", 1, "Specify the number of files to verify in parallel.")
+	flags.BoolVar(&verbose, "verbose", false, "Also list the files that verified correctly.")
+	flags.Usage = func() {
+		fmt.Println("Usage: cpj.go verify -manifest file [-jobs n] [-verbose] dest")
+		fmt.Printf("Exit status is 0 if the tree matches, otherwise the sum of %d (corrupted), %d (missing) and %d (extra files), or 1 on error.\n",
+			verifyCorrupt, verifyMissing, verifyExtra)
+		flags.PrintDefaults()
+	}
+	if err := applyEnv(flags); err != nil {
+		log.Print(err)
+		return 1
+	}
+	if err := flags.Parse(args); err != nil {
+		return parseStatus(err)
+	}
+	if manifestPath == "" || flags.NArg() != 1 {
+		flags.Usage()
+		return 1
+	}
+	root, err := filepath.Abs(flags.Arg(0))
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	entries, err := readManifest(manifestPath)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	results := verifyEntries(root, entries, jobs)
+	status := 0
+	var ok, corrupt, missing int
+	for _, res := range results {
+		switch {
+		case res.ok:
+			ok++
+			if verbose {
+				fmt.Printf("OK: %s\n", res.name)
+			}
+		case errors.Is(res.err, os.ErrNotExist):
+			missing++
+			status |= verifyMissing
+			fmt.Printf("MISSING: %s\n", res.name)
+		case res.err != nil:
+			// Unreadable files can't be shown to match, so count them as corrupt
+			corrupt++
+			status |= verifyCorrupt
+			fmt.Printf("CORRUPT: %s: %s\n", res.name, res.err)
+		default:
+			corrupt++
+			status |= verifyCorrupt
+			fmt.Printf("CORRUPT: %s\n", res.name)
+		}
+	}
+
+	extra, err := findExtraFiles(root, entries, manifestPath)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	for _, name := range extra {
+		fmt.Printf("EXTRA: %s\n", name)
+	}
+	if len(extra) > 0 {
+		status |= verifyExtra
+	}
+	fmt.Printf("Verified %d files: %d ok, %d corrupted, %d missing, %d extra.\n", len(entries), ok, corrupt, missing, len(extra))
+	return status
+}
+
+// readManifest parses a sha256sum manifest, including its backslash escaping
+// of awkward file names and the binary mode '*' marker.
+func readManifest(path string) ([]manifestEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var entries []manifestEntry
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		escaped := strings.HasPrefix(line, "\\")
+		line = strings.TrimPrefix(line, "\\")
+		// The digest is followed by a space and then a second space for
+		// text mode or '*' for binary mode.
+		sum, rest, found := strings.Cut(line, " ")
+		if !found || len(rest) < 2 || (rest[0] != ' ' && rest[0] != '*') {
+			return nil, fmt.Errorf("%s:%d: malformed manifest line", path, n)
+		}
+		name := rest[1:]
+		digest, err := hex.DecodeString(sum)
+		if err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("%s:%d: invalid sha256 digest", path, n)
+		}
+		if escaped {
+			name = strings.NewReplacer("\\\\", "\\", "\\n", "\n", "\\r", "\r").Replace(name)
+		}
+		entries = append(entries, manifestEntry{name: name, digest: digest})
+	}
+	return entries, scanner.Err()
+}
+
+// verifyEntries hashes every manifest entry below root using the given
+// number of parallel jobs. Results are returned in manifest order.
+func verifyEntries(root string, entries []manifestEntry, jobs int) []verifyResult {
+	if jobs < 1 {
+		jobs = 1
+	}
+	results := make([]verifyResult, len(entries))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h := sha256.New()
+			for i := range indexes {
+				entry := entries[i]
+				h.Reset()
+				err := hashFile(filepath.Join(root, filepath.FromSlash(entry.name)), h)
+				results[i] = verifyResult{name: entry.name, err: err}
+				if err == nil {
+					results[i].ok = bytes.Equal(h.Sum(nil), entry.digest)
+				}
+			}
+		}()
+	}
+	for i := range entries {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return results
+}
+
+func hashFile(path string, w io.Writer) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// findExtraFiles lists the regular files below root that are not in the
+// manifest, ignoring the manifest itself.
+func findExtraFiles(root string, entries []manifestEntry, manifestPath string) ([]string, error) {
+	listed := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		listed[entry.name] = true
+	}
+	manifestAbs, _ := filepath.Abs(manifestPath)
+	var extra []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || path == manifestAbs {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel = filepath.ToSlash(rel); !listed[rel] {
+			extra = append(extra, rel)
+		}
+		return nil
+	})
+	return extra, err
+}
@@ -0,0 +1,324 @@
+package copier
+
+import (
+	"cpj/cp"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// linkPolicy selects what the walker does with symbolic links below the source root.
+type linkPolicy string
+
+const (
+	// linksPreserve recreates symlinks at the destination as symlinks.
+	linksPreserve linkPolicy = "preserve"
+	// linksFollow copies whatever the link points to. Broken links are
+	// skipped with a warning, and links to a directory the walk is already
+	// in are not descended into.
+	linksFollow linkPolicy = "follow"
+	// linksSkip ignores symlinks entirely.
+	linksSkip linkPolicy = "skip"
+)
+
+func (l *linkPolicy) String() string {
+	return string(*l)
+}
+
+func (l *linkPolicy) Set(val string) error {
+	switch policy := linkPolicy(val); policy {
+	case linksPreserve, linksFollow, linksSkip:
+		*l = policy
+		return nil
+	}
+	return fmt.Errorf("invalid link policy %q, must be preserve, follow or skip", val)
+}
+
+// specialPolicy selects what the walker does with FIFOs, sockets and device nodes.
+type specialPolicy string
+
+const (
+	// specialSkip leaves special files out of the copy with a warning.
+	specialSkip specialPolicy = "skip"
+	// specialFail aborts the walk on the first special file.
+	specialFail specialPolicy = "fail"
+	// specialRecreate recreates FIFOs, and device nodes when running as
+	// root. Sockets cannot be recreated and are skipped with a warning.
+	specialRecreate specialPolicy = "recreate"
+)
+
+func (s *specialPolicy) String() string {
+	return string(*s)
+}
+
+func (s *specialPolicy) Set(val string) error {
+	switch policy := specialPolicy(val); policy {
+	case specialSkip, specialFail, specialRecreate:
+		*s = policy
+		return nil
+	}
+	return fmt.Errorf("invalid special file policy %q, must be skip, fail or recreate", val)
+}
+
+// fileTypes selects the kinds of file copied, as a comma separated list of
+// find -type letters: f for regular files, l symlinks, d directories, p FIFOs,
+// s sockets, c character and b block devices. Empty selects everything.
+type fileTypes string
+
+func (t *fileTypes) String() string {
+	return string(*t)
+}
+
+func (t *fileTypes) Set(val string) error {
+	letters := strings.ReplaceAll(val, ",", "")
+	if letters == "" {
+		return fmt.Errorf("invalid type %q, must be letters from fldpscb", val)
+	}
+	for _, c := range letters {
+		if !strings.ContainsRune("fldpscb", c) {
+			return fmt.Errorf("invalid type %q in %q, must be one of f, l, d, p, s, c or b", c, val)
+		}
+	}
+	*t = fileTypes(letters)
+	return nil
+}
+
+// selects reports whether files of the given mode are copied.
+func (t fileTypes) selects(mode os.FileMode) bool {
+	return t == "" || strings.IndexByte(string(t), typeLetter(mode)) >= 0
+}
+
+// typeSkipped reports whether the walk leaves out files of mode, whatever
+// their path, as symlinks with -links skip, not being of -type or being
+// special files it doesn't recreate.
+func (o *options) typeSkipped(mode os.FileMode) bool {
+	if mode&os.ModeSymlink != 0 && o.links == linksSkip {
+		return true
+	}
+	if cp.IsSpecial(mode) && (o.special != specialRecreate || mode&os.ModeSocket != 0 || mode&os.ModeDevice != 0 && os.Geteuid() != 0) {
+		return true
+	}
+	return !mode.IsDir() && !o.types.selects(mode)
+}
+
+// typeLetter returns the find -type letter for mode.
+func typeLetter(mode os.FileMode) byte {
+	switch {
+	case mode.IsDir():
+		return 'd'
+	case mode&os.ModeSymlink != 0:
+		return 'l'
+	case mode&os.ModeNamedPipe != 0:
+		return 'p'
+	case mode&os.ModeSocket != 0:
+		return 's'
+	case mode&os.ModeCharDevice != 0:
+		return 'c'
+	case mode&os.ModeDevice != 0:
+		return 'b'
+	}
+	return 'f'
+}
+
+// walkEntry is the fs.DirEntry handed out by walkTree. It keeps the result
+// of Info, so the filters and fn share a single lstat of each file.
+type walkEntry struct {
+	fs.DirEntry
+	info fs.FileInfo
+	err  error
+}
+
+func (e *walkEntry) Info() (fs.FileInfo, error) {
+	if e.info == nil && e.err == nil {
+		e.info, e.err = e.DirEntry.Info()
+	}
+	return e.info, e.err
+}
+
+// walkTree walks root, handing fn every path accepted by the filter after the
+// symlink policy has been applied. Directories at -max-depth, and with
+// -one-file-system mount points, are handed to fn but not descended into.
+// Directories are only statted when -one-file-system needs to, and the Info
+// of the entries fn gets describes a followed symlink's target.
+func walkTree(root string, opts *options, fn fs.WalkDirFunc) error {
+	var rootDev uint64
+	var sameFS bool
+	if opts.oneFileSystem {
+		if info, err := os.Stat(root); err == nil {
+			var id cp.FileID
+			id, _, sameFS = cp.Identity(info)
+			rootDev = id.Dev
+		}
+	}
+	var walkFn fs.WalkDirFunc
+	filtered := opts.filter.wrap(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fn(path, d, err)
+		}
+		if sameFS && path != root && d.IsDir() {
+			info, err := d.Info()
+			if err != nil {
+				return fn(path, d, err)
+			}
+			if id, _, ok := cp.Identity(info); ok && id.Dev != rootDev {
+				trace("Not crossing into mount point", "path", path)
+				if err := fn(path, d, nil); err != nil {
+					return err
+				}
+				return filepath.SkipDir
+			}
+		}
+		if opts.maxDepth > 0 && path != root {
+			if depth := pathDepth(root, path); depth > opts.maxDepth {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			} else if depth == opts.maxDepth && d.IsDir() {
+				if err := fn(path, d, nil); err != nil {
+					return err
+				}
+				return filepath.SkipDir
+			}
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			switch opts.links {
+			case linksSkip:
+				trace("Skipping symlink", "path", path)
+				return nil
+			case linksFollow:
+				target, err := os.Stat(path)
+				if err != nil {
+					slog.Warn("Skipping broken symlink", "path", path, "error", err)
+					return nil
+				}
+				if target.IsDir() {
+					if symlinkLoops(root, path, target) {
+						slog.Warn("Skipping symlink to a directory it is in", "path", path)
+						return nil
+					}
+					// A trailing separator makes WalkDir resolve the link
+					// instead of reporting the link itself.
+					return filepath.WalkDir(path+string(os.PathSeparator), walkFn)
+				}
+				d = &walkEntry{DirEntry: fs.FileInfoToDirEntry(target), info: target}
+			}
+		}
+		// The type bits are all these need, so only special files, which
+		// are reported with their permissions, are statted
+		if mode := d.Type(); cp.IsSpecial(mode) {
+			if info, err := d.Info(); err == nil {
+				mode = info.Mode()
+			}
+			switch {
+			case opts.special == specialFail:
+				return fmt.Errorf("special file %s (%q)", path, mode.String())
+			case opts.special == specialSkip, mode&os.ModeSocket != 0:
+				slog.Warn("Skipping special file", "path", path, "mode", mode.String())
+				return nil
+			case mode&os.ModeDevice != 0 && os.Geteuid() != 0:
+				slog.Warn("Skipping device: recreating devices requires root", "path", path)
+				return nil
+			}
+		}
+		if !d.IsDir() && !opts.types.selects(d.Type()) {
+			return nil
+		}
+		return fn(path, d, nil)
+	})
+	walkFn = func(path string, d fs.DirEntry, err error) error {
+		if err := opts.aborted(); err != nil {
+			return err
+		}
+		if d != nil {
+			d = &walkEntry{DirEntry: d}
+		}
+		return filtered(path, d, err)
+	}
+	return filepath.WalkDir(root, walkFn)
+}
+
+// walkFailure decides what a walk of the source does about err at path. A
+// path removed since its directory was read is skipped with a warning, as
+// files come and go in a live tree, and with -skip-unreadable one we may not
+// read is recorded and skipped. Anything else ends the walk, unless -continue
+// is set, when the path is skipped and counted for walkIncomplete.
+func walkFailure(path string, err error, opts *options) error {
+	if opts.skipUnreadable && errors.Is(err, fs.ErrPermission) {
+		opts.unreadable.add(path)
+		opts.events.skipped(path, "", "unreadable")
+		return nil
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		slog.Warn("Skipping path removed during the walk", "path", path)
+		return nil
+	}
+	if !opts.cont {
+		return err
+	}
+	slog.Warn("Skipping unreadable path", "path", path, "error", err)
+	opts.walkFailed++
+	return nil
+}
+
+// walkIncomplete returns an error if the walk of the source skipped any
+// unreadable paths.
+func walkIncomplete(opts *options) error {
+	if opts.walkFailed == 0 {
+		return nil
+	}
+	return errorOf(ErrPartial, "%d paths below the source could not be read", opts.walkFailed)
+}
+
+// pathDepth returns how many levels below root path is, 1 for its entries.
+func pathDepth(root, path string) int {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return 0
+	}
+	return strings.Count(rel, string(os.PathSeparator)) + 1
+}
+
+// symlinkLoops reports whether the directory symlink at path, below root,
+// resolves to target, a directory the walk is already in, which would make
+// following it recurse forever. The directories between path and root are
+// compared by device and inode, so the loop of links into each other's
+// directories, like a/b -> ../b and b/a -> ../a, is caught too.
+func symlinkLoops(root, path string, target os.FileInfo) bool {
+	id, _, ok := cp.Identity(target)
+	if !ok {
+		return symlinkLoopsByName(path)
+	}
+	root = filepath.Clean(root)
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		// Stat resolves the links followed on the way to dir
+		info, err := os.Stat(dir)
+		if err != nil {
+			return true
+		}
+		if dirID, _, _ := cp.Identity(info); dirID == id {
+			return true
+		}
+		if dir == root || dir == filepath.Dir(dir) {
+			return false
+		}
+	}
+}
+
+// symlinkLoopsByName is symlinkLoops where files have no inode numbers,
+// only catching a link resolving to a directory containing it.
+func symlinkLoopsByName(path string) bool {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return true
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return true
+	}
+	return parent == target || strings.HasPrefix(parent, target+string(os.PathSeparator))
+}
@@ -0,0 +1,196 @@
+package copier
+
+import (
+	"flag"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// changeSet gathers the paths below the watched tree that were created or
+// changed since the last sync, as the watcher reports them. rescan is set
+// when that isn't enough, because something was removed or events were lost,
+// and the whole tree must be synced again.
+type changeSet struct {
+	mu     sync.Mutex
+	paths  map[string]bool
+	rescan bool
+	// last is when the latest change came in, and notify is signalled on
+	// each one.
+	last   time.Time
+	notify chan struct{}
+}
+
+func newChangeSet() *changeSet {
+	return &changeSet{paths: make(map[string]bool), notify: make(chan struct{}, 1)}
+}
+
+// add records that rel, relative to the root, was created or changed.
+func (c *changeSet) add(rel string) {
+	c.mu.Lock()
+	c.paths[rel] = true
+	c.changed()
+}
+
+// resync records that the whole tree must be synced again.
+func (c *changeSet) resync() {
+	c.mu.Lock()
+	c.rescan = true
+	c.changed()
+}
+
+// changed notes a change and unlocks c.mu.
+func (c *changeSet) changed() {
+	c.last = time.Now()
+	c.mu.Unlock()
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// quiet returns how long it has been since the latest change.
+func (c *changeSet) quiet() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Since(c.last)
+}
+
+// take empties c, returning the paths changed in order, so directories come
+// before what they hold, or rescan when the whole tree must be synced.
+func (c *changeSet) take() (paths []string, rescan bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for rel := range c.paths {
+		paths = append(paths, rel)
+	}
+	slices.Sort(paths)
+	rescan = c.rescan
+	c.paths, c.rescan = make(map[string]bool), false
+	// Whatever was signalled has been taken
+	select {
+	case <-c.notify:
+	default:
+	}
+	return paths, rescan
+}
+
+// watchMain implements `cpj watch`, a live mirror: src is synced to dest as
+// sync would, then the files created or changed below src are copied as they
+// appear, a batch at a time once src has been quiet for -debounce. Removals
+// and lost events sync the whole tree again, which deletes from dest what is
+// gone from src unless -delete=false is given.
+func watchMain(args []string) int {
+	cmd := lookupCommand("watch")
+	debounce := time.Second
+	flags := flag.NewFlagSet("watch", flag.ContinueOnError)
+	flags.DurationVar(&debounce, "debounce", debounce, "Wait until src has had no changes for this long before copying them.")
+	flags.Usage = func() {
+		cmd.printUsage()
+		flags.PrintDefaults()
+	}
+	if err := applyEnv(flags); err != nil {
+		log.Print(err)
+		return exitUsage
+	}
+	syncArgs, err := cutFlags(flags, args)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		log.Print(err)
+		return exitUsage
+	}
+	if debounce <= 0 {
+		log.Print("-debounce must be positive")
+		return exitUsage
+	}
+	n := len(syncArgs)
+	if n < 2 || strings.HasPrefix(syncArgs[n-2], "-") || strings.HasPrefix(syncArgs[n-1], "-") {
+		flags.Usage()
+		return exitUsage
+	}
+	src, dest := syncArgs[n-2], syncArgs[n-1]
+	syncFlags := syncArgs[: n-2 : n-2]
+
+	srcAbs, err := filepath.Abs(src)
+	if err != nil {
+		log.Print(err)
+		return exitFailure
+	}
+	if info, err := os.Stat(srcAbs); err != nil {
+		log.Print(err)
+		return exitFailure
+	} else if !info.IsDir() {
+		log.Printf("%s is not a directory", src)
+		return exitNotDirectory
+	}
+	// Watch before the first sync, so nothing changed during it is missed
+	changes := newChangeSet()
+	watcher, err := newTreeWatcher(srcAbs, changes)
+	if err != nil {
+		log.Print(err)
+		return exitFailure
+	}
+	defer watcher.close()
+	failed := make(chan error, 1)
+	go func() { failed <- watcher.run() }()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	list, err := os.CreateTemp("", "cpj-watch-*")
+	if err != nil {
+		log.Print(err)
+		return exitFailure
+	}
+	list.Close()
+	defer os.Remove(list.Name())
+
+	status := runCopy("sync", syncDefaults, append(syncFlags, src, dest))
+	for status == 0 || status == exitPartial {
+		slog.Info("Watching for changes", "src", src)
+		select {
+		case <-changes.notify:
+		case err := <-failed:
+			slog.Error(err.Error())
+			return exitFailure
+		case <-signals:
+			return exitInterrupted
+		}
+		// Let a burst of changes settle before copying any of it
+		for wait := debounce; wait > 0; wait = debounce - changes.quiet() {
+			select {
+			case <-time.After(wait):
+			case <-signals:
+				return exitInterrupted
+			}
+		}
+		paths, rescan := changes.take()
+		if rescan {
+			slog.Info("Syncing the whole tree again", "src", src)
+			status = runCopy("sync", syncDefaults, append(syncFlags, src, dest))
+			continue
+		}
+		var entries strings.Builder
+		for _, rel := range paths {
+			entries.WriteString(rel)
+			entries.WriteByte(0)
+		}
+		if err := os.WriteFile(list.Name(), []byte(entries.String()), 0600); err != nil {
+			slog.Error(err.Error())
+			return exitFailure
+		}
+		slog.Info("Copying changes", "paths", len(paths))
+		status = runCopy("sync", syncDefaults, append(syncFlags, "-files-from", list.Name(), "-from0", src, dest))
+	}
+	return status
+}
@@ -0,0 +1,167 @@
+package copier
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchMask is what inotify reports on each directory watched. Files are
+// only taken as changed once closed after writing, so they aren't copied
+// half written.
+const watchMask = unix.IN_CLOSE_WRITE | unix.IN_CREATE | unix.IN_MOVED_TO | unix.IN_ATTRIB |
+	unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_DELETE_SELF | unix.IN_MOVE_SELF |
+	unix.IN_ONLYDIR | unix.IN_DONT_FOLLOW | unix.IN_EXCL_UNLINK
+
+// treeWatcher watches every directory below root with inotify, recording
+// what changes in changes.
+type treeWatcher struct {
+	fd      int
+	root    string
+	changes *changeSet
+	// dirs holds the path relative to root of each directory watched, by
+	// watch descriptor. Only run touches it once watching has started.
+	dirs map[int]string
+}
+
+func newTreeWatcher(root string, changes *changeSet) (*treeWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("watching %s: %w", root, err)
+	}
+	w := &treeWatcher{fd: fd, root: root, changes: changes, dirs: make(map[int]string)}
+	if err := w.addTree(".", false); err != nil {
+		w.close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// addTree watches the directory rel and those below it. With record set,
+// everything found is recorded as changed, as for a directory moved in
+// whose contents raise no events of their own.
+func (w *treeWatcher) addTree(rel string, record bool) error {
+	return filepath.WalkDir(filepath.Join(w.root, rel), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// It may be gone already, or be unreadable, which the sync
+			// will report
+			if path == w.root {
+				return err
+			}
+			return nil
+		}
+		sub, _ := filepath.Rel(w.root, path)
+		if record && sub != "." {
+			w.changes.add(sub)
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		wd, err := unix.InotifyAddWatch(w.fd, path, watchMask)
+		if err != nil {
+			if errors.Is(err, unix.ENOSPC) {
+				return fmt.Errorf("watching %s: too many directories, raise fs.inotify.max_user_watches", w.root)
+			}
+			if path == w.root {
+				return fmt.Errorf("watching %s: %w", w.root, err)
+			}
+			return nil
+		}
+		w.dirs[wd] = sub
+		return nil
+	})
+}
+
+// forget stops watching the directory rel and those below it, moved out of
+// the tree.
+func (w *treeWatcher) forget(rel string) {
+	for wd, dir := range w.dirs {
+		if dir == rel || strings.HasPrefix(dir, rel+"/") {
+			unix.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.dirs, wd)
+		}
+	}
+}
+
+// run reads events until the root goes away.
+func (w *treeWatcher) run() error {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := unix.Read(w.fd, buf)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("watching %s: %w", w.root, err)
+		}
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(event.Len)]
+			off += unix.SizeofInotifyEvent + int(event.Len)
+			if i := bytes.IndexByte(name, 0); i >= 0 {
+				name = name[:i]
+			}
+			if err := w.handle(int(event.Wd), event.Mask, string(name)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (w *treeWatcher) handle(wd int, mask uint32, name string) error {
+	if mask&unix.IN_Q_OVERFLOW != 0 {
+		// Events were lost, directories created meanwhile among them
+		w.changes.resync()
+		return w.addTree(".", false)
+	}
+	dir, ok := w.dirs[wd]
+	if !ok {
+		return nil
+	}
+	if mask&unix.IN_IGNORED != 0 {
+		delete(w.dirs, wd)
+		return nil
+	}
+	if mask&(unix.IN_DELETE_SELF|unix.IN_MOVE_SELF) != 0 {
+		if dir == "." {
+			return fmt.Errorf("stopped watching %s, which was removed or moved", w.root)
+		}
+		return nil
+	}
+	if name == "" {
+		// A change to the directory itself
+		return nil
+	}
+	rel := filepath.Join(dir, name)
+	switch {
+	case mask&(unix.IN_DELETE|unix.IN_MOVED_FROM) != 0:
+		if mask&unix.IN_ISDIR != 0 && mask&unix.IN_MOVED_FROM != 0 {
+			w.forget(rel)
+		}
+		w.changes.resync()
+	case mask&unix.IN_ISDIR != 0 && mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0:
+		return w.addTree(rel, true)
+	case mask&unix.IN_CREATE != 0:
+		// A new regular file is copied once written and closed, but
+		// links and special files raise nothing more
+		info, err := os.Lstat(filepath.Join(w.root, rel))
+		if err == nil && (!info.Mode().IsRegular() || info.Sys().(*syscall.Stat_t).Nlink > 1) {
+			w.changes.add(rel)
+		}
+	default:
+		w.changes.add(rel)
+	}
+	return nil
+}
+
+func (w *treeWatcher) close() error {
+	return unix.Close(w.fd)
+}
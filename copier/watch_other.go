@@ -0,0 +1,38 @@
+//go:build !linux
+
+package copier
+
+import "time"
+
+// watchPollInterval is how often the whole tree is synced again where it
+// can't be watched.
+const watchPollInterval = time.Minute
+
+// treeWatcher stands in for inotify on this platform, asking for the whole
+// tree to be synced again every watchPollInterval.
+type treeWatcher struct {
+	changes *changeSet
+	stop    chan struct{}
+}
+
+func newTreeWatcher(root string, changes *changeSet) (*treeWatcher, error) {
+	return &treeWatcher{changes: changes, stop: make(chan struct{})}, nil
+}
+
+func (w *treeWatcher) run() error {
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.changes.resync()
+		case <-w.stop:
+			return nil
+		}
+	}
+}
+
+func (w *treeWatcher) close() error {
+	close(w.stop)
+	return nil
+}
@@ -0,0 +1,31 @@
+package cp
+
+import "sync"
+
+// DefaultBufferSize is the copy buffer size used when none is given.
+const DefaultBufferSize = 128 * 1024
+
+// bufferPools holds a *sync.Pool of buffers for every buffer size in use, so
+// concurrent copies reuse buffers instead of allocating one per file.
+var bufferPools sync.Map
+
+// getBuffer returns a pooled buffer of the given size. Return it with putBuffer.
+func getBuffer(size int) *[]byte {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	pool, _ := bufferPools.LoadOrStore(size, &sync.Pool{
+		New: func() interface{} {
+			buf := make([]byte, size)
+			return &buf
+		},
+	})
+	return pool.(*sync.Pool).Get().(*[]byte)
+}
+
+// putBuffer returns buf to its pool.
+func putBuffer(buf *[]byte) {
+	if pool, ok := bufferPools.Load(len(*buf)); ok {
+		pool.(*sync.Pool).Put(buf)
+	}
+}
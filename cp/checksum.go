@@ -0,0 +1,45 @@
+package cp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+)
+
+// FileDigest returns the sha256 digest of the file at path, read with a
+// buffer of bufSize, or DefaultBufferSize if it is zero.
+func FileDigest(path string, bufSize int) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	h := sha256.New()
+	buf := getBuffer(bufSize)
+	defer putBuffer(buf)
+	if _, err := io.CopyBuffer(h, struct{ io.Reader }{file}, *buf); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// sameContents reports whether the files at src and dst, described by sfi and
+// dfi, hash the same, by opts.Digest if set.
+func sameContents(src, dst string, sfi, dfi os.FileInfo, opts Options) (bool, error) {
+	digest := opts.Digest
+	if digest == nil {
+		digest = func(path string, _ os.FileInfo) ([]byte, error) {
+			return FileDigest(path, opts.BufferSize)
+		}
+	}
+	srcSum, err := digest(src, sfi)
+	if err != nil {
+		return false, err
+	}
+	dstSum, err := digest(dst, dfi)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(srcSum, dstSum), nil
+}
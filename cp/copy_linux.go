@@ -0,0 +1,90 @@
+package cp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxKernelChunk bounds a single copy_file_range or sendfile call.
+const maxKernelChunk = 1 << 30
+
+// copyKernel copies the rest of src into dst without the data passing through
+// userspace, trying copy_file_range first and then sendfile. Both advance the
+// file offsets, so when neither is supported (handled is false) the caller can
+// finish with a buffered copy from wherever this left off. It stops between
+// calls once ctx is done.
+func copyKernel(ctx context.Context, dst, src *os.File) (handled bool, err error) {
+	for _, kernelCopy := range []func(out, in int) (int, error){copyFileRange, sendfile} {
+		handled, err = copyLoop(ctx, dst, src, kernelCopy)
+		if handled || err != nil {
+			return handled, err
+		}
+	}
+	return false, nil
+}
+
+func copyFileRange(out, in int) (int, error) {
+	return unix.CopyFileRange(in, nil, out, nil, maxKernelChunk, 0)
+}
+
+func sendfile(out, in int) (int, error) {
+	return unix.Sendfile(out, in, nil, maxKernelChunk)
+}
+
+// copyLoop calls kernelCopy until EOF. It reports handled as false, with no
+// error, if the kernel or filesystem rejects the call.
+func copyLoop(ctx context.Context, dst, src *os.File, kernelCopy func(out, in int) (int, error)) (bool, error) {
+	out, in := int(dst.Fd()), int(src.Fd())
+	for {
+		if err := ctx.Err(); err != nil {
+			return true, err
+		}
+		n, err := kernelCopy(out, in)
+		switch {
+		case err == unix.EINTR || err == unix.EAGAIN:
+			continue
+		case unsupportedKernelCopy(err):
+			return false, nil
+		case err != nil:
+			return true, &os.PathError{Op: "copy", Path: dst.Name(), Err: err}
+		case n == 0:
+			return true, nil
+		}
+	}
+}
+
+// unsupportedKernelCopy reports whether err means the syscall cannot be used
+// for this pair of files, e.g. across filesystems or on old kernels.
+func unsupportedKernelCopy(err error) bool {
+	for _, errno := range []unix.Errno{unix.EXDEV, unix.ENOSYS, unix.EOPNOTSUPP, unix.EINVAL, unix.EPERM, unix.EBADF} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// copyRange copies n bytes of src at srcOff to dst at dstOff inside the
+// kernel, which clones the range instead where the filesystem can, or else
+// through a buffer.
+func copyRange(dst, src *os.File, dstOff, srcOff, n int64) error {
+	for n > 0 {
+		m, err := unix.CopyFileRange(int(src.Fd()), &srcOff, int(dst.Fd()), &dstOff, int(min(n, maxKernelChunk)), 0)
+		switch {
+		case err == unix.EINTR || err == unix.EAGAIN:
+			continue
+		case unsupportedKernelCopy(err):
+			return copyRangeBuffered(dst, src, dstOff, srcOff, n)
+		case err != nil:
+			return &os.PathError{Op: "copy", Path: dst.Name(), Err: err}
+		case m == 0:
+			return io.ErrUnexpectedEOF
+		}
+		n -= int64(m)
+	}
+	return nil
+}
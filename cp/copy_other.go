@@ -0,0 +1,18 @@
+//go:build !linux
+
+package cp
+
+import (
+	"context"
+	"os"
+)
+
+// copyKernel has no kernel accelerated path on this platform.
+func copyKernel(ctx context.Context, dst, src *os.File) (handled bool, err error) {
+	return false, nil
+}
+
+// copyRange copies n bytes of src at srcOff to dst at dstOff.
+func copyRange(dst, src *os.File, dstOff, srcOff, n int64) error {
+	return copyRangeBuffered(dst, src, dstOff, srcOff, n)
+}
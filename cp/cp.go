@@ -2,12 +2,15 @@ package cp
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"os/user"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 func replaceHomeFolder(path string) (string, error) {
@@ -41,11 +44,204 @@ func AbsolutePath(path string) (string, error) {
 	return filepath.Abs(homeReplaced)
 }
 
+// Options controls how CopyFile creates the destination file.
+type Options struct {
+	// Hardlink attempts to hard link dst to src before falling back to a copy.
+	Hardlink bool
+	// LinkFrom, if set, names a file holding the same contents as src, such
+	// as its copy in an earlier backup, that dst is hard linked to before
+	// falling back to a copy. The attributes of dst are then those of that
+	// file.
+	LinkFrom string
+	// PreservePerms gives dst the same mode bits as src, including the
+	// setuid, setgid and sticky bits.
+	PreservePerms bool
+	// PreserveOwner chowns dst to the uid and gid of src. This needs
+	// privileges, and is silently skipped when they are missing.
+	PreserveOwner bool
+	// NumericIDs has no effect: source and destination share one user
+	// database, so the raw uid and gid are always kept. It is accepted for
+	// compatibility.
+	NumericIDs bool
+	// PreserveTimes gives dst the modification time of src, to the nanosecond.
+	PreserveTimes bool
+	// PreserveAtime also restores the access time when PreserveTimes is set.
+	PreserveAtime bool
+	// PreserveLinks recreates a symlink src as a symlink at dst instead of
+	// copying the file it points to.
+	PreserveLinks bool
+	// RecreateSpecial recreates FIFOs and device nodes at dst instead of
+	// rejecting them as non-regular files. Devices need root.
+	RecreateSpecial bool
+	// Reflink clones the file on copy-on-write filesystems instead of
+	// copying its contents. The zero value never clones.
+	Reflink ReflinkMode
+	// Engine selects how file data is copied. The zero value is EngineDefault.
+	Engine Engine
+	// QueueDepth is the number of chunks kept in flight by EngineIOUring.
+	QueueDepth int
+	// BufferSize is the size of the buffers used to copy file data when it
+	// cannot be copied inside the kernel, and of each io_uring request.
+	// Zero means DefaultBufferSize.
+	BufferSize int
+	// Delta updates an existing regular dst with rsync's algorithm, only
+	// writing the data of src that dst doesn't hold in blocks found by a
+	// rolling checksum. It is done in place while the blocks found stay
+	// where they were, and in a new file replacing dst once they move. It
+	// is not used for Atomic copies, which always write a new file.
+	Delta bool
+	// SkipUnchanged leaves an existing dst alone when it has the same size
+	// and modification time as src, like rsync's quick check.
+	SkipUnchanged bool
+	// Checksum leaves an existing dst alone when its contents hash the same
+	// as src, regardless of modification times. It takes precedence over
+	// SkipUnchanged.
+	Checksum bool
+	// Digest, if set, replaces hashing a file for Checksum, such as by
+	// looking its sha256 digest up in a cache. info describes the file as
+	// last statted. It may be called concurrently.
+	Digest func(path string, info os.FileInfo) ([]byte, error)
+	// Force replaces an existing dst that is not a regular file or cannot be
+	// opened for writing, by removing it first. Directories are never removed.
+	Force bool
+	// NoClobber never replaces an existing dst.
+	NoClobber bool
+	// Confirm, if set, is called before an existing dst is replaced.
+	// Returning false skips the file. It may be called concurrently.
+	Confirm func(dst string) bool
+	// Backup, if set, is called with an existing regular dst just before it
+	// is replaced, and must move it out of the way. It may be called
+	// concurrently.
+	Backup func(dst string) error
+	// DropCache advises the kernel to read src sequentially and to drop
+	// both files from the page cache once copied, so bulk copies don't
+	// evict everything else.
+	DropCache bool
+	// Atomic writes regular files to TempPath(dst) and renames them over dst
+	// once complete, so dst never holds a partly written file.
+	Atomic bool
+	// Open, if set, replaces os.Open for reading the contents of src when
+	// they are copied rather than linked or cloned. The data then always
+	// passes through userspace.
+	Open func(src string) (io.ReadCloser, error)
+	// Encode, if set, wraps dst in the writer it returns, such as a
+	// compressor, that the contents of src are written through and which
+	// is closed once they all are. The data then always passes through
+	// userspace, and dst is never linked, cloned, split or updated in place.
+	// Checksum doesn't apply, and SkipUnchanged only compares modification
+	// times, dst being as large as the encoded contents.
+	Encode func(w io.Writer) (io.WriteCloser, error)
+	// Decode, if set, wraps the contents of src in the reader it returns,
+	// such as a decompressor, whose contents dst gets instead. It is
+	// subject to the same limits as Encode.
+	Decode func(r io.Reader) (io.ReadCloser, error)
+	// SplitSize, if positive, has files larger than it copied in ranges of
+	// that size, SplitJobs at once, into a preallocated dst that is then
+	// compared with src range by range. Files written to a hash, read
+	// through Open or copied with EngineIOUring are never split.
+	SplitSize int64
+	SplitJobs int
+	// SrcInfo, if set, describes src as the caller last found it, by Lstat
+	// or by Stat for a followed symlink, and spares statting src again. A
+	// symlink is still resolved when it is not preserved.
+	SrcInfo os.FileInfo
+	// Context, if set, abandons the copy once done, between buffers or
+	// chunks, returning its error. The partly written dst is removed.
+	Context context.Context
+}
+
+// TempPath returns the hidden name beside dst that Atomic copies are written
+// to. A leftover from an interrupted copy is replaced by the next one.
+func TempPath(dst string) string {
+	return filepath.Join(filepath.Dir(dst), ".cpj-"+filepath.Base(dst)+".tmp")
+}
+
+// context returns the Context of o, or one never done.
+func (o Options) context() context.Context {
+	if o.Context == nil {
+		return context.Background()
+	}
+	return o.Context
+}
+
+// reader returns r, read only until the Context of o is done.
+func (o Options) reader(r io.Reader) io.Reader {
+	if o.Context == nil {
+		return r
+	}
+	return contextReader{o.Context, r}
+}
+
+// ContextReader returns r, failing once ctx is done, so a copy through it
+// stops at the next buffer. What r does besides Read, such as WriteTo, is
+// hidden.
+func ContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return contextReader{ctx, r}
+}
+
+// ContextWriter is ContextReader for the side written to.
+func ContextWriter(ctx context.Context, w io.Writer) io.Writer {
+	return contextWriter{ctx, w}
+}
+
+type contextReader struct {
+	ctx context.Context
+	io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.Reader.Read(p)
+}
+
+type contextWriter struct {
+	ctx context.Context
+	io.Writer
+}
+
+func (w contextWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.Writer.Write(p)
+}
+
+// transforms reports whether the contents of dst differ from those of src,
+// passing through Encode or Decode.
+func (o Options) transforms() bool {
+	return o.Encode != nil || o.Decode != nil
+}
+
+// Result describes what CopyFileDigest did with a file.
+type Result struct {
+	// Hashed is set when the contents of src were written to the hash.
+	Hashed bool
+	// Skipped is set when dst was left untouched because it was up to date.
+	Skipped bool
+	// Delta is set when dst was updated from a delta, Rewritten bytes of
+	// src being written to it.
+	Delta     bool
+	Rewritten int64
+}
+
 // CopyFile copies a file from src to dst. If src and dst files exist, and are
 // the same, then return success. Otherwise, attempt to create a hard link
 // between the two files. If that fails, copy the file contents from src to dst.
 // Creates any missing directories. Supports '~' notation for $HOME directory of the current user.
-func CopyFile(src, dst string, hardlink bool) (err error) {
+func CopyFile(src, dst string, opts Options) error {
+	_, err := CopyFileDigest(src, dst, opts, nil)
+	return err
+}
+
+// CopyFileDigest is like CopyFile, but also writes the contents of src to h as
+// they are copied, so no second read is needed to checksum the file. It
+// reports whether the contents were hashed, which is not the case for
+// symlinks, special files, skipped files or when src and dst are the same
+// file. A non-nil h disables hard linking, cloning and in-kernel copies, since
+// those never pass the data through userspace.
+func CopyFileDigest(src, dst string, opts Options, h hash.Hash) (res Result, err error) {
 	// srcAbs, err := AbsolutePath(src)
 	// if err != nil {
 	// 	return err
@@ -55,15 +251,39 @@ func CopyFile(src, dst string, hardlink bool) (err error) {
 	// 	return err
 	// }
 
+	if opts.NoClobber {
+		if _, err := os.Lstat(dst); err == nil {
+			res.Skipped = true
+			return res, nil
+		}
+	}
+
+	if opts.PreserveLinks {
+		lfi := opts.SrcInfo
+		if lfi == nil {
+			if lfi, err = os.Lstat(src); err != nil {
+				return res, err
+			}
+		}
+		if lfi.Mode()&os.ModeSymlink != 0 {
+			return res, copySymlink(src, dst, lfi, opts)
+		}
+	}
+
 	// open source file
-	sfi, err := os.Stat(src)
-	if err != nil {
-		return
+	sfi := opts.SrcInfo
+	if sfi == nil || sfi.Mode()&os.ModeSymlink != 0 {
+		if sfi, err = os.Stat(src); err != nil {
+			return
+		}
+	}
+	if opts.RecreateSpecial && IsSpecial(sfi.Mode()) {
+		return res, copySpecial(dst, sfi, opts)
 	}
 	if !sfi.Mode().IsRegular() {
 		// cannot copy non-regular files (e.g., directories,
 		// symlinks, devices, etc.)
-		return fmt.Errorf("CopyFile: non-regular source file %s (%q)", sfi.Name(), sfi.Mode().String())
+		return res, fmt.Errorf("CopyFile: non-regular source file %s (%q)", sfi.Name(), sfi.Mode().String())
 	}
 
 	// open dest file
@@ -75,30 +295,184 @@ func CopyFile(src, dst string, hardlink bool) (err error) {
 		// file doesn't exist
 		err := os.MkdirAll(filepath.Dir(dst), 0755)
 		if err != nil {
-			return err
+			return res, err
 		}
 
-	} else {
-		if !(dfi.Mode().IsRegular()) {
-			return fmt.Errorf("CopyFile: non-regular destination file %s (%q)", dfi.Name(), dfi.Mode().String())
+	} else if !dfi.Mode().IsRegular() {
+		if !opts.Force || dfi.IsDir() {
+			return res, fmt.Errorf("CopyFile: non-regular destination file %s (%q)", dfi.Name(), dfi.Mode().String())
+		}
+		if err = os.Remove(dst); err != nil {
+			return
 		}
+	} else {
 		if os.SameFile(sfi, dfi) {
+			res.Skipped = true
+			return
+		}
+		if opts.transforms() {
+			if opts.SkipUnchanged && dfi.ModTime().Equal(sfi.ModTime()) {
+				res.Skipped = true
+				return
+			}
+		} else if opts.Checksum {
+			if dfi.Size() == sfi.Size() {
+				if res.Skipped, err = sameContents(src, dst, sfi, dfi, opts); err != nil || res.Skipped {
+					return
+				}
+			}
+		} else if opts.SkipUnchanged && dfi.Size() == sfi.Size() && dfi.ModTime().Equal(sfi.ModTime()) {
+			res.Skipped = true
+			return
+		}
+		if opts.Confirm != nil && !opts.Confirm(dst) {
+			res.Skipped = true
+			return
+		}
+		// A backup moves dst away, leaving nothing for -force to remove
+		if opts.Backup != nil {
+			if err = opts.Backup(dst); err != nil {
+				return
+			}
+		} else if opts.Force {
+			// Like cp -f, remove a destination that can't be opened for writing
+			if f, err := os.OpenFile(dst, os.O_WRONLY, 0); err == nil {
+				f.Close()
+			} else if err := os.Remove(dst); err != nil {
+				return res, err
+			}
+		}
+	}
+	if err := opts.context().Err(); err != nil {
+		return res, err
+	}
+	// A copy abandoned midway leaves nothing worth keeping
+	defer func() {
+		if err != nil && opts.context().Err() != nil {
+			os.Remove(dst)
+		}
+	}()
+	if opts.Delta && !opts.Atomic && !opts.transforms() {
+		if dfi, err := os.Lstat(dst); err == nil && dfi.Mode().IsRegular() {
+			if res.Rewritten, err = copyDelta(src, dst, opts, h); err != nil {
+				return res, err
+			}
+			res.Delta, res.Hashed = true, h != nil
+			return res, PreserveAttributes(dst, sfi, opts)
+		}
+	}
+	if opts.Atomic {
+		final := dst
+		dst = TempPath(final)
+		if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+			return res, err
+		}
+		defer func() {
+			if err == nil {
+				err = os.Rename(dst, final)
+			}
+			if err != nil {
+				os.Remove(dst)
+			}
+		}()
+	}
+	// Encoded or decoded contents can't be shared with src
+	direct := h == nil && !opts.transforms()
+	if opts.LinkFrom != "" && direct {
+		if err = os.Link(opts.LinkFrom, dst); err == nil {
 			return
 		}
 	}
-	if hardlink {
+	if opts.Hardlink && direct {
 		if err = os.Link(src, dst); err == nil {
 			return
 		}
 	}
-	return copyFileContents(src, dst)
+	var cloned bool
+	if direct {
+		if cloned, err = cloneFile(src, dst, opts.Reflink); err != nil {
+			return
+		}
+	}
+	if !cloned {
+		if !opts.transforms() && splittable(sfi, opts, h) {
+			err = copyRanges(src, dst, sfi.Size(), opts)
+		} else {
+			err = copyFileContents(src, dst, opts, h)
+		}
+		if err != nil {
+			return
+		}
+	}
+	res.Hashed = h != nil
+	return res, PreserveAttributes(dst, sfi, opts)
+}
+
+// PreserveAttributes applies the owner, mode and times of the source file
+// described by sfi to dst, as requested by opts. The copy functions do so
+// themselves; it is for the directories a copy creates.
+func PreserveAttributes(dst string, sfi os.FileInfo, opts Options) error {
+	// Chown before chmod, since changing the owner clears setuid and setgid.
+	if opts.PreserveOwner {
+		if err := preserveOwner(dst, sfi); err != nil {
+			return err
+		}
+	}
+	if opts.PreservePerms {
+		if err := os.Chmod(dst, sfi.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+	}
+	// Times go last so nothing above bumps them again. A zero atime is left
+	// untouched by Chtimes.
+	if opts.PreserveTimes {
+		var atime time.Time
+		if opts.PreserveAtime {
+			atime = fileAtime(sfi)
+		}
+		return os.Chtimes(dst, atime, sfi.ModTime())
+	}
+	return nil
+}
+
+// IsSpecial reports whether mode describes a FIFO, socket or device node.
+func IsSpecial(mode os.FileMode) bool {
+	return mode&(os.ModeNamedPipe|os.ModeSocket|os.ModeDevice|os.ModeCharDevice) != 0
+}
+
+// copySpecial recreates the FIFO or device node described by sfi at dst,
+// replacing any existing non-directory dst.
+func copySpecial(dst string, sfi os.FileInfo, opts Options) error {
+	dfi, err := os.Lstat(dst)
+	if err == nil {
+		if dfi.IsDir() {
+			return fmt.Errorf("CopyFile: cannot replace directory %s with %s", dst, sfi.Mode().String())
+		}
+		if err := os.Remove(dst); err != nil {
+			return err
+		}
+	} else if os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+	} else {
+		return err
+	}
+	if err := mknod(dst, sfi); err != nil {
+		return err
+	}
+	return PreserveAttributes(dst, sfi, opts)
 }
 
 // copyFileContents copies the contents of the file named src to the file named
 // by dst. The file will be created if it does not already exist. If the
 // destination file exists, all it's contents will be replaced by the contents
-// of the source file.
-func copyFileContents(src, dst string) (err error) {
+// of the source file. If h is not nil the contents are also written to h.
+func copyFileContents(src, dst string, opts Options, h hash.Hash) (err error) {
+	if opts.Open != nil || opts.transforms() {
+		return copyFromReader(src, dst, opts, h)
+	}
+
 	// Open the source file for reading
 	srcFile, err := os.Open(src)
 	if err != nil {
@@ -120,10 +494,165 @@ func copyFileContents(src, dst string) (err error) {
 		}
 	}()
 
-	// Copy the contents of the source file into the destination files
-	if _, err = io.Copy(dstFile, srcFile); err != nil {
+	// Deferred calls run in reverse, so the cache is dropped after the Sync
+	// below and before the files are closed.
+	if opts.DropCache {
+		adviseSequential(srcFile)
+		defer func() {
+			adviseDontNeed(srcFile)
+			adviseDontNeed(dstFile)
+		}()
+	}
+
+	if h != nil {
+		buf := getBuffer(opts.BufferSize)
+		_, err = io.CopyBuffer(io.MultiWriter(dstFile, h), opts.reader(struct{ io.Reader }{srcFile}), *buf)
+		putBuffer(buf)
+		if err == nil {
+			err = dstFile.Sync()
+		}
 		return
 	}
+
+	if opts.Engine == EngineIOUring {
+		err = copyIOUring(opts.context(), dstFile, srcFile, opts.QueueDepth, opts.BufferSize)
+		if err != errIOUringUnavailable {
+			if err == nil {
+				err = dstFile.Sync()
+			}
+			return
+		}
+	}
+
+	// Copy the contents of the source file into the destination files,
+	// preferably inside the kernel. The buffered fallback hides the *os.File
+	// types so io.Copy doesn't retry the same syscalls.
+	handled, err := copyKernel(opts.context(), dstFile, srcFile)
+	if err != nil {
+		return
+	}
+	if !handled {
+		buf := getBuffer(opts.BufferSize)
+		_, err = io.CopyBuffer(struct{ io.Writer }{dstFile}, opts.reader(struct{ io.Reader }{srcFile}), *buf)
+		putBuffer(buf)
+		if err != nil {
+			return
+		}
+	}
 	err = dstFile.Sync()
 	return
 }
+
+// copyFromReader copies the contents of src, as read through opts.Open and
+// opts.Decode if set, to the file named by dst through opts.Encode if set,
+// replacing any previous contents. If h is not nil the contents are also
+// written to h.
+func copyFromReader(src, dst string, opts Options, h hash.Hash) (err error) {
+	var in io.ReadCloser
+	if opts.Open != nil {
+		in, err = opts.Open(src)
+	} else {
+		in, err = os.Open(src)
+	}
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	var r io.Reader = in
+	if opts.Decode != nil {
+		dec, err := opts.Decode(in)
+		if err != nil {
+			return &os.PathError{Op: "decode", Path: src, Err: err}
+		}
+		defer dec.Close()
+		r = decodeReader{dec, src}
+	}
+
+	dstFile, err := os.Create(dst)
+	if err != nil {
+		return
+	}
+	defer func() {
+		cerr := dstFile.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+	if opts.DropCache {
+		defer adviseDontNeed(dstFile)
+	}
+
+	var out io.Writer = dstFile
+	var enc io.WriteCloser
+	if opts.Encode != nil {
+		if enc, err = opts.Encode(dstFile); err != nil {
+			return
+		}
+		out = enc
+	}
+	var w io.Writer = struct{ io.Writer }{out}
+	if h != nil {
+		w = io.MultiWriter(out, h)
+	}
+	buf := getBuffer(opts.BufferSize)
+	_, err = io.CopyBuffer(w, opts.reader(r), *buf)
+	putBuffer(buf)
+	if enc != nil {
+		if cerr := enc.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err == nil {
+		err = dstFile.Sync()
+	}
+	return
+}
+
+// decodeReader names src in the errors of reading it through opts.Decode,
+// which otherwise don't say which file is corrupt.
+type decodeReader struct {
+	io.Reader
+	src string
+}
+
+func (r decodeReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = &os.PathError{Op: "decode", Path: r.src, Err: err}
+	}
+	return n, err
+}
+
+// copySymlink recreates the symlink src at dst, pointing at the same target.
+// An existing non-directory dst is replaced.
+func copySymlink(src, dst string, sfi os.FileInfo, opts Options) error {
+	target, err := os.Readlink(src)
+	if err != nil {
+		return err
+	}
+	dfi, err := os.Lstat(dst)
+	if err == nil {
+		if dfi.IsDir() {
+			return fmt.Errorf("CopyFile: cannot replace directory %s with a symlink", dst)
+		}
+		if existing, err := os.Readlink(dst); err == nil && existing == target {
+			return nil
+		}
+		if err := os.Remove(dst); err != nil {
+			return err
+		}
+	} else if os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+	} else {
+		return err
+	}
+	if err := os.Symlink(target, dst); err != nil {
+		return err
+	}
+	if opts.PreserveOwner {
+		return preserveOwner(dst, sfi)
+	}
+	return nil
+}
@@ -0,0 +1,337 @@
+package cp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"hash"
+	"io"
+	"math"
+	"os"
+)
+
+// The bounds of the block size of a delta signature. Between them it is
+// about the square root of the size of dst, as rsync picks it.
+const (
+	minDeltaBlock = 700
+	maxDeltaBlock = 128 << 10
+)
+
+// deltaBlockSize returns the block size of the signature of a file of size
+// bytes.
+func deltaBlockSize(size int64) int {
+	bs := int(math.Sqrt(float64(size))) &^ 7
+	return min(max(bs, minDeltaBlock), maxDeltaBlock)
+}
+
+// rollsum is rsync's weak checksum of a window of bytes, which can be moved
+// along by a byte without reading the rest of the window again.
+type rollsum struct {
+	a, b, n uint32
+}
+
+func (r *rollsum) init(window []byte) {
+	r.a, r.b, r.n = 0, 0, uint32(len(window))
+	for i, c := range window {
+		r.a += uint32(c)
+		r.b += uint32(len(window)-i) * uint32(c)
+	}
+}
+
+// roll moves the window along by one byte, out leaving it and in entering.
+func (r *rollsum) roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.n*uint32(out)
+}
+
+func (r *rollsum) sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+// deltaBlock is a block of the signature of dst, found by its weak checksum
+// and told apart from others with the same one by its strong checksum.
+type deltaBlock struct {
+	off    int64
+	strong [md5.Size]byte
+}
+
+// signature returns the blocks of size bs of f, by their weak checksum. A
+// last block shorter than bs is left out.
+func signature(f *os.File, size int64, bs int) (map[uint32][]deltaBlock, error) {
+	sig := make(map[uint32][]deltaBlock, size/int64(bs))
+	buf := make([]byte, bs)
+	var r rollsum
+	for off := int64(0); off+int64(bs) <= size; off += int64(bs) {
+		if _, err := f.ReadAt(buf, off); err != nil {
+			return nil, err
+		}
+		r.init(buf)
+		sig[r.sum()] = append(sig[r.sum()], deltaBlock{off, md5.Sum(buf)})
+	}
+	return sig, nil
+}
+
+// copyDelta updates the existing file dst to hold the contents of src with
+// rsync's algorithm. The blocks of dst are found wherever they are in src by
+// a rolling checksum, confirmed by a strong one, so only the data between
+// them, which dst doesn't hold, is written from src. It returns how many
+// bytes were. If h is not nil the contents of src are also written to h.
+//
+// While every block found is where it was, as with VM images and databases
+// changed where they stand, dst is updated in place, and the data between
+// the blocks is only written where it differs from what dst holds. Once data
+// has been inserted or removed, so a block has moved, the rest is written to
+// a new file beside dst, which then replaces it. The blocks are copied into
+// it from dst inside the kernel, which shares their extents instead where
+// the filesystem can clone them.
+func copyDelta(src, dst string, opts Options, h hash.Hash) (written int64, err error) {
+	var in io.ReadCloser
+	if opts.Open != nil {
+		in, err = opts.Open(src)
+	} else {
+		in, err = os.Open(src)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	dstFile, err := os.OpenFile(dst, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		cerr := dstFile.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+	if opts.DropCache {
+		defer adviseDontNeed(dstFile)
+	}
+	info, err := dstFile.Stat()
+	if err != nil {
+		return 0, err
+	}
+	bs := deltaBlockSize(info.Size())
+	sig, err := signature(dstFile, info.Size(), bs)
+	if err != nil {
+		return 0, err
+	}
+	a := &deltaApply{dst: dstFile, path: dst, mode: info.Mode().Perm(), buf: make([]byte, bs)}
+	defer a.abandon()
+
+	// The window being matched is buf[p:p+bs], and the data not matched yet
+	// before it starts at lit.
+	buf := make([]byte, 4*bs)
+	var p, lit, end int
+	var eof, rolled bool
+	var sum rollsum
+	r := opts.reader(in)
+	for {
+		// Rolling the window along needs the byte after it
+		if end-p <= bs && !eof {
+			if end == len(buf) {
+				copy(buf, buf[lit:end])
+				p, end, lit = p-lit, end-lit, 0
+			}
+			n, rerr := r.Read(buf[end:])
+			if h != nil {
+				h.Write(buf[end : end+n])
+			}
+			end += n
+			if rerr == io.EOF {
+				eof = true
+			} else if rerr != nil {
+				return a.written, rerr
+			}
+			continue
+		}
+		if end-p < bs {
+			break
+		}
+		window := buf[p : p+bs]
+		if !rolled {
+			sum.init(window)
+			rolled = true
+		}
+		if blocks, ok := sig[sum.sum()]; ok {
+			if off, ok := a.match(blocks, window); ok {
+				if err := a.literal(buf[lit:p]); err != nil {
+					return a.written, err
+				}
+				if err := a.block(off, window); err != nil {
+					return a.written, err
+				}
+				p += bs
+				lit, rolled = p, false
+				continue
+			}
+		}
+		if end-p == bs {
+			break
+		}
+		// Keep what is held back for the next match bounded
+		if p-lit >= bs {
+			if err := a.literal(buf[lit:p]); err != nil {
+				return a.written, err
+			}
+			lit = p
+		}
+		sum.roll(buf[p], buf[p+bs])
+		p++
+	}
+	if err := a.literal(buf[lit:end]); err != nil {
+		return a.written, err
+	}
+	return a.written, a.finish()
+}
+
+// deltaApply writes the new contents of dst as copyDelta finds them, in
+// place until a block is found somewhere else than where it is written, and
+// from then on into a new file beside dst.
+type deltaApply struct {
+	dst  *os.File
+	path string
+	mode os.FileMode
+	// tmp is the new file, once a block has moved.
+	tmp *os.File
+	// w is how much of the new contents there is so far. moved is how much
+	// there was when it started going into tmp: dst may no longer hold what
+	// it did below that.
+	w, moved int64
+	written  int64
+	// buf holds what dst has where data is written in place.
+	buf []byte
+}
+
+// match returns the offset of the block of dst among blocks that holds
+// window, preferring one where window would be written.
+func (a *deltaApply) match(blocks []deltaBlock, window []byte) (off int64, ok bool) {
+	strong := md5.Sum(window)
+	for _, b := range blocks {
+		if b.strong != strong {
+			continue
+		}
+		if b.off == a.w {
+			return b.off, true
+		}
+		if !ok {
+			off, ok = b.off, true
+		}
+	}
+	return off, ok
+}
+
+// literal writes data, which no block of dst holds.
+func (a *deltaApply) literal(data []byte) error {
+	if a.tmp != nil {
+		if _, err := a.tmp.WriteAt(data, a.w); err != nil {
+			return err
+		}
+		a.written += int64(len(data))
+		a.w += int64(len(data))
+		return nil
+	}
+	for len(data) > 0 {
+		chunk := data[:min(len(data), len(a.buf))]
+		n, _ := a.dst.ReadAt(a.buf[:len(chunk)], a.w)
+		if n != len(chunk) || !bytes.Equal(chunk, a.buf[:n]) {
+			if _, err := a.dst.WriteAt(chunk, a.w); err != nil {
+				return err
+			}
+			a.written += int64(len(chunk))
+		}
+		a.w += int64(len(chunk))
+		data = data[len(chunk):]
+	}
+	return nil
+}
+
+// block writes the block of dst at off, which holds data.
+func (a *deltaApply) block(off int64, data []byte) error {
+	if a.tmp == nil && off == a.w {
+		a.w += int64(len(data))
+		return nil
+	}
+	if a.tmp == nil {
+		if err := a.move(); err != nil {
+			return err
+		}
+	}
+	if off >= a.moved {
+		if err := copyRange(a.tmp, a.dst, a.w, off, int64(len(data))); err != nil {
+			return err
+		}
+	} else {
+		// dst may have been written over there while it was updated in place
+		if _, err := a.tmp.WriteAt(data, a.w); err != nil {
+			return err
+		}
+		a.written += int64(len(data))
+	}
+	a.w += int64(len(data))
+	return nil
+}
+
+// move starts the new file, with what has been written to dst in place.
+func (a *deltaApply) move() (err error) {
+	if a.tmp, err = os.OpenFile(TempPath(a.path), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+		return err
+	}
+	a.moved = a.w
+	return copyRange(a.tmp, a.dst, 0, 0, a.w)
+}
+
+// finish ends the new contents where they are, truncating dst, or replacing
+// it with the new file.
+func (a *deltaApply) finish() error {
+	if a.tmp == nil {
+		info, err := a.dst.Stat()
+		if err != nil {
+			return err
+		}
+		if info.Size() != a.w {
+			if err := a.dst.Truncate(a.w); err != nil {
+				return err
+			}
+		}
+		if a.written == 0 {
+			return nil
+		}
+		return a.dst.Sync()
+	}
+	if err := a.tmp.Chmod(a.mode); err != nil {
+		return err
+	}
+	if err := a.tmp.Sync(); err != nil {
+		return err
+	}
+	if err := a.tmp.Close(); err != nil {
+		return err
+	}
+	tmp := a.tmp.Name()
+	a.tmp = nil
+	if err := os.Rename(tmp, a.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// abandon removes the new file of an update that didn't finish.
+func (a *deltaApply) abandon() {
+	if a.tmp != nil {
+		a.tmp.Close()
+		os.Remove(a.tmp.Name())
+	}
+}
+
+// copyRangeBuffered copies n bytes of src at srcOff to dst at dstOff through
+// a buffer.
+func copyRangeBuffered(dst, src *os.File, dstOff, srcOff, n int64) error {
+	copied, err := io.Copy(io.NewOffsetWriter(dst, dstOff), io.NewSectionReader(src, srcOff, n))
+	if err == nil && copied != n {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,118 @@
+package cp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// deltaBlocks is how many blocks of minDeltaBlock bytes the destinations of
+// the tests below hold, few enough for that to be their block size.
+const deltaBlocks = 64
+
+func randomBytes(r *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(r.Uint32())
+	}
+	return b
+}
+
+// splice returns b with n bytes at off replaced by insert.
+func splice(b []byte, off, n int, insert []byte) []byte {
+	out := append([]byte{}, b[:off]...)
+	out = append(out, insert...)
+	return append(out, b[off+n:]...)
+}
+
+func TestCopyDelta(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	const bs = minDeltaBlock
+	old := randomBytes(r, deltaBlocks*bs)
+	if deltaBlockSize(int64(len(old))) != bs {
+		t.Fatalf("the destinations have blocks of %d bytes, not %d", deltaBlockSize(int64(len(old))), bs)
+	}
+	edited := bytes.Clone(old)
+	for _, off := range []int{10, 20*bs + 5, len(old) - 1} {
+		edited[off] ^= 0xff
+	}
+	front := randomBytes(r, 123)
+
+	for _, tc := range []struct {
+		name     string
+		dst, src []byte
+		// written is how many bytes of src the update should write, or
+		// -1 for no more than were in src.
+		written int64
+		// inPlace is whether dst should be updated in place rather than
+		// replaced.
+		inPlace bool
+	}{
+		{"unchanged", old, old, 0, true},
+		{"in-place edits", old, edited, 3 * bs, true},
+		// The insertion goes over the first block in place, which then has
+		// to be written out of src too once it is found to have moved
+		{"insertion at the front", old, append(bytes.Clone(front), old...), int64(len(front) + bs), false},
+		{"removal at the front", old, old[100:], -1, false},
+		{"block removed", old, splice(old, 10*bs, bs, nil), 0, false},
+		{"blocks swapped", old, append(bytes.Clone(old[bs:2*bs]), splice(old, bs, bs, nil)...), 0, false},
+		{"shrunk", old, old[:len(old)/2+17], 0, true},
+		{"grown", old, append(bytes.Clone(old), front...), int64(len(front)), true},
+		{"emptied", old, nil, 0, true},
+		{"empty dst", nil, old, int64(len(old)), true},
+		{"dst smaller than a block", old[:bs/2], old[:3*bs], -1, true},
+		// The literal goes over the second block in place, which is then
+		// found one block on, where dst no longer holds it.
+		{"block written over in place", old, splice(old, bs, 0, randomBytes(r, bs)), int64(2 * bs), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+			if err := os.WriteFile(src, tc.src, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(dst, tc.dst, 0600); err != nil {
+				t.Fatal(err)
+			}
+			before, err := os.Stat(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h := md5.New()
+			written, err := copyDelta(src, dst, Options{}, h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tc.src) {
+				t.Fatalf("dst holds %d bytes differing from the %d of src", len(got), len(tc.src))
+			}
+			if sum := md5.Sum(tc.src); !bytes.Equal(h.Sum(nil), sum[:]) {
+				t.Error("the hash of src differs from what it holds")
+			}
+			if tc.written >= 0 && written > tc.written || written > int64(len(tc.src)) {
+				t.Errorf("wrote %d bytes, want no more than %d", written, max(tc.written, 0))
+			}
+			after, err := os.Stat(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if inPlace := os.SameFile(before, after); inPlace != tc.inPlace {
+				t.Errorf("dst updated in place: %v, want %v", inPlace, tc.inPlace)
+			}
+			if after.Mode().Perm() != 0600 {
+				t.Errorf("dst has mode %v, want the -rw------- it had", after.Mode().Perm())
+			}
+			if _, err := os.Lstat(TempPath(dst)); !os.IsNotExist(err) {
+				t.Errorf("the new file of the update was left behind: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package cp
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Engine selects how CopyFile moves file data. It implements flag.Value.
+type Engine string
+
+const (
+	// EngineDefault copies in the kernel where possible, falling back to a
+	// buffered read/write loop.
+	EngineDefault Engine = "default"
+	// EngineIOUring keeps many reads and writes in flight through io_uring.
+	// It is experimental, and falls back to EngineDefault when io_uring is
+	// unavailable.
+	EngineIOUring Engine = "iouring"
+)
+
+// DefaultQueueDepth is the io_uring queue depth used when none is given.
+const DefaultQueueDepth = 32
+
+// errIOUringUnavailable means no ring could be set up, e.g. on old kernels,
+// other platforms or where seccomp blocks io_uring.
+var errIOUringUnavailable = errors.New("io_uring is not available")
+
+func (e *Engine) String() string {
+	return string(*e)
+}
+
+func (e *Engine) Set(val string) error {
+	switch engine := Engine(val); engine {
+	case EngineDefault, EngineIOUring:
+		*e = engine
+		return nil
+	}
+	return fmt.Errorf("invalid engine %q, must be default or iouring", val)
+}
@@ -0,0 +1,19 @@
+package cp
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// adviseSequential tells the kernel f will be read sequentially, so it reads
+// ahead aggressively.
+func adviseSequential(f *os.File) {
+	unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_SEQUENTIAL)
+}
+
+// adviseDontNeed asks the kernel to drop the cached pages of f. Dirty pages
+// are not dropped, so written files must be synced first.
+func adviseDontNeed(f *os.File) {
+	unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package cp
+
+import "os"
+
+// adviseSequential is a no-op on this platform.
+func adviseSequential(f *os.File) {}
+
+// adviseDontNeed is a no-op on this platform.
+func adviseDontNeed(f *os.File) {}
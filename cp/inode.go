@@ -0,0 +1,6 @@
+package cp
+
+// FileID identifies a file by the device it lives on and its inode number.
+type FileID struct {
+	Dev, Ino uint64
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package cp
+
+import "os"
+
+// Identity is not supported on this platform.
+func Identity(fi os.FileInfo) (id FileID, nlink uint64, ok bool) {
+	return FileID{}, 0, false
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package cp
+
+import (
+	"os"
+	"syscall"
+)
+
+// Identity returns the device and inode identifying the file described by fi,
+// along with its hard link count.
+func Identity(fi os.FileInfo) (id FileID, nlink uint64, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return FileID{}, 0, false
+	}
+	return FileID{Dev: uint64(st.Dev), Ino: uint64(st.Ino)}, uint64(st.Nlink), true
+}
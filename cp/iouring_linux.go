@@ -0,0 +1,322 @@
+package cp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Constants and layouts from <linux/io_uring.h>.
+const (
+	ioringOpRead  = 22
+	ioringOpWrite = 23
+
+	ioringEnterGetEvents = 1
+
+	ioringOffSQRing = 0
+	ioringOffCQRing = 0x8000000
+	ioringOffSQEs   = 0x10000000
+)
+
+type sqringOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type cqringOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type uringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  sqringOffsets
+	cqOff                                                                  cqringOffsets
+}
+
+type uringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	rwFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// uring is a minimal io_uring instance supporting plain reads and writes.
+type uring struct {
+	fd             int
+	sqRing, cqRing []byte
+	sqeMem         []byte
+	sqHead, sqTail *uint32
+	sqMask         uint32
+	sqArray        []uint32
+	sqes           []uringSQE
+	cqHead, cqTail *uint32
+	cqMask         uint32
+	cqes           []uringCQE
+	pending        uint32
+}
+
+func newUring(entries int) (*uring, error) {
+	var p uringParams
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, errIOUringUnavailable
+	}
+	r := &uring{fd: int(fd)}
+	var err error
+	r.sqRing, err = unix.Mmap(r.fd, ioringOffSQRing, int(p.sqOff.array+p.sqEntries*4), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		r.close()
+		return nil, err
+	}
+	r.cqRing, err = unix.Mmap(r.fd, ioringOffCQRing, int(p.cqOff.cqes+p.cqEntries*uint32(unsafe.Sizeof(uringCQE{}))), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		r.close()
+		return nil, err
+	}
+	r.sqeMem, err = unix.Mmap(r.fd, ioringOffSQEs, int(p.sqEntries*uint32(unsafe.Sizeof(uringSQE{}))), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		r.close()
+		return nil, err
+	}
+	r.sqHead = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.head]))
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.tail]))
+	r.sqMask = *(*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.ringMask]))
+	r.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.array])), p.sqEntries)
+	r.sqes = unsafe.Slice((*uringSQE)(unsafe.Pointer(&r.sqeMem[0])), p.sqEntries)
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.tail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.ringMask]))
+	r.cqes = unsafe.Slice((*uringCQE)(unsafe.Pointer(&r.cqRing[p.cqOff.cqes])), p.cqEntries)
+	return r, nil
+}
+
+func (r *uring) close() {
+	for _, m := range [][]byte{r.sqeMem, r.cqRing, r.sqRing} {
+		if m != nil {
+			unix.Munmap(m)
+		}
+	}
+	unix.Close(r.fd)
+}
+
+// queue adds a read or write of buf at off to the submission ring. The
+// caller must not have more entries outstanding than the ring holds.
+func (r *uring) queue(op uint8, fd int, buf []byte, off int64, userData uint64) {
+	tail := atomic.LoadUint32(r.sqTail)
+	idx := tail & r.sqMask
+	r.sqes[idx] = uringSQE{
+		opcode:   op,
+		fd:       int32(fd),
+		off:      uint64(off),
+		addr:     uint64(uintptr(unsafe.Pointer(&buf[0]))),
+		len:      uint32(len(buf)),
+		userData: userData,
+	}
+	r.sqArray[idx] = idx
+	atomic.StoreUint32(r.sqTail, tail+1)
+	r.pending++
+}
+
+// submitAndWait submits queued entries and blocks until at least one
+// completion is available.
+func (r *uring) submitAndWait() error {
+	if err := r.enter(r.pending); err != nil {
+		return err
+	}
+	r.pending = 0
+	return nil
+}
+
+// wait blocks until at least one completion is available, submitting
+// nothing.
+func (r *uring) wait() error {
+	return r.enter(0)
+}
+
+func (r *uring) enter(toSubmit uint32) error {
+	for {
+		_, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(toSubmit), 1, ioringEnterGetEvents, 0, 0)
+		if errno == unix.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	}
+}
+
+// reap calls fn for every available completion.
+func (r *uring) reap(fn func(cqe uringCQE)) {
+	head := atomic.LoadUint32(r.cqHead)
+	tail := atomic.LoadUint32(r.cqTail)
+	for ; head != tail; head++ {
+		cqe := r.cqes[head&r.cqMask]
+		atomic.StoreUint32(r.cqHead, head+1)
+		fn(cqe)
+	}
+}
+
+// uringSlot is one buffer cycling through read then write of a file region.
+type uringSlot struct {
+	pooled *[]byte
+	buf    []byte
+	off    int64
+	want   int
+	n      int
+	done   int
+}
+
+// stranded holds the buffers of requests that may still be in flight on a
+// ring that failed even to wait for them, so that they are never pooled
+// again nor collected while the kernel may write to them.
+var stranded struct {
+	sync.Mutex
+	bufs []*[]byte
+}
+
+// copyIOUring copies src to dst through io_uring with up to depth chunks of
+// the given size in flight. It returns errIOUringUnavailable if no ring could
+// be created.
+func copyIOUring(ctx context.Context, dst, src *os.File, depth, chunk int) error {
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	if depth < 1 {
+		depth = DefaultQueueDepth
+	}
+	if chunk < 1 {
+		chunk = DefaultBufferSize
+	}
+	r, err := newUring(depth)
+	if err != nil {
+		return err
+	}
+	defer r.close()
+
+	// Each slot has at most one request in flight, so depth slots never
+	// overflow the rings. The low bit of user data marks writes.
+	srcFd, dstFd := int(src.Fd()), int(dst.Fd())
+	slots := make([]uringSlot, depth)
+	defer func() {
+		for i := range slots {
+			if slots[i].pooled != nil {
+				putBuffer(slots[i].pooled)
+			}
+		}
+	}()
+	var next int64
+	inflight := 0
+	// Once ctx is done or a request fails no further requests are queued,
+	// and those in flight are waited for, as the kernel writes to their
+	// buffers
+	var failed error
+	start := func(i int) {
+		if next >= size || ctx.Err() != nil || failed != nil {
+			return
+		}
+		want := int64(chunk)
+		if size-next < want {
+			want = size - next
+		}
+		if slots[i].pooled == nil {
+			slots[i].pooled = getBuffer(chunk)
+			slots[i].buf = *slots[i].pooled
+		}
+		slots[i].off, slots[i].want = next, int(want)
+		next += want
+		r.queue(ioringOpRead, srcFd, slots[i].buf[:want], slots[i].off, uint64(i)<<1)
+		inflight++
+	}
+	for i := range slots {
+		start(i)
+	}
+	for inflight > 0 {
+		if err := r.submitAndWait(); err != nil {
+			// What was submitted before still reads into or writes from
+			// its buffers, so it is waited for before they are pooled
+			// again, and if even that fails they are stranded for good.
+			// What failed to be submitted is never started
+			for submitted := inflight - int(r.pending); submitted > 0; {
+				if r.wait() != nil {
+					stranded.Lock()
+					for i := range slots {
+						if slots[i].pooled != nil {
+							stranded.bufs = append(stranded.bufs, slots[i].pooled)
+							slots[i].pooled = nil
+						}
+					}
+					stranded.Unlock()
+					break
+				}
+				r.reap(func(uringCQE) { submitted-- })
+			}
+			return &os.PathError{Op: "io_uring_enter", Path: dst.Name(), Err: err}
+		}
+		r.reap(func(cqe uringCQE) {
+			inflight--
+			i, write := int(cqe.userData>>1), cqe.userData&1 == 1
+			s := &slots[i]
+			if cqe.res < 0 && failed == nil {
+				path, op := src.Name(), "read"
+				if write {
+					path, op = dst.Name(), "write"
+				}
+				failed = &os.PathError{Op: op, Path: path, Err: unix.Errno(-cqe.res)}
+			}
+			if failed != nil {
+				return
+			}
+			res := int(cqe.res)
+			switch {
+			case !write && res == 0:
+				failed = fmt.Errorf("%s shrank while being copied", src.Name())
+			case !write:
+				s.n, s.done = res, 0
+				r.queue(ioringOpWrite, dstFd, s.buf[:s.n], s.off, uint64(i)<<1|1)
+				inflight++
+			case s.done+res < s.n:
+				s.done += res
+				r.queue(ioringOpWrite, dstFd, s.buf[s.done:s.n], s.off+int64(s.done), uint64(i)<<1|1)
+				inflight++
+			case s.n < s.want:
+				// Short read: fetch the rest of this region.
+				s.off += int64(s.n)
+				s.want -= s.n
+				r.queue(ioringOpRead, srcFd, s.buf[:s.want], s.off, uint64(i)<<1)
+				inflight++
+			default:
+				start(i)
+			}
+		})
+	}
+	if failed != nil {
+		return failed
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package cp
+
+import (
+	"context"
+	"os"
+)
+
+// copyIOUring is not supported on this platform.
+func copyIOUring(ctx context.Context, dst, src *os.File, depth, chunk int) error {
+	return errIOUringUnavailable
+}
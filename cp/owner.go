@@ -0,0 +1,27 @@
+package cp
+
+import (
+	"errors"
+	"os"
+)
+
+// Owner returns the uid and gid of the file described by fi, where files
+// have them.
+func Owner(fi os.FileInfo) (uid, gid int, ok bool) {
+	return fileOwner(fi)
+}
+
+// preserveOwner chowns dst to the uid and gid of the source file described
+// by sfi. Lacking the privilege to chown is not an error unless running as
+// root.
+func preserveOwner(dst string, sfi os.FileInfo) error {
+	uid, gid, ok := fileOwner(sfi)
+	if !ok {
+		return nil
+	}
+	err := os.Lchown(dst, uid, gid)
+	if errors.Is(err, os.ErrPermission) && os.Geteuid() != 0 {
+		return nil
+	}
+	return err
+}
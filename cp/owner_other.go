@@ -0,0 +1,10 @@
+//go:build !unix
+
+package cp
+
+import "os"
+
+// fileOwner is not supported on this platform.
+func fileOwner(fi os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
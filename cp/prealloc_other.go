@@ -0,0 +1,11 @@
+//go:build !linux
+
+package cp
+
+import "os"
+
+// preallocate sets the size of f up front, as fallocate isn't available on
+// this platform.
+func preallocate(f *os.File, size int64) error {
+	return f.Truncate(size)
+}
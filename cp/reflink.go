@@ -0,0 +1,57 @@
+package cp
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ReflinkMode selects whether CopyFile clones files on copy-on-write
+// filesystems such as btrfs, XFS and APFS. It implements flag.Value.
+type ReflinkMode string
+
+const (
+	// ReflinkNever always copies the file contents.
+	ReflinkNever ReflinkMode = "never"
+	// ReflinkAuto clones when possible and copies otherwise.
+	ReflinkAuto ReflinkMode = "auto"
+	// ReflinkAlways fails rather than falling back to a copy.
+	ReflinkAlways ReflinkMode = "always"
+)
+
+// errReflinkUnsupported is returned by reflink on platforms without cloning.
+var errReflinkUnsupported = errors.New("reflink not supported on this platform")
+
+func (m *ReflinkMode) String() string {
+	return string(*m)
+}
+
+func (m *ReflinkMode) Set(val string) error {
+	switch mode := ReflinkMode(val); mode {
+	case ReflinkNever, ReflinkAuto, ReflinkAlways:
+		*m = mode
+		return nil
+	}
+	return fmt.Errorf("invalid reflink mode %q, must be auto, always or never", val)
+}
+
+// cloneFile tries to clone src to dst according to mode. It reports whether
+// dst now holds a clone; a failed clone is only an error for ReflinkAlways.
+func cloneFile(src, dst string, mode ReflinkMode) (bool, error) {
+	if mode != ReflinkAuto && mode != ReflinkAlways {
+		return false, nil
+	}
+	err := reflink(src, dst)
+	if err == nil {
+		return true, nil
+	}
+	if mode == ReflinkAlways {
+		return false, fmt.Errorf("CopyFile: reflink %s to %s: %w", src, dst, err)
+	}
+	return false, nil
+}
+
+// Reflink clones src to a new file dst, sharing its data extents, on
+// filesystems that support it.
+func Reflink(src, dst string) error {
+	return reflink(src, dst)
+}
@@ -0,0 +1,22 @@
+package cp
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// reflink clones src to dst with clonefile(2). clonefile refuses to replace an
+// existing file, so the clone is made beside dst and renamed over it.
+func reflink(src, dst string) error {
+	tmp := filepath.Join(filepath.Dir(dst), ".cpj-clone-"+filepath.Base(dst))
+	if err := unix.Clonefile(src, tmp, unix.CLONE_NOFOLLOW); err != nil {
+		return &os.LinkError{Op: "clonefile", Old: src, New: dst, Err: err}
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package cp
+
+// reflink is not supported on this platform.
+func reflink(src, dst string) error {
+	return errReflinkUnsupported
+}
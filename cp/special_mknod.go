@@ -0,0 +1,36 @@
+//go:build linux || darwin
+
+package cp
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// mknod creates a FIFO or device node at path matching the file described by fi.
+func mknod(path string, fi os.FileInfo) error {
+	mode := uint32(fi.Mode().Perm())
+	var dev int
+	switch m := fi.Mode(); {
+	case m&os.ModeNamedPipe != 0:
+		mode |= syscall.S_IFIFO
+	case m&os.ModeDevice != 0:
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("CopyFile: no device number for %s", fi.Name())
+		}
+		dev = int(st.Rdev)
+		if m&os.ModeCharDevice != 0 {
+			mode |= syscall.S_IFCHR
+		} else {
+			mode |= syscall.S_IFBLK
+		}
+	default:
+		return fmt.Errorf("CopyFile: cannot recreate %s (%q)", fi.Name(), fi.Mode().String())
+	}
+	if err := syscall.Mknod(path, mode, dev); err != nil {
+		return &os.PathError{Op: "mknod", Path: path, Err: err}
+	}
+	return nil
+}
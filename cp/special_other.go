@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package cp
+
+import (
+	"fmt"
+	"os"
+)
+
+// mknod is not supported on this platform.
+func mknod(path string, fi os.FileInfo) error {
+	return fmt.Errorf("CopyFile: cannot recreate %s (%q) on this platform", fi.Name(), fi.Mode().String())
+}
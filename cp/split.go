@@ -0,0 +1,128 @@
+package cp
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync"
+)
+
+// splittable reports whether the regular file described by sfi is copied in
+// ranges, as set up by opts.
+func splittable(sfi os.FileInfo, opts Options, h hash.Hash) bool {
+	return opts.SplitSize > 0 && opts.SplitJobs > 1 && sfi.Size() > opts.SplitSize &&
+		h == nil && opts.Open == nil && opts.Engine != EngineIOUring
+}
+
+// copyRanges copies the size bytes of src to dst in ranges of
+// opts.SplitSize, opts.SplitJobs at once, into a dst preallocated to the full
+// size. Each range of dst is then read back and compared with src.
+func copyRanges(src, dst string, size int64, opts Options) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return
+	}
+	defer func() {
+		cerr := out.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+	if opts.DropCache {
+		defer func() {
+			adviseDontNeed(in)
+			adviseDontNeed(out)
+		}()
+	}
+	if err = preallocate(out, size); err != nil {
+		return
+	}
+
+	err = forRanges(size, opts.SplitSize, opts.SplitJobs, func(off, n int64) error {
+		buf := getBuffer(opts.BufferSize)
+		defer putBuffer(buf)
+		_, err := io.CopyBuffer(io.NewOffsetWriter(out, off), opts.reader(io.NewSectionReader(in, off, n)), *buf)
+		return err
+	})
+	if err != nil {
+		return
+	}
+	if err = out.Sync(); err != nil {
+		return
+	}
+	return forRanges(size, opts.SplitSize, opts.SplitJobs, func(off, n int64) error {
+		same, err := sameRange(in, out, off, n, opts.BufferSize)
+		if err == nil && !same {
+			err = fmt.Errorf("CopyFile: %s differs from %s in bytes %d to %d after copying", dst, src, off, off+n)
+		}
+		return err
+	})
+}
+
+// forRanges calls fn for every range of at most chunk bytes of a file of
+// size bytes, with jobs calls at once. It stops handing out ranges after the
+// first error, which it returns.
+func forRanges(size, chunk int64, jobs int, fn func(off, n int64) error) error {
+	offsets := make(chan int64)
+	var mu sync.Mutex
+	var first error
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for off := range offsets {
+				if err := fn(off, min(chunk, size-off)); err != nil {
+					mu.Lock()
+					if first == nil {
+						first = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for off := int64(0); off < size; off += chunk {
+		mu.Lock()
+		failed := first != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+		offsets <- off
+	}
+	close(offsets)
+	wg.Wait()
+	return first
+}
+
+// sameRange reports whether a and b hold the same n bytes at off.
+func sameRange(a, b *os.File, off, n int64, bufSize int) (bool, error) {
+	abuf, bbuf := getBuffer(bufSize), getBuffer(bufSize)
+	defer putBuffer(abuf)
+	defer putBuffer(bbuf)
+	ra, rb := io.NewSectionReader(a, off, n), io.NewSectionReader(b, off, n)
+	for {
+		na, erra := io.ReadFull(ra, *abuf)
+		nb, errb := io.ReadFull(rb, *bbuf)
+		if na != nb || !bytes.Equal((*abuf)[:na], (*bbuf)[:nb]) {
+			return false, nil
+		}
+		if erra == io.EOF || erra == io.ErrUnexpectedEOF {
+			return true, nil
+		}
+		if erra != nil {
+			return false, erra
+		}
+		if errb != nil && errb != io.EOF && errb != io.ErrUnexpectedEOF {
+			return false, errb
+		}
+	}
+}
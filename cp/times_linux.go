@@ -0,0 +1,16 @@
+package cp
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// fileAtime returns the access time of the file described by fi.
+func fileAtime(fi os.FileInfo) time.Time {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(st.Atim.Unix())
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package cp
+
+import (
+	"os"
+	"time"
+)
+
+// fileAtime is not supported on this platform. The zero time leaves the
+// access time of the destination untouched.
+func fileAtime(fi os.FileInfo) time.Time {
+	return time.Time{}
+}
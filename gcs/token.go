@@ -0,0 +1,307 @@
+// Package gcs finds the OAuth 2 access tokens Google Cloud Storage takes,
+// from the application default credentials, as Google's own tools do. The
+// requests themselves go to its XML API, through package s3.
+package gcs
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Endpoint is the XML API of Google Cloud Storage.
+const Endpoint = "https://storage.googleapis.com"
+
+// scope is the access tokens are asked for: reading and writing objects.
+const scope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// ErrNoCredentials is returned when none of the sources of DefaultToken has
+// any.
+var ErrNoCredentials = errors.New("gcs: no credentials found in $GOOGLE_APPLICATION_CREDENTIALS, the gcloud application default credentials, or the instance metadata")
+
+// refreshWindow is how long before it expires a token is fetched again.
+const refreshWindow = time.Minute
+
+// token is an access token and when it expires.
+type token struct {
+	value   string
+	expires time.Time
+}
+
+// DefaultToken returns a source of access tokens from the application
+// default credentials: the service account key or gcloud user credentials
+// of the file $GOOGLE_APPLICATION_CREDENTIALS names, those gcloud auth
+// application-default login saved, or else the service account of a Compute
+// Engine instance. Tokens are reused until about to expire.
+func DefaultToken() func() (string, error) {
+	var (
+		mu     sync.Mutex
+		source func() (token, error)
+		cached token
+	)
+	return func() (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if cached.value != "" && time.Until(cached.expires) > refreshWindow {
+			return cached.value, nil
+		}
+		if source == nil {
+			var err error
+			if source, err = findSource(); err != nil {
+				return "", err
+			}
+		}
+		t, err := source()
+		if err != nil {
+			return "", err
+		}
+		cached = t
+		return t.value, nil
+	}
+}
+
+// findSource returns the first source of tokens with credentials.
+func findSource() (func() (token, error), error) {
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		path = wellKnownFile()
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			return fileSource(path, data)
+		}
+		if !os.IsNotExist(err) || os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") != "" {
+			return nil, fmt.Errorf("gcs: %w", err)
+		}
+	}
+	if onInstance() {
+		return instanceToken, nil
+	}
+	return nil, ErrNoCredentials
+}
+
+// wellKnownFile is where gcloud auth application-default login saves the
+// credentials of the user.
+func wellKnownFile() string {
+	const name = "application_default_credentials.json"
+	if runtime.GOOS == "windows" {
+		if dir := os.Getenv("APPDATA"); dir != "" {
+			return filepath.Join(dir, "gcloud", name)
+		}
+		return ""
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "gcloud", name)
+}
+
+// credentialsFile is a service account key or gcloud user credentials file.
+type credentialsFile struct {
+	Type string `json:"type"`
+	// A service account
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	PrivateKeyID string `json:"private_key_id"`
+	TokenURI     string `json:"token_uri"`
+	// A user
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// fileSource returns the source of tokens of the credentials file at path,
+// holding data.
+func fileSource(path string, data []byte) (func() (token, error), error) {
+	var f credentialsFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("gcs: %s: %w", path, err)
+	}
+	if f.TokenURI == "" {
+		f.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	switch f.Type {
+	case "service_account":
+		key, err := parseKey(f.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("gcs: %s: %w", path, err)
+		}
+		return func() (token, error) {
+			assertion, err := signJWT(f, key, time.Now())
+			if err != nil {
+				return token{}, err
+			}
+			return exchange(f.TokenURI, url.Values{
+				"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+				"assertion":  {assertion},
+			})
+		}, nil
+	case "authorized_user":
+		return func() (token, error) {
+			return exchange(f.TokenURI, url.Values{
+				"grant_type":    {"refresh_token"},
+				"client_id":     {f.ClientID},
+				"client_secret": {f.ClientSecret},
+				"refresh_token": {f.RefreshToken},
+			})
+		}, nil
+	}
+	return nil, fmt.Errorf("gcs: %s: unsupported credentials type %q", path, f.Type)
+}
+
+// parseKey parses the PEM private key of a service account.
+func parseKey(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("no PEM private key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an RSA key")
+	}
+	return key, nil
+}
+
+// signJWT returns the assertion, signed with the key of the service account
+// f, that exchanges for an access token.
+func signJWT(f credentialsFile, key *rsa.PrivateKey, now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": f.PrivateKeyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]any{
+		"iss":   f.ClientEmail,
+		"scope": scope,
+		"aud":   f.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+// tokenResponse is how both the token endpoint and the instance metadata
+// hand out access tokens.
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func (r tokenResponse) token(now time.Time) token {
+	return token{value: r.AccessToken, expires: now.Add(time.Duration(r.ExpiresIn) * time.Second)}
+}
+
+// exchange posts form to the token endpoint for an access token.
+func exchange(endpoint string, form url.Values) (token, error) {
+	now := time.Now()
+	resp, err := http.PostForm(endpoint, form)
+	if err != nil {
+		return token{}, fmt.Errorf("gcs: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var failed struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		json.NewDecoder(resp.Body).Decode(&failed)
+		return token{}, fmt.Errorf("gcs: getting an access token: %s: %s %s", resp.Status, failed.Error, failed.Description)
+	}
+	var r tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return token{}, fmt.Errorf("gcs: getting an access token: %w", err)
+	}
+	return r.token(now), nil
+}
+
+// metadataClient talks to the instance metadata, which answers quickly if
+// it is there at all.
+var metadataClient = &http.Client{Timeout: 2 * time.Second}
+
+// metadataURL is the instance metadata, at $GCE_METADATA_HOST if set.
+func metadataURL() string {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "169.254.169.254"
+	}
+	return "http://" + host + "/computeMetadata/v1/"
+}
+
+func metadataRequest(path string) *http.Request {
+	req, _ := http.NewRequest(http.MethodGet, metadataURL()+path, nil)
+	req.Header.Set("Metadata-Flavor", "Google")
+	return req
+}
+
+// onInstance reports whether the instance metadata of Compute Engine, or of
+// GKE and Cloud Run, which serve it too, answers.
+func onInstance() bool {
+	resp, err := metadataClient.Do(metadataRequest(""))
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.Header.Get("Metadata-Flavor") == "Google"
+}
+
+// instanceToken fetches a token for the service account of the instance.
+func instanceToken() (token, error) {
+	now := time.Now()
+	resp, err := metadataClient.Do(metadataRequest("instance/service-accounts/default/token?scopes=" + url.QueryEscape(scope)))
+	if err != nil {
+		return token{}, fmt.Errorf("gcs: instance token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return token{}, fmt.Errorf("gcs: instance token: %s", resp.Status)
+	}
+	var r tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return token{}, fmt.Errorf("gcs: instance token: %w", err)
+	}
+	return r.token(now), nil
+}
+
+// EmulatorEndpoint returns the endpoint of a local emulator of the store
+// $STORAGE_EMULATOR_HOST names, which takes requests without a token, or ""
+// if unset.
+func EmulatorEndpoint() string {
+	host := os.Getenv("STORAGE_EMULATOR_HOST")
+	if host == "" || strings.Contains(host, "://") {
+		return host
+	}
+	return "http://" + host
+}
@@ -0,0 +1,155 @@
+package gcs
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tokenServer is a token endpoint handing out tokens numbered by the
+// requests made, and passing each form to check.
+func tokenServer(t *testing.T, check func(form url.Values)) (*httptest.Server, *int) {
+	t.Helper()
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		check(r.PostForm)
+		requests++
+		json.NewEncoder(w).Encode(tokenResponse{AccessToken: "token" + strings.Repeat("!", requests), ExpiresIn: 3600})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func TestServiceAccount(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var srv *httptest.Server
+	srv, requests := tokenServer(t, func(form url.Values) {
+		if got := form.Get("grant_type"); got != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			t.Errorf("grant_type %q", got)
+		}
+		parts := strings.Split(form.Get("assertion"), ".")
+		if len(parts) != 3 {
+			t.Errorf("assertion of %d parts", len(parts))
+			return
+		}
+		var header map[string]string
+		var claims map[string]any
+		for i, v := range []any{&header, &claims} {
+			data, err := base64.RawURLEncoding.DecodeString(parts[i])
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if err := json.Unmarshal(data, v); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		if header["alg"] != "RS256" || header["kid"] != "key-1" {
+			t.Errorf("header %v", header)
+		}
+		if claims["iss"] != "copier@project.iam.gserviceaccount.com" || claims["scope"] != scope || claims["aud"] != srv.URL {
+			t.Errorf("claims %v", claims)
+		}
+		if iat, exp := claims["iat"].(float64), claims["exp"].(float64); exp-iat != 3600 {
+			t.Errorf("issued at %v, expiring at %v", iat, exp)
+		}
+		sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+			t.Errorf("signature: %v", err)
+		}
+	})
+	data, err := json.Marshal(credentialsFile{
+		Type:         "service_account",
+		ClientEmail:  "copier@project.iam.gserviceaccount.com",
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		PrivateKeyID: "key-1",
+		TokenURI:     srv.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", path)
+
+	// The token is fetched once, then reused while it lasts
+	tokens := DefaultToken()
+	for range 2 {
+		if tok, err := tokens(); err != nil || tok != "token!" {
+			t.Errorf("token %q, err %v", tok, err)
+		}
+	}
+	if *requests != 1 {
+		t.Errorf("%d requests for tokens, want 1", *requests)
+	}
+}
+
+func TestAuthorizedUser(t *testing.T) {
+	srv, _ := tokenServer(t, func(form url.Values) {
+		want := url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {"id"},
+			"client_secret": {"secret"},
+			"refresh_token": {"refresh"},
+		}
+		if form.Encode() != want.Encode() {
+			t.Errorf("form %v, want %v", form, want)
+		}
+	})
+	data := `{"type": "authorized_user", "client_id": "id", "client_secret": "secret", "refresh_token": "refresh", "token_uri": "` + srv.URL + `"}`
+	source, err := fileSource("adc.json", []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now()
+	tok, err := source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.value != "token!" || tok.expires.Before(before.Add(time.Hour)) || tok.expires.After(time.Now().Add(time.Hour)) {
+		t.Errorf("token %q expiring at %v", tok.value, tok.expires)
+	}
+}
+
+func TestCredentialsFileInvalid(t *testing.T) {
+	for _, data := range []string{
+		`not json`,
+		`{"type": "external_account"}`,
+		`{"type": "service_account", "private_key": "no key"}`,
+	} {
+		if _, err := fileSource("bad.json", []byte(data)); err == nil {
+			t.Errorf("took %s", data)
+		}
+	}
+}
@@ -1 +1,5 @@
 module cpj
+
+go 1.24
+
+require golang.org/x/sys v0.30.0
@@ -0,0 +1,12 @@
+// Command cpj copies files and directory trees in parallel. It is the command
+// line of package copier, which holds everything it does.
+package main
+
+import (
+	"cpj/copier"
+	"os"
+)
+
+func main() {
+	os.Exit(copier.Main(os.Args[1:]))
+}
@@ -0,0 +1,389 @@
+// Package s3 is a small client for S3 and compatible object stores, such as
+// MinIO or the XML API of Google Cloud Storage, covering what copying trees
+// needs: listing a prefix, ranged reads, and single and multipart uploads,
+// signed with AWS signature version 4 or carrying an OAuth 2 token.
+package s3
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MinPartSize and MaxParts bound the parts of a multipart upload. Every part
+// but the last must be at least MinPartSize.
+const (
+	MinPartSize = 5 << 20
+	MaxParts    = 10000
+)
+
+// Config describes the store a Client talks to.
+type Config struct {
+	// Endpoint is the URL of the store, like http://localhost:9000 for
+	// MinIO. Empty means AWS, in Region.
+	Endpoint string
+	// Region defaults to us-east-1.
+	Region string
+	// PathStyle puts the bucket in the path of each request rather than
+	// in the host name. It is always used with an Endpoint, which
+	// compatible stores expect.
+	PathStyle   bool
+	Credentials Provider
+	// Token, if set, authorizes requests with the OAuth 2 bearer token it
+	// returns instead of signing them with Credentials, as the XML API of
+	// Google Cloud Storage takes. An empty token sends none.
+	Token func() (string, error)
+	// Scheme names the store in errors, as in s3://bucket/key, which it
+	// defaults to.
+	Scheme string
+	// HTTPClient defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// Client makes requests to an S3 compatible store. It is safe for
+// concurrent use.
+type Client struct {
+	endpoint  *url.URL
+	region    string
+	pathStyle bool
+	creds     Provider
+	token     func() (string, error)
+	scheme    string
+	http      *http.Client
+}
+
+// New returns a Client for cfg.
+func New(cfg Config) (*Client, error) {
+	c := &Client{region: cfg.Region, pathStyle: cfg.PathStyle, creds: cfg.Credentials, token: cfg.Token, scheme: cfg.Scheme, http: cfg.HTTPClient}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+	if c.scheme == "" {
+		c.scheme = "s3"
+	}
+	if c.creds == nil && c.token == nil {
+		c.creds = DefaultCredentials()
+	}
+	if c.http == nil {
+		c.http = http.DefaultClient
+	}
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + c.region + ".amazonaws.com"
+	} else {
+		c.pathStyle = true
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("s3: invalid endpoint %q: %w", endpoint, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("s3: invalid endpoint %q: must be an http or https URL", endpoint)
+	}
+	c.endpoint = u
+	return c, nil
+}
+
+// Object describes an object of a bucket.
+type Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	ETag         string
+}
+
+// Part is a part of a multipart upload, as CompleteMultipart wants it.
+type Part struct {
+	Number int    `xml:"PartNumber"`
+	ETag   string `xml:"ETag"`
+}
+
+// Error is an error response of the store.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	// Scheme and Resource, the bucket and key of the request, name what
+	// it was about.
+	Scheme, Resource string
+}
+
+func (e *Error) Error() string {
+	msg := e.Code
+	if msg == "" {
+		msg = http.StatusText(e.StatusCode)
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return fmt.Sprintf("%s://%s: %s", e.Scheme, e.Resource, msg)
+}
+
+// Is makes a missing bucket or key match fs.ErrNotExist, and a denied
+// request fs.ErrPermission.
+func (e *Error) Is(target error) bool {
+	switch target {
+	case fs.ErrNotExist:
+		return e.StatusCode == http.StatusNotFound
+	case fs.ErrPermission:
+		return e.StatusCode == http.StatusForbidden
+	}
+	return false
+}
+
+// Temporary reports whether the request might succeed if made again: the
+// store was busy or failed, or the request timed out.
+func (e *Error) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusRequestTimeout || e.StatusCode == http.StatusTooManyRequests
+}
+
+// request is a request to make to the store.
+type request struct {
+	method      string
+	bucket, key string
+	query       url.Values
+	header      http.Header
+	// body, if set, is sent as is, unsigned, as size bytes. A body that
+	// is an io.ReaderAt is resent from the start on redirects.
+	body io.Reader
+	size int64
+	// payload is a small body that is signed.
+	payload []byte
+}
+
+// do makes req, returning the response if it succeeded. The caller must
+// close its body.
+func (c *Client) do(req request) (*http.Response, error) {
+	u := *c.endpoint
+	path := "/" + req.key
+	if c.pathStyle {
+		path = "/" + req.bucket + path
+	} else {
+		u.Host = req.bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = escape(u.Path, false)
+	u.RawQuery = canonicalQuery(req.query)
+
+	var body io.Reader
+	hash := emptyPayload
+	switch {
+	case req.body != nil && req.size == 0:
+		// Go would send an empty body it can't see the end of chunked
+		body, hash = http.NoBody, unsignedPayload
+	case req.body != nil:
+		body, hash = req.body, unsignedPayload
+	case req.payload != nil:
+		sum := sha256.Sum256(req.payload)
+		body, hash = bytes.NewReader(req.payload), hex.EncodeToString(sum[:])
+	}
+	hreq, err := http.NewRequest(req.method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if req.body != nil && req.size > 0 {
+		hreq.ContentLength = req.size
+		if r, ok := req.body.(io.ReaderAt); ok {
+			hreq.GetBody = func() (io.ReadCloser, error) {
+				return io.NopCloser(io.NewSectionReader(r, 0, req.size)), nil
+			}
+		}
+	}
+	for name, values := range req.header {
+		hreq.Header[name] = values
+	}
+	if err := c.authorize(hreq, hash); err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		return nil, c.responseError(resp, req.bucket+"/"+req.key)
+	}
+	return resp, nil
+}
+
+// authorize signs req, whose body has the digest payload, or gives it the
+// bearer token.
+func (c *Client) authorize(req *http.Request, payload string) error {
+	if c.token == nil {
+		creds, err := c.creds()
+		if err != nil {
+			return err
+		}
+		sign(req, creds, c.region, payload, time.Now())
+		return nil
+	}
+	token, err := c.token()
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return nil
+}
+
+// responseError reads the error of a failed response.
+func (c *Client) responseError(resp *http.Response, resource string) error {
+	e := &Error{StatusCode: resp.StatusCode, Scheme: c.scheme, Resource: resource}
+	var body struct {
+		Code, Message string
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if xml.Unmarshal(data, &body) == nil {
+		e.Code, e.Message = body.Code, body.Message
+	}
+	return e
+}
+
+// doXML makes req and decodes the XML response into v. Some requests fail
+// with an error in the body of a 200 response, which is returned too.
+func (c *Client) doXML(req request, v any) error {
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var failed struct {
+		XMLName       xml.Name `xml:"Error"`
+		Code, Message string
+	}
+	if xml.Unmarshal(data, &failed) == nil {
+		return &Error{StatusCode: resp.StatusCode, Code: failed.Code, Message: failed.Message, Scheme: c.scheme, Resource: req.bucket + "/" + req.key}
+	}
+	return xml.Unmarshal(data, v)
+}
+
+// List calls fn with each object of bucket whose key starts with prefix, in
+// the order of their keys, stopping at the first error fn returns.
+func (c *Client) List(bucket, prefix string, fn func(Object) error) error {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		var page struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+				ETag         string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if err := c.doXML(request{method: http.MethodGet, bucket: bucket, query: query}, &page); err != nil {
+			return err
+		}
+		for _, o := range page.Contents {
+			if err := fn(Object{Key: o.Key, Size: o.Size, LastModified: o.LastModified, ETag: o.ETag}); err != nil {
+				return err
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
+
+// Head returns the object bucket/key.
+func (c *Client) Head(bucket, key string) (Object, error) {
+	resp, err := c.do(request{method: http.MethodHead, bucket: bucket, key: key})
+	if err != nil {
+		return Object{}, err
+	}
+	resp.Body.Close()
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return Object{Key: key, Size: resp.ContentLength, LastModified: modified, ETag: resp.Header.Get("ETag")}, nil
+}
+
+// Get returns size bytes of the object bucket/key from offset on, or all of
+// it from there if size is negative.
+func (c *Client) Get(bucket, key string, offset, size int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	switch {
+	case size >= 0:
+		if size == 0 {
+			return io.NopCloser(strings.NewReader("")), nil
+		}
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+size-1))
+	case offset > 0:
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := c.do(request{method: http.MethodGet, bucket: bucket, key: key, header: header})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Put uploads size bytes of body as the object bucket/key.
+func (c *Client) Put(bucket, key string, body io.Reader, size int64) error {
+	resp, err := c.do(request{method: http.MethodPut, bucket: bucket, key: key, body: body, size: size})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// CreateMultipart starts a multipart upload of the object bucket/key,
+// returning its id.
+func (c *Client) CreateMultipart(bucket, key string) (string, error) {
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err := c.doXML(request{method: http.MethodPost, bucket: bucket, key: key, query: url.Values{"uploads": {""}}}, &result)
+	return result.UploadID, err
+}
+
+// UploadPart uploads size bytes of body as part number of the multipart
+// upload id, returning the part to complete it with.
+func (c *Client) UploadPart(bucket, key, id string, number int, body io.Reader, size int64) (Part, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {id}}
+	resp, err := c.do(request{method: http.MethodPut, bucket: bucket, key: key, query: query, body: body, size: size})
+	if err != nil {
+		return Part{}, err
+	}
+	resp.Body.Close()
+	return Part{Number: number, ETag: resp.Header.Get("ETag")}, nil
+}
+
+// CompleteMultipart joins parts, in order, into the object of the multipart
+// upload id.
+func (c *Client) CompleteMultipart(bucket, key, id string, parts []Part) error {
+	payload, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []Part   `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	var result struct{}
+	return c.doXML(request{method: http.MethodPost, bucket: bucket, key: key, query: url.Values{"uploadId": {id}}, payload: payload}, &result)
+}
+
+// AbortMultipart discards the multipart upload id and its parts.
+func (c *Client) AbortMultipart(bucket, key, id string) error {
+	resp, err := c.do(request{method: http.MethodDelete, bucket: bucket, key: key, query: url.Values{"uploadId": {id}}})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
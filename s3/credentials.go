@@ -0,0 +1,273 @@
+package s3
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credentials are the keys requests are signed with. Those of a role expire,
+// and are fetched again shortly before.
+type Credentials struct {
+	AccessKeyID, SecretAccessKey, SessionToken string
+	Expires                                    time.Time
+}
+
+// Provider returns the credentials to sign with.
+type Provider func() (Credentials, error)
+
+// ErrNoCredentials is returned when none of the sources of DefaultCredentials
+// has any.
+var ErrNoCredentials = errors.New("s3: no credentials found in the environment, the shared credentials file, or the container or instance metadata")
+
+// refreshWindow is how long before they expire credentials are fetched again.
+const refreshWindow = 5 * time.Minute
+
+// DefaultCredentials returns the standard AWS chain of providers: the
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN variables,
+// the AWS_PROFILE profile, or default, of the shared credentials file, then
+// the role of an ECS container or of an EC2 instance. The first source with
+// credentials is kept, and its credentials reused until about to expire.
+func DefaultCredentials() Provider {
+	var (
+		mu     sync.Mutex
+		source Provider
+		cached Credentials
+	)
+	chain := []Provider{envCredentials, sharedCredentials, containerCredentials, instanceCredentials}
+	return func() (Credentials, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if cached.AccessKeyID != "" && (cached.Expires.IsZero() || time.Until(cached.Expires) > refreshWindow) {
+			return cached, nil
+		}
+		if source != nil {
+			creds, err := source()
+			if err != nil {
+				return Credentials{}, err
+			}
+			cached = creds
+			return creds, nil
+		}
+		for _, p := range chain {
+			creds, err := p()
+			if errors.Is(err, ErrNoCredentials) {
+				continue
+			}
+			if err != nil {
+				return Credentials{}, err
+			}
+			source, cached = p, creds
+			return creds, nil
+		}
+		return Credentials{}, ErrNoCredentials
+	}
+}
+
+// StaticCredentials returns a Provider of creds.
+func StaticCredentials(creds Credentials) Provider {
+	return func() (Credentials, error) {
+		return creds, nil
+	}
+}
+
+func envCredentials() (Credentials, error) {
+	creds := Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return Credentials{}, ErrNoCredentials
+	}
+	return creds, nil
+}
+
+func sharedCredentials() (Credentials, error) {
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return Credentials{}, ErrNoCredentials
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	values, err := readProfile(path, profile(), false)
+	if os.IsNotExist(err) {
+		return Credentials{}, ErrNoCredentials
+	}
+	if err != nil {
+		return Credentials{}, err
+	}
+	creds := Credentials{
+		AccessKeyID:     values["aws_access_key_id"],
+		SecretAccessKey: values["aws_secret_access_key"],
+		SessionToken:    values["aws_session_token"],
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return Credentials{}, ErrNoCredentials
+	}
+	return creds, nil
+}
+
+// DefaultRegion returns the region of AWS_REGION, AWS_DEFAULT_REGION, or the
+// profile in the shared config file, or "" if none is set.
+func DefaultRegion() string {
+	for _, name := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(name); region != "" {
+			return region
+		}
+	}
+	path := os.Getenv("AWS_CONFIG_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		path = filepath.Join(home, ".aws", "config")
+	}
+	values, _ := readProfile(path, profile(), true)
+	return values["region"]
+}
+
+func profile() string {
+	if name := os.Getenv("AWS_PROFILE"); name != "" {
+		return name
+	}
+	return "default"
+}
+
+// readProfile returns the settings of the profile name in the ini file at
+// path. In the config file, profiles other than default are headed
+// [profile name].
+func readProfile(path, name string, config bool) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	section := name
+	if config && name != "default" {
+		section = "profile " + name
+	}
+	values := make(map[string]string)
+	in := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			in = strings.TrimSpace(line[1:len(line)-1]) == section
+			continue
+		}
+		if key, value, ok := strings.Cut(line, "="); ok && in {
+			values[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+		}
+	}
+	return values, scanner.Err()
+}
+
+// metadataClient fetches credentials from the container or instance
+// metadata, which answer quickly if they are there at all.
+var metadataClient = &http.Client{Timeout: 2 * time.Second}
+
+// roleCredentials is how the container and instance metadata hand out the
+// credentials of a role.
+type roleCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+func (r roleCredentials) credentials() Credentials {
+	return Credentials{AccessKeyID: r.AccessKeyID, SecretAccessKey: r.SecretAccessKey, SessionToken: r.Token, Expires: r.Expiration}
+}
+
+// containerCredentials fetches the credentials of the task role of an ECS
+// container, from the endpoint given in its environment.
+func containerCredentials() (Credentials, error) {
+	url := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); rel != "" {
+		url = "http://169.254.170.2" + rel
+	}
+	if url == "" {
+		return Credentials{}, ErrNoCredentials
+	}
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return Credentials{}, err
+	}
+	if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	var role roleCredentials
+	if err := metadataJSON(req, &role); err != nil {
+		return Credentials{}, fmt.Errorf("s3: container credentials: %w", err)
+	}
+	return role.credentials(), nil
+}
+
+// instanceCredentials fetches the credentials of the role of an EC2
+// instance, with IMDSv2. Anywhere else it finds nothing, once the metadata
+// address times out.
+func instanceCredentials() (Credentials, error) {
+	if os.Getenv("AWS_EC2_METADATA_DISABLED") == "true" {
+		return Credentials{}, ErrNoCredentials
+	}
+	const base = "http://169.254.169.254/latest"
+	req, _ := http.NewRequest(http.MethodPut, base+"/api/token", nil)
+	req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return Credentials{}, ErrNoCredentials
+	}
+	token, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return Credentials{}, ErrNoCredentials
+	}
+	get := func(path string) *http.Request {
+		req, _ := http.NewRequest(http.MethodGet, base+"/meta-data/iam/security-credentials/"+path, nil)
+		req.Header.Set("X-Aws-Ec2-Metadata-Token", string(token))
+		return req
+	}
+	resp, err = metadataClient.Do(get(""))
+	if err != nil {
+		return Credentials{}, ErrNoCredentials
+	}
+	name, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		// An instance without a role
+		return Credentials{}, ErrNoCredentials
+	}
+	roleName, _, _ := strings.Cut(strings.TrimSpace(string(name)), "\n")
+	var role roleCredentials
+	if err := metadataJSON(get(roleName), &role); err != nil {
+		return Credentials{}, fmt.Errorf("s3: instance credentials: %w", err)
+	}
+	return role.credentials(), nil
+}
+
+func metadataJSON(req *http.Request, v any) error {
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", req.URL, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
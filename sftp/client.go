@@ -0,0 +1,650 @@
+// Package sftp is a client for version 3 of the SSH file transfer protocol,
+// as OpenSSH's sftp-server speaks it, run over the ssh command so its
+// configuration, keys and agent all apply. Reads and writes of whole files
+// keep many requests in flight, so a long round trip doesn't limit them.
+package sftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+	"time"
+)
+
+// ErrConnectionLost is returned by every request once the connection has
+// failed.
+var ErrConnectionLost = errors.New("sftp: connection lost")
+
+// StatusError is a request the server refused.
+type StatusError struct {
+	Op, Path string
+	Code     uint32
+	Msg      string
+}
+
+func (e *StatusError) Error() string {
+	msg := e.Msg
+	if msg == "" {
+		msg = fmt.Sprintf("status %d", e.Code)
+	}
+	return fmt.Sprintf("sftp: %s %s: %s", e.Op, e.Path, msg)
+}
+
+// Is makes a missing file match fs.ErrNotExist, and a denied request
+// fs.ErrPermission.
+func (e *StatusError) Is(target error) bool {
+	switch target {
+	case fs.ErrNotExist:
+		return e.Code == statusNoSuchFile
+	case fs.ErrPermission:
+		return e.Code == statusPermission
+	}
+	return false
+}
+
+// Client makes requests to an sftp server. It is safe for concurrent use,
+// the requests of several goroutines going out together.
+type Client struct {
+	w io.WriteCloser
+	// exited, if set, waits for the ssh command to exit.
+	exited func() error
+	// extensions are those the server announced, with their data.
+	extensions map[string]string
+
+	wmu sync.Mutex
+	// mu guards the requests awaiting responses, the next request id and
+	// the error that ended the connection.
+	mu      sync.Mutex
+	pending map[uint32]chan response
+	next    uint32
+	err     error
+}
+
+// response is the reply to a request: its type and what follows the id.
+type response struct {
+	typ byte
+	r   reader
+}
+
+// Dial starts the sftp subsystem on host, [user@]host, with command, the
+// ssh command and any flags of its own, and returns a client talking to it.
+func Dial(command []string, host string) (*Client, error) {
+	if len(command) == 0 {
+		return nil, errors.New("sftp: no ssh command")
+	}
+	args := append(append([]string{}, command[1:]...), "-s", host, "sftp")
+	cmd := exec.Command(command[0], args...)
+	cmd.Stderr = os.Stderr
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("sftp: %s: %w", host, err)
+	}
+	c, err := NewClient(r, w)
+	if err != nil {
+		w.Close()
+		cmd.Wait()
+		return nil, fmt.Errorf("sftp: %s: %w", host, err)
+	}
+	c.exited = cmd.Wait
+	return c, nil
+}
+
+// NewClient starts a session with the server reading requests from w and
+// answering on r.
+func NewClient(r io.Reader, w io.WriteCloser) (*Client, error) {
+	c := &Client{w: w, pending: make(map[uint32]chan response), extensions: make(map[string]string)}
+	var init buffer
+	init.uint32(5)
+	init.byte(fxpInit)
+	init.uint32(protocolVersion)
+	if _, err := w.Write(init); err != nil {
+		return nil, err
+	}
+	typ, body, err := readPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	if typ != fxpVersion {
+		return nil, fmt.Errorf("unexpected packet %d instead of the version", typ)
+	}
+	rd := reader{p: body}
+	if version := rd.uint32(); version < protocolVersion {
+		return nil, fmt.Errorf("server speaks version %d of the protocol", version)
+	}
+	for len(rd.p) > 0 && rd.err == nil {
+		name, data := rd.string(), rd.string()
+		c.extensions[name] = data
+	}
+	go c.receive(r)
+	return c, nil
+}
+
+// readPacket reads the next packet, returning its type and the rest.
+func readPacket(r io.Reader) (byte, []byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n == 0 || n > maxPacket {
+		return 0, nil, fmt.Errorf("sftp: packet of %d bytes", n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return body[0], body[1:], nil
+}
+
+// receive hands each response to the request waiting for it, until the
+// connection fails, when every request still waiting fails too.
+func (c *Client) receive(r io.Reader) {
+	for {
+		typ, body, err := readPacket(r)
+		if err == nil && len(body) < 4 {
+			err = errShortPacket
+		}
+		if err != nil {
+			c.mu.Lock()
+			c.err = fmt.Errorf("%w: %w", ErrConnectionLost, err)
+			for id, ch := range c.pending {
+				close(ch)
+				delete(c.pending, id)
+			}
+			c.mu.Unlock()
+			return
+		}
+		id := binary.BigEndian.Uint32(body)
+		c.mu.Lock()
+		ch := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if ch != nil {
+			ch <- response{typ, reader{p: body[4:]}}
+		}
+	}
+}
+
+// send sends a request of type typ, filled in by fill, returning the
+// channel its response comes on, closed if the connection fails first.
+func (c *Client) send(typ byte, fill func(b *buffer)) (chan response, error) {
+	ch := make(chan response, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	id := c.next
+	c.next++
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	b := buffer{0, 0, 0, 0}
+	b.byte(typ)
+	b.uint32(id)
+	fill(&b)
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	c.wmu.Lock()
+	_, err := c.w.Write(b)
+	c.wmu.Unlock()
+	if err != nil {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return nil, fmt.Errorf("%w: %w", ErrConnectionLost, err)
+	}
+	return ch, nil
+}
+
+// wait waits for the response on ch.
+func (c *Client) wait(ch chan response) (response, error) {
+	resp, ok := <-ch
+	if !ok {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return response{}, c.err
+	}
+	return resp, nil
+}
+
+// call sends a request and waits for its response.
+func (c *Client) call(typ byte, fill func(b *buffer)) (response, error) {
+	ch, err := c.send(typ, fill)
+	if err != nil {
+		return response{}, err
+	}
+	return c.wait(ch)
+}
+
+// status returns the error of resp, a status response to op on p, or of a
+// response of another type than want.
+func status(resp response, op, p string, want byte) error {
+	if resp.typ == want && want != fxpStatus {
+		return nil
+	}
+	if resp.typ != fxpStatus {
+		return fmt.Errorf("sftp: %s %s: unexpected packet %d", op, p, resp.typ)
+	}
+	code, msg := resp.r.uint32(), resp.r.string()
+	if code == statusOK && want == fxpStatus {
+		return nil
+	}
+	if code == statusOK {
+		return fmt.Errorf("sftp: %s %s: no result", op, p)
+	}
+	if code == statusEOF {
+		return io.EOF
+	}
+	return &StatusError{Op: op, Path: p, Code: code, Msg: msg}
+}
+
+// Close ends the session, waiting for the ssh command to exit.
+func (c *Client) Close() error {
+	err := c.w.Close()
+	if c.exited != nil {
+		// Its exit status only says how the server took the end of input
+		c.exited()
+	}
+	return err
+}
+
+// Stat returns the attributes of the file at p, following symlinks.
+func (c *Client) Stat(p string) (os.FileInfo, error) {
+	return c.stat(fxpStat, "stat", p)
+}
+
+// Lstat returns the attributes of the file at p, or of the symlink at p.
+func (c *Client) Lstat(p string) (os.FileInfo, error) {
+	return c.stat(fxpLstat, "lstat", p)
+}
+
+func (c *Client) stat(typ byte, op, p string) (os.FileInfo, error) {
+	resp, err := c.call(typ, func(b *buffer) { b.string(p) })
+	if err != nil {
+		return nil, err
+	}
+	if err := status(resp, op, p, fxpAttrs); err != nil {
+		return nil, err
+	}
+	a := resp.r.attrs()
+	return &fileInfo{name: path.Base(p), a: a}, resp.r.err
+}
+
+// ReadDir returns the entries of the directory p, less . and .., as lstat
+// would describe them.
+func (c *Client) ReadDir(p string) ([]os.FileInfo, error) {
+	handle, err := c.open(fxpOpendir, "opendir", p, func(b *buffer) { b.string(p) })
+	if err != nil {
+		return nil, err
+	}
+	defer c.closeHandle(handle)
+	var entries []os.FileInfo
+	for {
+		resp, err := c.call(fxpReaddir, func(b *buffer) { b.string(handle) })
+		if err != nil {
+			return nil, err
+		}
+		if err := status(resp, "readdir", p, fxpName); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+		for n := resp.r.uint32(); n > 0; n-- {
+			name := resp.r.string()
+			resp.r.string()
+			a := resp.r.attrs()
+			if name != "." && name != ".." {
+				entries = append(entries, &fileInfo{name: name, a: a})
+			}
+		}
+		if resp.r.err != nil {
+			return nil, resp.r.err
+		}
+	}
+}
+
+// Mkdir creates the directory p with the permissions perm.
+func (c *Client) Mkdir(p string, perm os.FileMode) error {
+	return c.simple(fxpMkdir, "mkdir", p, func(b *buffer) {
+		b.string(p)
+		b.attrs(attrs{flags: attrPermissions, perm: uint32(perm.Perm())})
+	})
+}
+
+// Remove removes the file p.
+func (c *Client) Remove(p string) error {
+	return c.simple(fxpRemove, "remove", p, func(b *buffer) { b.string(p) })
+}
+
+// RemoveDir removes the empty directory p.
+func (c *Client) RemoveDir(p string) error {
+	return c.simple(fxpRmdir, "rmdir", p, func(b *buffer) { b.string(p) })
+}
+
+// Rename renames oldpath to newpath, replacing newpath if the server
+// supports OpenSSH's posix-rename. Without it an existing newpath is
+// removed first.
+func (c *Client) Rename(oldpath, newpath string) error {
+	if _, ok := c.extensions[posixRename]; ok {
+		return c.simple(fxpExtended, "rename", oldpath, func(b *buffer) {
+			b.string(posixRename)
+			b.string(oldpath)
+			b.string(newpath)
+		})
+	}
+	if err := c.Remove(newpath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return c.simple(fxpRename, "rename", oldpath, func(b *buffer) {
+		b.string(oldpath)
+		b.string(newpath)
+	})
+}
+
+// ReadLink returns the target of the symlink p.
+func (c *Client) ReadLink(p string) (string, error) {
+	return c.name(fxpReadlink, "readlink", p)
+}
+
+// RealPath returns p made absolute, with symlinks, . and .. resolved.
+func (c *Client) RealPath(p string) (string, error) {
+	return c.name(fxpRealpath, "realpath", p)
+}
+
+// name makes a request about p answered by a single name.
+func (c *Client) name(typ byte, op, p string) (string, error) {
+	resp, err := c.call(typ, func(b *buffer) { b.string(p) })
+	if err != nil {
+		return "", err
+	}
+	if err := status(resp, op, p, fxpName); err != nil {
+		return "", err
+	}
+	if resp.r.uint32() != 1 {
+		return "", fmt.Errorf("sftp: %s %s: expected one name", op, p)
+	}
+	name := resp.r.string()
+	return name, resp.r.err
+}
+
+// Symlink creates the symlink p pointing to target. OpenSSH, unlike the
+// draft of the protocol, takes the target first, and so does every server
+// written to work with its client.
+func (c *Client) Symlink(target, p string) error {
+	return c.simple(fxpSymlink, "symlink", p, func(b *buffer) {
+		b.string(target)
+		b.string(p)
+	})
+}
+
+// Chmod sets the permissions of p.
+func (c *Client) Chmod(p string, mode os.FileMode) error {
+	return c.setstat(p, attrs{flags: attrPermissions, perm: uint32(mode.Perm())})
+}
+
+// Chtimes sets the access and modification times of p, to the second.
+func (c *Client) Chtimes(p string, atime, mtime time.Time) error {
+	return c.setstat(p, attrs{flags: attrTimes, atime: uint32(atime.Unix()), mtime: uint32(mtime.Unix())})
+}
+
+func (c *Client) setstat(p string, a attrs) error {
+	return c.simple(fxpSetstat, "setstat", p, func(b *buffer) {
+		b.string(p)
+		b.attrs(a)
+	})
+}
+
+// simple makes a request answered by a status.
+func (c *Client) simple(typ byte, op, p string, fill func(b *buffer)) error {
+	resp, err := c.call(typ, fill)
+	if err != nil {
+		return err
+	}
+	return status(resp, op, p, fxpStatus)
+}
+
+// open makes a request answered by a handle.
+func (c *Client) open(typ byte, op, p string, fill func(b *buffer)) (string, error) {
+	resp, err := c.call(typ, fill)
+	if err != nil {
+		return "", err
+	}
+	if err := status(resp, op, p, fxpHandle); err != nil {
+		return "", err
+	}
+	handle := resp.r.string()
+	return handle, resp.r.err
+}
+
+func (c *Client) closeHandle(handle string) error {
+	return c.simple(fxpClose, "close", "", func(b *buffer) { b.string(handle) })
+}
+
+// Open opens the file p for reading.
+func (c *Client) Open(p string) (*File, error) {
+	handle, err := c.open(fxpOpen, "open", p, func(b *buffer) {
+		b.string(p)
+		b.uint32(openRead)
+		b.attrs(attrs{})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &File{c: c, path: p, handle: handle}, nil
+}
+
+// Create opens the file p for writing, creating it with the permissions perm
+// or truncating it.
+func (c *Client) Create(p string, perm os.FileMode) (*File, error) {
+	handle, err := c.open(fxpOpen, "create", p, func(b *buffer) {
+		b.string(p)
+		b.uint32(openWrite | openCreat | openTrunc)
+		b.attrs(attrs{flags: attrPermissions, perm: uint32(perm.Perm())})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &File{c: c, path: p, handle: handle}, nil
+}
+
+// chunkSize is the data each read or write request carries, which every
+// server takes, and inFlight how many of them go out before the first is
+// answered.
+const (
+	chunkSize = 32 << 10
+	inFlight  = 64
+)
+
+// File is an open remote file. Reads and writes carry on from where the
+// last left off.
+type File struct {
+	c      *Client
+	path   string
+	handle string
+	offset int64
+}
+
+// Read reads the next bytes of the file, a request at a time, where WriteTo
+// reads ahead.
+func (f *File) Read(p []byte) (int, error) {
+	if len(p) > chunkSize {
+		p = p[:chunkSize]
+	}
+	off := uint64(f.offset)
+	resp, err := f.c.call(fxpRead, func(b *buffer) {
+		b.string(f.handle)
+		b.uint64(off)
+		b.uint32(uint32(len(p)))
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := status(resp, "read", f.path, fxpData); err != nil {
+		return 0, err
+	}
+	n := copy(p, resp.r.bytes())
+	f.offset += int64(n)
+	return n, resp.r.err
+}
+
+// Write writes p to the file, a request at a time, where ReadFrom keeps
+// writes in flight.
+func (f *File) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := p[written:min(len(p), written+chunkSize)]
+		off := uint64(f.offset)
+		resp, err := f.c.call(fxpWrite, func(b *buffer) {
+			b.string(f.handle)
+			b.uint64(off)
+			b.bytes(chunk)
+		})
+		if err == nil {
+			err = status(resp, "write", f.path, fxpStatus)
+		}
+		if err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		f.offset += int64(len(chunk))
+	}
+	return written, nil
+}
+
+// Stat returns the attributes of the file.
+func (f *File) Stat() (os.FileInfo, error) {
+	return f.c.Stat(f.path)
+}
+
+// Close closes the file. For a file written, errors writing it out may only
+// be reported here.
+func (f *File) Close() error {
+	resp, err := f.c.call(fxpClose, func(b *buffer) { b.string(f.handle) })
+	if err != nil {
+		return err
+	}
+	return status(resp, "close", f.path, fxpStatus)
+}
+
+// WriteTo writes the rest of the contents of the file to w.
+func (f *File) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	offset := uint64(f.offset)
+	defer func() { f.offset = int64(offset) }()
+	for {
+		// Read ahead, then take the answers in order. A short read, which
+		// servers only give near the end, starts over after it.
+		var reads []chan response
+		var err error
+		for i := 0; i < inFlight; i++ {
+			off := offset + uint64(i)*chunkSize
+			ch, serr := f.c.send(fxpRead, func(b *buffer) {
+				b.string(f.handle)
+				b.uint64(off)
+				b.uint32(chunkSize)
+			})
+			if serr != nil {
+				err = serr
+				break
+			}
+			reads = append(reads, ch)
+		}
+		for _, ch := range reads {
+			if err != nil {
+				// Let the answers to reads no longer wanted come in
+				go f.c.wait(ch)
+				continue
+			}
+			var resp response
+			if resp, err = f.c.wait(ch); err != nil {
+				continue
+			}
+			if err = status(resp, "read", f.path, fxpData); err != nil {
+				continue
+			}
+			data := resp.r.bytes()
+			if err = resp.r.err; err != nil {
+				continue
+			}
+			n, werr := w.Write(data)
+			written += int64(n)
+			offset += uint64(n)
+			if werr != nil {
+				err = werr
+			} else if len(data) < chunkSize {
+				err = errShortRead
+			}
+		}
+		switch err {
+		case nil, errShortRead:
+		case io.EOF:
+			return written, nil
+		default:
+			return written, err
+		}
+	}
+}
+
+var errShortRead = errors.New("sftp: short read")
+
+// ReadFrom writes what it reads from r to the file until r runs out.
+func (f *File) ReadFrom(r io.Reader) (int64, error) {
+	var written int64
+	start := f.offset
+	defer func() { f.offset = start + written }()
+	var writes []chan response
+	// check takes the answer to the oldest write still out
+	check := func() error {
+		ch := writes[0]
+		writes = writes[1:]
+		resp, err := f.c.wait(ch)
+		if err != nil {
+			return err
+		}
+		return status(resp, "write", f.path, fxpStatus)
+	}
+	buf := make([]byte, chunkSize)
+	var err error
+	for err == nil {
+		var n int
+		n, err = io.ReadFull(r, buf)
+		if n > 0 {
+			off := uint64(start + written)
+			ch, serr := f.c.send(fxpWrite, func(b *buffer) {
+				b.string(f.handle)
+				b.uint64(off)
+				b.bytes(buf[:n])
+			})
+			if serr != nil {
+				return written, serr
+			}
+			written += int64(n)
+			writes = append(writes, ch)
+		}
+		if err == nil && len(writes) >= inFlight {
+			err = check()
+		}
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	for len(writes) > 0 {
+		if werr := check(); err == nil {
+			err = werr
+		}
+	}
+	return written, err
+}
@@ -0,0 +1,256 @@
+package sftp
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FS is the tree below a directory of a host, as the read and write sides of
+// package vfs have one. Its requests go over a pool of connections, as many
+// as are used at once, made when first needed. A connection found lost is
+// dropped, and the next request makes another.
+type FS struct {
+	root string
+	dial func() (*Client, error)
+	mu   sync.Mutex
+	idle []*Client
+}
+
+// NewFS returns the tree below root, connecting to its host with dial.
+func NewFS(root string, dial func() (*Client, error)) *FS {
+	return &FS{root: root, dial: dial}
+}
+
+// Close closes the connections of the pool. Those in use by open files are
+// closed as the files are.
+func (f *FS) Close() error {
+	f.mu.Lock()
+	idle := f.idle
+	f.idle = nil
+	f.mu.Unlock()
+	var err error
+	for _, c := range idle {
+		err = errors.Join(err, c.Close())
+	}
+	return err
+}
+
+// Path returns the remote path of name.
+func (f *FS) Path(name string) string {
+	return path.Join(f.root, name)
+}
+
+func (f *FS) path(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return f.Path(name), nil
+}
+
+// get takes an idle connection from the pool, or makes one.
+func (f *FS) get() (*Client, error) {
+	f.mu.Lock()
+	if n := len(f.idle); n > 0 {
+		c := f.idle[n-1]
+		f.idle = f.idle[:n-1]
+		f.mu.Unlock()
+		return c, nil
+	}
+	f.mu.Unlock()
+	return f.dial()
+}
+
+// put returns c to the pool, or closes it if err says it was lost.
+func (f *FS) put(c *Client, err error) {
+	if errors.Is(err, ErrConnectionLost) {
+		c.Close()
+		return
+	}
+	f.mu.Lock()
+	f.idle = append(f.idle, c)
+	f.mu.Unlock()
+}
+
+// do calls fn with a connection of the pool, and the remote path of name.
+func (f *FS) do(op, name string, fn func(c *Client, p string) error) error {
+	p, err := f.path(op, name)
+	if err != nil {
+		return err
+	}
+	c, err := f.get()
+	if err != nil {
+		return err
+	}
+	err = fn(c, p)
+	f.put(c, err)
+	return err
+}
+
+// Open opens the file name for reading. It keeps a connection of the pool
+// until closed.
+func (f *FS) Open(name string) (fs.File, error) {
+	p, err := f.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	c, err := f.get()
+	if err != nil {
+		return nil, err
+	}
+	file, err := c.Open(p)
+	if err != nil {
+		f.put(c, err)
+		return nil, err
+	}
+	return &poolFile{File: file, fs: f}, nil
+}
+
+// Create opens the file name for writing, as Client.Create does. It keeps a
+// connection of the pool until closed.
+func (f *FS) Create(name string, perm fs.FileMode) (io.WriteCloser, error) {
+	p, err := f.path("create", name)
+	if err != nil {
+		return nil, err
+	}
+	c, err := f.get()
+	if err != nil {
+		return nil, err
+	}
+	file, err := c.Create(p, perm)
+	if err != nil {
+		f.put(c, err)
+		return nil, err
+	}
+	return &poolFile{File: file, fs: f}, nil
+}
+
+// poolFile is a File holding its connection until closed.
+type poolFile struct {
+	*File
+	fs *FS
+}
+
+func (f *poolFile) Close() error {
+	err := f.File.Close()
+	f.fs.put(f.c, err)
+	return err
+}
+
+// ReadDir returns the entries of the directory name, sorted by name.
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	var entries []fs.DirEntry
+	err := f.do("readdir", name, func(c *Client, p string) error {
+		infos, err := c.ReadDir(p)
+		for _, info := range infos {
+			entries = append(entries, fs.FileInfoToDirEntry(info))
+		}
+		return err
+	})
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, err
+}
+
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	var info fs.FileInfo
+	err := f.do("stat", name, func(c *Client, p string) (err error) {
+		info, err = c.Stat(p)
+		return err
+	})
+	return info, err
+}
+
+func (f *FS) Lstat(name string) (fs.FileInfo, error) {
+	var info fs.FileInfo
+	err := f.do("lstat", name, func(c *Client, p string) (err error) {
+		info, err = c.Lstat(p)
+		return err
+	})
+	return info, err
+}
+
+func (f *FS) ReadLink(name string) (string, error) {
+	var target string
+	err := f.do("readlink", name, func(c *Client, p string) (err error) {
+		target, err = c.ReadLink(p)
+		return err
+	})
+	return target, err
+}
+
+// RealPath returns the remote path of name, absolute and with symlinks
+// resolved.
+func (f *FS) RealPath(name string) (string, error) {
+	var real string
+	err := f.do("realpath", name, func(c *Client, p string) (err error) {
+		real, err = c.RealPath(p)
+		return err
+	})
+	return real, err
+}
+
+// MkdirAll creates the directory name and any parents missing.
+func (f *FS) MkdirAll(name string, perm fs.FileMode) error {
+	return f.do("mkdir", name, func(c *Client, p string) error {
+		return mkdirAll(c, p, perm)
+	})
+}
+
+func mkdirAll(c *Client, p string, perm fs.FileMode) error {
+	info, err := c.Stat(p)
+	if err == nil {
+		if !info.IsDir() {
+			return &StatusError{Op: "mkdir", Path: p, Code: statusFailure, Msg: "not a directory"}
+		}
+		return nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if parent := path.Dir(p); parent != p {
+		if err := mkdirAll(c, parent, perm); err != nil {
+			return err
+		}
+	}
+	return c.Mkdir(p, perm)
+}
+
+func (f *FS) Rename(oldname, newname string) error {
+	newpath, err := f.path("rename", newname)
+	if err != nil {
+		return err
+	}
+	return f.do("rename", oldname, func(c *Client, p string) error {
+		return c.Rename(p, newpath)
+	})
+}
+
+func (f *FS) Remove(name string) error {
+	return f.do("remove", name, func(c *Client, p string) error {
+		return c.Remove(p)
+	})
+}
+
+func (f *FS) Symlink(target, name string) error {
+	return f.do("symlink", name, func(c *Client, p string) error {
+		return c.Symlink(target, p)
+	})
+}
+
+func (f *FS) Chmod(name string, mode fs.FileMode) error {
+	return f.do("chmod", name, func(c *Client, p string) error {
+		return c.Chmod(p, mode)
+	})
+}
+
+// Chtimes sets the modification time of name, and its access time with it.
+func (f *FS) Chtimes(name string, mtime time.Time) error {
+	return f.do("chtimes", name, func(c *Client, p string) error {
+		return c.Chtimes(p, time.Now(), mtime)
+	})
+}
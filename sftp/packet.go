@@ -0,0 +1,252 @@
+package sftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"time"
+)
+
+// Packet types of version 3 of the protocol.
+const (
+	fxpInit     = 1
+	fxpVersion  = 2
+	fxpOpen     = 3
+	fxpClose    = 4
+	fxpRead     = 5
+	fxpWrite    = 6
+	fxpLstat    = 7
+	fxpSetstat  = 9
+	fxpOpendir  = 11
+	fxpReaddir  = 12
+	fxpRemove   = 13
+	fxpMkdir    = 14
+	fxpRmdir    = 15
+	fxpRealpath = 16
+	fxpStat     = 17
+	fxpRename   = 18
+	fxpReadlink = 19
+	fxpSymlink  = 20
+	fxpStatus   = 101
+	fxpHandle   = 102
+	fxpData     = 103
+	fxpName     = 104
+	fxpAttrs    = 105
+	fxpExtended = 200
+)
+
+// Flags of an open request.
+const (
+	openRead  = 0x01
+	openWrite = 0x02
+	openCreat = 0x08
+	openTrunc = 0x10
+)
+
+// Flags saying which attributes are present.
+const (
+	attrSize        = 0x01
+	attrUIDGID      = 0x02
+	attrPermissions = 0x04
+	attrTimes       = 0x08
+	attrExtended    = 0x80000000
+)
+
+// Status codes.
+const (
+	statusOK         = 0
+	statusEOF        = 1
+	statusNoSuchFile = 2
+	statusPermission = 3
+	statusFailure    = 4
+)
+
+const (
+	protocolVersion = 3
+	// maxPacket bounds the packets read, well above what a read of
+	// chunkSize comes back as.
+	maxPacket   = 256 << 10
+	posixRename = "posix-rename@openssh.com"
+)
+
+// File type bits of the permissions attribute.
+const (
+	fileTypeMask       = 0170000
+	fileTypeDir        = 0040000
+	fileTypeSymlink    = 0120000
+	fileTypeRegular    = 0100000
+	fileTypeNamedPipe  = 0010000
+	fileTypeSocket     = 0140000
+	fileTypeCharDevice = 0020000
+	fileTypeDevice     = 0060000
+)
+
+var errShortPacket = errors.New("sftp: short packet")
+
+// buffer builds a packet.
+type buffer []byte
+
+func (b *buffer) byte(v byte) {
+	*b = append(*b, v)
+}
+
+func (b *buffer) uint32(v uint32) {
+	*b = binary.BigEndian.AppendUint32(*b, v)
+}
+
+func (b *buffer) uint64(v uint64) {
+	*b = binary.BigEndian.AppendUint64(*b, v)
+}
+
+func (b *buffer) string(s string) {
+	b.uint32(uint32(len(s)))
+	*b = append(*b, s...)
+}
+
+func (b *buffer) bytes(p []byte) {
+	b.uint32(uint32(len(p)))
+	*b = append(*b, p...)
+}
+
+// attrs appends the attributes a, setting only those a has.
+func (b *buffer) attrs(a attrs) {
+	b.uint32(a.flags)
+	if a.flags&attrSize != 0 {
+		b.uint64(a.size)
+	}
+	if a.flags&attrUIDGID != 0 {
+		b.uint32(a.uid)
+		b.uint32(a.gid)
+	}
+	if a.flags&attrPermissions != 0 {
+		b.uint32(a.perm)
+	}
+	if a.flags&attrTimes != 0 {
+		b.uint32(a.atime)
+		b.uint32(a.mtime)
+	}
+}
+
+// reader takes a packet apart. The first read past its end sets err, and
+// every read after that returns zero values.
+type reader struct {
+	p   []byte
+	err error
+}
+
+func (r *reader) take(n int) []byte {
+	if r.err != nil || len(r.p) < n {
+		r.err = errShortPacket
+		return nil
+	}
+	v := r.p[:n]
+	r.p = r.p[n:]
+	return v
+}
+
+func (r *reader) byte() byte {
+	if v := r.take(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (r *reader) uint32() uint32 {
+	if v := r.take(4); v != nil {
+		return binary.BigEndian.Uint32(v)
+	}
+	return 0
+}
+
+func (r *reader) uint64() uint64 {
+	if v := r.take(8); v != nil {
+		return binary.BigEndian.Uint64(v)
+	}
+	return 0
+}
+
+func (r *reader) bytes() []byte {
+	n := r.uint32()
+	if r.err != nil || uint32(len(r.p)) < n {
+		r.err = errShortPacket
+		return nil
+	}
+	return r.take(int(n))
+}
+
+func (r *reader) string() string {
+	return string(r.bytes())
+}
+
+func (r *reader) attrs() attrs {
+	a := attrs{flags: r.uint32()}
+	if a.flags&attrSize != 0 {
+		a.size = r.uint64()
+	}
+	if a.flags&attrUIDGID != 0 {
+		a.uid, a.gid = r.uint32(), r.uint32()
+	}
+	if a.flags&attrPermissions != 0 {
+		a.perm = r.uint32()
+	}
+	if a.flags&attrTimes != 0 {
+		a.atime, a.mtime = r.uint32(), r.uint32()
+	}
+	if a.flags&attrExtended != 0 {
+		for n := r.uint32(); n > 0 && r.err == nil; n-- {
+			r.string()
+			r.string()
+		}
+	}
+	return a
+}
+
+// attrs are the attributes of a file. Times are in seconds.
+type attrs struct {
+	flags        uint32
+	size         uint64
+	uid, gid     uint32
+	perm         uint32
+	atime, mtime uint32
+}
+
+// fileInfo is the os.FileInfo of a remote file.
+type fileInfo struct {
+	name string
+	a    attrs
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return int64(fi.a.size) }
+func (fi *fileInfo) ModTime() time.Time { return time.Unix(int64(fi.a.mtime), 0) }
+func (fi *fileInfo) IsDir() bool        { return fi.Mode().IsDir() }
+func (fi *fileInfo) Sys() any           { return nil }
+
+// Mode translates the unix mode bits of the file.
+func (fi *fileInfo) Mode() os.FileMode {
+	mode := os.FileMode(fi.a.perm & 0777)
+	if fi.a.perm&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if fi.a.perm&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if fi.a.perm&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	switch fi.a.perm & fileTypeMask {
+	case fileTypeDir:
+		mode |= os.ModeDir
+	case fileTypeSymlink:
+		mode |= os.ModeSymlink
+	case fileTypeNamedPipe:
+		mode |= os.ModeNamedPipe
+	case fileTypeSocket:
+		mode |= os.ModeSocket
+	case fileTypeCharDevice:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case fileTypeDevice:
+		mode |= os.ModeDevice
+	}
+	return mode
+}
@@ -0,0 +1,203 @@
+package sftp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+)
+
+func TestAttrsRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		a    attrs
+		size int
+	}{
+		{"none", attrs{}, 4},
+		{"size", attrs{flags: attrSize, size: 1 << 40}, 12},
+		{"owner", attrs{flags: attrUIDGID, uid: 1000, gid: 100}, 12},
+		{"mode", attrs{flags: attrPermissions, perm: fileTypeRegular | 0644}, 8},
+		{"times", attrs{flags: attrTimes, atime: 1700000000, mtime: 1700000001}, 12},
+		{"all", attrs{flags: attrSize | attrUIDGID | attrPermissions | attrTimes, size: 5, uid: 1, gid: 2, perm: fileTypeDir | 0755, atime: 3, mtime: 4}, 32},
+	} {
+		var b buffer
+		b.attrs(tc.a)
+		if len(b) != tc.size {
+			t.Errorf("%s: encoded in %d bytes, want %d", tc.name, len(b), tc.size)
+		}
+		r := reader{p: b}
+		if got := r.attrs(); got != tc.a || r.err != nil || len(r.p) != 0 {
+			t.Errorf("%s: decoded %+v, %d bytes left, err %v, want %+v", tc.name, got, len(r.p), r.err, tc.a)
+		}
+	}
+}
+
+func TestPacketEncoding(t *testing.T) {
+	var b buffer
+	b.byte(fxpOpen)
+	b.uint32(7)
+	b.string("a/b")
+	b.uint32(openWrite | openCreat | openTrunc)
+	b.attrs(attrs{flags: attrPermissions, perm: 0600})
+	want := []byte{
+		fxpOpen,
+		0, 0, 0, 7,
+		0, 0, 0, 3, 'a', '/', 'b',
+		0, 0, 0, 0x1a,
+		0, 0, 0, attrPermissions, 0, 0, 0x01, 0x80,
+	}
+	if !bytes.Equal(b, want) {
+		t.Fatalf("encoded % x, want % x", []byte(b), want)
+	}
+	r := reader{p: b[1:]}
+	if id, p, flags := r.uint32(), r.string(), r.uint32(); id != 7 || p != "a/b" || flags != 0x1a {
+		t.Errorf("decoded id %d, path %q, flags %#x", id, p, flags)
+	}
+	if a := r.attrs(); a.perm != 0600 || r.err != nil {
+		t.Errorf("decoded attrs %+v, err %v", a, r.err)
+	}
+}
+
+func TestAttrsExtended(t *testing.T) {
+	var b buffer
+	b.uint32(attrSize | attrExtended)
+	b.uint64(9)
+	b.uint32(2)
+	for _, s := range []string{"a@example.com", "1", "b@example.com", "2"} {
+		b.string(s)
+	}
+	b.string("after")
+	r := reader{p: b}
+	if a := r.attrs(); a.size != 9 || r.err != nil {
+		t.Fatalf("decoded %+v, err %v", a, r.err)
+	}
+	if s := r.string(); s != "after" {
+		t.Errorf("read %q after the extended attributes", s)
+	}
+}
+
+func TestShortPacket(t *testing.T) {
+	var b buffer
+	b.attrs(attrs{flags: attrSize | attrTimes, size: 1, atime: 2, mtime: 3})
+	b.string("name")
+	for n := range len(b) {
+		r := reader{p: b[:n]}
+		r.attrs()
+		r.string()
+		if r.err != errShortPacket {
+			t.Errorf("%d of %d bytes: err %v, want errShortPacket", n, len(b), r.err)
+		}
+	}
+	// A string longer than what is left
+	r := reader{p: []byte{0, 0, 0, 9, 'x'}}
+	if s := r.string(); s != "" || r.err != errShortPacket {
+		t.Errorf("read %q, err %v", s, r.err)
+	}
+}
+
+func TestReadPacket(t *testing.T) {
+	typ, body, err := readPacket(bytes.NewReader([]byte{0, 0, 0, 3, fxpHandle, 'h', 'i', 0xff}))
+	if err != nil || typ != fxpHandle || string(body) != "hi" {
+		t.Errorf("read type %d, %q, err %v", typ, body, err)
+	}
+	for _, p := range [][]byte{
+		{0, 0, 0, 0},
+		{0, 0x10, 0, 1},
+		{0, 0, 0, 5, fxpData},
+		{0, 0},
+	} {
+		if _, _, err := readPacket(bytes.NewReader(p)); err == nil {
+			t.Errorf("read % x", p)
+		}
+	}
+}
+
+// TestClient checks the packets a client sends and how it takes the
+// responses, against a server playing a script.
+func TestClient(t *testing.T) {
+	toServer, fromClient := io.Pipe()
+	toClient, fromServer := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- func() error {
+			defer toServer.Close()
+			defer fromServer.Close()
+			for _, step := range []struct {
+				want  func(b *buffer)
+				reply func(b *buffer)
+			}{
+				{
+					func(b *buffer) { b.byte(fxpInit); b.uint32(protocolVersion) },
+					func(b *buffer) {
+						b.byte(fxpVersion)
+						b.uint32(protocolVersion)
+						b.string(posixRename)
+						b.string("1")
+					},
+				},
+				{
+					func(b *buffer) { b.byte(fxpStat); b.uint32(0); b.string("/d/f") },
+					func(b *buffer) {
+						b.byte(fxpAttrs)
+						b.uint32(0)
+						b.attrs(attrs{flags: attrSize | attrPermissions | attrTimes, size: 42, perm: fileTypeRegular | 0640, mtime: 1700000000})
+					},
+				},
+				{
+					func(b *buffer) { b.byte(fxpRemove); b.uint32(1); b.string("/d/g") },
+					func(b *buffer) {
+						b.byte(fxpStatus)
+						b.uint32(1)
+						b.uint32(statusNoSuchFile)
+						b.string("No such file")
+						b.string("")
+					},
+				},
+			} {
+				var want buffer
+				step.want(&want)
+				typ, body, err := readPacket(toServer)
+				if err != nil {
+					return err
+				}
+				if got := append([]byte{typ}, body...); !bytes.Equal(got, want) {
+					return errors.New("unexpected request")
+				}
+				reply := buffer{0, 0, 0, 0}
+				step.reply(&reply)
+				reply[3] = byte(len(reply) - 4)
+				if _, err := fromServer.Write(reply); err != nil {
+					return err
+				}
+			}
+			return nil
+		}()
+	}()
+
+	c, err := NewClient(toClient, fromClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.extensions[posixRename] != "1" {
+		t.Errorf("extensions %v", c.extensions)
+	}
+	fi, err := c.Stat("/d/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Name() != "f" || fi.Size() != 42 || fi.Mode() != 0640 || fi.ModTime().Unix() != 1700000000 {
+		t.Errorf("stat gave %s, %d bytes, mode %v, modified %v", fi.Name(), fi.Size(), fi.Mode(), fi.ModTime())
+	}
+	if err := c.Remove("/d/g"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("remove of a missing file: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	// The server hung up, so what is asked next fails
+	if _, err := c.Stat("/d/f"); !errors.Is(err, ErrConnectionLost) {
+		t.Errorf("stat after the server went: %v", err)
+	}
+}
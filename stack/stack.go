@@ -1,34 +1,129 @@
+// Package stack provides a generic LIFO stack, and a variant of it that is
+// safe for concurrent use.
 package stack
 
-import "fmt"
+import (
+	"errors"
+	"sync"
+)
 
-type Stack []string
+var (
+	// ErrNil is returned when pushing onto a nil *Stack.
+	ErrNil = errors.New("stack: nil stack")
+	// ErrEmpty is returned when popping or peeking at an empty stack.
+	ErrEmpty = errors.New("stack: empty stack")
+)
 
-func Push(stk *Stack, val string) *Stack {
-	if stk == nil {
-		fmt.Printf("Error: Stack is nil!\n")
-		return nil
+// Stack is a LIFO stack whose top is the end of the slice. The zero value is
+// an empty stack. It is not safe for concurrent use, see Safe for that.
+type Stack[T any] []T
+
+// Push adds val to the top of the stack.
+func (s *Stack[T]) Push(val T) error {
+	if s == nil {
+		return ErrNil
+	}
+	*s = append(*s, val)
+	return nil
+}
+
+// Pop removes and returns the top of the stack.
+func (s *Stack[T]) Pop() (T, error) {
+	var zero T
+	if s == nil || len(*s) == 0 {
+		return zero, ErrEmpty
 	}
-	if stk == nil {
-		fmt.Printf("Error : *Stack is nil!\n")
-		return nil
+	n := len(*s) - 1
+	val := (*s)[n]
+	(*s)[n] = zero
+	*s = (*s)[:n]
+	return val, nil
+}
+
+// Peek returns the top of the stack without removing it.
+func (s Stack[T]) Peek() (T, error) {
+	if len(s) == 0 {
+		var zero T
+		return zero, ErrEmpty
 	}
-	(*stk) = append(*stk, val)
-	return stk
+	return s[len(s)-1], nil
 }
 
-func Pop(stk *Stack) (string, *Stack) {
-	if stk == nil || len(*stk) == 0 {
-		return "", nil
+// Len returns the number of items on the stack.
+func (s Stack[T]) Len() int {
+	return len(s)
+}
+
+// IsEmpty reports whether the stack holds no items.
+func (s Stack[T]) IsEmpty() bool {
+	return len(s) == 0
+}
+
+// Merge pushes every item of src, from the bottom up.
+func (s *Stack[T]) Merge(src Stack[T]) error {
+	if s == nil {
+		return ErrNil
 	}
-	n := len(*stk) - 1
-	ret := ((*stk)[:n])
-	return (*stk)[n], &ret
+	*s = append(*s, src...)
+	return nil
+}
+
+// Safe is a Stack guarded by a mutex, so it can be shared between goroutines.
+// The zero value is an empty stack.
+type Safe[T any] struct {
+	mu    sync.Mutex
+	items Stack[T]
 }
 
-func Merge(dest, src *Stack) *Stack {
-	for _, str := range *src {
-		Push(dest, str)
+// Push adds val to the top of the stack.
+func (s *Safe[T]) Push(val T) error {
+	if s == nil {
+		return ErrNil
 	}
-	return dest
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.items.Push(val)
+}
+
+// Pop removes and returns the top of the stack.
+func (s *Safe[T]) Pop() (T, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.items.Pop()
+}
+
+// Peek returns the top of the stack without removing it.
+func (s *Safe[T]) Peek() (T, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.items.Peek()
+}
+
+// Len returns the number of items on the stack.
+func (s *Safe[T]) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.items.Len()
+}
+
+// IsEmpty reports whether the stack holds no items.
+func (s *Safe[T]) IsEmpty() bool {
+	return s.Len() == 0
+}
+
+// Items returns a copy of the items, from the bottom up.
+func (s *Safe[T]) Items() Stack[T] {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append(Stack[T](nil), s.items...)
+}
+
+// Drain removes and returns every item, from the bottom up, without copying
+// them.
+func (s *Safe[T]) Drain() Stack[T] {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items := s.items
+	s.items = nil
+	return items
 }
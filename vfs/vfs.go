@@ -0,0 +1,200 @@
+// Package vfs defines the filesystems a copy reads and writes, so a tree is
+// copied the same way whether it is on the local disk, in an archive, on a
+// remote host or in a bucket. The read side is io/fs, with the symlinks it
+// leaves out; the write side is the little a copy does to its destination.
+//
+// Names are slash separated and relative to the root of the filesystem, as
+// fs.ValidPath has them, "." naming the root itself.
+package vfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FS is a tree to copy from.
+type FS interface {
+	fs.ReadDirFS
+	// Stat describes name, following a final symlink.
+	Stat(name string) (fs.FileInfo, error)
+	// Lstat describes name, or the symlink name.
+	Lstat(name string) (fs.FileInfo, error)
+	// ReadLink returns the target of the symlink name.
+	ReadLink(name string) (string, error)
+}
+
+// RealPathFS is implemented by an FS that can resolve the symlinks of a
+// name, which tells a followed symlink to a directory above it, whose walk
+// would never end.
+type RealPathFS interface {
+	FS
+	RealPath(name string) (string, error)
+}
+
+// WriteFS is a tree to copy to. What a WriteFS can't do, such as a bucket
+// creating a symlink, fails with errors.ErrUnsupported.
+type WriteFS interface {
+	Stat(name string) (fs.FileInfo, error)
+	Lstat(name string) (fs.FileInfo, error)
+	// MkdirAll creates the directory name and any parents missing.
+	MkdirAll(name string, perm fs.FileMode) error
+	// Create creates the file name with the permissions perm, or truncates
+	// it. It is only complete once closed without an error.
+	Create(name string, perm fs.FileMode) (io.WriteCloser, error)
+	// Rename renames oldname to newname, replacing newname.
+	Rename(oldname, newname string) error
+	Remove(name string) error
+	Symlink(target, name string) error
+	Chmod(name string, mode fs.FileMode) error
+	// Chtimes sets the modification time of name.
+	Chtimes(name string, mtime time.Time) error
+}
+
+// Atomic is implemented by a WriteFS whose files only appear once complete,
+// as the objects of a bucket do, which need no temporary name to be written
+// under.
+type Atomic interface {
+	WriteFS
+	AtomicCreate()
+}
+
+// Aborter is implemented by the writer of a file of an Atomic, to give the
+// file up, leaving nothing, rather than complete it by closing it.
+type Aborter interface {
+	Abort() error
+}
+
+// IsAtomic reports whether the files of fsys only appear once complete.
+func IsAtomic(fsys WriteFS) bool {
+	_, ok := fsys.(Atomic)
+	return ok
+}
+
+// Dir is the local directory tree below a path, as both an FS and a WriteFS.
+type Dir string
+
+// Path returns the local path of name.
+func (d Dir) Path(name string) string {
+	return filepath.Join(string(d), filepath.FromSlash(name))
+}
+
+// path returns the local path of name, if name is valid.
+func (d Dir) path(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return d.Path(name), nil
+}
+
+func (d Dir) Open(name string) (fs.File, error) {
+	p, err := d.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+// ReadDir returns the entries of the directory name, sorted by name.
+func (d Dir) ReadDir(name string) ([]fs.DirEntry, error) {
+	p, err := d.path("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadDir(p)
+}
+
+func (d Dir) Stat(name string) (fs.FileInfo, error) {
+	p, err := d.path("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+func (d Dir) Lstat(name string) (fs.FileInfo, error) {
+	p, err := d.path("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Lstat(p)
+}
+
+func (d Dir) ReadLink(name string) (string, error) {
+	p, err := d.path("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	return os.Readlink(p)
+}
+
+// RealPath returns the local path of name, with symlinks resolved.
+func (d Dir) RealPath(name string) (string, error) {
+	p, err := d.path("realpath", name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(p)
+}
+
+func (d Dir) MkdirAll(name string, perm fs.FileMode) error {
+	p, err := d.path("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(p, perm)
+}
+
+func (d Dir) Create(name string, perm fs.FileMode) (io.WriteCloser, error) {
+	p, err := d.path("create", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+}
+
+func (d Dir) Rename(oldname, newname string) error {
+	oldpath, err := d.path("rename", oldname)
+	if err != nil {
+		return err
+	}
+	newpath, err := d.path("rename", newname)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldpath, newpath)
+}
+
+func (d Dir) Remove(name string) error {
+	p, err := d.path("remove", name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func (d Dir) Symlink(target, name string) error {
+	p, err := d.path("symlink", name)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(target, p)
+}
+
+func (d Dir) Chmod(name string, mode fs.FileMode) error {
+	p, err := d.path("chmod", name)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(p, mode)
+}
+
+func (d Dir) Chtimes(name string, mtime time.Time) error {
+	p, err := d.path("chtimes", name)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(p, time.Time{}, mtime)
+}
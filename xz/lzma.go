@@ -0,0 +1,336 @@
+package xz
+
+// rangeDecoder decodes the bits of an LZMA chunk.
+type rangeDecoder struct {
+	in    []byte
+	rng   uint32
+	code  uint32
+	empty bool
+}
+
+func (rc *rangeDecoder) init(in []byte) error {
+	if len(in) < 5 || in[0] != 0 {
+		return errCorrupt
+	}
+	rc.rng = 0xffffffff
+	rc.code = uint32(in[1])<<24 | uint32(in[2])<<16 | uint32(in[3])<<8 | uint32(in[4])
+	rc.in = in[5:]
+	rc.empty = false
+	return nil
+}
+
+func (rc *rangeDecoder) normalize() {
+	if rc.rng < 1<<24 {
+		rc.rng <<= 8
+		if len(rc.in) == 0 {
+			// Reading past the chunk, which finished() reports
+			rc.empty = true
+			rc.code <<= 8
+			return
+		}
+		rc.code = rc.code<<8 | uint32(rc.in[0])
+		rc.in = rc.in[1:]
+	}
+}
+
+// finished reports whether the chunk was decoded to its end and no further.
+// The bits are normalized before they are decoded, so it takes in the last
+// byte, if the last bit left it.
+func (rc *rangeDecoder) finished() bool {
+	rc.normalize()
+	return len(rc.in) == 0 && !rc.empty && rc.code == 0
+}
+
+// bit decodes a bit with probability p of being 0, adapting p.
+func (rc *rangeDecoder) bit(p *uint16) uint32 {
+	rc.normalize()
+	bound := (rc.rng >> 11) * uint32(*p)
+	if rc.code < bound {
+		rc.rng = bound
+		*p += (2048 - *p) >> 5
+		return 0
+	}
+	rc.rng -= bound
+	rc.code -= bound
+	*p -= *p >> 5
+	return 1
+}
+
+// direct decodes n bits of even probability.
+func (rc *rangeDecoder) direct(n int) uint32 {
+	var v uint32
+	for ; n > 0; n-- {
+		rc.normalize()
+		rc.rng >>= 1
+		rc.code -= rc.rng
+		t := 0 - (rc.code >> 31)
+		rc.code += rc.rng & t
+		v = v<<1 + t + 1
+	}
+	return v
+}
+
+// tree decodes n bits, highest first, with the probabilities of a bit tree.
+func (rc *rangeDecoder) tree(probs []uint16, n int) uint32 {
+	m := uint32(1)
+	for i := 0; i < n; i++ {
+		m = m<<1 | rc.bit(&probs[m])
+	}
+	return m - 1<<n
+}
+
+// reverseTree decodes n bits, lowest first, with the probabilities of a bit
+// tree.
+func (rc *rangeDecoder) reverseTree(probs []uint16, n int) uint32 {
+	m, v := uint32(1), uint32(0)
+	for i := 0; i < n; i++ {
+		b := rc.bit(&probs[m])
+		m = m<<1 | b
+		v |= b << i
+	}
+	return v
+}
+
+const (
+	states         = 12
+	maxPosBits     = 4
+	lenToPosStates = 4
+	endPosModel    = 14
+	fullDistances  = 128
+	alignBits      = 4
+	minMatch       = 2
+)
+
+// lenDecoder decodes match lengths.
+type lenDecoder struct {
+	choice, choice2 uint16
+	low, mid        [1 << maxPosBits][8]uint16
+	high            [256]uint16
+}
+
+func (l *lenDecoder) reset() {
+	l.choice, l.choice2 = 1024, 1024
+	for i := range l.low {
+		reset(l.low[i][:])
+		reset(l.mid[i][:])
+	}
+	reset(l.high[:])
+}
+
+func (l *lenDecoder) decode(rc *rangeDecoder, posState uint32) uint32 {
+	if rc.bit(&l.choice) == 0 {
+		return minMatch + rc.tree(l.low[posState][:], 3)
+	}
+	if rc.bit(&l.choice2) == 0 {
+		return minMatch + 8 + rc.tree(l.mid[posState][:], 3)
+	}
+	return minMatch + 16 + rc.tree(l.high[:], 8)
+}
+
+func reset(probs []uint16) {
+	for i := range probs {
+		probs[i] = 1024
+	}
+}
+
+// lzma is the state of the LZMA decoder of an LZMA2 stream, carried from one
+// chunk to the next.
+type lzma struct {
+	lc, lp, pb uint32
+
+	state uint32
+	reps  [4]uint32
+
+	isMatch    [states << maxPosBits]uint16
+	isRep      [states]uint16
+	isRepG0    [states]uint16
+	isRepG1    [states]uint16
+	isRepG2    [states]uint16
+	isRep0Long [states << maxPosBits]uint16
+	posSlot    [lenToPosStates][64]uint16
+	posSpecial [fullDistances - endPosModel + 1]uint16
+	align      [1 << alignBits]uint16
+	matchLen   lenDecoder
+	repLen     lenDecoder
+	literal    []uint16
+}
+
+// setProps sets lc, lp and pb from the byte that codes them.
+func (s *lzma) setProps(b byte) error {
+	if b >= 9*5*5 {
+		return errCorrupt
+	}
+	s.lc, s.lp, s.pb = uint32(b%9), uint32(b/9%5), uint32(b/45)
+	if s.lc+s.lp > 4 {
+		return errCorrupt
+	}
+	s.literal = make([]uint16, 0x300<<(s.lc+s.lp))
+	return nil
+}
+
+// reset starts the state and probabilities over.
+func (s *lzma) reset() {
+	s.state = 0
+	s.reps = [4]uint32{}
+	reset(s.isMatch[:])
+	reset(s.isRep[:])
+	reset(s.isRepG0[:])
+	reset(s.isRepG1[:])
+	reset(s.isRepG2[:])
+	reset(s.isRep0Long[:])
+	for i := range s.posSlot {
+		reset(s.posSlot[i][:])
+	}
+	reset(s.posSpecial[:])
+	reset(s.align[:])
+	s.matchLen.reset()
+	s.repLen.reset()
+	reset(s.literal)
+}
+
+// dict is the output of a block, back at least as far as the dictionary
+// reaches.
+type dict struct {
+	buf []byte
+	// total is how much was decoded since the dictionary was last reset,
+	// before which matches can't reach.
+	total int64
+	size  int64
+}
+
+// has reports whether a match at distance dist, from 0, can be copied.
+func (d *dict) has(dist uint32) bool {
+	return int64(dist) < d.total && int64(dist) < d.size
+}
+
+func (d *dict) put(b byte) {
+	d.buf = append(d.buf, b)
+	d.total++
+}
+
+func (d *dict) byteAt(dist uint32) byte {
+	return d.buf[len(d.buf)-1-int(dist)]
+}
+
+// decode decodes an LZMA chunk of n bytes onto d.
+func (s *lzma) decode(rc *rangeDecoder, d *dict, n int) error {
+	end := d.total + int64(n)
+	pbMask := uint32(1)<<s.pb - 1
+	lpMask := uint32(1)<<s.lp - 1
+	for d.total < end {
+		pos := uint32(d.total)
+		posState := pos & pbMask
+		if rc.bit(&s.isMatch[s.state<<maxPosBits+posState]) == 0 {
+			var prev uint32
+			if d.total > 0 {
+				prev = uint32(d.byteAt(0))
+			}
+			probs := s.literal[0x300*((pos&lpMask)<<s.lc+prev>>(8-s.lc)):]
+			symbol := uint32(1)
+			if s.state < 7 {
+				for symbol < 0x100 {
+					symbol = symbol<<1 | rc.bit(&probs[symbol])
+				}
+			} else {
+				if !d.has(s.reps[0]) {
+					return errCorrupt
+				}
+				match := uint32(d.byteAt(s.reps[0]))
+				offs := uint32(0x100)
+				for symbol < 0x100 {
+					match <<= 1
+					matchBit := match & offs
+					b := rc.bit(&probs[offs+matchBit+symbol])
+					symbol = symbol<<1 | b
+					if b != 0 {
+						offs &= matchBit
+					} else {
+						offs &= ^matchBit
+					}
+				}
+			}
+			d.put(byte(symbol))
+			switch {
+			case s.state < 4:
+				s.state = 0
+			case s.state < 10:
+				s.state -= 3
+			default:
+				s.state -= 6
+			}
+			continue
+		}
+
+		var length uint32
+		if rc.bit(&s.isRep[s.state]) == 0 {
+			s.reps[3], s.reps[2], s.reps[1] = s.reps[2], s.reps[1], s.reps[0]
+			length = s.matchLen.decode(rc, posState)
+			if s.state < 7 {
+				s.state = 7
+			} else {
+				s.state = 10
+			}
+			s.reps[0] = s.distance(rc, length)
+		} else {
+			if rc.bit(&s.isRepG0[s.state]) == 0 {
+				if rc.bit(&s.isRep0Long[s.state<<maxPosBits+posState]) == 0 {
+					if !d.has(s.reps[0]) {
+						return errCorrupt
+					}
+					if s.state < 7 {
+						s.state = 9
+					} else {
+						s.state = 11
+					}
+					d.put(d.byteAt(s.reps[0]))
+					continue
+				}
+			} else {
+				var dist uint32
+				if rc.bit(&s.isRepG1[s.state]) == 0 {
+					dist = s.reps[1]
+				} else {
+					if rc.bit(&s.isRepG2[s.state]) == 0 {
+						dist = s.reps[2]
+					} else {
+						dist = s.reps[3]
+						s.reps[3] = s.reps[2]
+					}
+					s.reps[2] = s.reps[1]
+				}
+				s.reps[1] = s.reps[0]
+				s.reps[0] = dist
+			}
+			length = s.repLen.decode(rc, posState)
+			if s.state < 7 {
+				s.state = 8
+			} else {
+				s.state = 11
+			}
+		}
+		if !d.has(s.reps[0]) || d.total+int64(length) > end {
+			return errCorrupt
+		}
+		from := len(d.buf) - 1 - int(s.reps[0])
+		for i := 0; i < int(length); i++ {
+			d.buf = append(d.buf, d.buf[from+i])
+		}
+		d.total += int64(length)
+	}
+	return nil
+}
+
+// distance decodes the distance of a match of length.
+func (s *lzma) distance(rc *rangeDecoder, length uint32) uint32 {
+	slot := rc.tree(s.posSlot[min(length-minMatch, lenToPosStates-1)][:], 6)
+	if slot < 4 {
+		return slot
+	}
+	direct := int(slot>>1) - 1
+	dist := (2 | slot&1) << direct
+	if slot < endPosModel {
+		return dist + rc.reverseTree(s.posSpecial[dist-slot:], direct)
+	}
+	dist += rc.direct(direct-alignBits) << alignBits
+	return dist + rc.reverseTree(s.align[:], alignBits)
+}
@@ -0,0 +1,507 @@
+// Package xz reads the .xz format, as the xz tool writes it: streams of
+// blocks compressed with LZMA2, checked with CRC32, CRC64 or SHA-256. Blocks
+// with other filters, like the branch converters of xz --x86, can't be read.
+package xz
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+)
+
+var (
+	errCorrupt     = errors.New("xz: corrupt input")
+	errChecksum    = errors.New("xz: checksum mismatch")
+	errFilter      = errors.New("xz: only blocks compressed with LZMA2 alone are supported")
+	errDictionary  = errors.New("xz: dictionary too large")
+	headerMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0}
+	footerMagic    = []byte{'Y', 'Z'}
+	crc64Table     = crc64.MakeTable(crc64.ECMA)
+	checkSizes     = [16]int{0, 4, 4, 4, 8, 8, 8, 16, 16, 16, 32, 32, 32, 64, 64, 64}
+	maxDictionary  = int64(1) << 30
+	filterLZMA2    = uint64(0x21)
+	maxChunkPacked = 1 << 16
+)
+
+// The checks a stream can have that are verified.
+const (
+	checkNone   = 0
+	checkCRC32  = 1
+	checkCRC64  = 4
+	checkSHA256 = 10
+)
+
+// counter is the input, counting what was read of it.
+type counter struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *counter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *counter) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// record is what the index of a stream says of a block.
+type record struct {
+	unpadded, uncompressed int64
+}
+
+// Reader decompresses a sequence of xz streams.
+type Reader struct {
+	in  *counter
+	err error
+	// out is how much of d.buf has been read.
+	out int
+
+	flags   [2]byte
+	check   byte
+	records []record
+
+	// The block being decoded, if inBlock: where it started in the input,
+	// the size of its header and what it gives as its sizes, or -1.
+	inBlock                bool
+	blockStart, headerSize int64
+	packed, unpacked       int64
+	decoded                int64
+	sum                    hash.Hash
+
+	d         dict
+	lz        lzma
+	needReset bool
+	needProps bool
+	needState bool
+	chunk     []byte
+	rc        rangeDecoder
+}
+
+// NewReader returns a Reader of the streams of r. It reads the header of
+// the first.
+func NewReader(r io.Reader) (*Reader, error) {
+	z := &Reader{in: &counter{r: bufio.NewReader(r)}}
+	if err := z.streamHeader(); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+func (z *Reader) Read(p []byte) (int, error) {
+	for z.out == len(z.d.buf) {
+		if z.err != nil {
+			return 0, z.err
+		}
+		z.err = z.next()
+	}
+	n := copy(p, z.d.buf[z.out:])
+	z.out += n
+	return n, nil
+}
+
+// Close releases what z holds. It doesn't close the reader underneath.
+func (z *Reader) Close() error {
+	z.d.buf, z.chunk = nil, nil
+	if z.err == nil {
+		z.err = io.ErrClosedPipe
+	}
+	return nil
+}
+
+func (z *Reader) streamHeader() error {
+	var h [12]byte
+	if _, err := io.ReadFull(z.in, h[:]); err != nil {
+		return noEOF(err)
+	}
+	if !bytes.Equal(h[:6], headerMagic) {
+		return errCorrupt
+	}
+	if crc32.ChecksumIEEE(h[6:8]) != binary.LittleEndian.Uint32(h[8:]) {
+		return errChecksum
+	}
+	if h[6] != 0 || h[7]&0xf0 != 0 {
+		return errCorrupt
+	}
+	z.flags = [2]byte{h[6], h[7]}
+	z.check = h[7]
+	z.records = z.records[:0]
+	return nil
+}
+
+// next decodes the next chunk of a block, or reads what comes between
+// blocks. It returns io.EOF after the last stream.
+func (z *Reader) next() error {
+	if z.inBlock {
+		return z.nextChunk()
+	}
+	b, err := z.in.ReadByte()
+	if err != nil {
+		return noEOF(err)
+	}
+	if b == 0 {
+		if err := z.index(); err != nil {
+			return err
+		}
+		return z.nextStream()
+	}
+	return z.blockHeader(b)
+}
+
+func (z *Reader) blockHeader(size byte) error {
+	z.blockStart = z.in.n - 1
+	z.headerSize = 4 * (int64(size) + 1)
+	h := make([]byte, z.headerSize)
+	h[0] = size
+	if _, err := io.ReadFull(z.in, h[1:]); err != nil {
+		return noEOF(err)
+	}
+	body := h[:len(h)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(h[len(h)-4:]) {
+		return errChecksum
+	}
+	flags := body[1]
+	if flags&0x3c != 0 {
+		return errCorrupt
+	}
+	r := bytes.NewReader(body[2:])
+	z.packed, z.unpacked = -1, -1
+	if flags&0x40 != 0 {
+		v, err := vli(r)
+		if err != nil {
+			return err
+		}
+		z.packed = int64(v)
+	}
+	if flags&0x80 != 0 {
+		v, err := vli(r)
+		if err != nil {
+			return err
+		}
+		z.unpacked = int64(v)
+	}
+	if flags&3 != 0 {
+		return errFilter
+	}
+	id, err := vli(r)
+	if err != nil {
+		return err
+	}
+	propsSize, err := vli(r)
+	if err != nil {
+		return err
+	}
+	if id != filterLZMA2 {
+		return errFilter
+	}
+	if propsSize != 1 {
+		return errCorrupt
+	}
+	prop, err := r.ReadByte()
+	if err != nil {
+		return errCorrupt
+	}
+	if prop > 40 {
+		return errCorrupt
+	}
+	dictSize := maxDictionary + 1
+	if prop < 40 {
+		dictSize = int64(2|prop&1) << (prop/2 + 11)
+	}
+	if dictSize > maxDictionary {
+		return errDictionary
+	}
+	for r.Len() > 0 {
+		if b, _ := r.ReadByte(); b != 0 {
+			return errCorrupt
+		}
+	}
+
+	z.d = dict{buf: z.d.buf[:0], size: dictSize}
+	z.out = 0
+	z.needReset, z.needProps, z.needState = true, true, true
+	z.decoded = 0
+	switch z.check {
+	case checkCRC32:
+		z.sum = crc32.NewIEEE()
+	case checkCRC64:
+		z.sum = crc64.New(crc64Table)
+	case checkSHA256:
+		z.sum = sha256.New()
+	default:
+		z.sum = nil
+	}
+	z.inBlock = true
+	return nil
+}
+
+// nextChunk decodes the next chunk of LZMA2 data, ending the block after the
+// last.
+func (z *Reader) nextChunk() error {
+	// Keep the dictionary, dropping what is before it once that is as big
+	if keep := int64(len(z.d.buf)) - z.d.size; keep >= max(z.d.size, 1<<20) {
+		z.d.buf = z.d.buf[:copy(z.d.buf, z.d.buf[keep:])]
+		z.out -= int(keep)
+	}
+	control, err := z.in.ReadByte()
+	if err != nil {
+		return noEOF(err)
+	}
+	start := len(z.d.buf)
+	switch {
+	case control == 0:
+		return z.endBlock()
+	case control == 1 || control == 2:
+		if control == 1 {
+			z.d.total = 0
+			z.needReset = false
+		} else if z.needReset {
+			return errCorrupt
+		}
+		var h [2]byte
+		if _, err := io.ReadFull(z.in, h[:]); err != nil {
+			return noEOF(err)
+		}
+		n := int(binary.BigEndian.Uint16(h[:])) + 1
+		z.d.buf = append(z.d.buf, make([]byte, n)...)
+		if _, err := io.ReadFull(z.in, z.d.buf[start:]); err != nil {
+			return noEOF(err)
+		}
+		z.d.total += int64(n)
+	case control >= 0x80:
+		var h [4]byte
+		if _, err := io.ReadFull(z.in, h[:]); err != nil {
+			return noEOF(err)
+		}
+		n := int(control&0x1f)<<16 + int(binary.BigEndian.Uint16(h[:])) + 1
+		packed := int(binary.BigEndian.Uint16(h[2:])) + 1
+		reset := control >> 5 & 3
+		if reset == 3 {
+			z.d.total = 0
+			z.needReset = false
+		} else if z.needReset {
+			return errCorrupt
+		}
+		if reset >= 2 {
+			prop, err := z.in.ReadByte()
+			if err != nil {
+				return noEOF(err)
+			}
+			if err := z.lz.setProps(prop); err != nil {
+				return err
+			}
+			z.needProps = false
+		} else if z.needProps {
+			return errCorrupt
+		}
+		if reset >= 1 {
+			z.lz.reset()
+			z.needState = false
+		} else if z.needState {
+			return errCorrupt
+		}
+		if cap(z.chunk) < maxChunkPacked {
+			z.chunk = make([]byte, maxChunkPacked)
+		}
+		chunk := z.chunk[:packed]
+		if _, err := io.ReadFull(z.in, chunk); err != nil {
+			return noEOF(err)
+		}
+		if err := z.rc.init(chunk); err != nil {
+			return err
+		}
+		if err := z.lz.decode(&z.rc, &z.d, n); err != nil {
+			return err
+		}
+		if !z.rc.finished() {
+			return errCorrupt
+		}
+	default:
+		return errCorrupt
+	}
+	z.decoded += int64(len(z.d.buf) - start)
+	if z.unpacked >= 0 && z.decoded > z.unpacked {
+		return errCorrupt
+	}
+	if z.sum != nil {
+		z.sum.Write(z.d.buf[start:])
+	}
+	return nil
+}
+
+// endBlock checks the block just decoded.
+func (z *Reader) endBlock() error {
+	z.inBlock = false
+	packed := z.in.n - z.blockStart - z.headerSize
+	if z.packed >= 0 && packed != z.packed || z.unpacked >= 0 && z.decoded != z.unpacked {
+		return errCorrupt
+	}
+	if err := z.padding(packed); err != nil {
+		return err
+	}
+	size := checkSizes[z.check]
+	check := make([]byte, size)
+	if _, err := io.ReadFull(z.in, check); err != nil {
+		return noEOF(err)
+	}
+	if z.sum != nil {
+		sum := z.sum.Sum(nil)
+		if z.check != checkSHA256 {
+			// CRCs are stored little endian
+			for i, j := 0, len(sum)-1; i < j; i, j = i+1, j-1 {
+				sum[i], sum[j] = sum[j], sum[i]
+			}
+		}
+		if !bytes.Equal(sum, check) {
+			return errChecksum
+		}
+	}
+	z.records = append(z.records, record{z.headerSize + packed + int64(size), z.decoded})
+	return nil
+}
+
+// padding reads the zeros after n bytes up to a multiple of four.
+func (z *Reader) padding(n int64) error {
+	for ; n%4 != 0; n++ {
+		b, err := z.in.ReadByte()
+		if err != nil {
+			return noEOF(err)
+		}
+		if b != 0 {
+			return errCorrupt
+		}
+	}
+	return nil
+}
+
+// index reads the index of a stream, after its indicator, checking it lists
+// the blocks decoded, and the footer after it.
+func (z *Reader) index() error {
+	start := z.in.n - 1
+	var buf bytes.Buffer
+	buf.WriteByte(0)
+	r := io.TeeReader(z.in, &buf)
+	br := &byteReader{r}
+	n, err := vli(br)
+	if err != nil {
+		return err
+	}
+	if n != uint64(len(z.records)) {
+		return errCorrupt
+	}
+	for _, rec := range z.records {
+		unpadded, err := vli(br)
+		if err != nil {
+			return err
+		}
+		uncompressed, err := vli(br)
+		if err != nil {
+			return err
+		}
+		if unpadded != uint64(rec.unpadded) || uncompressed != uint64(rec.uncompressed) {
+			return errCorrupt
+		}
+	}
+	for (z.in.n-start)%4 != 0 {
+		b, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b != 0 {
+			return errCorrupt
+		}
+	}
+	var crc [4]byte
+	if _, err := io.ReadFull(z.in, crc[:]); err != nil {
+		return noEOF(err)
+	}
+	if crc32.ChecksumIEEE(buf.Bytes()) != binary.LittleEndian.Uint32(crc[:]) {
+		return errChecksum
+	}
+	indexSize := z.in.n - start
+
+	var f [12]byte
+	if _, err := io.ReadFull(z.in, f[:]); err != nil {
+		return noEOF(err)
+	}
+	if !bytes.Equal(f[10:], footerMagic) {
+		return errCorrupt
+	}
+	if crc32.ChecksumIEEE(f[4:10]) != binary.LittleEndian.Uint32(f[:4]) {
+		return errChecksum
+	}
+	if (int64(binary.LittleEndian.Uint32(f[4:]))+1)*4 != indexSize || [2]byte{f[8], f[9]} != z.flags {
+		return errCorrupt
+	}
+	return nil
+}
+
+// nextStream skips the padding after a stream and reads the header of the
+// next, returning io.EOF if there is none.
+func (z *Reader) nextStream() error {
+	for {
+		word, err := z.in.r.Peek(4)
+		if len(word) == 0 && err == io.EOF {
+			return io.EOF
+		}
+		if err != nil {
+			return noEOF(err)
+		}
+		if !bytes.Equal(word, []byte{0, 0, 0, 0}) {
+			return z.streamHeader()
+		}
+		z.in.r.Discard(4)
+	}
+}
+
+// byteReader reads the index a byte at a time, as it is checksummed.
+type byteReader struct {
+	r io.Reader
+}
+
+func (b *byteReader) ReadByte() (byte, error) {
+	var p [1]byte
+	if _, err := io.ReadFull(b.r, p[:]); err != nil {
+		return 0, noEOF(err)
+	}
+	return p[0], nil
+}
+
+// vli reads a variable length integer.
+func vli(r io.ByteReader) (uint64, error) {
+	var v uint64
+	for i := 0; i < 9; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, errCorrupt
+		}
+		v |= uint64(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			if i > 0 && b == 0 {
+				return 0, errCorrupt
+			}
+			return v, nil
+		}
+	}
+	return 0, errCorrupt
+}
+
+// noEOF turns the end of the input inside a stream into an error.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
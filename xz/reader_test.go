@@ -0,0 +1,167 @@
+package xz
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"strings"
+	"testing"
+)
+
+// corpus returns n bytes of text made of lines of words drawn from a small
+// vocabulary, which compresses into both literals and matches.
+func corpus(n int) []byte {
+	words := strings.Fields("the quick brown fox jumps over lazy dog copy files in parallel " +
+		"archive stream frame block window match literal offset sequence table")
+	r := rand.New(rand.NewPCG(1, 2))
+	var b bytes.Buffer
+	for line := 0; b.Len() < n; line++ {
+		fmt.Fprintf(&b, "%d:", line)
+		for range 1 + r.IntN(12) {
+			b.WriteString(" " + words[r.IntN(len(words))])
+		}
+		b.WriteByte('\n')
+	}
+	return b.Bytes()[:n]
+}
+
+// random returns n bytes that don't compress.
+func random(n int) []byte {
+	r := rand.New(rand.NewPCG(3, 4))
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(r.Uint32())
+	}
+	return b
+}
+
+// The files of testdata, made by the xz tool from the data below:
+//
+//	text.xz      xz -6, one block checked with CRC64
+//	random.xz    xz --check=crc32, uncompressed LZMA2 chunks
+//	long.xz      xz --check=sha256, long matches
+//	blocks.xz    xz --block-size=16384, four blocks
+//	streams.xz   the first half of the text compressed by xz, stream
+//	             padding, and the second half by xz --check=none
+//	empty.xz     xz of nothing
+//	x86.xz       xz --x86 --lzma2, with a filter that can't be read
+var goldenFiles = []struct {
+	name string
+	want []byte
+}{
+	{"text.xz", corpus(64 << 10)},
+	{"random.xz", random(20 << 10)},
+	{"long.xz", bytes.Repeat(random(1000), 400)},
+	{"blocks.xz", corpus(64 << 10)},
+	{"streams.xz", corpus(64 << 10)},
+	{"empty.xz", nil},
+}
+
+func readFile(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func decompress(data []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func TestDecodeGolden(t *testing.T) {
+	for _, g := range goldenFiles {
+		got, err := decompress(readFile(t, g.name))
+		if err != nil {
+			t.Errorf("%s: %v", g.name, err)
+			continue
+		}
+		if !bytes.Equal(got, g.want) {
+			t.Errorf("%s decoded to %d bytes, differing from the %d expected", g.name, len(got), len(g.want))
+		}
+	}
+}
+
+// TestDecodeSmallReads checks that blocks decode the same read a byte at a
+// time.
+func TestDecodeSmallReads(t *testing.T) {
+	r, err := NewReader(bytes.NewReader(readFile(t, "blocks.xz")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	var b [1]byte
+	for {
+		n, err := r.Read(b[:])
+		got = append(got, b[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(got, corpus(64<<10)) {
+		t.Fatalf("decoded %d bytes, differing from the text", len(got))
+	}
+}
+
+// TestDecodeTruncated checks that every stream cut short is an error.
+func TestDecodeTruncated(t *testing.T) {
+	for _, name := range []string{"text.xz", "random.xz", "blocks.xz", "streams.xz"} {
+		data := readFile(t, name)
+		for n := 0; n < len(data); n += 1 + n/64 {
+			if _, err := decompress(data[:n]); err == nil {
+				t.Errorf("%s cut to %d of %d bytes decoded without an error", name, n, len(data))
+			}
+		}
+	}
+}
+
+// TestDecodeCorrupt checks that a stream with a byte changed, anywhere, is
+// either an error or, where the byte didn't matter, decodes as it did, and
+// never panics.
+func TestDecodeCorrupt(t *testing.T) {
+	for _, g := range goldenFiles[:4] {
+		data := readFile(t, g.name)
+		for i := 0; i < len(data); i += 1 + i/128 {
+			for _, x := range []byte{0x01, 0x80, 0xff} {
+				bad := bytes.Clone(data)
+				bad[i] ^= x
+				if got, err := decompress(bad); err == nil && !bytes.Equal(got, g.want) {
+					t.Errorf("%s with byte %d xored with %#x decoded to other data without an error", g.name, i, x)
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	text := readFile(t, "text.xz")
+	// The last byte of the block is that of its CRC64, just before the index
+	badCheck := bytes.Clone(text)
+	badCheck[len(text)-12-12-1] ^= 1
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"not xz", []byte("plain text, not a stream"), errCorrupt},
+		{"bad check", badCheck, errChecksum},
+		{"filter", readFile(t, "x86.xz"), errFilter},
+		{"trailing garbage", append(bytes.Clone(text), "not another stream"...), errCorrupt},
+		{"short padding", append(bytes.Clone(text), 0, 0), io.ErrUnexpectedEOF},
+	} {
+		if _, err := decompress(tc.data); err != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
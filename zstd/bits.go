@@ -0,0 +1,131 @@
+package zstd
+
+import "math/bits"
+
+// reverseReader reads a bitstream of FSE or Huffman codes, which is read
+// from its end towards its start. The stream is ended by a set bit, the
+// highest of its last byte, which isn't part of it.
+type reverseReader struct {
+	in []byte
+	// off is how much of in hasn't been loaded into value yet.
+	off int
+	// value holds nbits bits, read from the top. nbits goes below zero when
+	// more bits are read than the stream has.
+	value uint64
+	nbits int
+}
+
+func (r *reverseReader) init(in []byte) error {
+	if len(in) == 0 || in[len(in)-1] == 0 {
+		return errCorrupt
+	}
+	last := in[len(in)-1]
+	r.in = in
+	r.off = len(in) - 1
+	r.value = uint64(last)
+	r.nbits = bits.Len8(last) - 1
+	r.fill()
+	return nil
+}
+
+func (r *reverseReader) fill() {
+	for r.nbits <= 56 && r.off > 0 {
+		r.off--
+		r.value = r.value<<8 | uint64(r.in[r.off])
+		r.nbits += 8
+	}
+}
+
+// read returns the next n bits. Past the start of the stream they are zeros.
+func (r *reverseReader) read(n int) uint64 {
+	v := r.peek(n)
+	r.nbits -= n
+	return v
+}
+
+// peek returns the next n bits without reading them.
+func (r *reverseReader) peek(n int) uint64 {
+	if r.nbits < n {
+		r.fill()
+	}
+	if n == 0 {
+		return 0
+	}
+	if r.nbits >= n {
+		return r.value >> (r.nbits - n) & (1<<n - 1)
+	}
+	if r.nbits <= 0 {
+		return 0
+	}
+	return r.value << (n - r.nbits) & (1<<n - 1)
+}
+
+// overflowed reports whether more bits were read than the stream has.
+func (r *reverseReader) overflowed() bool {
+	return r.nbits < 0
+}
+
+// finished reports whether every bit of the stream was read, and no more.
+func (r *reverseReader) finished() bool {
+	return r.off == 0 && r.nbits == 0
+}
+
+// forwardReader reads the bits of a table description from the lowest of
+// its first byte up.
+type forwardReader struct {
+	in     []byte
+	bitOff int
+}
+
+func (r *forwardReader) read(n int) (uint32, error) {
+	var v uint32
+	for i := 0; i < n; i++ {
+		byteOff := r.bitOff >> 3
+		if byteOff >= len(r.in) {
+			return 0, errCorrupt
+		}
+		v |= uint32(r.in[byteOff]>>(r.bitOff&7)&1) << i
+		r.bitOff++
+	}
+	return v, nil
+}
+
+// bytesRead is how many bytes the bits read so far take up.
+func (r *forwardReader) bytesRead() int {
+	return (r.bitOff + 7) >> 3
+}
+
+// bitWriter writes bits from the lowest of each byte up, as both kinds of
+// bitstream are written: one read in reverse is closed by a set bit.
+type bitWriter struct {
+	out   []byte
+	acc   uint64
+	nbits uint
+}
+
+// add writes the low n bits of v, n being at most 32.
+func (w *bitWriter) add(v uint64, n uint) {
+	w.acc |= (v & (1<<n - 1)) << w.nbits
+	w.nbits += n
+	if w.nbits >= 32 {
+		w.out = append(w.out, byte(w.acc), byte(w.acc>>8), byte(w.acc>>16), byte(w.acc>>24))
+		w.acc >>= 32
+		w.nbits -= 32
+	}
+}
+
+// flush writes out the bits added, the last byte padded with zeros.
+func (w *bitWriter) flush() []byte {
+	for w.nbits > 0 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc >>= 8
+		w.nbits -= min(w.nbits, 8)
+	}
+	return w.out
+}
+
+// close ends a bitstream that is read in reverse.
+func (w *bitWriter) close() []byte {
+	w.add(1, 1)
+	return w.flush()
+}
@@ -0,0 +1,363 @@
+package zstd
+
+import "math/bits"
+
+// minTableLog is the least accuracy log of a table description.
+const minTableLog = 5
+
+// readNormalized reads a table description: the normalized counts of the
+// symbols up to maxSymbol, which add up to 1<<tableLog, a count of -1 being a
+// symbol less likely than 1 in that. It returns how many bytes it took up.
+func readNormalized(in []byte, maxSymbol, maxLog int) (norm []int16, tableLog, n int, err error) {
+	r := forwardReader{in: in}
+	v, err := r.read(4)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	tableLog = int(v) + minTableLog
+	if tableLog > maxLog {
+		return nil, 0, 0, errCorrupt
+	}
+	norm = make([]int16, maxSymbol+1)
+	remaining := 1<<tableLog + 1
+	threshold := 1 << tableLog
+	nbits := tableLog + 1
+	s := 0
+	previous0 := false
+	for remaining > 1 && s <= maxSymbol {
+		if previous0 {
+			for {
+				run, err := r.read(2)
+				if err != nil {
+					return nil, 0, 0, err
+				}
+				s += int(run)
+				if run != 3 {
+					break
+				}
+			}
+			if s > maxSymbol {
+				return nil, 0, 0, errCorrupt
+			}
+		}
+		max := 2*threshold - 1 - remaining
+		v, err := r.read(nbits - 1)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		count := int(v)
+		if count >= max {
+			top, err := r.read(1)
+			if err != nil {
+				return nil, 0, 0, err
+			}
+			count |= int(top) << (nbits - 1)
+			if count >= threshold {
+				count -= max
+			}
+		}
+		count--
+		if count < 0 {
+			remaining--
+		} else {
+			remaining -= count
+		}
+		if remaining < 1 {
+			return nil, 0, 0, errCorrupt
+		}
+		norm[s] = int16(count)
+		s++
+		previous0 = count == 0
+		for remaining < threshold {
+			nbits--
+			threshold >>= 1
+		}
+	}
+	if remaining != 1 {
+		return nil, 0, 0, errCorrupt
+	}
+	return norm, tableLog, r.bytesRead(), nil
+}
+
+// spread returns the symbol of each state of a table of normalized counts,
+// as both its encoder and decoder lay it out.
+func spread(norm []int16, tableLog int) []uint8 {
+	size := 1 << tableLog
+	symbols := make([]uint8, size)
+	high := size - 1
+	for s, n := range norm {
+		if n == -1 {
+			symbols[high] = uint8(s)
+			high--
+		}
+	}
+	step := size>>1 + size>>3 + 3
+	pos := 0
+	for s, n := range norm {
+		for i := 0; i < int(n); i++ {
+			symbols[pos] = uint8(s)
+			pos = (pos + step) & (size - 1)
+			for pos > high {
+				pos = (pos + step) & (size - 1)
+			}
+		}
+	}
+	return symbols
+}
+
+// decodeEntry is a state of an FSE decoding table: its symbol, and how the
+// next state is read.
+type decodeEntry struct {
+	symbol   uint8
+	nbits    uint8
+	baseline uint16
+}
+
+// fseTable is an FSE decoding table.
+type fseTable struct {
+	log     int
+	entries []decodeEntry
+}
+
+func buildTable(norm []int16, tableLog int) (*fseTable, error) {
+	size := 1 << tableLog
+	total := 0
+	for _, n := range norm {
+		if n < 0 {
+			total++
+		} else {
+			total += int(n)
+		}
+	}
+	if total != size {
+		return nil, errCorrupt
+	}
+	symbols := spread(norm, tableLog)
+	next := make([]int, len(norm))
+	for s, n := range norm {
+		if n < 0 {
+			next[s] = 1
+		} else {
+			next[s] = int(n)
+		}
+	}
+	t := &fseTable{log: tableLog, entries: make([]decodeEntry, size)}
+	for u, s := range symbols {
+		ns := next[s]
+		next[s]++
+		nb := tableLog - (bits.Len(uint(ns)) - 1)
+		t.entries[u] = decodeEntry{symbol: s, nbits: uint8(nb), baseline: uint16(ns<<nb - size)}
+	}
+	return t, nil
+}
+
+// rleTable returns the table of a stream of a single symbol.
+func rleTable(symbol uint8) *fseTable {
+	return &fseTable{entries: []decodeEntry{{symbol: symbol}}}
+}
+
+// fseState is where a decoder is in its table.
+type fseState struct {
+	t     *fseTable
+	state int
+}
+
+func (s *fseState) init(t *fseTable, r *reverseReader) {
+	s.t = t
+	s.state = int(r.read(t.log))
+}
+
+func (s *fseState) symbol() uint8 {
+	return s.t.entries[s.state].symbol
+}
+
+func (s *fseState) update(r *reverseReader) {
+	e := s.t.entries[s.state]
+	s.state = int(e.baseline) + int(r.read(int(e.nbits)))
+}
+
+// encodeTable is an FSE encoding table.
+type encodeTable struct {
+	log        int
+	stateTable []uint16
+	symbols    []symbolTransform
+}
+
+// symbolTransform is how a symbol moves an encoder from one state to the
+// next, as the reference implementation lays it out.
+type symbolTransform struct {
+	deltaNbBits    uint32
+	deltaFindState int32
+	// first is the state an encoder starts in for the symbol.
+	first uint16
+}
+
+func buildEncodeTable(norm []int16, tableLog int) *encodeTable {
+	size := 1 << tableLog
+	symbols := spread(norm, tableLog)
+	cumul := make([]int, len(norm)+1)
+	for s, n := range norm {
+		if n < 0 {
+			n = 1
+		}
+		cumul[s+1] = cumul[s] + int(n)
+	}
+	t := &encodeTable{log: tableLog, stateTable: make([]uint16, size), symbols: make([]symbolTransform, len(norm))}
+	pos := append([]int(nil), cumul...)
+	for u, s := range symbols {
+		t.stateTable[pos[s]] = uint16(size + u)
+		pos[s]++
+	}
+	total := 0
+	for s, n := range norm {
+		switch {
+		case n == 0:
+		case n == -1 || n == 1:
+			t.symbols[s] = symbolTransform{
+				deltaNbBits:    uint32(tableLog<<16 - size),
+				deltaFindState: int32(total - 1),
+			}
+			total++
+		default:
+			maxBitsOut := tableLog - (bits.Len(uint(n-1)) - 1)
+			minStatePlus := int(n) << maxBitsOut
+			t.symbols[s] = symbolTransform{
+				deltaNbBits:    uint32(maxBitsOut<<16 - minStatePlus),
+				deltaFindState: int32(total - int(n)),
+			}
+			total += int(n)
+		}
+		if n != 0 {
+			t.symbols[s].first = t.stateTable[cumul[s]]
+		}
+	}
+	return t
+}
+
+// encodeState is where an encoder is in its table. Symbols are encoded in
+// the reverse of the order they are decoded in. Without a table, a run of one
+// symbol, it writes nothing.
+type encodeState struct {
+	t     *encodeTable
+	value uint32
+}
+
+// init starts the encoder with the last symbol to be decoded.
+func (s *encodeState) init(t *encodeTable, symbol uint8) {
+	s.t = t
+	if t != nil {
+		s.value = uint32(t.symbols[symbol].first)
+	}
+}
+
+func (s *encodeState) encode(w *bitWriter, symbol uint8) {
+	if s.t == nil {
+		return
+	}
+	tt := s.t.symbols[symbol]
+	nb := (s.value + tt.deltaNbBits) >> 16
+	w.add(uint64(s.value), uint(nb))
+	s.value = uint32(s.t.stateTable[int32(s.value>>nb)+tt.deltaFindState])
+}
+
+// flush ends the encoding with the state the decoder starts in.
+func (s *encodeState) flush(w *bitWriter) {
+	if s.t == nil {
+		return
+	}
+	w.add(uint64(s.value), uint(s.t.log))
+}
+
+// normalize scales counts, which add up to total, to add up to 1<<tableLog,
+// giving every symbol that occurs at least 1. There must be fewer symbols
+// that occur than that.
+func normalize(counts []int, total, tableLog int) []int16 {
+	size := 1 << tableLog
+	norm := make([]int16, len(counts))
+	sum, largest := 0, 0
+	for s, c := range counts {
+		if c == 0 {
+			continue
+		}
+		n := max((c*size+total/2)/total, 1)
+		norm[s] = int16(n)
+		sum += n
+		if c > counts[largest] {
+			largest = s
+		}
+	}
+	for sum > size {
+		big := 0
+		for s, n := range norm {
+			if n > norm[big] {
+				big = s
+			}
+		}
+		norm[big]--
+		sum--
+	}
+	norm[largest] += int16(size - sum)
+	return norm
+}
+
+// writeNormalized appends the table description of norm.
+func writeNormalized(out []byte, norm []int16, tableLog int) []byte {
+	w := bitWriter{out: out}
+	w.add(uint64(tableLog-minTableLog), 4)
+	remaining := 1<<tableLog + 1
+	threshold := 1 << tableLog
+	nbits := tableLog + 1
+	previous0 := false
+	for s := 0; s < len(norm) && remaining > 1; {
+		if previous0 {
+			start := s
+			for norm[s] == 0 {
+				s++
+			}
+			for ; s >= start+3; start += 3 {
+				w.add(3, 2)
+			}
+			w.add(uint64(s-start), 2)
+		}
+		count := int(norm[s])
+		s++
+		max := 2*threshold - 1 - remaining
+		if count < 0 {
+			remaining--
+		} else {
+			remaining -= count
+		}
+		count++
+		if count >= threshold {
+			count += max
+		}
+		if count < max {
+			w.add(uint64(count), uint(nbits-1))
+		} else {
+			w.add(uint64(count), uint(nbits))
+		}
+		previous0 = count == 1
+		for remaining < threshold {
+			nbits--
+			threshold >>= 1
+		}
+	}
+	return w.flush()
+}
+
+// tableCost estimates the bits it takes to encode counts with norm, or -1
+// if a symbol that occurs has no state.
+func tableCost(counts []int, norm []int16, tableLog int) float64 {
+	cost := 0.0
+	for s, c := range counts {
+		if c == 0 {
+			continue
+		}
+		if s >= len(norm) || norm[s] == 0 {
+			return -1
+		}
+		n := max(int(norm[s]), 1)
+		cost += float64(c) * (float64(tableLog) - log2(n))
+	}
+	return cost
+}
@@ -0,0 +1,354 @@
+package zstd
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// maxHuffBits bounds the length of a Huffman code.
+const maxHuffBits = 11
+
+// huffEntry is an entry of a Huffman decoding table, which is indexed by
+// the next maxBits bits of a stream.
+type huffEntry struct {
+	symbol uint8
+	nbits  uint8
+}
+
+type huffTable struct {
+	maxBits int
+	entries []huffEntry
+}
+
+// readHuffTable reads the description of a Huffman tree. It returns how many
+// bytes it took up.
+func readHuffTable(in []byte) (*huffTable, int, error) {
+	if len(in) == 0 {
+		return nil, 0, errCorrupt
+	}
+	var weights []uint8
+	header := int(in[0])
+	n := 1
+	if header < 128 {
+		// The weights are FSE compressed, with two states taking turns
+		if 1+header > len(in) {
+			return nil, 0, errCorrupt
+		}
+		in = in[1 : 1+header]
+		norm, tableLog, used, err := readNormalized(in, maxHuffBits+1, 6)
+		if err != nil {
+			return nil, 0, err
+		}
+		t, err := buildTable(norm, tableLog)
+		if err != nil {
+			return nil, 0, err
+		}
+		var r reverseReader
+		if err := r.init(in[used:]); err != nil {
+			return nil, 0, err
+		}
+		var s1, s2 fseState
+		s1.init(t, &r)
+		s2.init(t, &r)
+		for len(weights) < 255 {
+			weights = append(weights, s1.symbol())
+			s1.update(&r)
+			if r.overflowed() {
+				weights = append(weights, s2.symbol())
+				break
+			}
+			weights = append(weights, s2.symbol())
+			s2.update(&r)
+			if r.overflowed() {
+				weights = append(weights, s1.symbol())
+				break
+			}
+		}
+		if !r.overflowed() {
+			return nil, 0, errCorrupt
+		}
+		n += header
+	} else {
+		count := header - 127
+		size := (count + 1) / 2
+		if 1+size > len(in) {
+			return nil, 0, errCorrupt
+		}
+		for i := 0; i < count; i++ {
+			b := in[1+i/2]
+			if i%2 == 0 {
+				weights = append(weights, b>>4)
+			} else {
+				weights = append(weights, b&15)
+			}
+		}
+		n += size
+	}
+	t, err := buildHuffTable(weights)
+	return t, n, err
+}
+
+// buildHuffTable builds the table of weights, the weight of the last symbol
+// being what makes up a complete tree.
+func buildHuffTable(weights []uint8) (*huffTable, error) {
+	if len(weights) > 255 {
+		return nil, errCorrupt
+	}
+	total := 0
+	for _, w := range weights {
+		if w > maxHuffBits {
+			return nil, errCorrupt
+		}
+		if w > 0 {
+			total += 1 << (w - 1)
+		}
+	}
+	if total == 0 {
+		return nil, errCorrupt
+	}
+	maxBits := bits.Len(uint(total))
+	if maxBits > maxHuffBits {
+		return nil, errCorrupt
+	}
+	rest := 1<<maxBits - total
+	if rest&(rest-1) != 0 {
+		return nil, errCorrupt
+	}
+	weights = append(weights, uint8(bits.Len(uint(rest))))
+
+	var start [maxHuffBits + 2]int
+	for _, w := range weights {
+		if w > 0 {
+			start[w+1] += 1 << (w - 1)
+		}
+	}
+	for w := 2; w < len(start); w++ {
+		start[w] += start[w-1]
+	}
+	t := &huffTable{maxBits: maxBits, entries: make([]huffEntry, 1<<maxBits)}
+	for s, w := range weights {
+		if w == 0 {
+			continue
+		}
+		e := huffEntry{symbol: uint8(s), nbits: uint8(maxBits + 1 - int(w))}
+		for i := 0; i < 1<<(w-1); i++ {
+			t.entries[start[w]+i] = e
+		}
+		start[w] += 1 << (w - 1)
+	}
+	return t, nil
+}
+
+// decode appends the symbols of a stream of codes to out until it holds n.
+func (t *huffTable) decode(out, in []byte, n int) ([]byte, error) {
+	var r reverseReader
+	if err := r.init(in); err != nil {
+		return nil, err
+	}
+	for len(out) < n {
+		e := t.entries[r.peek(t.maxBits)]
+		r.nbits -= int(e.nbits)
+		out = append(out, e.symbol)
+	}
+	if !r.finished() {
+		return nil, errCorrupt
+	}
+	return out, nil
+}
+
+// huffCode is the code of a symbol.
+type huffCode struct {
+	value uint16
+	nbits uint8
+}
+
+// huffEncoder is a Huffman code for the literals of a block.
+type huffEncoder struct {
+	codes   [256]huffCode
+	weights []uint8
+	maxBits int
+}
+
+// newHuffEncoder returns a code for symbols of the given counts, or nil if
+// there is only one.
+func newHuffEncoder(counts *[256]int) *huffEncoder {
+	lengths := huffLengths(counts, maxHuffBits)
+	if lengths == nil {
+		return nil
+	}
+	e := &huffEncoder{}
+	last := 0
+	for s, l := range lengths {
+		e.maxBits = max(e.maxBits, int(l))
+		if l > 0 {
+			last = s
+		}
+	}
+	weights := make([]uint8, last+1)
+	for s, l := range lengths[:last+1] {
+		if l > 0 {
+			weights[s] = uint8(e.maxBits + 1 - int(l))
+		}
+	}
+	var start [maxHuffBits + 2]int
+	for _, w := range weights {
+		if w > 0 {
+			start[w+1] += 1 << (w - 1)
+		}
+	}
+	for w := 2; w < len(start); w++ {
+		start[w] += start[w-1]
+	}
+	for s, w := range weights {
+		if w == 0 {
+			continue
+		}
+		e.codes[s] = huffCode{value: uint16(start[w] >> (w - 1)), nbits: lengths[s]}
+		start[w] += 1 << (w - 1)
+	}
+	e.weights = weights[:last]
+	return e
+}
+
+// huffLengths returns the lengths of an optimal prefix code for counts no
+// longer than limit bits, found by package-merge, or nil if fewer than two
+// symbols occur.
+func huffLengths(counts *[256]int, limit int) []uint8 {
+	type item struct {
+		weight      int
+		symbol      int
+		left, right *item
+	}
+	var leaves []*item
+	for s, c := range counts {
+		if c > 0 {
+			leaves = append(leaves, &item{weight: c, symbol: s})
+		}
+	}
+	if len(leaves) < 2 {
+		return nil
+	}
+	sort.SliceStable(leaves, func(i, j int) bool { return leaves[i].weight < leaves[j].weight })
+	list := leaves
+	for level := 1; level < limit; level++ {
+		var packages []*item
+		for i := 0; i+1 < len(list); i += 2 {
+			packages = append(packages, &item{weight: list[i].weight + list[i+1].weight, symbol: -1, left: list[i], right: list[i+1]})
+		}
+		merged := make([]*item, 0, len(leaves)+len(packages))
+		i, j := 0, 0
+		for i < len(leaves) || j < len(packages) {
+			if j == len(packages) || i < len(leaves) && leaves[i].weight <= packages[j].weight {
+				merged = append(merged, leaves[i])
+				i++
+			} else {
+				merged = append(merged, packages[j])
+				j++
+			}
+		}
+		list = merged
+	}
+	lengths := make([]uint8, 256)
+	var count func(*item)
+	count = func(it *item) {
+		if it.symbol >= 0 {
+			lengths[it.symbol]++
+			return
+		}
+		count(it.left)
+		count(it.right)
+	}
+	for _, it := range list[:2*len(leaves)-2] {
+		count(it)
+	}
+	return lengths
+}
+
+// size returns the bytes it takes to encode data with e, roughly.
+func (e *huffEncoder) size(counts *[256]int) int {
+	n := 0
+	for s, c := range counts {
+		n += c * int(e.codes[s].nbits)
+	}
+	return n/8 + 1
+}
+
+// encode appends the stream of codes of data.
+func (e *huffEncoder) encode(out, data []byte) []byte {
+	w := bitWriter{out: out}
+	for i := len(data) - 1; i >= 0; i-- {
+		c := e.codes[data[i]]
+		w.add(uint64(c.value), uint(c.nbits))
+	}
+	return w.close()
+}
+
+// writeTable appends the description of the tree, its weights FSE
+// compressed where that is smaller, or the only way there are more than 128
+// of them. It returns false if they can be written neither way.
+func (e *huffEncoder) writeTable(out []byte) ([]byte, bool) {
+	if compressed := compressWeights(e.weights); compressed != nil && (len(compressed) < (len(e.weights)+1)/2 || len(e.weights) > 128) {
+		out = append(out, byte(len(compressed)))
+		return append(out, compressed...), true
+	}
+	if len(e.weights) > 128 {
+		return out, false
+	}
+	out = append(out, byte(127+len(e.weights)))
+	for i := 0; i < len(e.weights); i += 2 {
+		b := e.weights[i] << 4
+		if i+1 < len(e.weights) {
+			b |= e.weights[i+1]
+		}
+		out = append(out, b)
+	}
+	return out, true
+}
+
+// compressWeights returns the weights FSE compressed with two states taking
+// turns, or nil if they can't be or that takes 128 bytes or more.
+func compressWeights(weights []uint8) []byte {
+	if len(weights) <= 2 {
+		return nil
+	}
+	counts := make([]int, maxHuffBits+1)
+	symbols := 0
+	for _, w := range weights {
+		if counts[w] == 0 {
+			symbols++
+		}
+		counts[w]++
+	}
+	if symbols < 2 {
+		return nil
+	}
+	tableLog := 6
+	norm := normalize(counts, len(weights), tableLog)
+	out := writeNormalized(nil, norm, tableLog)
+	t := buildEncodeTable(norm, tableLog)
+	w := bitWriter{out: out}
+	var s1, s2 encodeState
+	i := len(weights)
+	if i%2 == 1 {
+		s1.init(t, weights[i-1])
+		s2.init(t, weights[i-2])
+		s1.encode(&w, weights[i-3])
+		i -= 3
+	} else {
+		s2.init(t, weights[i-1])
+		s1.init(t, weights[i-2])
+		i -= 2
+	}
+	for i > 0 {
+		s2.encode(&w, weights[i-1])
+		s1.encode(&w, weights[i-2])
+		i -= 2
+	}
+	s2.flush(&w)
+	s1.flush(&w)
+	out = w.close()
+	if len(out) >= 128 {
+		return nil
+	}
+	return out
+}
@@ -0,0 +1,196 @@
+package zstd
+
+import (
+	"math"
+	"math/bits"
+)
+
+// Prices are in eighths of a bit.
+const (
+	priceScale = 8
+	noPrice    = math.MaxInt32
+)
+
+// prices are what literals and the codes of sequences cost, by how often
+// they came up in a parse of the block.
+type prices struct {
+	lit [256]int32
+	ll  [maxLLCode + 1]int32
+	ml  [maxMLCode + 1]int32
+	of  [maxOFCode + 1]int32
+}
+
+// price returns what a symbol seen n times out of total costs, counting
+// every symbol once more so those not seen aren't free, and no more than
+// limit bits.
+func price(n, total, symbols, limit int) int32 {
+	return int32(priceScale * min(float64(limit), log2(total+symbols)-log2(n+1)))
+}
+
+// set sets the prices from the literals and sequences of a parse.
+func (p *prices) set(lits []byte, seqs []sequence) {
+	var lit [256]int
+	for _, b := range lits {
+		lit[b]++
+	}
+	for b, n := range lit {
+		p.lit[b] = price(n, len(lits), len(lit), 8)
+	}
+	var ll [maxLLCode + 1]int
+	var ml [maxMLCode + 1]int
+	var of [maxOFCode + 1]int
+	for _, s := range seqs {
+		ll[llCode(s.litLen)]++
+		ml[mlCode(s.matchLen)]++
+		of[bits.Len32(s.offset)-1]++
+	}
+	for c, n := range ll {
+		p.ll[c] = price(n, len(seqs), len(ll), maxLLLog) + priceScale*int32(llBits[c])
+	}
+	for c, n := range ml {
+		p.ml[c] = price(n, len(seqs), len(ml), maxMLLog) + priceScale*int32(mlBits[c])
+	}
+	for c, n := range of {
+		p.of[c] = price(n, len(seqs), len(of), maxOFLog) + priceScale*int32(c)
+	}
+}
+
+// literal returns what b costs as the literal ending a run of litLen,
+// counting what the longer run adds to the length of it a sequence codes.
+// A run as long as a block is left to the end of one, coded by none.
+func (p *prices) literal(b byte, litLen uint32) int32 {
+	if litLen >= maxBlockSize {
+		return p.lit[b]
+	}
+	return p.lit[b] + p.ll[llCode(litLen)] - p.ll[llCode(litLen-1)]
+}
+
+// match returns what a sequence costs, but for its literals.
+func (p *prices) match(matchLen, value uint32) int32 {
+	return p.ll[0] + p.ml[mlCode(matchLen)] + p.of[bits.Len32(value)-1]
+}
+
+// node is the cheapest way found of coding a block up to a position: its
+// price, the match ending there, of no length if a literal does, how many
+// literals end there, and the repeat offsets after it.
+type node struct {
+	price          int32
+	length, offset uint32
+	litLen         uint32
+	reps           [3]uint32
+}
+
+// parseOptimal finds the sequences of hist[start:end] that cost the least
+// by the prices of literals and matches, rather than taking each match as
+// it comes. Every position is tried with every repeat offset and every
+// match its hash chain gives, and the cheapest way there kept. The prices
+// come from the parse of the block found before, a lazy one.
+func (z *Writer) parseOptimal(start, end int) {
+	z.prices.set(z.lits, z.seqs)
+	n := end - start
+
+	if cap(z.nodes) < n+1 {
+		z.nodes = make([]node, n+1)
+	}
+	nodes := z.nodes[:n+1]
+	for i := range nodes {
+		nodes[i].price = noPrice
+	}
+	nodes[0] = node{reps: z.reps}
+	p := &z.prices
+	// through reaches the nodes the match of offset from i does, for each
+	// length up to length
+	through := func(i, length, offset int) {
+		from := &nodes[i]
+		value := offsetValue(from.reps, uint32(offset), from.litLen)
+		reps := from.reps
+		resolveOffset(&reps, value, from.litLen)
+		for l := 4; l <= length; l++ {
+			price := from.price + p.match(uint32(l), value)
+			if to := &nodes[i+l]; price < to.price {
+				*to = node{price, uint32(l), uint32(offset), 0, reps}
+			}
+		}
+	}
+	limit := n - 8
+	for i := 0; i < n; i++ {
+		pos := start + i
+		from := &nodes[i]
+		if price := from.price + p.literal(z.hist[pos], from.litLen+1); price < nodes[i+1].price {
+			nodes[i+1] = node{price, 0, 0, from.litLen + 1, from.reps}
+		}
+		if i >= limit {
+			continue
+		}
+		z.insertUpTo(pos)
+		cur := z.hist[pos:end]
+		longest, longestOffset := 0, 0
+		repeats := from.reps
+		if from.litLen == 0 {
+			repeats = [3]uint32{from.reps[1], from.reps[2], from.reps[0] - 1}
+		}
+		for _, r := range repeats {
+			if r == 0 || int(r) > pos || int(r) > z.window {
+				continue
+			}
+			if l := matchLen(cur, z.hist[pos-int(r):]); l >= 4 {
+				through(i, l, int(r))
+				if l > longest {
+					longest, longestOffset = l, int(r)
+				}
+			}
+		}
+		if longest < z.p.target {
+			z.matches(pos, end, max(longest, z.p.minMatch-1), z.p.optimal, func(l, o int) bool {
+				through(i, l, o)
+				if l > longest {
+					longest, longestOffset = l, o
+				}
+				return l < z.p.target
+			})
+		}
+		if longest >= z.p.target {
+			// Take a match this long as it is, rather than trying every
+			// position it covers
+			through(i, longest, longestOffset)
+			i += longest - 1
+		}
+	}
+
+	// Follow the cheapest way back from the end, then code it in order
+	z.seqs, z.lits = z.seqs[:0], z.lits[:0]
+	path := z.path[:0]
+	for i := n; i > 0; {
+		if l := int(nodes[i].length); l > 0 {
+			path = append(path, i)
+			i -= l
+		} else {
+			i--
+		}
+	}
+	litStart := start
+	for k := len(path) - 1; k >= 0; k-- {
+		nd := &nodes[path[k]]
+		pos := start + path[k] - int(nd.length)
+		litLen := uint32(pos - litStart)
+		z.lits = append(z.lits, z.hist[litStart:pos]...)
+		z.seqs = append(z.seqs, sequence{litLen, nd.length, z.code(nd.offset, litLen)})
+		litStart = pos + int(nd.length)
+	}
+	z.lits = append(z.lits, z.hist[litStart:end]...)
+	z.path = path
+}
+
+// mark keeps the heads of the hash chains as they are, for rewind.
+func (z *Writer) mark() {
+	z.heads = append(z.heads[:0], z.head...)
+	z.marked = z.inserted
+}
+
+// rewind takes the hash chains back to where mark left them, to parse the
+// same positions again. The links of the positions inserted since are put
+// back as they were when they are inserted again.
+func (z *Writer) rewind() {
+	copy(z.head, z.heads)
+	z.inserted = z.marked
+}
@@ -0,0 +1,524 @@
+package zstd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// Reader decompresses a stream of frames, as the zstd tool writes them.
+type Reader struct {
+	r   *bufio.Reader
+	err error
+	// hist is what the frame has decoded so far, back as far as its window
+	// reaches, of which hist[out:] hasn't been read yet.
+	hist []byte
+	out  int
+
+	window      int
+	last        bool
+	hasChecksum bool
+	checksum    xxhash64
+	// size is the content size the frame gives, or -1, and decoded how much
+	// it has decoded.
+	size, decoded int64
+
+	block    []byte
+	literals []byte
+	huff     *huffTable
+	ll, ml   *fseTable
+	of       *fseTable
+	reps     [3]uint32
+}
+
+// NewReader returns a Reader of the frames of r. It reads the header of the
+// first.
+func NewReader(r io.Reader) (*Reader, error) {
+	z := &Reader{r: bufio.NewReader(r)}
+	ok, err := z.frame()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return z, nil
+}
+
+func (z *Reader) Read(p []byte) (int, error) {
+	for z.out == len(z.hist) {
+		if z.err != nil {
+			return 0, z.err
+		}
+		z.err = z.next()
+	}
+	n := copy(p, z.hist[z.out:])
+	z.out += n
+	return n, nil
+}
+
+// Close releases what z holds. It doesn't close the reader underneath.
+func (z *Reader) Close() error {
+	z.hist, z.block, z.literals = nil, nil, nil
+	if z.err == nil {
+		z.err = io.ErrClosedPipe
+	}
+	return nil
+}
+
+// next decodes the next block, starting the next frame after the last.
+func (z *Reader) next() error {
+	if z.last {
+		if err := z.endFrame(); err != nil {
+			return err
+		}
+		ok, err := z.frame()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return io.EOF
+		}
+	}
+	return z.nextBlock()
+}
+
+// frame reads the header of the next frame, skipping skippable frames. It
+// returns false at the end of the stream.
+func (z *Reader) frame() (bool, error) {
+	var buf [14]byte
+	for {
+		n, err := io.ReadFull(z.r, buf[:4])
+		if n == 0 && err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, noEOF(err)
+		}
+		m := binary.LittleEndian.Uint32(buf[:4])
+		if m&skippableMask == skippable {
+			if _, err := io.ReadFull(z.r, buf[:4]); err != nil {
+				return false, noEOF(err)
+			}
+			if _, err := z.r.Discard(int(binary.LittleEndian.Uint32(buf[:4]))); err != nil {
+				return false, noEOF(err)
+			}
+			continue
+		}
+		if m != magic {
+			return false, errCorrupt
+		}
+		break
+	}
+	fhd, err := z.r.ReadByte()
+	if err != nil {
+		return false, noEOF(err)
+	}
+	if fhd&8 != 0 {
+		return false, errCorrupt
+	}
+	singleSegment := fhd&0x20 != 0
+	dictSize := [4]int{0, 1, 2, 4}[fhd&3]
+	sizeSize := [4]int{0, 2, 4, 8}[fhd>>6]
+	if sizeSize == 0 && singleSegment {
+		sizeSize = 1
+	}
+	n := dictSize + sizeSize
+	if !singleSegment {
+		n++
+	}
+	if _, err := io.ReadFull(z.r, buf[:n]); err != nil {
+		return false, noEOF(err)
+	}
+	h := buf[:n]
+	window := int64(0)
+	if !singleSegment {
+		exp, mantissa := int64(h[0]>>3), int64(h[0]&7)
+		if exp+10 > maxWindowLog {
+			return false, errWindow
+		}
+		base := int64(1) << (10 + exp)
+		window = base + base/8*mantissa
+		h = h[1:]
+	}
+	var dict uint64
+	for i := dictSize - 1; i >= 0; i-- {
+		dict = dict<<8 | uint64(h[i])
+	}
+	if dict != 0 {
+		return false, errDictionary
+	}
+	h = h[dictSize:]
+	z.size = -1
+	if sizeSize > 0 {
+		var size uint64
+		for i := sizeSize - 1; i >= 0; i-- {
+			size = size<<8 | uint64(h[i])
+		}
+		if sizeSize == 2 {
+			size += 256
+		}
+		if size > math.MaxInt64 {
+			return false, errCorrupt
+		}
+		z.size = int64(size)
+		if singleSegment {
+			window = int64(size)
+		}
+	}
+	if window > 1<<maxWindowLog {
+		return false, errWindow
+	}
+	z.window = int(window)
+	z.hasChecksum = fhd&4 != 0
+	z.checksum.reset()
+	z.decoded = 0
+	z.last = false
+	z.hist, z.out = z.hist[:0], 0
+	z.huff, z.ll, z.ml, z.of = nil, nil, nil, nil
+	z.reps = [3]uint32{1, 4, 8}
+	return true, nil
+}
+
+// endFrame checks the frame just decoded.
+func (z *Reader) endFrame() error {
+	if z.size >= 0 && z.decoded != z.size {
+		return errCorrupt
+	}
+	if !z.hasChecksum {
+		return nil
+	}
+	var buf [4]byte
+	if _, err := io.ReadFull(z.r, buf[:]); err != nil {
+		return noEOF(err)
+	}
+	if binary.LittleEndian.Uint32(buf[:]) != uint32(z.checksum.sum64()) {
+		return errChecksum
+	}
+	return nil
+}
+
+func (z *Reader) nextBlock() error {
+	// Keep the window, dropping what is before it once that is as big
+	if keep := len(z.hist) - z.window; keep >= max(z.window, 1<<20) {
+		z.hist = z.hist[:copy(z.hist, z.hist[keep:])]
+		z.out -= keep
+	}
+	var header [3]byte
+	if _, err := io.ReadFull(z.r, header[:]); err != nil {
+		return noEOF(err)
+	}
+	h := uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16
+	z.last = h&1 != 0
+	size := int(h >> 3)
+	if size > maxBlockSize {
+		return errCorrupt
+	}
+	start := len(z.hist)
+	switch h >> 1 & 3 {
+	case blockRaw:
+		z.hist = grow(z.hist, size)
+		if _, err := io.ReadFull(z.r, z.hist[start:]); err != nil {
+			return noEOF(err)
+		}
+	case blockRLE:
+		b, err := z.r.ReadByte()
+		if err != nil {
+			return noEOF(err)
+		}
+		z.hist = grow(z.hist, size)
+		for i := start; i < len(z.hist); i++ {
+			z.hist[i] = b
+		}
+	case blockCompressed:
+		z.block = grow(z.block[:0], size)
+		if _, err := io.ReadFull(z.r, z.block); err != nil {
+			return noEOF(err)
+		}
+		if err := z.decompress(z.block); err != nil {
+			return err
+		}
+		if len(z.hist)-start > maxBlockSize {
+			return errCorrupt
+		}
+	default:
+		return errCorrupt
+	}
+	z.checksum.Write(z.hist[start:])
+	z.decoded += int64(len(z.hist) - start)
+	return nil
+}
+
+// grow returns b extended by n bytes.
+func grow(b []byte, n int) []byte {
+	size := len(b) + n
+	if cap(b) < size {
+		b = append(b[:cap(b)], make([]byte, size-cap(b))...)
+	}
+	return b[:size]
+}
+
+// decompress decodes a compressed block onto hist.
+func (z *Reader) decompress(in []byte) error {
+	n, err := z.readLiterals(in)
+	if err != nil {
+		return err
+	}
+	in = in[n:]
+	if len(in) == 0 {
+		return errCorrupt
+	}
+	nseq := int(in[0])
+	switch {
+	case nseq == 0:
+		z.hist = append(z.hist, z.literals...)
+		return nil
+	case nseq < 128:
+		in = in[1:]
+	case nseq < 255:
+		if len(in) < 2 {
+			return errCorrupt
+		}
+		nseq = (nseq-128)<<8 + int(in[1])
+		in = in[2:]
+	default:
+		if len(in) < 3 {
+			return errCorrupt
+		}
+		nseq = int(in[1]) + int(in[2])<<8 + 0x7f00
+		in = in[3:]
+	}
+	if len(in) == 0 {
+		return errCorrupt
+	}
+	modes := in[0]
+	if modes&3 != 0 {
+		return errCorrupt
+	}
+	in = in[1:]
+	if z.ll, in, err = z.table(in, modes>>6, z.ll, llDefaultTable, maxLLCode, maxLLLog); err != nil {
+		return err
+	}
+	if z.of, in, err = z.table(in, modes>>4&3, z.of, ofDefaultTable, maxOFCode, maxOFLog); err != nil {
+		return err
+	}
+	if z.ml, in, err = z.table(in, modes>>2&3, z.ml, mlDefaultTable, maxMLCode, maxMLLog); err != nil {
+		return err
+	}
+	return z.sequences(in, nseq)
+}
+
+// table reads the table of a sequences section in mode, returning it and
+// what follows its description.
+func (z *Reader) table(in []byte, mode uint8, previous, predefined *fseTable, maxCode, maxLog int) (*fseTable, []byte, error) {
+	switch mode {
+	case modePredefined:
+		return predefined, in, nil
+	case modeRLE:
+		if len(in) == 0 || int(in[0]) > maxCode {
+			return nil, nil, errCorrupt
+		}
+		return rleTable(in[0]), in[1:], nil
+	case modeFSE:
+		norm, tableLog, n, err := readNormalized(in, maxCode, maxLog)
+		if err != nil {
+			return nil, nil, err
+		}
+		t, err := buildTable(norm, tableLog)
+		if err != nil {
+			return nil, nil, err
+		}
+		return t, in[n:], nil
+	default:
+		if previous == nil {
+			return nil, nil, errCorrupt
+		}
+		return previous, in, nil
+	}
+}
+
+// readLiterals decodes the literals section of a block into z.literals. It
+// returns how many bytes the section took up.
+func (z *Reader) readLiterals(in []byte) (int, error) {
+	if len(in) == 0 {
+		return 0, errCorrupt
+	}
+	kind := in[0] & 3
+	format := in[0] >> 2 & 3
+	if kind == literalsRaw || kind == literalsRLE {
+		var size, n int
+		switch format {
+		case 0, 2:
+			size, n = int(in[0]>>3), 1
+		case 1:
+			if len(in) < 2 {
+				return 0, errCorrupt
+			}
+			size, n = int(in[0]>>4)+int(in[1])<<4, 2
+		default:
+			if len(in) < 3 {
+				return 0, errCorrupt
+			}
+			size, n = int(in[0]>>4)+int(in[1])<<4+int(in[2])<<12, 3
+		}
+		if size > maxBlockSize {
+			return 0, errCorrupt
+		}
+		if kind == literalsRaw {
+			if n+size > len(in) {
+				return 0, errCorrupt
+			}
+			z.literals = append(z.literals[:0], in[n:n+size]...)
+			return n + size, nil
+		}
+		if n >= len(in) {
+			return 0, errCorrupt
+		}
+		z.literals = z.literals[:0]
+		for i := 0; i < size; i++ {
+			z.literals = append(z.literals, in[n])
+		}
+		return n + 1, nil
+	}
+
+	var size, compressed, n int
+	streams := 4
+	switch format {
+	case 0, 1:
+		if len(in) < 3 {
+			return 0, errCorrupt
+		}
+		v := int(in[0]) | int(in[1])<<8 | int(in[2])<<16
+		size, compressed, n = v>>4&0x3ff, v>>14&0x3ff, 3
+		if format == 0 {
+			streams = 1
+		}
+	case 2:
+		if len(in) < 4 {
+			return 0, errCorrupt
+		}
+		v := int(binary.LittleEndian.Uint32(in))
+		size, compressed, n = v>>4&0x3fff, v>>18&0x3fff, 4
+	default:
+		if len(in) < 5 {
+			return 0, errCorrupt
+		}
+		v := int(binary.LittleEndian.Uint32(in)) | int(in[4])<<32
+		size, compressed, n = v>>4&0x3ffff, v>>22&0x3ffff, 5
+	}
+	if size > maxBlockSize || n+compressed > len(in) {
+		return 0, errCorrupt
+	}
+	data := in[n : n+compressed]
+	if kind == literalsCompressed {
+		t, used, err := readHuffTable(data)
+		if err != nil {
+			return 0, err
+		}
+		z.huff = t
+		data = data[used:]
+	} else if z.huff == nil {
+		return 0, errCorrupt
+	}
+	var err error
+	z.literals = z.literals[:0]
+	if streams == 1 {
+		z.literals, err = z.huff.decode(z.literals, data, size)
+		if err != nil {
+			return 0, err
+		}
+		return n + compressed, nil
+	}
+	if len(data) < 6 {
+		return 0, errCorrupt
+	}
+	var sizes [4]int
+	sizes[0] = int(binary.LittleEndian.Uint16(data))
+	sizes[1] = int(binary.LittleEndian.Uint16(data[2:]))
+	sizes[2] = int(binary.LittleEndian.Uint16(data[4:]))
+	sizes[3] = len(data) - 6 - sizes[0] - sizes[1] - sizes[2]
+	if sizes[3] < 0 {
+		return 0, errCorrupt
+	}
+	data = data[6:]
+	each := (size + 3) / 4
+	if 3*each > size {
+		return 0, errCorrupt
+	}
+	for i, s := range sizes {
+		want := len(z.literals) + each
+		if i == 3 {
+			want = size
+		}
+		if z.literals, err = z.huff.decode(z.literals, data[:s], want); err != nil {
+			return 0, err
+		}
+		data = data[s:]
+	}
+	return n + compressed, nil
+}
+
+// sequences decodes the sequences of a block and carries them out.
+func (z *Reader) sequences(in []byte, nseq int) error {
+	var r reverseReader
+	if err := r.init(in); err != nil {
+		return err
+	}
+	var ll, of, ml fseState
+	ll.init(z.ll, &r)
+	of.init(z.of, &r)
+	ml.init(z.ml, &r)
+	lits := z.literals
+	for i := 0; i < nseq; i++ {
+		ofCode, llc, mlc := of.symbol(), ll.symbol(), ml.symbol()
+		if ofCode > maxOFCode || llc > maxLLCode || mlc > maxMLCode {
+			return errCorrupt
+		}
+		offset := uint32(1)<<ofCode + uint32(r.read(int(ofCode)))
+		matchLen := mlBase[mlc] + uint32(r.read(int(mlBits[mlc])))
+		litLen := llBase[llc] + uint32(r.read(int(llBits[llc])))
+		if i < nseq-1 {
+			ll.update(&r)
+			ml.update(&r)
+			of.update(&r)
+		}
+		if r.overflowed() {
+			return errCorrupt
+		}
+
+		if offset = resolveOffset(&z.reps, offset, litLen); offset == 0 {
+			return errCorrupt
+		}
+
+		if int(litLen) > len(lits) {
+			return errCorrupt
+		}
+		z.hist = append(z.hist, lits[:litLen]...)
+		lits = lits[litLen:]
+		if int(offset) > len(z.hist) || int(matchLen) > maxBlockSize {
+			return errCorrupt
+		}
+		from := len(z.hist) - int(offset)
+		if int(offset) >= int(matchLen) {
+			z.hist = append(z.hist, z.hist[from:from+int(matchLen)]...)
+		} else {
+			for j := 0; j < int(matchLen); j++ {
+				z.hist = append(z.hist, z.hist[from+j])
+			}
+		}
+	}
+	if !r.finished() {
+		return errCorrupt
+	}
+	z.hist = append(z.hist, lits...)
+	return nil
+}
+
+// noEOF turns the end of the input inside a frame into an error.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
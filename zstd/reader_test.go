@@ -0,0 +1,146 @@
+package zstd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"testing"
+)
+
+// The files of testdata, made by the zstd tool from the text of corpus and
+// the data below:
+//
+//	text.zst     zstd -19, one frame of one block
+//	blocks.zst   zstd -3 reading a pipe, one frame of blocks without a
+//	             content size
+//	frames.zst   the first half of the text compressed by zstd, followed by
+//	             the second by zstd --no-check
+//	empty.zst    zstd of nothing
+var goldenFiles = []struct {
+	name string
+	want []byte
+}{
+	{"text.zst", corpus(64 << 10)},
+	{"blocks.zst", bytes.Repeat(random(1000), 400)},
+	{"frames.zst", corpus(64 << 10)},
+	{"empty.zst", nil},
+}
+
+func readFile(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDecodeGolden(t *testing.T) {
+	for _, g := range goldenFiles {
+		got, err := decompress(readFile(t, g.name))
+		if err != nil {
+			t.Errorf("%s: %v", g.name, err)
+			continue
+		}
+		if !bytes.Equal(got, g.want) {
+			t.Errorf("%s decoded to %d bytes, differing from the %d expected", g.name, len(got), len(g.want))
+		}
+	}
+}
+
+// TestSkippableFrames checks that skippable frames are passed over, wherever
+// they are.
+func TestSkippableFrames(t *testing.T) {
+	skip := binary.LittleEndian.AppendUint32(nil, skippable|7)
+	skip = binary.LittleEndian.AppendUint32(skip, 5)
+	skip = append(skip, "extra"...)
+	frames := readFile(t, "frames.zst")
+	half := bytes.Index(frames[4:], binary.LittleEndian.AppendUint32(nil, magic)) + 4
+
+	var data []byte
+	data = append(data, skip...)
+	data = append(data, frames[:half]...)
+	data = append(data, skip...)
+	data = append(data, frames[half:]...)
+	data = append(data, skip...)
+	got, err := decompress(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, corpus(64<<10)) {
+		t.Fatalf("decoded %d bytes, differing from the text", len(got))
+	}
+}
+
+// TestDecodeSmallReads checks that a frame decodes the same read a byte at a
+// time.
+func TestDecodeSmallReads(t *testing.T) {
+	r, err := NewReader(bytes.NewReader(readFile(t, "blocks.zst")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	var b [1]byte
+	for {
+		n, err := r.Read(b[:])
+		got = append(got, b[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(got, bytes.Repeat(random(1000), 400)) {
+		t.Fatalf("decoded %d bytes, differing from what was compressed", len(got))
+	}
+}
+
+// TestDecodeTruncated checks that every stream cut short is an error.
+func TestDecodeTruncated(t *testing.T) {
+	for _, name := range []string{"text.zst", "blocks.zst", "frames.zst"} {
+		data := readFile(t, name)
+		for n := 0; n < len(data); n += 1 + n/64 {
+			if _, err := decompress(data[:n]); err == nil {
+				t.Errorf("%s cut to %d of %d bytes decoded without an error", name, n, len(data))
+			}
+		}
+	}
+}
+
+// TestDecodeCorrupt checks that a stream with a byte changed, anywhere, is
+// either an error or, where the byte didn't matter, decodes as it did, and
+// never panics.
+func TestDecodeCorrupt(t *testing.T) {
+	for _, g := range goldenFiles[:2] {
+		data := readFile(t, g.name)
+		for i := 0; i < len(data); i += 1 + i/128 {
+			for _, x := range []byte{0x01, 0x80, 0xff} {
+				bad := bytes.Clone(data)
+				bad[i] ^= x
+				if got, err := decompress(bad); err == nil && !bytes.Equal(got, g.want) {
+					t.Errorf("%s with byte %d xored with %#x decoded to other data without an error", g.name, i, x)
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	text := readFile(t, "text.zst")
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"not zstd", []byte("plain text, not a frame"), errCorrupt},
+		{"bad checksum", append(bytes.Clone(text[:len(text)-4]), 0, 0, 0, 0), errChecksum},
+		{"dictionary", []byte{0x28, 0xb5, 0x2f, 0xfd, 0x21, 0x01, 0x00}, errDictionary},
+		{"huge window", []byte{0x28, 0xb5, 0x2f, 0xfd, 0x04, 0xf8}, errWindow},
+	} {
+		if _, err := decompress(tc.data); err != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
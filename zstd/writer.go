@@ -0,0 +1,655 @@
+package zstd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// params are how hard a level searches for matches: the window, hash and
+// chain tables, how many candidates it tries, how short a match it takes,
+// whether it looks a byte or two ahead for a longer one, how long a match
+// ends the search, and how many candidates it tries parsing optimally, if
+// it does.
+type params struct {
+	windowLog, hashLog, chainLog int
+	depth, minMatch, lazy        int
+	target, optimal              int
+}
+
+var levels = [MaxLevel + 1]params{
+	1:  {19, 15, 0, 1, 6, 0, 16, 0},
+	2:  {20, 16, 16, 6, 5, 0, 24, 0},
+	3:  {21, 17, 16, 4, 5, 1, 32, 0},
+	4:  {21, 17, 17, 8, 4, 1, 32, 0},
+	5:  {21, 18, 18, 10, 4, 1, 48, 0},
+	6:  {21, 18, 19, 10, 4, 2, 64, 0},
+	7:  {22, 19, 20, 10, 4, 2, 128, 0},
+	8:  {22, 19, 21, 10, 4, 2, 128, 24},
+	9:  {22, 19, 21, 10, 4, 2, 192, 32},
+	10: {22, 20, 21, 10, 4, 2, 256, 48},
+	11: {22, 20, 22, 10, 4, 2, 256, 64},
+	12: {23, 20, 22, 10, 4, 2, 384, 96},
+	13: {23, 21, 22, 10, 4, 2, 384, 128},
+	14: {23, 21, 23, 10, 4, 2, 512, 160},
+	15: {23, 21, 23, 10, 4, 2, 512, 192},
+	16: {23, 22, 23, 10, 4, 2, 768, 256},
+	17: {23, 22, 23, 10, 4, 2, 999, 320},
+	18: {23, 22, 23, 10, 4, 2, 999, 384},
+	19: {23, 22, 23, 10, 4, 2, 999, 512},
+}
+
+// errClosed is returned by a Writer once it is closed.
+var errClosed = errors.New("zstd: writer is closed")
+
+// sequence is literals followed by a match, its offset as coded.
+type sequence struct {
+	litLen, matchLen, offset uint32
+}
+
+// Writer compresses what is written to it into a single frame, which Close
+// ends. Blocks are compressed as 128 KiB are written.
+type Writer struct {
+	w   io.Writer
+	err error
+	p   params
+
+	// hist is what was written, back as far as the window reaches, of which
+	// hist[pending:] hasn't been compressed yet. Positions up to inserted
+	// are in the hash chains.
+	hist     []byte
+	pending  int
+	inserted int
+	window   int
+	head     []int32
+	chain    []int32
+	reps     [3]uint32
+	started  bool
+	checksum xxhash64
+
+	seqs []sequence
+	lits []byte
+	out  []byte
+
+	// What parseOptimal works with
+	prices prices
+	nodes  []node
+	alt    []byte
+	heads  []int32
+	marked int
+	path   []int
+}
+
+// NewWriter returns a Writer compressing to w at level, from MinLevel to
+// MaxLevel.
+func NewWriter(w io.Writer, level int) (*Writer, error) {
+	if level < MinLevel || level > MaxLevel {
+		return nil, fmt.Errorf("zstd: level %d is not between %d and %d", level, MinLevel, MaxLevel)
+	}
+	z := &Writer{w: w, p: levels[level], reps: [3]uint32{1, 4, 8}}
+	z.window = 1 << z.p.windowLog
+	z.head = make([]int32, 1<<z.p.hashLog)
+	for i := range z.head {
+		z.head[i] = -1
+	}
+	if z.p.chainLog > 0 {
+		z.chain = make([]int32, 1<<z.p.chainLog)
+	}
+	z.checksum.reset()
+	return z, nil
+}
+
+func (z *Writer) Write(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		if len(z.hist) >= 2*z.window+maxBlockSize {
+			z.slide()
+		}
+		chunk := p[:min(len(p), maxBlockSize)]
+		z.hist = append(z.hist, chunk...)
+		z.checksum.Write(chunk)
+		p = p[len(chunk):]
+		// Hold back a block, so the last is known to be when Close comes
+		for len(z.hist)-z.pending > maxBlockSize {
+			if z.err = z.writeBlock(z.pending+maxBlockSize, false); z.err != nil {
+				return n - len(p), z.err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close compresses what is left as the last block and ends the frame. It
+// doesn't close the writer underneath.
+func (z *Writer) Close() error {
+	if z.err == errClosed {
+		return nil
+	}
+	if z.err != nil {
+		return z.err
+	}
+	if z.err = z.writeBlock(len(z.hist), true); z.err != nil {
+		return z.err
+	}
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], uint32(z.checksum.sum64()))
+	if _, z.err = z.w.Write(sum[:]); z.err != nil {
+		return z.err
+	}
+	z.err = errClosed
+	return nil
+}
+
+// slide drops what is out of reach of the window from hist, by a multiple
+// of the window so positions keep their place in the chain table.
+func (z *Writer) slide() {
+	d := (z.pending - z.window) &^ (z.window - 1)
+	if d <= 0 {
+		return
+	}
+	z.hist = z.hist[:copy(z.hist, z.hist[d:])]
+	z.pending -= d
+	z.inserted -= d
+	rebase := func(table []int32) {
+		for i, v := range table {
+			if int(v) >= d {
+				table[i] = v - int32(d)
+			} else {
+				table[i] = -1
+			}
+		}
+	}
+	rebase(z.head)
+	rebase(z.chain)
+}
+
+// writeBlock compresses hist[pending:end], writing the frame header first
+// if it hasn't been yet.
+func (z *Writer) writeBlock(end int, last bool) error {
+	out := z.out[:0]
+	if !z.started {
+		out = binary.LittleEndian.AppendUint32(out, magic)
+		out = append(out, 4, byte(z.p.windowLog-10)<<3)
+		z.started = true
+	}
+	src := z.hist[z.pending:end]
+	header := len(out)
+	out = append(out, 0, 0, 0)
+	kind := blockCompressed
+	if rle(src) {
+		kind = blockRLE
+		out = append(out, src[0])
+	} else {
+		reps := z.reps
+		start := len(out)
+		out = z.compress(out, z.pending, end)
+		if len(out)-start >= len(src) {
+			// Raw, and as if the sequences were never found
+			z.reps = reps
+			kind = blockRaw
+			out = append(out[:start], src...)
+		}
+	}
+	size := len(src)
+	if kind == blockCompressed {
+		size = len(out) - header - 3
+	}
+	h := uint32(size)<<3 | uint32(kind)<<1
+	if last {
+		h |= 1
+	}
+	out[header], out[header+1], out[header+2] = byte(h), byte(h>>8), byte(h>>16)
+	z.pending = end
+	z.out = out
+	_, err := z.w.Write(out)
+	return err
+}
+
+// rle reports whether src, which isn't empty, is a run of one byte.
+func rle(src []byte) bool {
+	if len(src) < 2 {
+		return false
+	}
+	for _, b := range src[1:] {
+		if b != src[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// compress appends the block hist[start:end] compressed. Levels parsing it
+// optimally parse it lazily first, for the prices, and keep what codes the
+// smaller, the prices being only a guess.
+func (z *Writer) compress(out []byte, start, end int) []byte {
+	reps := z.reps
+	if z.p.optimal > 0 {
+		z.mark()
+	}
+	z.findSequences(start, end)
+	mark := len(out)
+	out = encodeSequences(encodeLiterals(out, z.lits), z.seqs)
+	if z.p.optimal == 0 {
+		return out
+	}
+	lazy := z.reps
+	z.reps = reps
+	z.rewind()
+	z.parseOptimal(start, end)
+	z.alt = encodeSequences(encodeLiterals(z.alt[:0], z.lits), z.seqs)
+	if len(z.alt) >= len(out)-mark {
+		z.reps = lazy
+		return out
+	}
+	return append(out[:mark], z.alt...)
+}
+
+// hash returns the slot of the head table of the minMatch bytes at pos.
+func (z *Writer) hash(pos int) uint32 {
+	v := binary.LittleEndian.Uint64(z.hist[pos:]) << (64 - 8*z.p.minMatch)
+	return uint32(v * 0x9e3779b185ebca87 >> (64 - z.p.hashLog))
+}
+
+// insertUpTo adds the positions before pos to the hash chains.
+func (z *Writer) insertUpTo(pos int) {
+	for ; z.inserted < pos; z.inserted++ {
+		h := z.hash(z.inserted)
+		if z.chain != nil {
+			z.chain[z.inserted&(len(z.chain)-1)] = z.head[h]
+		}
+		z.head[h] = int32(z.inserted)
+	}
+}
+
+// matchLen returns how many bytes a and b start with in common.
+func matchLen(a, b []byte) int {
+	n := 0
+	for len(a) >= 8 && len(b) >= 8 {
+		if x := binary.LittleEndian.Uint64(a) ^ binary.LittleEndian.Uint64(b); x != 0 {
+			return n + bits.TrailingZeros64(x)>>3
+		}
+		a, b, n = a[8:], b[8:], n+8
+	}
+	for i := 0; i < len(a) && i < len(b) && a[i] == b[i]; i++ {
+		n++
+	}
+	return n
+}
+
+// bestMatch returns the match for pos, ending by end, with the most gain
+// among the repeat offsets and the candidates of its hash chain.
+func (z *Writer) bestMatch(pos, end int) (length, offset int) {
+	z.insertUpTo(pos)
+	cur := z.hist[pos:end]
+	for _, r := range z.reps {
+		if int(r) > pos || int(r) > z.window {
+			continue
+		}
+		if l := matchLen(cur, z.hist[pos-int(r):]); l >= 4 && l > length {
+			length, offset = l, int(r)
+		}
+	}
+	z.matches(pos, end, length, z.p.depth, func(l, o int) bool {
+		if z.gain(l, o) > z.gain(length, offset) {
+			length, offset = l, o
+		}
+		return l < z.p.target
+	})
+	if length < z.p.minMatch && !(length >= 4 && z.isRep(offset)) {
+		return 0, 0
+	}
+	return length, offset
+}
+
+// matches calls found with each match for pos, ending by end, that one of
+// the first depth candidates of its hash chain gives and that is longer than
+// shorter and the matches before it, nearest first, until found returns
+// false. The positions before pos have to be in the hash chains.
+func (z *Writer) matches(pos, end, shorter, depth int, found func(length, offset int) bool) {
+	cur := z.hist[pos:end]
+	low := max(0, pos-z.window)
+	cand := int(z.head[z.hash(pos)])
+	for ; depth > 0 && cand >= low; depth-- {
+		if shorter < len(cur) && z.hist[cand+shorter] == cur[shorter] {
+			if l := matchLen(cur, z.hist[cand:]); l > shorter {
+				shorter = l
+				if !found(l, pos-cand) || l == len(cur) {
+					return
+				}
+			}
+		}
+		if z.chain == nil || cand < pos-len(z.chain) {
+			return
+		}
+		next := int(z.chain[cand&(len(z.chain)-1)])
+		if next >= cand {
+			return
+		}
+		cand = next
+	}
+}
+
+func (z *Writer) isRep(offset int) bool {
+	return offset == int(z.reps[0]) || offset == int(z.reps[1]) || offset == int(z.reps[2])
+}
+
+// gain is what a match saves, roughly, for comparing them: its length less
+// the bits of its offset, which a repeat offset all but saves.
+func (z *Writer) gain(length, offset int) int {
+	if length == 0 {
+		return 0
+	}
+	if z.isRep(offset) {
+		return 4*length - 1
+	}
+	return 4*length - bits.Len(uint(offset+3))
+}
+
+// findSequences finds the sequences of hist[start:end] and the literals
+// they take, updating the repeat offsets as they are coded.
+func (z *Writer) findSequences(start, end int) {
+	z.seqs, z.lits = z.seqs[:0], z.lits[:0]
+	litStart, pos := start, start
+	limit := end - 8
+	for pos < limit {
+		length, offset := z.bestMatch(pos, end)
+		if length == 0 {
+			if z.p.lazy == 0 {
+				// Skip through what doesn't compress faster the longer it goes on
+				pos += 1 + (pos-litStart)>>8
+			} else {
+				pos++
+			}
+			continue
+		}
+		// Put the match off while one a byte or two on saves more than the
+		// literals it takes, then look on from there again
+	lazy:
+		for pos+1 < limit {
+			for ahead := 1; ahead <= z.p.lazy && pos+ahead < limit; ahead++ {
+				l, o := z.bestMatch(pos+ahead, end)
+				if l > 0 && z.gain(l, o) > z.gain(length, offset)+1+3*ahead {
+					pos, length, offset = pos+ahead, l, o
+					continue lazy
+				}
+			}
+			break
+		}
+		for pos > litStart && offset < pos && z.hist[pos-1] == z.hist[pos-1-offset] {
+			pos--
+			length++
+		}
+		litLen := pos - litStart
+		z.lits = append(z.lits, z.hist[litStart:pos]...)
+		z.seqs = append(z.seqs, sequence{uint32(litLen), uint32(length), z.code(uint32(offset), uint32(litLen))})
+		pos += length
+		litStart = pos
+	}
+	z.lits = append(z.lits, z.hist[litStart:end]...)
+}
+
+// code returns how offset is coded after litLen literals, as a repeat
+// offset if it is one, and moves the repeat offsets along as decoding it
+// will.
+func (z *Writer) code(offset, litLen uint32) uint32 {
+	value := offsetValue(z.reps, offset, litLen)
+	resolveOffset(&z.reps, value, litLen)
+	return value
+}
+
+// offsetValue returns how offset is coded after litLen literals, given the
+// repeat offsets reps.
+func offsetValue(reps [3]uint32, offset, litLen uint32) uint32 {
+	if litLen > 0 {
+		switch offset {
+		case reps[0]:
+			return 1
+		case reps[1]:
+			return 2
+		case reps[2]:
+			return 3
+		}
+	} else {
+		switch offset {
+		case reps[1]:
+			return 1
+		case reps[2]:
+			return 2
+		case reps[0] - 1:
+			return 3
+		}
+	}
+	return offset + 3
+}
+
+// encodeLiterals appends the literals section of lits, Huffman coded where
+// that makes it smaller.
+func encodeLiterals(out, lits []byte) []byte {
+	n := len(lits)
+	if rle(lits) {
+		out = literalsHeader(out, literalsRLE, n)
+		return append(out, lits[0])
+	}
+	if n >= 64 {
+		var counts [256]int
+		for _, b := range lits {
+			counts[b]++
+		}
+		if enc := newHuffEncoder(&counts); enc != nil && enc.size(&counts) < n-n/64 {
+			if compressed, ok := huffLiterals(out, lits, enc); ok {
+				return compressed
+			}
+		}
+	}
+	out = literalsHeader(out, literalsRaw, n)
+	return append(out, lits...)
+}
+
+// literalsHeader appends the header of raw or RLE literals.
+func literalsHeader(out []byte, kind, n int) []byte {
+	switch {
+	case n < 32:
+		return append(out, byte(kind|n<<3))
+	case n < 4096:
+		return append(out, byte(kind|1<<2|n<<4), byte(n>>4))
+	default:
+		return append(out, byte(kind|3<<2|n<<4), byte(n>>4), byte(n>>12))
+	}
+}
+
+// huffLiterals appends the literals section of lits coded with enc, in one
+// stream if there are few of them or four otherwise. It returns false if
+// that is bigger than the literals themselves.
+func huffLiterals(out, lits []byte, enc *huffEncoder) ([]byte, bool) {
+	n := len(lits)
+	start := len(out)
+	headerSize := 3
+	switch {
+	case n >= 16384:
+		headerSize = 5
+	case n >= 1024:
+		headerSize = 4
+	}
+	out = append(out, make([]byte, headerSize)...)
+	body := len(out)
+	out, ok := enc.writeTable(out)
+	if !ok {
+		return out[:start], false
+	}
+	format := 0
+	if n < 1024 {
+		out = enc.encode(out, lits)
+	} else {
+		format = headerSize - 2
+		each := (n + 3) / 4
+		jump := len(out)
+		out = append(out, 0, 0, 0, 0, 0, 0)
+		for i := 0; i < 4; i++ {
+			s := len(out)
+			out = enc.encode(out, lits[i*each:min((i+1)*each, n)])
+			if i < 3 {
+				binary.LittleEndian.PutUint16(out[jump+2*i:], uint16(len(out)-s))
+			}
+		}
+	}
+	size := len(out) - body
+	if size >= n || size >= 1<<(10+4*(headerSize-3)) {
+		return out[:start], false
+	}
+	v := uint64(literalsCompressed) | uint64(format)<<2 | uint64(n)<<4
+	switch headerSize {
+	case 3:
+		v |= uint64(size) << 14
+	case 4:
+		v |= uint64(size) << 18
+	default:
+		v |= uint64(size) << 22
+	}
+	for i := 0; i < headerSize; i++ {
+		out[start+i] = byte(v >> (8 * i))
+	}
+	return out, true
+}
+
+// seqTable is how one of the codes of the sequences of a block is encoded.
+type seqTable struct {
+	codes   []uint8
+	maxCode int
+	maxLog  int
+	norm    []int16
+	normLog int
+	table   *encodeTable
+}
+
+// encodeSequences appends the sequences section of seqs.
+func encodeSequences(out []byte, seqs []sequence) []byte {
+	n := len(seqs)
+	switch {
+	case n < 128:
+		out = append(out, byte(n))
+	case n < 0x7f00:
+		out = append(out, byte(n>>8+128), byte(n))
+	default:
+		out = append(out, 255, byte(n-0x7f00), byte((n-0x7f00)>>8))
+	}
+	if n == 0 {
+		return out
+	}
+	ll := seqTable{maxCode: maxLLCode, maxLog: maxLLLog, norm: llDefault, normLog: llDefaultLog, table: llDefaultEncode}
+	of := seqTable{maxCode: maxOFCode, maxLog: maxOFLog, norm: ofDefault, normLog: ofDefaultLog, table: ofDefaultEncode}
+	ml := seqTable{maxCode: maxMLCode, maxLog: maxMLLog, norm: mlDefault, normLog: mlDefaultLog, table: mlDefaultEncode}
+	for _, s := range seqs {
+		ll.codes = append(ll.codes, llCode(s.litLen))
+		of.codes = append(of.codes, uint8(bits.Len32(s.offset)-1))
+		ml.codes = append(ml.codes, mlCode(s.matchLen))
+	}
+	modes := len(out)
+	out = append(out, 0)
+	var m [3]uint8
+	for i, t := range []*seqTable{&ll, &of, &ml} {
+		m[i], out = t.choose(out)
+	}
+	out[modes] = m[0]<<6 | m[1]<<4 | m[2]<<2
+
+	w := bitWriter{out: out}
+	var lls, ofs, mls encodeState
+	last := n - 1
+	lls.init(ll.table, ll.codes[last])
+	ofs.init(of.table, of.codes[last])
+	mls.init(ml.table, ml.codes[last])
+	extra := func(i int) {
+		s := seqs[i]
+		c := ll.codes[i]
+		w.add(uint64(s.litLen-llBase[c]), uint(llBits[c]))
+		c = ml.codes[i]
+		w.add(uint64(s.matchLen-mlBase[c]), uint(mlBits[c]))
+		c = of.codes[i]
+		w.add(uint64(s.offset-1<<c), uint(c))
+	}
+	extra(last)
+	for i := last - 1; i >= 0; i-- {
+		ofs.encode(&w, of.codes[i])
+		mls.encode(&w, ml.codes[i])
+		lls.encode(&w, ll.codes[i])
+		extra(i)
+	}
+	mls.flush(&w)
+	ofs.flush(&w)
+	lls.flush(&w)
+	return w.close()
+}
+
+// choose picks the cheapest of the predefined table, a run of one code, or
+// a table of their own for the codes, appending its description. It returns
+// its mode.
+func (t *seqTable) choose(out []byte) (uint8, []byte) {
+	counts := make([]int, t.maxCode+1)
+	distinct := 0
+	for _, c := range t.codes {
+		if counts[c] == 0 {
+			distinct++
+		}
+		counts[c]++
+	}
+	if distinct == 1 {
+		t.table = nil
+		return modeRLE, append(out, t.codes[0])
+	}
+	best := tableCost(counts, t.norm, t.normLog)
+	if best < 0 {
+		best = math.Inf(1)
+	}
+	tableLog := min(t.maxLog, max(minTableLog, bits.Len(uint(len(t.codes)))-1))
+	for 1<<tableLog <= distinct {
+		tableLog++
+	}
+	if tableLog > t.maxLog {
+		return modePredefined, out
+	}
+	norm := normalize(counts, len(t.codes), tableLog)
+	description := writeNormalized(nil, norm, tableLog)
+	if cost := tableCost(counts, norm, tableLog) + float64(8*len(description)); cost < best {
+		t.table = buildEncodeTable(norm, tableLog)
+		return modeFSE, append(out, description...)
+	}
+	return modePredefined, out
+}
+
+// resolveOffset returns the offset a sequence of litLen literals codes as
+// value, or 0 if there is none, and moves the repeat offsets along.
+func resolveOffset(reps *[3]uint32, value, litLen uint32) uint32 {
+	if value > 3 {
+		offset := value - 3
+		*reps = [3]uint32{offset, reps[0], reps[1]}
+		return offset
+	}
+	idx := value - 1
+	if litLen == 0 {
+		idx++
+	}
+	switch idx {
+	case 0:
+		return reps[0]
+	case 1:
+		offset := reps[1]
+		*reps = [3]uint32{offset, reps[0], reps[2]}
+		return offset
+	case 2:
+		offset := reps[2]
+		*reps = [3]uint32{offset, reps[0], reps[1]}
+		return offset
+	default:
+		offset := reps[0] - 1
+		if offset == 0 {
+			return 0
+		}
+		*reps = [3]uint32{offset, reps[0], reps[1]}
+		return offset
+	}
+}
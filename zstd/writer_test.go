@@ -0,0 +1,207 @@
+package zstd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// corpus returns n bytes of text made of lines of words drawn from a small
+// vocabulary, which compresses into both literals and matches. It is what
+// the files of testdata were made from.
+func corpus(n int) []byte {
+	words := strings.Fields("the quick brown fox jumps over lazy dog copy files in parallel " +
+		"archive stream frame block window match literal offset sequence table")
+	r := rand.New(rand.NewPCG(1, 2))
+	var b bytes.Buffer
+	for line := 0; b.Len() < n; line++ {
+		fmt.Fprintf(&b, "%d:", line)
+		for range 1 + r.IntN(12) {
+			b.WriteString(" " + words[r.IntN(len(words))])
+		}
+		b.WriteByte('\n')
+	}
+	return b.Bytes()[:n]
+}
+
+// random returns n bytes that don't compress.
+func random(n int) []byte {
+	r := rand.New(rand.NewPCG(3, 4))
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(r.Uint32())
+	}
+	return b
+}
+
+// roundTripInputs are what Writer is tested on.
+var roundTripInputs = []struct {
+	name string
+	data []byte
+}{
+	{"empty", nil},
+	{"one byte", []byte{'x'}},
+	{"short", []byte("abcabcabcabcabcabc")},
+	{"incompressible", random(300 << 10)},
+	{"long matches", bytes.Repeat(random(1000), 400)},
+	{"run", make([]byte, 300<<10)},
+	{"text", corpus(300 << 10)},
+}
+
+// compress returns data compressed at level, written to the Writer in pieces
+// of chunk bytes, or all at once if chunk is 0.
+func compress(t *testing.T, data []byte, level, chunk int) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	w, err := NewWriter(&b, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p := data; len(p) > 0; {
+		n := len(p)
+		if chunk > 0 {
+			n = min(n, chunk)
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func decompress(data []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, in := range roundTripInputs {
+		for level := MinLevel; level <= MaxLevel; level++ {
+			t.Run(fmt.Sprintf("%s/%d", in.name, level), func(t *testing.T) {
+				got, err := decompress(compress(t, in.data, level, 0))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, in.data) {
+					t.Fatalf("decompressed %d bytes, differing from the %d written", len(got), len(in.data))
+				}
+			})
+		}
+	}
+}
+
+// TestRoundTripChunked checks that the blocks come out the same however the
+// input is split between writes.
+func TestRoundTripChunked(t *testing.T) {
+	data := corpus(300 << 10)
+	want := compress(t, data, DefaultLevel, 0)
+	for _, chunk := range []int{1, 1000, maxBlockSize - 1, maxBlockSize + 1} {
+		if got := compress(t, data, DefaultLevel, chunk); !bytes.Equal(got, want) {
+			t.Errorf("writes of %d bytes compressed differently from one write", chunk)
+		}
+	}
+}
+
+func TestLevels(t *testing.T) {
+	for _, level := range []int{MinLevel - 1, MaxLevel + 1} {
+		if _, err := NewWriter(io.Discard, level); err == nil {
+			t.Errorf("NewWriter took level %d", level)
+		}
+	}
+}
+
+// TestLevelSizes checks that no level compresses repetitive input or text
+// into more than the level below it does.
+func TestLevelSizes(t *testing.T) {
+	var numbers []byte
+	for i := 1; i <= 100000; i++ {
+		numbers = strconv.AppendInt(numbers, int64(i), 10)
+		numbers = append(numbers, '\n')
+	}
+	for _, in := range []struct {
+		name string
+		data []byte
+	}{
+		{"numbers", numbers},
+		{"text", corpus(300 << 10)},
+	} {
+		prev := 0
+		for level := MinLevel; level <= MaxLevel; level++ {
+			n := len(compress(t, in.data, level, 0))
+			if level > MinLevel && n > prev {
+				t.Errorf("%s: level %d compressed to %d bytes, more than the %d of level %d", in.name, level, n, prev, level-1)
+			}
+			prev = n
+		}
+	}
+}
+
+// TestWriteAfterClose checks that a closed Writer refuses more data, and can
+// be closed again.
+func TestWriteAfterClose(t *testing.T) {
+	w, err := NewWriter(io.Discard, DefaultLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("late")); err == nil {
+		t.Error("Write after Close succeeded")
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
+
+// TestReferenceFixture checks that the text compressed by the zstd tool, as
+// testdata/text.zst was with zstd -19, decodes to what Writer is given.
+func TestReferenceFixture(t *testing.T) {
+	data, err := os.ReadFile("testdata/text.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decompress(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, corpus(64<<10)) {
+		t.Fatal("testdata/text.zst doesn't decode to the text")
+	}
+}
+
+// TestReferenceDecoder checks that the zstd tool reads what Writer writes,
+// at every level, when it is installed.
+func TestReferenceDecoder(t *testing.T) {
+	zstd, err := exec.LookPath("zstd")
+	if err != nil {
+		t.Skip("zstd isn't installed")
+	}
+	for _, in := range roundTripInputs {
+		for level := MinLevel; level <= MaxLevel; level++ {
+			cmd := exec.Command(zstd, "-d", "-c", "-q")
+			cmd.Stdin = bytes.NewReader(compress(t, in.data, level, 0))
+			got, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("zstd -d of %s at level %d: %v", in.name, level, err)
+			}
+			if !bytes.Equal(got, in.data) {
+				t.Errorf("zstd -d of %s at level %d gave %d bytes, differing from the %d written", in.name, level, len(got), len(in.data))
+			}
+		}
+	}
+}
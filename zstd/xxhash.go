@@ -0,0 +1,108 @@
+package zstd
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// The primes of XXH64, which frames check their content with. They are
+// variables so their sums can wrap around.
+var (
+	prime64x1 uint64 = 11400714785074694791
+	prime64x2 uint64 = 14029467366897019727
+	prime64x3 uint64 = 1609587929392839161
+	prime64x4 uint64 = 9650029242287828579
+	prime64x5 uint64 = 2870177450012600261
+)
+
+// xxhash64 is XXH64 with a seed of 0, written to as the content of a frame
+// is read or written.
+type xxhash64 struct {
+	v1, v2, v3, v4 uint64
+	total          uint64
+	mem            [32]byte
+	n              int
+}
+
+func (x *xxhash64) reset() {
+	x.v1 = prime64x1 + prime64x2
+	x.v2 = prime64x2
+	x.v3 = 0
+	x.v4 = -prime64x1
+	x.total = 0
+	x.n = 0
+}
+
+func xxhRound(acc, input uint64) uint64 {
+	acc += input * prime64x2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * prime64x1
+}
+
+func xxhMerge(acc, val uint64) uint64 {
+	acc ^= xxhRound(0, val)
+	return acc*prime64x1 + prime64x4
+}
+
+func (x *xxhash64) Write(p []byte) (int, error) {
+	n := len(p)
+	x.total += uint64(n)
+	if x.n+len(p) < 32 {
+		x.n += copy(x.mem[x.n:], p)
+		return n, nil
+	}
+	if x.n > 0 {
+		c := copy(x.mem[x.n:], p)
+		x.stripe(x.mem[:])
+		p = p[c:]
+		x.n = 0
+	}
+	for len(p) >= 32 {
+		x.stripe(p)
+		p = p[32:]
+	}
+	x.n = copy(x.mem[:], p)
+	return n, nil
+}
+
+func (x *xxhash64) stripe(p []byte) {
+	x.v1 = xxhRound(x.v1, binary.LittleEndian.Uint64(p))
+	x.v2 = xxhRound(x.v2, binary.LittleEndian.Uint64(p[8:]))
+	x.v3 = xxhRound(x.v3, binary.LittleEndian.Uint64(p[16:]))
+	x.v4 = xxhRound(x.v4, binary.LittleEndian.Uint64(p[24:]))
+}
+
+func (x *xxhash64) sum64() uint64 {
+	var h uint64
+	if x.total >= 32 {
+		h = bits.RotateLeft64(x.v1, 1) + bits.RotateLeft64(x.v2, 7) +
+			bits.RotateLeft64(x.v3, 12) + bits.RotateLeft64(x.v4, 18)
+		h = xxhMerge(h, x.v1)
+		h = xxhMerge(h, x.v2)
+		h = xxhMerge(h, x.v3)
+		h = xxhMerge(h, x.v4)
+	} else {
+		h = prime64x5
+	}
+	h += x.total
+	p := x.mem[:x.n]
+	for ; len(p) >= 8; p = p[8:] {
+		h ^= xxhRound(0, binary.LittleEndian.Uint64(p))
+		h = bits.RotateLeft64(h, 27)*prime64x1 + prime64x4
+	}
+	if len(p) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(p)) * prime64x1
+		h = bits.RotateLeft64(h, 23)*prime64x2 + prime64x3
+		p = p[4:]
+	}
+	for _, c := range p {
+		h ^= uint64(c) * prime64x5
+		h = bits.RotateLeft64(h, 11) * prime64x1
+	}
+	h ^= h >> 33
+	h *= prime64x2
+	h ^= h >> 29
+	h *= prime64x3
+	h ^= h >> 32
+	return h
+}
@@ -0,0 +1,171 @@
+// Package zstd reads and writes the Zstandard format of RFC 8878, as the
+// zstd tool does. Frames are written with compressed blocks, their
+// sequences found by hash chains searched harder as the level goes up, and
+// their literals Huffman coded, with a checksum of their content. Frames
+// with a dictionary can't be read.
+package zstd
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+)
+
+// The levels a Writer can compress at.
+const (
+	MinLevel     = 1
+	MaxLevel     = 19
+	DefaultLevel = 3
+)
+
+var (
+	errCorrupt    = errors.New("zstd: corrupt input")
+	errChecksum   = errors.New("zstd: checksum mismatch")
+	errDictionary = errors.New("zstd: frames with a dictionary aren't supported")
+	errWindow     = errors.New("zstd: window too large")
+)
+
+const (
+	magic         = 0xfd2fb528
+	skippableMask = 0xfffffff0
+	skippable     = 0x184d2a50
+	maxBlockSize  = 128 << 10
+	// maxWindowLog bounds the window a frame may need, as zstd does unless
+	// told otherwise.
+	maxWindowLog = 27
+)
+
+// The types of block.
+const (
+	blockRaw = iota
+	blockRLE
+	blockCompressed
+)
+
+// The types of literals section.
+const (
+	literalsRaw = iota
+	literalsRLE
+	literalsCompressed
+	literalsTreeless
+)
+
+// The modes of the tables of a sequences section.
+const (
+	modePredefined = iota
+	modeRLE
+	modeFSE
+	modeRepeat
+)
+
+// The largest code of literal lengths, match lengths and offsets, and the
+// accuracy their tables may have.
+const (
+	maxLLCode = 35
+	maxMLCode = 52
+	maxOFCode = 31
+	maxLLLog  = 9
+	maxMLLog  = 9
+	maxOFLog  = 8
+)
+
+// The baselines and extra bits of literal length and match length codes.
+var (
+	llBase = [maxLLCode + 1]uint32{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536,
+	}
+	llBits = [maxLLCode + 1]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16,
+	}
+	mlBase = [maxMLCode + 1]uint32{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539,
+	}
+	mlBits = [maxMLCode + 1]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16,
+	}
+)
+
+// The predefined distributions of literal length, match length and offset
+// codes.
+var (
+	llDefault = []int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	}
+	mlDefault = []int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	}
+	ofDefault = []int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	}
+)
+
+const (
+	llDefaultLog = 6
+	mlDefaultLog = 6
+	ofDefaultLog = 5
+)
+
+// The predefined tables, for decoding and encoding.
+var (
+	llDefaultTable, mlDefaultTable, ofDefaultTable    = mustBuild(llDefault, llDefaultLog), mustBuild(mlDefault, mlDefaultLog), mustBuild(ofDefault, ofDefaultLog)
+	llDefaultEncode, mlDefaultEncode, ofDefaultEncode = buildEncodeTable(llDefault, llDefaultLog), buildEncodeTable(mlDefault, mlDefaultLog), buildEncodeTable(ofDefault, ofDefaultLog)
+)
+
+func mustBuild(norm []int16, tableLog int) *fseTable {
+	t, err := buildTable(norm, tableLog)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// llCode returns the code of a literal length.
+func llCode(ll uint32) uint8 {
+	if ll < 64 {
+		return llCodes[ll]
+	}
+	return uint8(bits.Len32(ll)-1) + 19
+}
+
+// mlCode returns the code of a match length.
+func mlCode(ml uint32) uint8 {
+	if ml-3 < 128 {
+		return mlCodes[ml-3]
+	}
+	return uint8(bits.Len32(ml-3)-1) + 36
+}
+
+var llCodes, mlCodes = codeTable(llBase[:], 64, 0), codeTable(mlBase[:], 128, 3)
+
+// codeTable returns the code of each length below n, the lowest being low.
+func codeTable(base []uint32, n int, low uint32) []uint8 {
+	codes := make([]uint8, n)
+	c := 0
+	for v := range codes {
+		for c+1 < len(base) && base[c+1] <= uint32(v)+low {
+			c++
+		}
+		codes[v] = uint8(c)
+	}
+	return codes
+}
+
+func log2(n int) float64 {
+	return math.Log2(float64(n))
+}